@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// requestActivity tracks the requests the server is handling, so background
+// thumbnail generation can make way for people using it.
+type requestActivity struct {
+	inFlight atomic.Int64
+	last     atomic.Int64 // Unix nanoseconds a request last started or ended; 0 before any
+}
+
+// serverActivity is the activity of serve's HTTP server.
+var serverActivity requestActivity
+
+// middleware counts every request except status polls, which pages repeat
+// while they sit open and which would otherwise keep the server busy forever.
+func (a *requestActivity) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/status") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		a.inFlight.Add(1)
+		a.last.Store(time.Now().UnixNano())
+		defer func() {
+			a.last.Store(time.Now().UnixNano())
+			a.inFlight.Add(-1)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// idle returns how long the server has gone without requests at now: zero
+// while one is being handled, and the longest duration before the first.
+func (a *requestActivity) idle(now time.Time) time.Duration {
+	if a.inFlight.Load() > 0 {
+		return 0
+	}
+	last := a.last.Load()
+	if last == 0 {
+		return math.MaxInt64
+	}
+	return max(0, now.Sub(time.Unix(0, last)))
+}
+
+// thumbnailIdleAfter is how long the server must go without requests before
+// background thumbnail generation runs at full speed; until then it uses one
+// worker. 0 never throttles it.
+var thumbnailIdleAfter atomic.Int64
+
+// throttledThumbnailWorkers returns the thumbnail worker count for serve's
+// background generation: one while the server is busy, otherwise the
+// configured count.
+func throttledThumbnailWorkers() int {
+	if thumbnailThrottled(time.Now()) {
+		return 1
+	}
+	return currentThumbnailWorkers()
+}
+
+// thumbnailThrottled reports whether background thumbnail generation is
+// held to one worker at now.
+func thumbnailThrottled(now time.Time) bool {
+	after := time.Duration(thumbnailIdleAfter.Load())
+	return after > 0 && serverActivity.idle(now) < after
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"jukel.org/q2/db"
+)
+
+// Errors returned by exportAlbum, matched with errors.Is.
+var (
+	errAlbumNotFound     = errors.New("album not found")
+	errInvalidExportDest = errors.New("invalid destination")
+)
+
+// AlbumExportResult reports what exportAlbum wrote.
+type AlbumExportResult struct {
+	Dest    string   `json:"dest"`
+	Files   []string `json:"files"`             // Names written, in album order
+	Linked  int      `json:"linked"`            // Of Files, how many are hard links
+	Missing []string `json:"missing,omitempty"` // Album files no longer on disk
+}
+
+// albumExportItem is an album file to export and its name in the destination.
+type albumExportItem struct {
+	path string
+	name string
+}
+
+// numberedName returns name with " (n)" before its extension, the way
+// repeated names are told apart in downloads and exports.
+func numberedName(name string, n int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// albumExportItems returns the album's files in album order, each named with
+// a zero-padded position prefix ("001 - beach.jpg") so the destination lists
+// them in the same order.
+func albumExportItems(database *db.DB, albumID int64) ([]albumExportItem, error) {
+	var exists bool
+	if err := database.QueryRow("SELECT EXISTS(SELECT 1 FROM albums WHERE id = ?)", albumID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("%w: %d", errAlbumNotFound, albumID)
+	}
+
+	rows, err := database.Query(`
+		SELECT f.path FROM album_items ai
+		JOIN files f ON ai.file_id = f.id
+		WHERE ai.album_id = ? AND f.deleted_at IS NULL
+		ORDER BY ai.position, ai.id`, albumID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []albumExportItem
+	for rows.Next() {
+		var item albumExportItem
+		if err := rows.Scan(&item.path); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	width := max(3, len(fmt.Sprint(len(items))))
+	for i := range items {
+		items[i].name = fmt.Sprintf("%0*d - %s", width, i+1, filepath.Base(items[i].path))
+	}
+	return items, nil
+}
+
+// validateExportDest cleans dest, creating it if needed, and checks that it
+// is a directory outside the monitored folders, where exported copies would
+// be indexed again as duplicates.
+func validateExportDest(database *db.DB, dest string) (string, error) {
+	dest, ok := cleanPath(dest)
+	if !ok {
+		return "", fmt.Errorf("%w: a directory is required", errInvalidExportDest)
+	}
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return "", err
+	}
+
+	roots, err := getMonitoredFolders(database)
+	if err != nil {
+		return "", err
+	}
+	if root := isPathWithinRoots(dest, roots); root != "" {
+		return "", fmt.Errorf("%w: %s is inside monitored folder %s", errInvalidExportDest, dest, root)
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidExportDest, err)
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%w: %s is not a directory", errInvalidExportDest, dest)
+	}
+	return dest, nil
+}
+
+// exportAlbum copies an album's files into dest in album order, or hard-links
+// them with link, which saves space when dest is on the same filesystem;
+// files that cannot be linked, e.g. across filesystems, are copied instead.
+// Existing files in dest are never overwritten: a clashing name gets a
+// " (2)" suffix. Album files missing from disk are skipped and reported.
+func exportAlbum(database *db.DB, albumID int64, dest string, link bool) (AlbumExportResult, error) {
+	result := AlbumExportResult{Files: []string{}}
+	items, err := albumExportItems(database, albumID)
+	if err != nil {
+		return result, err
+	}
+	if result.Dest, err = validateExportDest(database, dest); err != nil {
+		return result, err
+	}
+
+	for _, item := range items {
+		info, err := os.Stat(item.path)
+		if err != nil || !info.Mode().IsRegular() {
+			result.Missing = append(result.Missing, item.path)
+			continue
+		}
+
+		name := item.name
+		for n := 2; ; n++ {
+			linked, err := exportFile(item.path, filepath.Join(result.Dest, name), info, link)
+			if errors.Is(err, os.ErrExist) {
+				name = numberedName(item.name, n)
+				continue
+			}
+			if err != nil {
+				return result, fmt.Errorf("failed to export %s: %w", item.path, err)
+			}
+			if linked {
+				result.Linked++
+			}
+			break
+		}
+		result.Files = append(result.Files, name)
+	}
+	return result, nil
+}
+
+// exportFile hard-links or copies src to dst, failing with os.ErrExist if
+// dst exists. It reports whether a link was made.
+func exportFile(src, dst string, info os.FileInfo, link bool) (bool, error) {
+	if link {
+		err := os.Link(src, dst)
+		if err == nil || errors.Is(err, os.ErrExist) {
+			return err == nil, err
+		}
+		// Not linkable here; copy instead
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return false, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return false, err
+	}
+	os.Chtimes(dst, info.ModTime(), info.ModTime())
+	return false, nil
+}
+
+// makeAlbumExportHandler creates a handler for POST /api/album/export, which
+// exports an album into a directory on the server as exportalbum does.
+// Writing to the server's disk needs the same authorization as folder changes.
+func makeAlbumExportHandler(database *db.DB, apiToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		if !authorized(r, apiToken) {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "unauthorized"})
+			return
+		}
+
+		var req AlbumExportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+			return
+		}
+		if req.AlbumID == 0 || strings.TrimSpace(req.Dest) == "" {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "album_id and dest are required"})
+			return
+		}
+
+		result, err := exportAlbum(database, req.AlbumID, req.Dest, req.Link)
+		switch {
+		case errors.Is(err, errAlbumNotFound):
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: err.Error()})
+			return
+		case errors.Is(err, errInvalidExportDest):
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
@@ -3,17 +3,75 @@ package cast
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/vishen/go-chromecast/application"
+	castproto "github.com/vishen/go-chromecast/cast"
 )
 
+// Keepalive and reconnect defaults.
+const (
+	DefaultKeepaliveInterval    = 15 * time.Second
+	DefaultMaxReconnectAttempts = 3
+	defaultReconnectBackoff     = 2 * time.Second
+	connectTimeout              = 10 * time.Second
+)
+
+// Device cache defaults.
+const (
+	// DefaultMaxMissedDiscoveries is how many discovery runs in a row a
+	// device may be absent from before it is dropped from the cache.
+	DefaultMaxMissedDiscoveries = 3
+)
+
+// Errors returned by Connect and ConnectByName, matched with errors.Is.
+var (
+	ErrDeviceNotFound  = errors.New("device not found")
+	ErrAmbiguousDevice = errors.New("device name is ambiguous")
+)
+
+// ErrNotConnected is returned by the playback controls when no device is connected.
+var ErrNotConnected = errors.New("not connected to any device")
+
+// deviceError keeps a descriptive message while matching one of the errors above.
+type deviceError struct {
+	kind error
+	msg  string
+}
+
+func (e *deviceError) Error() string        { return e.msg }
+func (e *deviceError) Is(target error) bool { return target == e.kind }
+
+// castApp is the subset of go-chromecast's Application used by Manager.
+// It exists so tests can substitute a fake device connection.
+type castApp interface {
+	Start(addr string, port int) error
+	Update() error
+	Close(stopMedia bool) error
+	Status() (*castproto.Application, *castproto.Media, *castproto.Volume)
+	Load(filenameOrUrl string, startTime int, contentType string, transcode, detach, forceDetach bool) error
+	Pause() error
+	Unpause() error
+	Stop() error
+	Seek(value int) error
+	SetVolume(value float32) error
+	SetMuted(value bool) error
+}
+
+// newApplication is the production castApp factory.
+func newApplication() castApp {
+	return application.NewApplication()
+}
+
 // Device represents a discovered Chromecast device.
 type Device struct {
 	UUID       string `json:"uuid"`
@@ -22,6 +80,9 @@ type Device struct {
 	Port       int    `json:"port"`
 	DeviceType string `json:"device_type"`
 	IsAudio    bool   `json:"is_audio"`
+
+	LastSeen time.Time `json:"last_seen"` // Last discovery run that found the device
+	missed   int       // Discovery runs in a row that didn't find the device
 }
 
 // audioDeviceTypes contains device types that are audio-only (speakers).
@@ -56,36 +117,119 @@ func isAudioDevice(deviceType string) bool {
 	return false
 }
 
+// Audio codecs cast devices decode, named as ffprobe reports them. Every
+// Cast receiver plays these; TV devices also pass Dolby audio through.
+var (
+	castAudioCodecs = []string{"aac", "mp3", "opus", "vorbis", "flac"}
+	tvAudioCodecs   = []string{"aac", "mp3", "opus", "vorbis", "flac", "ac3", "eac3"}
+)
+
+// ConservativeAudioCodecs are the audio codecs assumed for devices of an
+// unknown type, which every Cast generation has played.
+var ConservativeAudioCodecs = []string{"aac", "mp3"}
+
+// deviceAudioCodecs maps device types to the audio codecs they decode.
+var deviceAudioCodecs = map[string][]string{
+	"Chromecast":                castAudioCodecs,
+	"Chromecast Ultra":          tvAudioCodecs,
+	"Chromecast HD":             tvAudioCodecs,
+	"Chromecast with Google TV": tvAudioCodecs,
+	"Google TV Streamer":        tvAudioCodecs,
+	"Google Nest Hub":           castAudioCodecs,
+	"Google Nest Hub Max":       castAudioCodecs,
+}
+
+// AudioCodecs returns the audio codecs a device of deviceType decodes, so
+// media with other codecs can be transcoded for it: its entry in the table,
+// else by the kind of device its type names, else ConservativeAudioCodecs.
+func AudioCodecs(deviceType string) []string {
+	if codecs, ok := deviceAudioCodecs[deviceType]; ok {
+		return codecs
+	}
+	if isAudioDevice(deviceType) {
+		return castAudioCodecs
+	}
+	lower := strings.ToLower(deviceType)
+	if strings.Contains(lower, "google tv") || strings.Contains(lower, "android tv") {
+		return tvAudioCodecs
+	}
+	if strings.Contains(lower, "chromecast") {
+		return castAudioCodecs
+	}
+	return ConservativeAudioCodecs
+}
+
 // Status represents the current playback status.
 type Status struct {
-	Connected   bool    `json:"connected"`
-	DeviceName  string  `json:"device_name,omitempty"`
-	MediaURL    string  `json:"media_url,omitempty"`
-	MediaTitle  string  `json:"media_title,omitempty"`
-	PlayerState string  `json:"player_state,omitempty"` // IDLE, BUFFERING, PLAYING, PAUSED
-	CurrentTime float64 `json:"current_time"`
-	Duration    float64 `json:"duration"`
-	Volume      float64 `json:"volume"`
-	Muted       bool    `json:"muted"`
+	Connected    bool    `json:"connected"`
+	Reconnecting bool    `json:"reconnecting,omitempty"` // Connection dropped, retrying in background
+	DeviceName   string  `json:"device_name,omitempty"`
+	MediaURL     string  `json:"media_url,omitempty"`
+	MediaTitle   string  `json:"media_title,omitempty"`
+	PlayerState  string  `json:"player_state,omitempty"` // IDLE, BUFFERING, PLAYING, PAUSED
+	CurrentTime  float64 `json:"current_time"`
+	Duration     float64 `json:"duration"`
+	Volume       float64 `json:"volume"`
+	Muted        bool    `json:"muted"`
 }
 
 // Manager handles Chromecast device discovery and control.
 type Manager struct {
-	mu          sync.RWMutex
-	devices     map[string]*Device
-	app         *application.Application
-	connectedTo *Device
-	baseURL     string // Base URL for media streaming (e.g., "http://192.168.1.100:8090")
+	mu           sync.RWMutex
+	devices      map[string]*Device
+	app          castApp
+	connectedTo  *Device
+	baseURL      string // Base URL for media streaming (e.g., "http://192.168.1.100:8090")
+	reconnecting bool
+	keepalive    chan struct{} // closed to stop the current keepalive loop
+
+	// KeepaliveInterval is how often the connection is checked with app.Update.
+	KeepaliveInterval time.Duration
+	// MaxReconnectAttempts is how many times to re-run app.Start after the
+	// connection drops before giving up and clearing it.
+	MaxReconnectAttempts int
+
+	// DeviceTTL is how long discovered devices are served from the cache
+	// before DiscoverDevices runs mDNS again. Zero disables the cache.
+	DeviceTTL time.Duration
+	// MaxMissedDiscoveries is how many discovery runs in a row a cached
+	// device may be missing from before it is dropped.
+	MaxMissedDiscoveries int
+
+	// Logger receives connection events, such as a dropped connection being
+	// re-established; nil uses slog.Default(). Connects, media loads and
+	// status failures are logged at debug level.
+	Logger *slog.Logger
+
+	newApp           func() castApp
+	reconnectBackoff time.Duration // doubled after each failed attempt
+
+	discover      func(ctx context.Context) ([]Device, error)
+	discoverMu    sync.Mutex // Serializes discovery runs
+	lastDiscovery time.Time
 }
 
 // NewManager creates a new cast manager.
 func NewManager(baseURL string) *Manager {
 	return &Manager{
-		devices: make(map[string]*Device),
-		baseURL: baseURL,
+		devices:              make(map[string]*Device),
+		baseURL:              baseURL,
+		KeepaliveInterval:    DefaultKeepaliveInterval,
+		MaxReconnectAttempts: DefaultMaxReconnectAttempts,
+		MaxMissedDiscoveries: DefaultMaxMissedDiscoveries,
+		newApp:               newApplication,
+		reconnectBackoff:     defaultReconnectBackoff,
+		discover:             discoverCastDevicesUnicast,
 	}
 }
 
+func (m *Manager) logger() *slog.Logger {
+	if m.Logger != nil {
+		return m.Logger
+	}
+	return slog.Default()
+}
+
 // SetBaseURL updates the base URL for media streaming.
 func (m *Manager) SetBaseURL(baseURL string) {
 	m.mu.Lock()
@@ -93,6 +237,15 @@ func (m *Manager) SetBaseURL(baseURL string) {
 	m.baseURL = baseURL
 }
 
+// SetDiscoverySource replaces how devices are found on the network, e.g.
+// with a fixed list for tests. The source is called with the discovery
+// timeout applied to ctx.
+func (m *Manager) SetDiscoverySource(discover func(ctx context.Context) ([]Device, error)) {
+	m.discoverMu.Lock()
+	defer m.discoverMu.Unlock()
+	m.discover = discover
+}
+
 // mdnsEntry accumulates DNS-SD records for a single Chromecast device instance.
 type mdnsEntry struct {
 	hostName string // from SRV Target
@@ -335,28 +488,66 @@ func discoverCastDevicesUnicast(ctx context.Context) ([]Device, error) {
 // DiscoverDevices searches for Chromecast devices on the network using unicast mDNS
 // (RFC 6762 §6). This approach is reliable on Windows where zeroconf's multicast
 // socket binding fails.
+// When DeviceTTL is set and the last discovery is younger than it, the cached
+// devices are returned without searching.
 func (m *Manager) DiscoverDevices(ctx context.Context, timeout time.Duration) ([]Device, error) {
+	return m.discoverDevices(ctx, timeout, false)
+}
+
+// RefreshDevices searches for devices like DiscoverDevices, ignoring the cache.
+func (m *Manager) RefreshDevices(ctx context.Context, timeout time.Duration) ([]Device, error) {
+	return m.discoverDevices(ctx, timeout, true)
+}
+
+func (m *Manager) discoverDevices(ctx context.Context, timeout time.Duration, force bool) ([]Device, error) {
+	m.discoverMu.Lock()
+	defer m.discoverMu.Unlock()
+
+	m.mu.RLock()
+	fresh := m.DeviceTTL > 0 && !m.lastDiscovery.IsZero() && time.Since(m.lastDiscovery) < m.DeviceTTL
+	m.mu.RUnlock()
+	if fresh && !force {
+		return m.GetDevices(), nil
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	devices, err := discoverCastDevicesUnicast(ctx)
+	devices, err := m.discover(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	newDevicesMap := make(map[string]*Device, len(devices))
+	now := time.Now()
+	m.mu.Lock()
+	if m.DeviceTTL <= 0 {
+		// No cache: the result replaces the device list
+		m.devices = make(map[string]*Device, len(devices))
+	}
+	seen := make(map[string]bool, len(devices))
 	for i := range devices {
-		newDevicesMap[devices[i].UUID] = &devices[i]
+		d := devices[i]
+		d.LastSeen = now
+		d.missed = 0
+		m.devices[d.UUID] = &d
+		seen[d.UUID] = true
 	}
-
-	m.mu.Lock()
-	m.devices = newDevicesMap
+	for uuid, d := range m.devices {
+		if seen[uuid] {
+			continue
+		}
+		d.missed++
+		if d.missed >= m.MaxMissedDiscoveries {
+			delete(m.devices, uuid)
+		}
+	}
+	m.lastDiscovery = now
 	m.mu.Unlock()
 
-	return devices, nil
+	return m.GetDevices(), nil
 }
 
-// GetDevices returns the cached list of discovered devices.
+// GetDevices returns the cached list of discovered devices, sorted by name.
 func (m *Manager) GetDevices() []Device {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -365,9 +556,81 @@ func (m *Manager) GetDevices() []Device {
 	for _, d := range m.devices {
 		result = append(result, *d)
 	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].UUID < result[j].UUID
+	})
 	return result
 }
 
+// GetDeviceByName returns the discovered device whose friendly name matches
+// name case-insensitively. It returns false when no device or more than one
+// device matches.
+func (m *Manager) GetDeviceByName(name string) (*Device, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	matches := m.devicesByNameLocked(name)
+	if len(matches) != 1 {
+		return nil, false
+	}
+	d := *matches[0]
+	return &d, true
+}
+
+// ConnectByName connects to the discovered device with the given friendly
+// name, matched case-insensitively.
+func (m *Manager) ConnectByName(name string) error {
+	m.mu.RLock()
+	matches := m.devicesByNameLocked(name)
+	var names []string
+	for _, d := range m.devices {
+		names = append(names, fmt.Sprintf("%q", d.Name))
+	}
+	m.mu.RUnlock()
+	sort.Strings(names)
+
+	switch len(matches) {
+	case 0:
+		if len(names) == 0 {
+			return &deviceError{ErrDeviceNotFound, fmt.Sprintf("no device named %q (no devices discovered)", name)}
+		}
+		return &deviceError{ErrDeviceNotFound, fmt.Sprintf("no device named %q (available: %s)", name, strings.Join(names, ", "))}
+	case 1:
+		return m.Connect(matches[0].UUID)
+	default:
+		var found []string
+		for _, d := range matches {
+			found = append(found, fmt.Sprintf("%q (%s, %s)", d.Name, d.UUID, d.Host))
+		}
+		sort.Strings(found)
+		return &deviceError{ErrAmbiguousDevice, fmt.Sprintf("device name %q is ambiguous, matches: %s", name, strings.Join(found, ", "))}
+	}
+}
+
+// devicesByNameLocked returns the devices whose name matches name
+// case-insensitively. When several match, an exact-case match wins if unique.
+// Caller must hold m.mu.
+func (m *Manager) devicesByNameLocked(name string) []*Device {
+	name = strings.TrimSpace(name)
+
+	var matches, exact []*Device
+	for _, d := range m.devices {
+		if strings.EqualFold(d.Name, name) {
+			matches = append(matches, d)
+			if d.Name == name {
+				exact = append(exact, d)
+			}
+		}
+	}
+	if len(matches) > 1 && len(exact) == 1 {
+		return exact
+	}
+	return matches
+}
+
 // Connect establishes a connection to a Chromecast device.
 func (m *Manager) Connect(uuid string) error {
 	m.mu.Lock()
@@ -375,10 +638,11 @@ func (m *Manager) Connect(uuid string) error {
 	device, ok := m.devices[uuid]
 	if !ok {
 		m.mu.Unlock()
-		return fmt.Errorf("device not found: %s", uuid)
+		return fmt.Errorf("%w: %s", ErrDeviceNotFound, uuid)
 	}
 
 	// Disconnect from current device if connected
+	m.stopKeepaliveLocked()
 	if m.app != nil {
 		oldApp := m.app
 		m.app = nil
@@ -394,8 +658,30 @@ func (m *Manager) Connect(uuid string) error {
 	port := device.Port
 	m.mu.Unlock()
 
-	// Create new application connection with timeout
-	app := application.NewApplication()
+	start := time.Now()
+	app, err := m.startApp(host, port)
+	if err != nil {
+		m.logger().Debug("cast connect failed", "device", device.Name, "host", host, "err", err)
+		return err
+	}
+	m.logger().Debug("cast connected", "device", device.Name, "host", host, "elapsed", time.Since(start))
+
+	m.mu.Lock()
+	m.app = app
+	m.connectedTo = device
+	m.reconnecting = false
+	stop := make(chan struct{})
+	m.keepalive = stop
+	m.mu.Unlock()
+
+	go m.keepaliveLoop(stop)
+
+	return nil
+}
+
+// startApp creates a new application connection to host:port with a timeout.
+func (m *Manager) startApp(host string, port int) (castApp, error) {
+	app := m.newApp()
 
 	errChan := make(chan error, 1)
 	go func() {
@@ -405,18 +691,125 @@ func (m *Manager) Connect(uuid string) error {
 	select {
 	case err := <-errChan:
 		if err != nil {
-			return fmt.Errorf("failed to connect: %w", err)
+			return nil, fmt.Errorf("failed to connect: %w", err)
+		}
+	case <-time.After(connectTimeout):
+		return nil, fmt.Errorf("connection timed out after %s", connectTimeout)
+	}
+	return app, nil
+}
+
+// stopKeepaliveLocked stops the running keepalive loop, if any. m.mu must be held.
+func (m *Manager) stopKeepaliveLocked() {
+	if m.keepalive != nil {
+		close(m.keepalive)
+		m.keepalive = nil
+	}
+	m.reconnecting = false
+}
+
+// keepaliveLoop periodically pings the connected device and reconnects when
+// the connection drops. It exits when stop is closed or reconnection fails.
+func (m *Manager) keepaliveLoop(stop chan struct{}) {
+	interval := m.KeepaliveInterval
+	if interval <= 0 {
+		interval = DefaultKeepaliveInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.RLock()
+		app := m.app
+		m.mu.RUnlock()
+		if app == nil {
+			return
+		}
+
+		if err := app.Update(); err == nil {
+			continue
+		}
+
+		if !m.reconnect(stop) {
+			return
 		}
-	case <-time.After(10 * time.Second):
-		return fmt.Errorf("connection timed out after 10 seconds")
 	}
+}
 
+// reconnect re-runs app.Start against the connected device with exponential
+// backoff. On success the new connection replaces the old one; after
+// MaxReconnectAttempts failures the connection is cleared. Returns true if
+// the keepalive loop should keep running.
+func (m *Manager) reconnect(stop chan struct{}) bool {
 	m.mu.Lock()
-	m.app = app
-	m.connectedTo = device
+	if m.keepalive != stop || m.connectedTo == nil {
+		m.mu.Unlock()
+		return false
+	}
+	m.reconnecting = true
+	host := m.connectedTo.Host
+	port := m.connectedTo.Port
+	log := m.logger().With("device", m.connectedTo.Name, "host", host)
 	m.mu.Unlock()
 
-	return nil
+	log.Info("cast connection lost, reconnecting")
+	backoff := m.reconnectBackoff
+	for attempt := 0; attempt < m.MaxReconnectAttempts; attempt++ {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		app, err := m.startApp(host, port)
+		if err != nil {
+			log.Debug("cast reconnect attempt failed", "attempt", attempt+1, "err", err)
+			continue
+		}
+
+		m.mu.Lock()
+		if m.keepalive != stop {
+			// Disconnected or reconnected elsewhere while we were dialling
+			m.mu.Unlock()
+			go app.Close(false)
+			return false
+		}
+		oldApp := m.app
+		m.app = app
+		m.reconnecting = false
+		m.mu.Unlock()
+
+		if oldApp != nil {
+			go oldApp.Close(false)
+		}
+		log.Info("cast reconnected", "attempts", attempt+1)
+		return true
+	}
+
+	// Give up: clear the dead connection
+	m.mu.Lock()
+	var oldApp castApp
+	if m.keepalive == stop {
+		oldApp = m.app
+		m.app = nil
+		m.connectedTo = nil
+		m.keepalive = nil
+		m.reconnecting = false
+	}
+	m.mu.Unlock()
+
+	if oldApp != nil {
+		go oldApp.Close(false)
+		log.Warn("cast reconnect failed, disconnected", "attempts", m.MaxReconnectAttempts)
+	}
+	return false
 }
 
 // Disconnect closes the connection to the current device.
@@ -424,6 +817,7 @@ func (m *Manager) Disconnect() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	m.stopKeepaliveLocked()
 	if m.app != nil {
 		m.app.Close(false)
 		m.app = nil
@@ -447,7 +841,7 @@ func (m *Manager) PlayMedia(filePath, contentType, title string) (string, error)
 
 	if m.app == nil {
 		m.mu.Unlock()
-		return "", fmt.Errorf("not connected to any device")
+		return "", ErrNotConnected
 	}
 
 	if m.baseURL == "" {
@@ -460,7 +854,9 @@ func (m *Manager) PlayMedia(filePath, contentType, title string) (string, error)
 	encodedPath := strings.ReplaceAll(url.QueryEscape(filePath), "+", "%20")
 	var mediaURL string
 	if len(contentType) >= 5 && contentType[:5] == "video" {
-		mediaURL = fmt.Sprintf("%s/api/video?path=%s", m.baseURL, encodedPath)
+		// The server transcodes audio the device cannot decode
+		codecs := strings.Join(AudioCodecs(m.connectedTo.DeviceType), ",")
+		mediaURL = fmt.Sprintf("%s/api/video?path=%s&codecs=%s", m.baseURL, encodedPath, codecs)
 	} else if len(contentType) >= 5 && contentType[:5] == "image" {
 		mediaURL = fmt.Sprintf("%s/api/image?path=%s", m.baseURL, encodedPath)
 	} else {
@@ -469,10 +865,14 @@ func (m *Manager) PlayMedia(filePath, contentType, title string) (string, error)
 
 	// Store app reference before releasing lock
 	app := m.app
+	log := m.logger().With("device", m.connectedTo.Name, "url", mediaURL, "content_type", contentType)
 
 	// Release lock before calling Load (it can block)
 	m.mu.Unlock()
 
+	start := time.Now()
+	log.Debug("cast loading media")
+
 	// Load the media with a timeout using a channel
 	errChan := make(chan error, 1)
 	go func() {
@@ -484,12 +884,15 @@ func (m *Manager) PlayMedia(filePath, contentType, title string) (string, error)
 	select {
 	case err := <-errChan:
 		if err != nil {
+			log.Debug("cast media load failed", "err", err, "elapsed", time.Since(start))
 			return mediaURL, fmt.Errorf("failed to load media: %w", err)
 		}
 	case <-time.After(10 * time.Second):
+		log.Debug("cast media load timed out")
 		return mediaURL, fmt.Errorf("load timed out after 10 seconds")
 	}
 
+	log.Debug("cast media loaded", "elapsed", time.Since(start))
 	return mediaURL, nil
 }
 
@@ -498,7 +901,7 @@ func (m *Manager) Pause() error {
 	m.mu.Lock()
 	if m.app == nil {
 		m.mu.Unlock()
-		return fmt.Errorf("not connected to any device")
+		return ErrNotConnected
 	}
 	app := m.app
 	m.mu.Unlock()
@@ -511,7 +914,7 @@ func (m *Manager) Resume() error {
 	m.mu.Lock()
 	if m.app == nil {
 		m.mu.Unlock()
-		return fmt.Errorf("not connected to any device")
+		return ErrNotConnected
 	}
 	app := m.app
 	m.mu.Unlock()
@@ -524,7 +927,7 @@ func (m *Manager) Stop() error {
 	m.mu.Lock()
 	if m.app == nil {
 		m.mu.Unlock()
-		return fmt.Errorf("not connected to any device")
+		return ErrNotConnected
 	}
 	app := m.app
 	m.mu.Unlock()
@@ -537,7 +940,7 @@ func (m *Manager) Seek(position float64) error {
 	m.mu.Lock()
 	if m.app == nil {
 		m.mu.Unlock()
-		return fmt.Errorf("not connected to any device")
+		return ErrNotConnected
 	}
 	app := m.app
 	m.mu.Unlock()
@@ -550,7 +953,7 @@ func (m *Manager) SetVolume(level float64) error {
 	m.mu.Lock()
 	if m.app == nil {
 		m.mu.Unlock()
-		return fmt.Errorf("not connected to any device")
+		return ErrNotConnected
 	}
 	app := m.app
 	m.mu.Unlock()
@@ -563,7 +966,7 @@ func (m *Manager) SetMuted(muted bool) error {
 	m.mu.Lock()
 	if m.app == nil {
 		m.mu.Unlock()
-		return fmt.Errorf("not connected to any device")
+		return ErrNotConnected
 	}
 	app := m.app
 	m.mu.Unlock()
@@ -576,10 +979,12 @@ func (m *Manager) GetStatus() Status {
 	m.mu.RLock()
 	app := m.app
 	connectedTo := m.connectedTo
+	reconnecting := m.reconnecting
 	m.mu.RUnlock()
 
 	status := Status{
-		Connected: app != nil && connectedTo != nil,
+		Connected:    app != nil && connectedTo != nil,
+		Reconnecting: reconnecting,
 	}
 
 	if connectedTo != nil {
@@ -590,9 +995,9 @@ func (m *Manager) GetStatus() Status {
 		return status
 	}
 
-	// Force status update from device
+	// Force status update from device; on failure the status is stale
 	if err := app.Update(); err != nil {
-		_ = err // update errors are non-fatal; status will be stale
+		m.logger().Debug("cast status update failed", "device", status.DeviceName, "err", err)
 	}
 
 	// Get cast status
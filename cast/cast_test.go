@@ -0,0 +1,616 @@
+package cast
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	castproto "github.com/vishen/go-chromecast/cast"
+)
+
+// fakeApp is a castApp that records calls and can be told to fail.
+type fakeApp struct {
+	mu         sync.Mutex
+	startErr   error
+	updateErrs []error // returned in order by Update, then nil
+	started    int
+	updates    int
+	closed     bool
+	calls      []string // Playback commands, e.g. "seek 90"
+
+	media  *castproto.Media
+	volume *castproto.Volume
+}
+
+// record notes a playback command.
+func (f *fakeApp) record(format string, args ...interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+	return nil
+}
+
+// isClosed reports whether Close was called, which Connect does in the background.
+func (f *fakeApp) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *fakeApp) Start(addr string, port int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.started++
+	return f.startErr
+}
+
+func (f *fakeApp) Update() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.updates++
+	if len(f.updateErrs) > 0 {
+		err := f.updateErrs[0]
+		f.updateErrs = f.updateErrs[1:]
+		return err
+	}
+	return nil
+}
+
+func (f *fakeApp) Close(stopMedia bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakeApp) Status() (*castproto.Application, *castproto.Media, *castproto.Volume) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return nil, f.media, f.volume
+}
+
+func (f *fakeApp) Load(url string, _ int, contentType string, _, _, _ bool) error {
+	return f.record("load %s %s", url, contentType)
+}
+func (f *fakeApp) Pause() error                  { return f.record("pause") }
+func (f *fakeApp) Unpause() error                { return f.record("unpause") }
+func (f *fakeApp) Stop() error                   { return f.record("stop") }
+func (f *fakeApp) Seek(value int) error          { return f.record("seek %d", value) }
+func (f *fakeApp) SetVolume(value float32) error { return f.record("volume %g", value) }
+func (f *fakeApp) SetMuted(value bool) error     { return f.record("muted %t", value) }
+
+// newTestManager returns a Manager with one known device whose connections
+// are produced by the given factory, and fast keepalive timings.
+func newTestManager(factory func() castApp) *Manager {
+	m := NewManager("http://127.0.0.1:8090")
+	m.devices["dev-1"] = &Device{UUID: "dev-1", Name: "Living Room TV", Host: "127.0.0.1", Port: 8009}
+	m.newApp = factory
+	m.Logger = slog.New(slog.DiscardHandler)
+	m.KeepaliveInterval = 10 * time.Millisecond
+	m.reconnectBackoff = 5 * time.Millisecond
+	return m
+}
+
+// waitFor polls cond until it returns true or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met before timeout")
+}
+
+func TestKeepalive_ReconnectsAfterFailure(t *testing.T) {
+	first := &fakeApp{updateErrs: []error{errors.New("connection reset")}}
+	second := &fakeApp{}
+
+	var mu sync.Mutex
+	apps := []*fakeApp{first, second}
+	m := newTestManager(func() castApp {
+		mu.Lock()
+		defer mu.Unlock()
+		app := apps[0]
+		if len(apps) > 1 {
+			apps = apps[1:]
+		}
+		return app
+	})
+	defer m.Disconnect()
+
+	if err := m.Connect("dev-1"); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	// The first Update fails, so the manager should swap in the second app.
+	waitFor(t, time.Second, func() bool {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		return m.app == castApp(second)
+	})
+
+	status := m.GetStatus()
+	if !status.Connected {
+		t.Error("Expected to be connected after reconnect")
+	}
+	if status.Reconnecting {
+		t.Error("Expected reconnecting flag to be cleared after reconnect")
+	}
+	if status.DeviceName != "Living Room TV" {
+		t.Errorf("Expected device name to be kept, got %q", status.DeviceName)
+	}
+
+	waitFor(t, time.Second, func() bool {
+		first.mu.Lock()
+		defer first.mu.Unlock()
+		return first.closed
+	})
+}
+
+func TestKeepalive_GivesUpAfterMaxAttempts(t *testing.T) {
+	var mu sync.Mutex
+	created := 0
+	m := newTestManager(func() castApp {
+		mu.Lock()
+		defer mu.Unlock()
+		created++
+		if created == 1 {
+			// Initial connection succeeds, then every ping fails
+			return &fakeApp{updateErrs: []error{errors.New("gone")}}
+		}
+		return &fakeApp{startErr: errors.New("unreachable")}
+	})
+	m.MaxReconnectAttempts = 2
+
+	if err := m.Connect("dev-1"); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	waitFor(t, time.Second, func() bool { return !m.IsConnected() })
+
+	status := m.GetStatus()
+	if status.Connected || status.Reconnecting {
+		t.Errorf("Expected cleared connection, got %+v", status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if created != 1+m.MaxReconnectAttempts {
+		t.Errorf("Expected %d connection attempts, got %d", 1+m.MaxReconnectAttempts, created)
+	}
+}
+
+func TestDisconnect_StopsKeepalive(t *testing.T) {
+	app := &fakeApp{}
+	m := newTestManager(func() castApp { return app })
+
+	if err := m.Connect("dev-1"); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	m.Disconnect()
+
+	app.mu.Lock()
+	updates := app.updates
+	app.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.updates != updates {
+		t.Errorf("Expected no keepalive pings after Disconnect, got %d more", app.updates-updates)
+	}
+}
+
+func TestConnect_ReplacesPreviousConnection(t *testing.T) {
+	var apps []*fakeApp
+	m := newTestManager(func() castApp {
+		app := &fakeApp{}
+		apps = append(apps, app)
+		return app
+	})
+	m.devices["dev-2"] = &Device{UUID: "dev-2", Name: "Kitchen Speaker", Host: "127.0.0.2", Port: 8009}
+	defer m.Disconnect()
+
+	if err := m.Connect("dev-1"); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := m.Connect("dev-2"); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if d := m.ConnectedDevice(); d == nil || d.UUID != "dev-2" {
+		t.Errorf("Expected to be connected to dev-2, got %+v", d)
+	}
+	waitFor(t, time.Second, apps[0].isClosed)
+	if apps[1].isClosed() {
+		t.Error("Expected the new connection to stay open")
+	}
+
+	// Unknown devices leave the connection alone
+	if err := m.Connect("dev-9"); !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("Expected ErrDeviceNotFound, got %v", err)
+	}
+	if d := m.ConnectedDevice(); d == nil || d.UUID != "dev-2" {
+		t.Errorf("Expected to stay connected to dev-2, got %+v", d)
+	}
+}
+
+func TestConnect_FailureLeavesDisconnected(t *testing.T) {
+	m := newTestManager(func() castApp { return &fakeApp{startErr: errors.New("unreachable")} })
+
+	if err := m.Connect("dev-1"); err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Fatalf("Expected the start error, got %v", err)
+	}
+	if m.IsConnected() || m.ConnectedDevice() != nil || m.GetStatus().Connected {
+		t.Error("Expected no connection after a failed start")
+	}
+}
+
+func TestDisconnect_ClearsConnection(t *testing.T) {
+	app := &fakeApp{}
+	m := newTestManager(func() castApp { return app })
+
+	if err := m.Connect("dev-1"); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if status := m.GetStatus(); !status.Connected || status.DeviceName != "Living Room TV" {
+		t.Errorf("Expected a connected status, got %+v", status)
+	}
+
+	m.Disconnect()
+	if !app.isClosed() {
+		t.Error("Expected Disconnect to close the application")
+	}
+	if m.IsConnected() || m.GetStatus().Connected {
+		t.Error("Expected no connection after Disconnect")
+	}
+	if err := m.Pause(); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Expected ErrNotConnected after Disconnect, got %v", err)
+	}
+}
+
+func TestAudioCodecs(t *testing.T) {
+	for _, tt := range []struct {
+		deviceType string
+		ac3, flac  bool
+	}{
+		{"Chromecast with Google TV", true, true},
+		{"Chromecast", false, true},
+		{"Google Nest Mini", false, true},
+		{"Acme Smart Speaker", false, true},
+		{"Sony Android TV 2023", true, true},
+		{"", false, false},
+		{"Acme Projector", false, false},
+	} {
+		codecs := AudioCodecs(tt.deviceType)
+		if !slices.Contains(codecs, "aac") {
+			t.Errorf("%q: expected every device to play AAC, got %v", tt.deviceType, codecs)
+		}
+		if slices.Contains(codecs, "ac3") != tt.ac3 || slices.Contains(codecs, "flac") != tt.flac {
+			t.Errorf("%q: expected ac3 %v and flac %v, got %v", tt.deviceType, tt.ac3, tt.flac, codecs)
+		}
+	}
+}
+
+func TestPlayMedia_VideoCodecsForDevice(t *testing.T) {
+	m := newTestManager(func() castApp { return &fakeApp{} })
+	m.devices["dev-1"].DeviceType = "Chromecast with Google TV"
+	if err := m.Connect("dev-1"); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer m.Disconnect()
+
+	got, err := m.PlayMedia("/videos/film.mkv", "video/x-matroska", "")
+	if err != nil || !strings.HasSuffix(got, "&codecs=aac,mp3,opus,vorbis,flac,ac3,eac3") {
+		t.Errorf("Expected the device's codecs in the URL, got %s (%v)", got, err)
+	}
+}
+
+func TestPlayMedia_URLByContentType(t *testing.T) {
+	app := &fakeApp{}
+	m := newTestManager(func() castApp { return app })
+
+	if _, err := m.PlayMedia("/music/song.mp3", "audio/mpeg", ""); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Expected ErrNotConnected before connecting, got %v", err)
+	}
+	if err := m.Connect("dev-1"); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer m.Disconnect()
+
+	for _, tt := range []struct {
+		path, contentType, want string
+	}{
+		{"/music/my song.mp3", "audio/mpeg", "http://127.0.0.1:8090/api/stream?path=%2Fmusic%2Fmy%20song.mp3"},
+		{"/videos/clip.mp4", "video/mp4", "http://127.0.0.1:8090/api/video?path=%2Fvideos%2Fclip.mp4&codecs=aac,mp3"},
+		{"/photos/a+b.jpg", "image/jpeg", "http://127.0.0.1:8090/api/image?path=%2Fphotos%2Fa%2Bb.jpg"},
+	} {
+		got, err := m.PlayMedia(tt.path, tt.contentType, "")
+		if err != nil || got != tt.want {
+			t.Errorf("%s: expected %s, got %s (%v)", tt.path, tt.want, got, err)
+		}
+	}
+
+	app.mu.Lock()
+	calls := app.calls
+	app.mu.Unlock()
+	if len(calls) != 3 || calls[1] != "load http://127.0.0.1:8090/api/video?path=%2Fvideos%2Fclip.mp4&codecs=aac,mp3 video/mp4" {
+		t.Errorf("Expected each URL loaded with its content type, got %v", calls)
+	}
+
+	m.SetBaseURL("")
+	if _, err := m.PlayMedia("/music/song.mp3", "audio/mpeg", ""); err == nil || errors.Is(err, ErrNotConnected) {
+		t.Errorf("Expected a base URL error, got %v", err)
+	}
+}
+
+func TestPlaybackControls_ForwardToApp(t *testing.T) {
+	app := &fakeApp{
+		media:  &castproto.Media{PlayerState: "PLAYING", CurrentTime: 42, Media: castproto.MediaItem{ContentId: "http://q2/clip", Duration: 120}},
+		volume: &castproto.Volume{Level: 0.25, Muted: true},
+	}
+	m := newTestManager(func() castApp { return app })
+
+	controls := []func() error{
+		m.Pause,
+		m.Resume,
+		m.Stop,
+		func() error { return m.Seek(90.7) },
+		func() error { return m.SetVolume(0.5) },
+		func() error { return m.SetMuted(true) },
+	}
+	for i, control := range controls {
+		if err := control(); !errors.Is(err, ErrNotConnected) {
+			t.Errorf("Control %d: expected ErrNotConnected before connecting, got %v", i, err)
+		}
+	}
+
+	if err := m.Connect("dev-1"); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer m.Disconnect()
+	for i, control := range controls {
+		if err := control(); err != nil {
+			t.Errorf("Control %d failed: %v", i, err)
+		}
+	}
+	app.mu.Lock()
+	got := strings.Join(app.calls, ", ")
+	app.mu.Unlock()
+	if want := "pause, unpause, stop, seek 90, volume 0.5, muted true"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	status := m.GetStatus()
+	if status.PlayerState != "PLAYING" || status.CurrentTime != 42 || status.Duration != 120 ||
+		status.MediaURL != "http://q2/clip" || status.Volume != 0.25 || !status.Muted {
+		t.Errorf("Expected the status reported by the device, got %+v", status)
+	}
+}
+
+func TestGetDeviceByName_Match(t *testing.T) {
+	m := newTestManager(func() castApp { return &fakeApp{} })
+	m.devices["dev-2"] = &Device{UUID: "dev-2", Name: "Kitchen Speaker", Host: "127.0.0.2", Port: 8009}
+
+	d, ok := m.GetDeviceByName("Living Room TV")
+	if !ok || d.UUID != "dev-1" {
+		t.Fatalf("Expected exact match dev-1, got %+v, %v", d, ok)
+	}
+
+	d, ok = m.GetDeviceByName("  kitchen SPEAKER ")
+	if !ok || d.UUID != "dev-2" {
+		t.Fatalf("Expected case-insensitive match dev-2, got %+v, %v", d, ok)
+	}
+
+	if _, ok := m.GetDeviceByName("Bedroom"); ok {
+		t.Error("Expected no match for unknown name")
+	}
+}
+
+func TestConnectByName_CaseInsensitive(t *testing.T) {
+	app := &fakeApp{}
+	m := newTestManager(func() castApp { return app })
+	defer m.Disconnect()
+
+	if err := m.ConnectByName("living room tv"); err != nil {
+		t.Fatalf("ConnectByName failed: %v", err)
+	}
+	if d := m.ConnectedDevice(); d == nil || d.UUID != "dev-1" {
+		t.Errorf("Expected to be connected to dev-1, got %+v", d)
+	}
+}
+
+func TestConnectByName_NoMatchListsAvailable(t *testing.T) {
+	m := newTestManager(func() castApp { return &fakeApp{} })
+
+	err := m.ConnectByName("Bedroom")
+	if err == nil {
+		t.Fatal("Expected error for unknown device name")
+	}
+	if !strings.Contains(err.Error(), `"Living Room TV"`) {
+		t.Errorf("Expected error to list available names, got %v", err)
+	}
+}
+
+func TestConnectByName_Ambiguous(t *testing.T) {
+	m := newTestManager(func() castApp { return &fakeApp{} })
+	m.devices["dev-2"] = &Device{UUID: "dev-2", Name: "living room tv", Host: "127.0.0.2", Port: 8009}
+	m.devices["dev-3"] = &Device{UUID: "dev-3", Name: "LIVING ROOM TV", Host: "127.0.0.3", Port: 8009}
+
+	err := m.ConnectByName("Living room TV")
+	if err == nil {
+		t.Fatal("Expected ambiguity error")
+	}
+	for _, uuid := range []string{"dev-1", "dev-2", "dev-3"} {
+		if !strings.Contains(err.Error(), uuid) {
+			t.Errorf("Expected error to mention %s, got %v", uuid, err)
+		}
+	}
+	if m.IsConnected() {
+		t.Error("Expected no connection after ambiguous name")
+	}
+
+	// An exact-case match disambiguates
+	d, ok := m.GetDeviceByName("living room tv")
+	if !ok || d.UUID != "dev-2" {
+		t.Errorf("Expected exact-case match dev-2, got %+v, %v", d, ok)
+	}
+}
+
+// countingDiscovery returns a discover func that reports the given device
+// lists in order (repeating the last) and counts its calls.
+func countingDiscovery(results ...[]Device) (func(ctx context.Context) ([]Device, error), *int) {
+	calls := 0
+	return func(ctx context.Context) ([]Device, error) {
+		i := calls
+		if i >= len(results) {
+			i = len(results) - 1
+		}
+		calls++
+		return results[i], nil
+	}, &calls
+}
+
+func TestDiscoverDevices_CachedWithinTTL(t *testing.T) {
+	m := NewManager("")
+	m.DeviceTTL = time.Minute
+	discover, calls := countingDiscovery([]Device{{UUID: "a", Name: "Den"}})
+	m.discover = discover
+
+	if _, err := m.DiscoverDevices(context.Background(), time.Second); err != nil {
+		t.Fatalf("DiscoverDevices failed: %v", err)
+	}
+	devices, err := m.DiscoverDevices(context.Background(), time.Second)
+	if err != nil {
+		t.Fatalf("DiscoverDevices failed: %v", err)
+	}
+
+	if *calls != 1 {
+		t.Errorf("Expected discovery to run once within the TTL, ran %d times", *calls)
+	}
+	if len(devices) != 1 || devices[0].UUID != "a" || devices[0].LastSeen.IsZero() {
+		t.Errorf("Expected cached device with last-seen time, got %+v", devices)
+	}
+
+	// Forcing bypasses the cache
+	if _, err := m.RefreshDevices(context.Background(), time.Second); err != nil {
+		t.Fatalf("RefreshDevices failed: %v", err)
+	}
+	if *calls != 2 {
+		t.Errorf("Expected forced refresh to run discovery, ran %d times", *calls)
+	}
+}
+
+func TestDiscoverDevices_DropsAfterMissedCycles(t *testing.T) {
+	m := NewManager("")
+	m.DeviceTTL = time.Minute
+	m.MaxMissedDiscoveries = 2
+	discover, _ := countingDiscovery(
+		[]Device{{UUID: "a", Name: "Den"}, {UUID: "b", Name: "Office"}},
+		[]Device{{UUID: "a", Name: "Den"}},
+	)
+	m.discover = discover
+
+	for i, want := range []int{2, 2, 1} {
+		devices, err := m.RefreshDevices(context.Background(), time.Second)
+		if err != nil {
+			t.Fatalf("RefreshDevices failed: %v", err)
+		}
+		if len(devices) != want {
+			t.Errorf("Run %d: expected %d devices, got %d", i+1, want, len(devices))
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to log to from the keepalive goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureStdout returns what fn writes to os.Stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	fn()
+	w.Close()
+	return <-out
+}
+
+func TestManager_LogsOnlyToLogger(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		var logs syncBuffer
+		apps := []*fakeApp{{updateErrs: []error{errors.New("connection reset"), errors.New("connection reset")}}, {}}
+		var created atomic.Int64
+		m := newTestManager(func() castApp {
+			return apps[min(int(created.Add(1))-1, len(apps)-1)]
+		})
+		m.Logger = slog.New(slog.DiscardHandler)
+		if debug {
+			m.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		}
+
+		stdout := captureStdout(t, func() {
+			if err := m.Connect("dev-1"); err != nil {
+				t.Fatalf("Connect failed: %v", err)
+			}
+			m.GetStatus() // Fails the first update
+			if _, err := m.PlayMedia("/music/song.mp3", "audio/mpeg", ""); err != nil {
+				t.Fatalf("PlayMedia failed: %v", err)
+			}
+			waitFor(t, time.Second, func() bool { return created.Load() == 2 && !m.GetStatus().Reconnecting })
+			m.Disconnect()
+		})
+		if stdout != "" {
+			t.Errorf("Expected nothing on stdout, got %q", stdout)
+		}
+		if !debug {
+			continue
+		}
+		for _, msg := range []string{"cast connected", "cast status update failed", "cast media loaded", "cast connection lost", "cast reconnected"} {
+			if !strings.Contains(logs.String(), msg) {
+				t.Errorf("Expected %q logged, got %q", msg, logs.String())
+			}
+		}
+		if !strings.Contains(logs.String(), `device="Living Room TV"`) {
+			t.Errorf("Expected the device name as a field, got %q", logs.String())
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/media"
+)
+
+// Sources of configuration values, from least to most specific.
+const (
+	configDefault  = "default"  // Built in
+	configEnv      = "env"      // An environment variable a flag defaults to
+	configFlag     = "flag"     // Given on the command line
+	configSettings = "settings" // Stored in the settings table, overriding any flag
+	configDerived  = "derived"  // Worked out from the others or the system
+)
+
+// ConfigValue is one value of the configuration serve runs with, as listed
+// by the config command and GET /api/config.
+type ConfigValue struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"` // default, env, flag, settings or derived
+}
+
+// flagEnv names the environment variables flags default to.
+var flagEnv = map[string]string{"api-token": "Q2_API_TOKEN"}
+
+// secretFlags are the flags whose values are never shown.
+var secretFlags = map[string]bool{"api-token": true}
+
+// redacted stands in for a secret that is set.
+const redacted = "(redacted)"
+
+// effectiveConfig returns the configuration serve runs with given the parsed
+// serve flags: every flag with where its value came from, the settings
+// stored in the database (which override the flags they share a meaning
+// with), and derived values such as the ffmpeg in use. Secrets are redacted.
+func effectiveConfig(opts *serveFlags, database *db.DB, baseDir string, ffmpegMgr *ffmpeg.Manager) []ConfigValue {
+	given := map[string]bool{}
+	opts.fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	runtimeSettings := loadRuntimeSettings(database)
+	var config []ConfigValue
+	opts.fs.VisitAll(func(f *flag.Flag) {
+		v := ConfigValue{Name: f.Name, Value: f.Value.String(), Source: configDefault}
+		switch {
+		case given[f.Name]:
+			v.Source = configFlag
+		case flagEnv[f.Name] != "" && os.Getenv(flagEnv[f.Name]) != "":
+			v.Source = configEnv
+		}
+		if d := runtimeSettings.WatchDebounceMS; f.Name == "watch-debounce" && d != nil {
+			v.Value, v.Source = (time.Duration(*d) * time.Millisecond).String(), configSettings
+		}
+		if n := runtimeSettings.ScanConcurrency; f.Name == "scan-concurrency" && n != nil {
+			v.Value, v.Source = strconv.Itoa(*n), configSettings
+		}
+		if l := runtimeSettings.LogLevel; f.Name == "log-level" && l != nil {
+			v.Value, v.Source = *l, configSettings
+		}
+		if secretFlags[f.Name] && v.Value != "" {
+			v.Value = redacted
+		}
+		config = append(config, v)
+	})
+
+	// Settings without a flag, as the code reading them resolves them
+	setting := func(key, value string) {
+		v := ConfigValue{Name: key, Value: value, Source: configDefault}
+		var stored string
+		if database.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&stored) == nil {
+			v.Source = configSettings
+		}
+		config = append(config, v)
+	}
+	workers := 0
+	if runtimeSettings.ThumbnailWorkers != nil {
+		workers = *runtimeSettings.ThumbnailWorkers
+	}
+	setting(settingThumbnailWorkers, strconv.Itoa(workers))
+	setting("thumbnail_mode", thumbnailMode(database))
+	placement := media.PlacementCentral
+	if _, ok := thumbnailStore(database, baseDir).(media.SidecarStore); ok {
+		placement = media.PlacementSidecar
+	}
+	setting("thumbnail_store", placement)
+	setting("thumbnail_format", thumbnailFormat(database))
+	codecs := compatibleAudioCodecs(database)
+	if codecs == nil {
+		codecs = ffmpeg.DefaultCompatibleAudioCodecs
+	}
+	setting("compatible_audio_codecs", strings.Join(codecs, ","))
+	var audioDestination string
+	database.QueryRow("SELECT value FROM settings WHERE key = 'audio_destination'").Scan(&audioDestination)
+	setting("audio_destination", audioDestination)
+
+	dataDir, err := filepath.Abs(baseDir)
+	if err != nil {
+		dataDir = baseDir
+	}
+	ffmpegPath := ffmpegMgr.FindFFmpeg()
+	if ffmpegPath == "" {
+		ffmpegPath = "(not found)"
+	}
+	return append(config,
+		ConfigValue{Name: "data-dir", Value: dataDir, Source: configDerived},
+		ConfigValue{Name: "database", Value: filepath.Join(dataDir, dbFile), Source: configDerived},
+		ConfigValue{Name: "ffmpeg", Value: ffmpegPath, Source: configDerived},
+	)
+}
+
+// printConfig writes config to w, one aligned value per line.
+func printConfig(w io.Writer, config []ConfigValue) {
+	width := 0
+	for _, v := range config {
+		width = max(width, len(v.Name))
+	}
+	for _, v := range config {
+		fmt.Fprintf(w, "%-*s  %s (%s)\n", width, v.Name, cmp.Or(v.Value, "(unset)"), v.Source)
+	}
+}
+
+// makeConfigHandler creates a handler for GET /api/config, which returns the
+// configuration the server is running with, secrets redacted.
+func makeConfigHandler(opts *serveFlags, database *db.DB, baseDir string, ffmpegMgr *ffmpeg.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, effectiveConfig(opts, database, baseDir, ffmpegMgr))
+	}
+}
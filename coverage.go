@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"jukel.org/q2/db"
+)
+
+// FolderCoverage counts a folder's indexed files that are still missing
+// metadata, thumbnails or hashes, showing what the background workers have
+// left to do and what keeps failing.
+type FolderCoverage struct {
+	FolderID              int64  `json:"folder_id,omitempty"`
+	Path                  string `json:"path,omitempty"`
+	Files                 int64  `json:"files"`
+	Images                int64  `json:"images"`
+	ImagesWithoutMetadata int64  `json:"images_without_metadata"` // No image_metadata row
+	Audio                 int64  `json:"audio"`
+	AudioWithoutMetadata  int64  `json:"audio_without_metadata"` // No audio_metadata row
+	Videos                int64  `json:"videos"`
+	ThumbnailsPending     int64  `json:"thumbnails_pending"` // Images and videos enrichment hasn't tried yet
+	ThumbnailsFailed      int64  `json:"thumbnails_failed"`  // Tried, but still without thumbnails (failed, or skipped for the library type)
+	WithoutHash           int64  `json:"without_hash"`
+}
+
+// add adds the counts of c to t.
+func (t *FolderCoverage) add(c FolderCoverage) {
+	t.Files += c.Files
+	t.Images += c.Images
+	t.ImagesWithoutMetadata += c.ImagesWithoutMetadata
+	t.Audio += c.Audio
+	t.AudioWithoutMetadata += c.AudioWithoutMetadata
+	t.Videos += c.Videos
+	t.ThumbnailsPending += c.ThumbnailsPending
+	t.ThumbnailsFailed += c.ThumbnailsFailed
+	t.WithoutHash += c.WithoutHash
+}
+
+// coverageQuery counts per folder in one pass. Files indexed by the metadata
+// refresh are typed image/audio/video rather than IMG/AUD/VID, so both are counted.
+const coverageQuery = `
+	SELECT fo.id, fo.path,
+		COUNT(f.id),
+		SUM(CASE WHEN f.mediatype IN ('IMG', 'image') THEN 1 ELSE 0 END),
+		SUM(CASE WHEN f.mediatype IN ('IMG', 'image')
+			AND NOT EXISTS (SELECT 1 FROM image_metadata m WHERE m.file_id = f.id) THEN 1 ELSE 0 END),
+		SUM(CASE WHEN f.mediatype IN ('AUD', 'audio') THEN 1 ELSE 0 END),
+		SUM(CASE WHEN f.mediatype IN ('AUD', 'audio')
+			AND NOT EXISTS (SELECT 1 FROM audio_metadata m WHERE m.file_id = f.id) THEN 1 ELSE 0 END),
+		SUM(CASE WHEN f.mediatype IN ('VID', 'video') THEN 1 ELSE 0 END),
+		SUM(CASE WHEN f.mediatype IN ('IMG', 'image', 'VID', 'video')
+			AND COALESCE(f.thumbnail_small_path, '') = '' AND f.enriched_at IS NULL THEN 1 ELSE 0 END),
+		SUM(CASE WHEN f.mediatype IN ('IMG', 'image', 'VID', 'video')
+			AND COALESCE(f.thumbnail_small_path, '') = '' AND f.enriched_at IS NOT NULL THEN 1 ELSE 0 END),
+		SUM(CASE WHEN f.id IS NOT NULL AND COALESCE(f.xxhash, '') = '' THEN 1 ELSE 0 END)
+	FROM folders fo
+	LEFT JOIN files f ON f.folder_id = fo.id AND f.deleted_at IS NULL
+	GROUP BY fo.id
+	ORDER BY fo.path`
+
+// metadataCoverage returns the coverage of every monitored folder, ordered
+// by path, and the totals across them.
+func metadataCoverage(database *db.DB) ([]FolderCoverage, FolderCoverage, error) {
+	var total FolderCoverage
+	rows, err := database.Query(coverageQuery)
+	if err != nil {
+		return nil, total, err
+	}
+	defer rows.Close()
+
+	folders := []FolderCoverage{}
+	for rows.Next() {
+		var c FolderCoverage
+		if err := rows.Scan(&c.FolderID, &c.Path, &c.Files, &c.Images, &c.ImagesWithoutMetadata,
+			&c.Audio, &c.AudioWithoutMetadata, &c.Videos, &c.ThumbnailsPending, &c.ThumbnailsFailed, &c.WithoutHash); err != nil {
+			return nil, total, err
+		}
+		folders = append(folders, c)
+		total.add(c)
+	}
+	return folders, total, rows.Err()
+}
+
+// printCoverage prints the coverage command's report.
+func printCoverage(database *db.DB) error {
+	folders, total, err := metadataCoverage(database)
+	if err != nil {
+		return fmt.Errorf("failed to count coverage: %w", err)
+	}
+	if len(folders) == 0 {
+		fmt.Println("No folders stored")
+		return nil
+	}
+
+	for _, c := range folders {
+		fmt.Println(c.Path)
+		printCoverageCounts(c)
+	}
+	if len(folders) > 1 {
+		fmt.Println("Total")
+		printCoverageCounts(total)
+	}
+	return nil
+}
+
+func printCoverageCounts(c FolderCoverage) {
+	fmt.Printf("  files:       %d (%d without hash)\n", c.Files, c.WithoutHash)
+	fmt.Printf("  images:      %d (%d without metadata)\n", c.Images, c.ImagesWithoutMetadata)
+	fmt.Printf("  audio:       %d (%d without metadata)\n", c.Audio, c.AudioWithoutMetadata)
+	fmt.Printf("  videos:      %d\n", c.Videos)
+	fmt.Printf("  thumbnails:  %d pending, %d failed\n", c.ThumbnailsPending, c.ThumbnailsFailed)
+}
+
+// makeCoverageHandler creates a handler for GET /api/coverage, which reports
+// the coverage command's counts per folder and in total.
+func makeCoverageHandler(database *db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		folders, total, err := metadataCoverage(database)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"folders": folders, "total": total})
+	}
+}
@@ -6,12 +6,25 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Reads that find the database busy (e.g. during a WAL checkpoint) are
+// retried this many times, waiting readRetryDelay and then twice as long
+// before each further attempt. Writes rely on busy_timeout instead.
+const (
+	readRetries    = 5
+	readRetryDelay = 5 * time.Millisecond
+)
+
 // Statement is a single SQL statement used in a transaction.
 type Statement struct {
 	Query string
@@ -26,6 +39,9 @@ type WriteRequest struct {
 	// Tx, if non-nil, means run all TxStatements in a single transaction.
 	Tx         []Statement
 	TxResult   chan error
+	// TxFunc, if non-nil, is run in a transaction by Transaction; its result
+	// is sent on TxResult.
+	TxFunc func(tx *DB) error
 }
 
 // WriteResult contains the result of a write operation.
@@ -43,24 +59,133 @@ type DB struct {
 	writeChan chan WriteRequest
 	done      chan struct{}
 	wg        sync.WaitGroup
+
+	// closed is set by Close. Requests are queued holding closeMu's read
+	// lock, and Close sets closed holding the write lock, so nothing is
+	// queued once the writer may have drained the queue and exited.
+	closeMu sync.RWMutex
+	closed  atomic.Bool
+
+	writes       atomic.Uint64 // Writes and transactions processed
+	writeLatency atomic.Int64  // Moving average execution time, in nanoseconds
+
+	tx *sql.Tx // Set on the DB a Transaction function is given; every read and write goes through it
+
+	execHook func(query string) // Called before each statement the writer runs, for tests
 }
 
-// Open creates a new DB instance with the Single Writer pattern.
+// walAutoCheckpointPages is how many pages the WAL grows to before commits
+// checkpoint it back into the database (about 4MB with 4KB pages). Readers
+// holding old snapshots can stop these passive checkpoints from finishing,
+// so long-running processes also call Checkpoint.
+const walAutoCheckpointPages = 1000
+
+// Checkpoint modes, see https://sqlite.org/pragma.html#pragma_wal_checkpoint.
+const (
+	CheckpointPassive  = "PASSIVE"  // Checkpoint what it can without waiting
+	CheckpointFull     = "FULL"     // Wait for writers, then checkpoint everything
+	CheckpointRestart  = "RESTART"  // FULL, then wait for readers so the WAL restarts from the beginning
+	CheckpointTruncate = "TRUNCATE" // RESTART, and truncate the WAL file to zero bytes
+)
+
+// ErrCheckpointBusy is returned by Checkpoint when readers or writers kept
+// it from completing.
+var ErrCheckpointBusy = errors.New("checkpoint could not complete: database busy")
+
+// ErrClosed is returned by writes made once Close has begun.
+var ErrClosed = errors.New("database is closed")
+
+// ErrWritePanic is returned for a write, transaction or Transaction
+// function that panicked on the writer goroutine. The panic is recovered so
+// the writer keeps serving later writes instead of leaving them blocked.
+var ErrWritePanic = errors.New("write panicked")
+
+// latencyWeight is the weight of the newest write in the moving average latency.
+const latencyWeight = 0.1
+
+// Stats is a snapshot of the single writer's load.
+type Stats struct {
+	QueueDepth    int           `json:"queue_depth"`    // Writes waiting for the writer
+	QueueCapacity int           `json:"queue_capacity"` // Buffered writes before callers block
+	Writes        uint64        `json:"writes"`         // Writes and transactions processed
+	WriteLatency  time.Duration `json:"write_latency"`  // Moving average execution time, in nanoseconds
+}
+
+// Stats reports how busy the writer is, for finding out why indexing is slow.
+func (db *DB) Stats() Stats {
+	return Stats{
+		QueueDepth:    len(db.writeChan),
+		QueueCapacity: cap(db.writeChan),
+		Writes:        db.writes.Load(),
+		WriteLatency:  time.Duration(db.writeLatency.Load()),
+	}
+}
+
+// Synchronous modes for Options.Synchronous, see
+// https://sqlite.org/pragma.html#pragma_synchronous.
+const (
+	SynchronousNormal = "NORMAL" // Faster; in WAL mode a power loss can lose the last commits but not corrupt the database
+	SynchronousFull   = "FULL"   // Sync the WAL on every commit (SQLite's default)
+)
+
+// Options configures a DB. Zero fields take the values from DefaultOptions.
+type Options struct {
+	ReadPoolSize int           // Maximum open read connections; half are kept idle
+	BusyTimeout  time.Duration // How long a connection waits for a lock before failing with SQLITE_BUSY
+	Synchronous  string        // SynchronousNormal or SynchronousFull; "" keeps SQLite's default
+}
+
+// DefaultOptions returns the options used by Open.
+func DefaultOptions() Options {
+	return Options{
+		ReadPoolSize: 10,
+		BusyTimeout:  5 * time.Second,
+	}
+}
+
+func (o Options) withDefaults() Options {
+	d := DefaultOptions()
+	if o.ReadPoolSize <= 0 {
+		o.ReadPoolSize = d.ReadPoolSize
+	}
+	if o.BusyTimeout <= 0 {
+		o.BusyTimeout = d.BusyTimeout
+	}
+	return o
+}
+
+// Open creates a new DB instance with the Single Writer pattern and
+// DefaultOptions. See OpenWithOptions.
+func Open(dbPath string) (*DB, error) {
+	return OpenWithOptions(dbPath, DefaultOptions())
+}
+
+// OpenWithOptions creates a new DB instance with the Single Writer pattern.
 // It opens separate connections for reading and writing, enables WAL mode,
 // and starts the writer goroutine.
-func Open(dbPath string) (*DB, error) {
+func OpenWithOptions(dbPath string, opts Options) (*DB, error) {
+	opts = opts.withDefaults()
+	dsnOptions := fmt.Sprintf("_journal_mode=WAL&_busy_timeout=%d", opts.BusyTimeout.Milliseconds())
+	switch strings.ToUpper(opts.Synchronous) {
+	case "":
+	case SynchronousNormal, SynchronousFull:
+		dsnOptions += "&_synchronous=" + strings.ToUpper(opts.Synchronous)
+	default:
+		return nil, fmt.Errorf("invalid synchronous mode %q (must be %s or %s)", opts.Synchronous, SynchronousNormal, SynchronousFull)
+	}
+
 	// Open read pool (multiple concurrent readers allowed)
-	readPool, err := sql.Open("sqlite3", dbPath+"?mode=ro&_journal_mode=WAL")
+	readPool, err := sql.Open("sqlite3", dbPath+"?mode=ro&"+dsnOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open read pool: %w", err)
 	}
 
 	// Configure read pool for concurrent access
-	readPool.SetMaxOpenConns(10)
-	readPool.SetMaxIdleConns(5)
+	readPool.SetMaxOpenConns(opts.ReadPoolSize)
+	readPool.SetMaxIdleConns(max(opts.ReadPoolSize/2, 1))
 
 	// Open write connection (single writer)
-	writeConn, err := sql.Open("sqlite3", dbPath+"?mode=rwc&_journal_mode=WAL&_busy_timeout=5000")
+	writeConn, err := sql.Open("sqlite3", dbPath+"?mode=rwc&"+dsnOptions)
 	if err != nil {
 		readPool.Close()
 		return nil, fmt.Errorf("failed to open write connection: %w", err)
@@ -76,6 +201,11 @@ func Open(dbPath string) (*DB, error) {
 		writeConn.Close()
 		return nil, fmt.Errorf("failed to enable WAL mode: %w", err)
 	}
+	if _, err := writeConn.Exec(fmt.Sprintf("PRAGMA wal_autocheckpoint=%d", walAutoCheckpointPages)); err != nil {
+		readPool.Close()
+		writeConn.Close()
+		return nil, fmt.Errorf("failed to set WAL auto-checkpoint: %w", err)
+	}
 
 	db := &DB{
 		readPool:  readPool,
@@ -97,11 +227,35 @@ func (db *DB) writerLoop() {
 	defer db.wg.Done()
 
 	process := func(req WriteRequest) {
+		// Counted before replying, so a caller sees its own write in Stats
+		start := time.Now()
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			err := fmt.Errorf("%w: %v", ErrWritePanic, p)
+			db.recordWrite(time.Since(start))
+			if req.TxResult != nil {
+				req.TxResult <- err
+			} else {
+				req.Result <- WriteResult{Err: err}
+			}
+		}()
+		if req.TxFunc != nil {
+			err := db.executeTxFunc(req.TxFunc)
+			db.recordWrite(time.Since(start))
+			req.TxResult <- err
+			return
+		}
 		if req.TxResult != nil {
-			req.TxResult <- db.executeTransaction(req.Tx)
+			err := db.executeTransaction(req.Tx)
+			db.recordWrite(time.Since(start))
+			req.TxResult <- err
 			return
 		}
 		result := db.executeWrite(req.Query, req.Args)
+		db.recordWrite(time.Since(start))
 		req.Result <- result
 	}
 
@@ -123,26 +277,80 @@ func (db *DB) writerLoop() {
 	}
 }
 
-// executeTransaction runs multiple statements in a single SQLite transaction.
+// recordWrite counts a processed write and folds its latency into the
+// moving average. Only the writer goroutine calls it.
+func (db *DB) recordWrite(latency time.Duration) {
+	avg := latency
+	if db.writes.Load() > 0 {
+		prev := time.Duration(db.writeLatency.Load())
+		avg = prev + time.Duration(latencyWeight*float64(latency-prev))
+	}
+	db.writeLatency.Store(int64(avg))
+	db.writes.Add(1)
+}
+
+// executeTransaction runs multiple statements in a single SQLite transaction,
+// rolling back if one fails or panics.
 func (db *DB) executeTransaction(stmts []Statement) error {
 	tx, err := db.writeConn.Begin()
 	if err != nil {
-		return fmt.Errorf("begin transaction: %w", err)
+		return fmt.Errorf("begin transaction: %w", Classify(err))
 	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+	}()
+
 	for _, s := range stmts {
+		if db.execHook != nil {
+			db.execHook(s.Query)
+		}
 		if _, err := tx.Exec(s.Query, s.Args...); err != nil {
 			_ = tx.Rollback()
-			return err
+			return Classify(err)
+		}
+	}
+	return Classify(tx.Commit())
+}
+
+// executeTxFunc runs fn in a transaction, committing if it succeeds and
+// rolling back if it fails or panics.
+func (db *DB) executeTxFunc(fn func(tx *DB) error) (err error) {
+	tx, err := db.writeConn.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", Classify(err))
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
 		}
+	}()
+
+	if err := fn(&DB{tx: tx}); err != nil {
+		_ = tx.Rollback()
+		return err
 	}
-	return tx.Commit()
+	return Classify(tx.Commit())
 }
 
 // executeWrite performs the actual write operation.
 func (db *DB) executeWrite(query string, args []any) WriteResult {
-	result, err := db.writeConn.Exec(query, args...)
+	if db.execHook != nil {
+		db.execHook(query)
+	}
+	if db.tx != nil {
+		return writeResult(db.tx.Exec(query, args...))
+	}
+	return writeResult(db.writeConn.Exec(query, args...))
+}
+
+// writeResult converts the result of an Exec.
+func writeResult(result sql.Result, err error) WriteResult {
 	if err != nil {
-		return WriteResult{Err: err}
+		return WriteResult{Err: Classify(err)}
 	}
 
 	lastID, _ := result.LastInsertId()
@@ -156,74 +364,210 @@ func (db *DB) executeWrite(query string, args []any) WriteResult {
 
 // WriteTransaction executes multiple statements atomically in a single transaction.
 // Runs on the writer goroutine to maintain the Single Writer guarantee.
+// Within a Transaction, the statements join it instead.
 func (db *DB) WriteTransaction(stmts []Statement) error {
+	if db.tx != nil {
+		for _, st := range stmts {
+			if _, err := db.tx.Exec(st.Query, st.Args...); err != nil {
+				return Classify(err)
+			}
+		}
+		return nil
+	}
 	req := WriteRequest{
 		Tx:       stmts,
 		TxResult: make(chan error, 1),
 	}
-	db.writeChan <- req
+	if err := db.send(context.Background(), req); err != nil {
+		return err
+	}
+	return <-req.TxResult
+}
+
+// Transaction runs fn in a single transaction on the writer goroutine,
+// committing if it returns nil and rolling back if it returns an error. fn
+// is given a DB whose reads and writes all go through the transaction, so it
+// sees its own changes; only those methods may be used on it, and it must not
+// be kept. Writing to the outer DB from fn would wait forever. Called within
+// a Transaction, fn joins the open one. If fn panics, the transaction is
+// rolled back and ErrWritePanic returned.
+func (db *DB) Transaction(fn func(tx *DB) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+	req := WriteRequest{
+		TxFunc:   fn,
+		TxResult: make(chan error, 1),
+	}
+	if err := db.send(context.Background(), req); err != nil {
+		return err
+	}
 	return <-req.TxResult
 }
 
 // Write sends a write request to the writer goroutine and waits for the result.
 // This method is safe to call from multiple goroutines.
 func (db *DB) Write(query string, args ...any) WriteResult {
+	if db.tx != nil {
+		return db.executeWrite(query, args)
+	}
 	req := WriteRequest{
 		Query:  query,
 		Args:   args,
 		Result: make(chan WriteResult, 1),
 	}
 
-	db.writeChan <- req
+	if err := db.send(context.Background(), req); err != nil {
+		return WriteResult{Err: err}
+	}
 	return <-req.Result
 }
 
 // WriteContext sends a write request with context support for cancellation.
 func (db *DB) WriteContext(ctx context.Context, query string, args ...any) WriteResult {
+	if db.tx != nil {
+		return writeResult(db.tx.ExecContext(ctx, query, args...))
+	}
 	req := WriteRequest{
 		Query:  query,
 		Args:   args,
 		Result: make(chan WriteResult, 1),
 	}
 
+	if err := db.send(ctx, req); err != nil {
+		return WriteResult{Err: err}
+	}
 	select {
-	case db.writeChan <- req:
-		select {
-		case result := <-req.Result:
-			return result
-		case <-ctx.Done():
-			return WriteResult{Err: ctx.Err()}
-		}
+	case result := <-req.Result:
+		return result
 	case <-ctx.Done():
 		return WriteResult{Err: ctx.Err()}
 	}
 }
 
+// send queues req for the writer goroutine, waiting while the queue is
+// full until ctx is done. Returns ErrClosed once Close has begun: a request
+// queued after the writer drained the queue would never get its result.
+func (db *DB) send(ctx context.Context, req WriteRequest) error {
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	select {
+	case db.writeChan <- req:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Query executes a read query and returns the rows.
 // Safe for concurrent use - uses the read connection pool.
 func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
-	return db.readPool.Query(query, args...)
+	return db.QueryContext(context.Background(), query, args...)
 }
 
 // QueryContext executes a read query with context support.
+// A busy database is retried until ctx is done.
 func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
-	return db.readPool.QueryContext(ctx, query, args...)
+	if db.tx != nil {
+		rows, err := db.tx.QueryContext(ctx, query, args...)
+		return rows, Classify(err)
+	}
+	rows, err := retryBusy(ctx, func() (*sql.Rows, error) {
+		return db.readPool.QueryContext(ctx, query, args...)
+	})
+	return rows, Classify(err)
 }
 
 // QueryRow executes a read query that returns at most one row.
 func (db *DB) QueryRow(query string, args ...any) *sql.Row {
-	return db.readPool.QueryRow(query, args...)
+	return db.QueryRowContext(context.Background(), query, args...)
 }
 
 // QueryRowContext executes a read query with context support.
+// A busy database is retried until ctx is done.
 func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
-	return db.readPool.QueryRowContext(ctx, query, args...)
+	if db.tx != nil {
+		return db.tx.QueryRowContext(ctx, query, args...)
+	}
+	row, _ := retryBusy(ctx, func() (*sql.Row, error) {
+		row := db.readPool.QueryRowContext(ctx, query, args...)
+		return row, row.Err()
+	})
+	return row
+}
+
+// retryBusy calls query until it returns something other than SQLITE_BUSY,
+// it has been retried readRetries times, or ctx is done. The last result is
+// returned either way.
+func retryBusy[T any](ctx context.Context, query func() (T, error)) (T, error) {
+	delay := readRetryDelay
+	for attempt := 0; ; attempt++ {
+		result, err := query()
+		if !isBusy(err) || attempt == readRetries {
+			return result, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		}
+		delay *= 2
+	}
+}
+
+// Checkpoint copies the WAL back into the database file with
+// PRAGMA wal_checkpoint(mode), mode being one of the Checkpoint constants.
+// It runs on the write connection, so it waits for any write in progress.
+func (db *DB) Checkpoint(mode string) error {
+	mode = strings.ToUpper(mode)
+	switch mode {
+	case CheckpointPassive, CheckpointFull, CheckpointRestart, CheckpointTruncate:
+	default:
+		return fmt.Errorf("invalid checkpoint mode %q", mode)
+	}
+
+	var busy, logPages, checkpointed int
+	if err := db.writeConn.QueryRow("PRAGMA wal_checkpoint("+mode+")").Scan(&busy, &logPages, &checkpointed); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	if busy != 0 {
+		return ErrCheckpointBusy
+	}
+	return nil
+}
+
+// Backup writes a consistent snapshot of the database to destPath with
+// VACUUM INTO. It runs on the writer goroutine, so it is safe while the
+// database is in use, and the copy is compacted. An existing destPath is
+// rejected rather than overwritten.
+func (db *DB) Backup(destPath string) error {
+	if _, err := os.Stat(destPath); err == nil {
+		return &os.PathError{Op: "backup", Path: destPath, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return db.Write("VACUUM INTO ?", destPath).Err
 }
 
 // Close gracefully shuts down the database connections.
 // It signals the writer goroutine to stop, waits for pending writes to complete,
-// and closes both connection pools.
+// and closes both connection pools. Writes made once it has begun return
+// ErrClosed instead of waiting forever; closing again does nothing.
 func (db *DB) Close() error {
+	// Waits for requests being queued; later ones fail with ErrClosed
+	db.closeMu.Lock()
+	alreadyClosed := db.closed.Swap(true)
+	db.closeMu.Unlock()
+	if alreadyClosed {
+		return nil
+	}
+
 	close(db.done)
 	db.wg.Wait()
 
@@ -2,14 +2,20 @@ package db
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/mattn/go-sqlite3"
 )
 
-func setupTestDB(t *testing.T) (*DB, func()) {
+func setupTestDB(t testing.TB) (*DB, func()) {
 	tmpDir, err := os.MkdirTemp("", "q2-db-test-*")
 	if err != nil {
 		t.Fatalf("Failed to create temp dir: %v", err)
@@ -310,6 +316,53 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestWrite_ConcurrentWithClose(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Writers racing Close either land before it or fail with ErrClosed; none hang
+	const writers = 50
+	results := make(chan error, writers)
+	var start sync.WaitGroup
+	start.Add(1)
+	for i := 0; i < writers; i++ {
+		go func() {
+			start.Wait()
+			results <- db.Write("INSERT INTO test (name, value) VALUES ('racer', ?)", i).Err
+		}()
+	}
+	start.Done()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < writers; i++ {
+		select {
+		case err := <-results:
+			if err != nil && !errors.Is(err, ErrClosed) {
+				t.Errorf("Expected success or ErrClosed, got %v", err)
+			}
+		case <-timeout:
+			t.Fatalf("%d writes still blocked after Close", writers-i)
+		}
+	}
+
+	// Once closed, every kind of write fails straight away
+	if err := db.Write("INSERT INTO test (name) VALUES ('late')").Err; !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Write, got %v", err)
+	}
+	if err := db.WriteContext(context.Background(), "INSERT INTO test (name) VALUES ('late')").Err; !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from WriteContext, got %v", err)
+	}
+	if err := db.Transaction(func(tx *DB) error { return nil }); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Transaction, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Expected closing again to do nothing, got %v", err)
+	}
+}
+
 func TestWriteError(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -320,3 +373,480 @@ func TestWriteError(t *testing.T) {
 		t.Error("Expected error for insert into nonexistent table")
 	}
 }
+
+func TestWrite_PanicKeepsWriterRunning(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Set before the writes below are sent, which orders it before the writer reads it
+	db.execHook = func(query string) {
+		if strings.Contains(query, "boom") {
+			panic("driver bug")
+		}
+	}
+
+	result := db.Write("INSERT INTO test (name, value) VALUES ('boom', 1)")
+	if !errors.Is(result.Err, ErrWritePanic) || !strings.Contains(result.Err.Error(), "driver bug") {
+		t.Errorf("Expected ErrWritePanic with the panic value, got %v", result.Err)
+	}
+	err := db.Transaction(func(tx *DB) error {
+		panic("caller bug")
+	})
+	if !errors.Is(err, ErrWritePanic) {
+		t.Errorf("Expected ErrWritePanic from a panicking Transaction, got %v", err)
+	}
+	// A panic part way through a WriteTransaction rolls back what it wrote
+	err = db.WriteTransaction([]Statement{
+		{Query: "INSERT INTO test (name, value) VALUES ('first', 1)"},
+		{Query: "INSERT INTO test (name, value) VALUES ('boom', 2)"},
+	})
+	if !errors.Is(err, ErrWritePanic) {
+		t.Errorf("Expected ErrWritePanic from a panicking WriteTransaction, got %v", err)
+	}
+
+	// Later writes are still served
+	done := make(chan WriteResult, 1)
+	go func() { done <- db.Write("INSERT INTO test (name, value) VALUES ('after', 2)") }()
+	select {
+	case result := <-done:
+		if result.Err != nil {
+			t.Fatalf("Write after the panic failed: %v", result.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write after the panic blocked; the writer goroutine died")
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM test").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected only the write after the panic stored, got %d rows", count)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	count := func() int {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM test").Scan(&n)
+		return n
+	}
+
+	// Reads inside see the transaction's own writes, even while iterating
+	err := db.Transaction(func(tx *DB) error {
+		for _, name := range []string{"a", "b"} {
+			if r := tx.Write("INSERT INTO test (name, value) VALUES (?, 1)", name); r.Err != nil {
+				return r.Err
+			}
+		}
+		rows, err := tx.Query("SELECT name FROM test ORDER BY name")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return err
+			}
+			if r := tx.Write("UPDATE test SET value = 2 WHERE name = ?", name); r.Err != nil {
+				return r.Err
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+	var sum int
+	db.QueryRow("SELECT SUM(value) FROM test").Scan(&sum)
+	if count() != 2 || sum != 4 {
+		t.Errorf("Expected 2 committed rows updated to 2, got %d rows summing %d", count(), sum)
+	}
+
+	// A failure rolls back everything, including a nested transaction
+	failure := errors.New("stop")
+	err = db.Transaction(func(tx *DB) error {
+		tx.Write("INSERT INTO test (name) VALUES ('c')")
+		tx.Transaction(func(nested *DB) error {
+			return nested.WriteTransaction([]Statement{{Query: "INSERT INTO test (name) VALUES ('d')"}})
+		})
+		var n int
+		if tx.QueryRow("SELECT COUNT(*) FROM test").Scan(&n); n != 4 {
+			t.Errorf("Expected the transaction to see 4 rows, got %d", n)
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("Expected the function's error, got %v", err)
+	}
+	if count() != 2 {
+		t.Errorf("Expected the failed transaction rolled back, got %d rows", count())
+	}
+}
+
+// busyQuery returns a query that reports SQLITE_BUSY for the first failures
+// calls and then succeeds, counting every call.
+func busyQuery(failures int, calls *int) func() (string, error) {
+	return func() (string, error) {
+		*calls++
+		if *calls <= failures {
+			return "", fmt.Errorf("query: %w", sqlite3.Error{Code: sqlite3.ErrBusy})
+		}
+		return "ok", nil
+	}
+}
+
+func TestRetryBusy(t *testing.T) {
+	calls := 0
+	got, err := retryBusy(context.Background(), busyQuery(3, &calls))
+	if err != nil || got != "ok" {
+		t.Fatalf("Expected success after retries, got %q, %v", got, err)
+	}
+	if calls != 4 {
+		t.Errorf("Expected 4 attempts, got %d", calls)
+	}
+
+	// Gives up after readRetries retries
+	calls = 0
+	if _, err := retryBusy(context.Background(), busyQuery(100, &calls)); !isBusy(err) {
+		t.Errorf("Expected the busy error once retries run out, got %v", err)
+	}
+	if calls != readRetries+1 {
+		t.Errorf("Expected %d attempts, got %d", readRetries+1, calls)
+	}
+
+	// Other errors are returned at once
+	calls = 0
+	_, err = retryBusy(context.Background(), func() (string, error) {
+		calls++
+		return "", errors.New("no such table: missing")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("Expected one attempt for a non-busy error, got %d (%v)", calls, err)
+	}
+
+	// A cancelled context stops retrying
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	if _, err := retryBusy(ctx, busyQuery(100, &calls)); !isBusy(err) || calls != 1 {
+		t.Errorf("Expected one attempt with a cancelled context, got %d (%v)", calls, err)
+	}
+}
+
+func TestQueryRow_NotBusyUnchanged(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM test").Scan(&n); err != nil {
+		t.Fatalf("QueryRow failed: %v", err)
+	}
+	var name string
+	if err := db.QueryRow("SELECT name FROM test WHERE id = ?", 42).Scan(&name); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows, got %v", err)
+	}
+	if _, err := db.Query("SELECT * FROM missing"); err == nil {
+		t.Error("Expected an error for a missing table")
+	}
+}
+
+func TestClassify(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	if r := db.Write("CREATE TABLE tags (id INTEGER PRIMARY KEY, name TEXT UNIQUE)"); r.Err != nil {
+		t.Fatalf("Failed to create table: %v", r.Err)
+	}
+	if r := db.Write("INSERT INTO tags (id, name) VALUES (1, 'a')"); r.Err != nil {
+		t.Fatalf("Insert failed: %v", r.Err)
+	}
+
+	// Driver errors from writes come back typed, with the driver error kept
+	r := db.Write("INSERT INTO tags (id, name) VALUES (2, 'a')")
+	if !errors.Is(r.Err, ErrUniqueViolation) {
+		t.Errorf("Expected ErrUniqueViolation for a UNIQUE column, got %v", r.Err)
+	}
+	var sqliteErr sqlite3.Error
+	if !errors.As(r.Err, &sqliteErr) || sqliteErr.ExtendedCode != sqlite3.ErrConstraintUnique {
+		t.Errorf("Expected the driver error to be kept, got %v", r.Err)
+	}
+	if !strings.Contains(r.Err.Error(), "UNIQUE constraint failed") {
+		t.Errorf("Expected the driver message to be kept, got %q", r.Err)
+	}
+	err := db.WriteTransaction([]Statement{{Query: "INSERT INTO tags (id, name) VALUES (1, 'b')"}})
+	if !errors.Is(err, ErrUniqueViolation) {
+		t.Errorf("Expected ErrUniqueViolation for a PRIMARY KEY, got %v", err)
+	}
+
+	// Scans are classified by the caller
+	var name string
+	err = Classify(db.QueryRow("SELECT name FROM tags WHERE id = 42").Scan(&name))
+	if !errors.Is(err, ErrNotFound) || !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected ErrNotFound wrapping sql.ErrNoRows, got %v", err)
+	}
+
+	for _, code := range []sqlite3.ErrNo{sqlite3.ErrBusy, sqlite3.ErrLocked} {
+		err := Classify(fmt.Errorf("query: %w", sqlite3.Error{Code: code}))
+		if !errors.Is(err, ErrBusy) {
+			t.Errorf("Expected ErrBusy for %v, got %v", code, err)
+		}
+	}
+
+	// Anything else is left alone
+	other := errors.New("no such table: missing")
+	if got := Classify(other); got != other {
+		t.Errorf("Expected other errors unchanged, got %v", got)
+	}
+	if r := db.Write("INSERT INTO missing (foo) VALUES (1)"); errors.Is(r.Err, ErrUniqueViolation) || errors.Is(r.Err, ErrBusy) {
+		t.Errorf("Expected an unclassified error, got %v", r.Err)
+	}
+	if Classify(nil) != nil {
+		t.Error("Expected nil for nil")
+	}
+}
+
+func TestStats(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	before := db.Stats()
+	if before.QueueCapacity != cap(db.writeChan) {
+		t.Errorf("Expected queue capacity %d, got %d", cap(db.writeChan), before.QueueCapacity)
+	}
+
+	const n = 250
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			db.Write("INSERT INTO test (name, value) VALUES (?, ?)", "stats", i)
+		}(i)
+	}
+	wg.Wait()
+	db.WriteTransaction([]Statement{{Query: "DELETE FROM test WHERE value < 10"}})
+
+	stats := db.Stats()
+	if got := stats.Writes - before.Writes; got != n+1 {
+		t.Errorf("Expected %d writes processed, got %d", n+1, got)
+	}
+	if stats.QueueDepth != 0 {
+		t.Errorf("Expected an empty queue once writes return, got %d", stats.QueueDepth)
+	}
+	if stats.WriteLatency <= 0 {
+		t.Errorf("Expected a write latency, got %s", stats.WriteLatency)
+	}
+}
+
+func TestCheckpoint_TruncatesWAL(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+
+	db.Write("CREATE TABLE test (id INTEGER PRIMARY KEY, data TEXT)")
+	stmts := make([]Statement, 500)
+	for i := range stmts {
+		stmts[i] = Statement{Query: "INSERT INTO test (data) VALUES (?)", Args: []interface{}{strings.Repeat("x", 1000)}}
+	}
+	for i := 0; i < 4; i++ {
+		if err := db.WriteTransaction(stmts); err != nil {
+			t.Fatalf("WriteTransaction failed: %v", err)
+		}
+	}
+
+	walSize := func() int64 {
+		info, err := os.Stat(dbPath + "-wal")
+		if err != nil {
+			t.Fatalf("Failed to stat WAL: %v", err)
+		}
+		return info.Size()
+	}
+	before := walSize()
+	if before == 0 {
+		t.Fatal("Expected the writes to grow the WAL")
+	}
+
+	if err := db.Checkpoint(CheckpointPassive); err != nil {
+		t.Errorf("Passive checkpoint failed: %v", err)
+	}
+	if err := db.Checkpoint("truncate"); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if after := walSize(); after != 0 {
+		t.Errorf("Expected TRUNCATE to empty the WAL (%d bytes before), got %d bytes", before, after)
+	}
+
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM test").Scan(&n)
+	if n != 2000 {
+		t.Errorf("Expected 2000 rows after checkpointing, got %d", n)
+	}
+
+	if err := db.Checkpoint("SOMETIMES"); err == nil {
+		t.Error("Expected an error for an invalid mode")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for i := 0; i < 50; i++ {
+		db.Write("INSERT INTO test (name, value) VALUES (?, ?)", "row", i)
+	}
+	db.Write("CREATE TABLE other (id INTEGER PRIMARY KEY)")
+	db.Write("INSERT INTO other (id) VALUES (1), (2), (3)")
+
+	dest := filepath.Join(t.TempDir(), "backup.db")
+	if err := db.Backup(dest); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	backup, err := Open(dest)
+	if err != nil {
+		t.Fatalf("Failed to open backup: %v", err)
+	}
+	defer backup.Close()
+	for _, table := range []string{"test", "other"} {
+		var want, got int
+		db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&want)
+		if err := backup.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&got); err != nil {
+			t.Fatalf("Failed to count %s in backup: %v", table, err)
+		}
+		if got != want {
+			t.Errorf("%s: expected %d rows in backup, got %d", table, want, got)
+		}
+	}
+
+	// An existing file is never overwritten
+	if err := db.Backup(dest); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Expected os.ErrExist for an existing destination, got %v", err)
+	}
+}
+
+// benchmarkRows is how many rows each insert benchmark iteration writes.
+const benchmarkRows = 1000
+
+// reportRows reports the rows written per second across all iterations.
+func reportRows(b *testing.B, perOp int) {
+	b.ReportMetric(float64(perOp*b.N)/b.Elapsed().Seconds(), "rows/s")
+}
+
+func BenchmarkWrite_PerRow(b *testing.B) {
+	db, cleanup := setupTestDB(b)
+	defer cleanup()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchmarkRows; j++ {
+			if r := db.Write("INSERT INTO test (name, value) VALUES (?, ?)", "row", j); r.Err != nil {
+				b.Fatalf("Write failed: %v", r.Err)
+			}
+		}
+	}
+	reportRows(b, benchmarkRows)
+}
+
+func BenchmarkWrite_Batched(b *testing.B) {
+	db, cleanup := setupTestDB(b)
+	defer cleanup()
+
+	stmts := make([]Statement, benchmarkRows)
+	for j := range stmts {
+		stmts[j] = Statement{Query: "INSERT INTO test (name, value) VALUES (?, ?)", Args: []interface{}{"row", j}}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.WriteTransaction(stmts); err != nil {
+			b.Fatalf("WriteTransaction failed: %v", err)
+		}
+	}
+	reportRows(b, benchmarkRows)
+}
+
+// BenchmarkQueryRow_DuringWrites measures point reads while a writer inserts
+// continuously, as the web UI reads while a scan is running.
+func BenchmarkQueryRow_DuringWrites(b *testing.B) {
+	db, cleanup := setupTestDB(b)
+	defer cleanup()
+
+	for j := 0; j < benchmarkRows; j++ {
+		db.Write("INSERT INTO test (name, value) VALUES (?, ?)", "initial", j)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; ctx.Err() == nil; j++ {
+			db.Write("INSERT INTO test (name, value) VALUES (?, ?)", "concurrent", j)
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var name string
+		for i := 1; pb.Next(); i++ {
+			if err := db.QueryRow("SELECT name FROM test WHERE id = ?", i%benchmarkRows+1).Scan(&name); err != nil {
+				b.Errorf("QueryRow failed: %v", err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "reads/s")
+
+	cancel()
+	wg.Wait()
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWithOptions(filepath.Join(dir, "test.db"), Options{
+		ReadPoolSize: 2,
+		BusyTimeout:  1234 * time.Millisecond,
+		Synchronous:  SynchronousNormal,
+	})
+	if err != nil {
+		t.Fatalf("OpenWithOptions failed: %v", err)
+	}
+	defer db.Close()
+
+	var timeout, synchronous int
+	if err := db.QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil || timeout != 1234 {
+		t.Errorf("Expected read busy_timeout 1234, got %d, %v", timeout, err)
+	}
+	if err := db.writeConn.QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil || timeout != 1234 {
+		t.Errorf("Expected write busy_timeout 1234, got %d, %v", timeout, err)
+	}
+	if err := db.writeConn.QueryRow("PRAGMA synchronous").Scan(&synchronous); err != nil || synchronous != 1 {
+		t.Errorf("Expected synchronous NORMAL (1), got %d, %v", synchronous, err)
+	}
+	if got := db.readPool.Stats().MaxOpenConnections; got != 2 {
+		t.Errorf("Expected 2 read connections, got %d", got)
+	}
+
+	// Open keeps the defaults
+	defaults, err := Open(filepath.Join(dir, "defaults.db"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer defaults.Close()
+	if err := defaults.QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil || timeout != 5000 {
+		t.Errorf("Expected default busy_timeout 5000, got %d, %v", timeout, err)
+	}
+
+	if _, err := OpenWithOptions(filepath.Join(dir, "bad.db"), Options{Synchronous: "OFF"}); err == nil {
+		t.Error("Expected an error for an unsupported synchronous mode")
+	}
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Typed errors for the failures callers handle, so they can use errors.Is
+// instead of matching driver codes or messages. Write, WriteTransaction and
+// Query return errors already classified; use Classify for QueryRow scans.
+var (
+	ErrUniqueViolation = errors.New("unique constraint violation") // A UNIQUE or PRIMARY KEY constraint failed
+	ErrBusy            = errors.New("database busy")               // SQLITE_BUSY or SQLITE_LOCKED
+	ErrNotFound        = errors.New("not found")                   // sql.ErrNoRows
+)
+
+// Classify returns err wrapped with ErrUniqueViolation, ErrBusy or
+// ErrNotFound when it is one of those failures. The message and the original
+// error are kept, and other errors are returned unchanged.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	kind := driverKind(err)
+	if kind == nil && errors.Is(err, sql.ErrNoRows) {
+		kind = ErrNotFound
+	}
+	if kind == nil || errors.Is(err, kind) {
+		return err
+	}
+	return &classifiedError{kind: kind, err: err}
+}
+
+// classifiedError is an error matching both its typed kind and the driver error.
+type classifiedError struct {
+	kind error
+	err  error
+}
+
+func (e *classifiedError) Error() string   { return e.err.Error() }
+func (e *classifiedError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// isBusy reports whether err is SQLITE_BUSY or SQLITE_LOCKED.
+func isBusy(err error) bool {
+	return errors.Is(Classify(err), ErrBusy)
+}
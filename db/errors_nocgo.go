@@ -0,0 +1,10 @@
+//go:build !cgo
+
+package db
+
+// driverKind returns the typed error for a SQLite driver error. Without cgo
+// the driver is a stub that never returns any; this keeps the package
+// building for cross-compiles.
+func driverKind(err error) error {
+	return nil
+}
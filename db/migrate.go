@@ -42,12 +42,28 @@ func (db *DB) Migrate() error {
 		return fmt.Errorf("failed to create migrations table: %w", result.Err)
 	}
 
-	// Get applied migrations
-	applied, err := db.getAppliedMigrations()
+	pending, err := db.plan()
 	if err != nil {
 		return fmt.Errorf("failed to get applied migrations: %w", err)
 	}
 
+	// Apply pending migrations
+	for _, m := range pending {
+		if err := db.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// plan returns the migrations not yet applied, in the order Migrate applies them.
+func (db *DB) plan() ([]Migration, error) {
+	applied, err := db.getAppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
 	// Sort migrations by ID
 	migrations := make([]Migration, len(registry))
 	copy(migrations, registry)
@@ -55,18 +71,28 @@ func (db *DB) Migrate() error {
 		return migrations[i].ID < migrations[j].ID
 	})
 
-	// Apply pending migrations
+	var pending []Migration
 	for _, m := range migrations {
-		if applied[m.ID] {
-			continue
+		if !applied[m.ID] {
+			pending = append(pending, m)
 		}
+	}
+	return pending, nil
+}
 
-		if err := db.applyMigration(m); err != nil {
-			return fmt.Errorf("migration %s failed: %w", m.ID, err)
-		}
+// PlanMigrations returns the IDs of the migrations Migrate would apply, in
+// the order it would apply them, without applying any.
+func (db *DB) PlanMigrations() ([]string, error) {
+	pending, err := db.plan()
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	ids := []string{}
+	for _, m := range pending {
+		ids = append(ids, m.ID)
+	}
+	return ids, nil
 }
 
 // MigrateDown rolls back the last n migrations.
@@ -142,35 +168,37 @@ func (db *DB) getAppliedMigrations() (map[string]bool, error) {
 	return applied, rows.Err()
 }
 
-// applyMigration runs the Up function and records the migration.
+// applyMigration runs the Up function and records the migration, in one
+// transaction so a failure partway leaves neither changes nor a record.
 func (db *DB) applyMigration(m Migration) error {
 	if m.Up == nil {
 		return fmt.Errorf("migration %s has no Up function", m.ID)
 	}
 
-	if err := m.Up(db); err != nil {
-		return err
-	}
-
-	result := db.Write(
-		"INSERT INTO _migrations (id, applied_at) VALUES (?, ?)",
-		m.ID, time.Now().UTC(),
-	)
-	return result.Err
+	return db.Transaction(func(tx *DB) error {
+		if err := m.Up(tx); err != nil {
+			return err
+		}
+		return tx.Write(
+			"INSERT INTO _migrations (id, applied_at) VALUES (?, ?)",
+			m.ID, time.Now().UTC(),
+		).Err
+	})
 }
 
-// rollbackMigration runs the Down function and removes the migration record.
+// rollbackMigration runs the Down function and removes the migration
+// record, in one transaction.
 func (db *DB) rollbackMigration(m Migration) error {
 	if m.Down == nil {
 		return fmt.Errorf("migration %s has no Down function", m.ID)
 	}
 
-	if err := m.Down(db); err != nil {
-		return err
-	}
-
-	result := db.Write("DELETE FROM _migrations WHERE id = ?", m.ID)
-	return result.Err
+	return db.Transaction(func(tx *DB) error {
+		if err := m.Down(tx); err != nil {
+			return err
+		}
+		return tx.Write("DELETE FROM _migrations WHERE id = ?", m.ID).Err
+	})
 }
 
 // GetAppliedMigrations returns a list of applied migration IDs in order.
@@ -189,20 +217,9 @@ func (db *DB) GetAppliedMigrations() ([]string, error) {
 }
 
 // PendingMigrations returns migration IDs that haven't been applied yet.
+// It is the same as PlanMigrations.
 func (db *DB) PendingMigrations() ([]string, error) {
-	applied, err := db.getAppliedMigrations()
-	if err != nil {
-		return nil, err
-	}
-
-	var pending []string
-	for _, m := range registry {
-		if !applied[m.ID] {
-			pending = append(pending, m.ID)
-		}
-	}
-	sort.Strings(pending)
-	return pending, nil
+	return db.PlanMigrations()
 }
 
 // ClearRegistry removes all registered migrations.
@@ -3,6 +3,8 @@ package db
 import (
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -290,6 +292,51 @@ func TestPendingMigrations(t *testing.T) {
 	}
 }
 
+func TestPlanMigrations_MatchesAppliedOrder(t *testing.T) {
+	db, cleanup := setupMigrateTestDB(t)
+	defer cleanup()
+
+	var order []string
+	// Register out of order, with one already applied
+	for _, id := range []string{"010_tenth", "002_second", "001_first", "003_third"} {
+		Register(Migration{
+			ID: id,
+			Up: func(db *DB) error {
+				order = append(order, id)
+				return nil
+			},
+			Down: func(db *DB) error { return nil },
+		})
+	}
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if err := db.MigrateDown(3); err != nil {
+		t.Fatalf("MigrateDown failed: %v", err)
+	}
+	order = nil
+
+	plan, err := db.PlanMigrations()
+	if err != nil {
+		t.Fatalf("PlanMigrations failed: %v", err)
+	}
+	if len(order) != 0 {
+		t.Fatalf("Expected planning to apply nothing, applied %v", order)
+	}
+
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	expected := []string{"002_second", "003_third", "010_tenth"}
+	if !slices.Equal(plan, expected) || !slices.Equal(order, plan) {
+		t.Errorf("Expected plan %v to match applied order %v, both %v", plan, order, expected)
+	}
+
+	if plan, err := db.PlanMigrations(); err != nil || len(plan) != 0 {
+		t.Errorf("Expected an empty plan once migrated, got %v (%v)", plan, err)
+	}
+}
+
 func TestMigrate_FailsOnError(t *testing.T) {
 	db, cleanup := setupMigrateTestDB(t)
 	defer cleanup()
@@ -308,3 +355,63 @@ func TestMigrate_FailsOnError(t *testing.T) {
 		t.Error("Expected migration to fail")
 	}
 }
+
+func TestMigrate_FailureMidwayLeavesNoChanges(t *testing.T) {
+	db, cleanup := setupMigrateTestDB(t)
+	defer cleanup()
+
+	Register(Migration{
+		ID: "001_half",
+		Up: func(db *DB) error {
+			if r := db.Write("CREATE TABLE half (id INTEGER PRIMARY KEY)"); r.Err != nil {
+				return r.Err
+			}
+			if r := db.Write("INSERT INTO half (id) VALUES (1)"); r.Err != nil {
+				return r.Err
+			}
+			return db.Write("INVALID SQL STATEMENT").Err
+		},
+		Down: func(db *DB) error { return nil },
+	})
+
+	if err := db.Migrate(); err == nil {
+		t.Fatal("Expected migration to fail")
+	}
+
+	var tables int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'half'").Scan(&tables)
+	if tables != 0 {
+		t.Error("Expected the failed migration's table rolled back")
+	}
+	applied, err := db.GetAppliedMigrations()
+	if err != nil || len(applied) != 0 {
+		t.Errorf("Expected no migration recorded, got %v (%v)", applied, err)
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	db, cleanup := setupMigrateTestDB(t)
+	defer cleanup()
+
+	if r := db.Write("CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, extra TEXT)"); r.Err != nil {
+		t.Fatalf("Failed to create table: %v", r.Err)
+	}
+
+	// Extra columns and tables are fine
+	if err := db.ValidateSchema([]Table{{Name: "items", Columns: []string{"id", "name"}}}); err != nil {
+		t.Errorf("Expected a matching schema to pass, got %v", err)
+	}
+
+	err := db.ValidateSchema([]Table{
+		{Name: "items", Columns: []string{"id", "name", "size", "color"}},
+		{Name: "tags", Columns: []string{"id"}},
+	})
+	if err == nil {
+		t.Fatal("Expected an error for missing tables and columns")
+	}
+	for _, want := range []string{"table items is missing columns size, color", "missing table tags"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in %q", want, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+)
+
+// ScanAll reads every row of rows into dest, a pointer to a slice of structs
+// or struct pointers, and closes rows. Columns are matched to fields by their
+// `db:"column"` tag; columns without a field are discarded, and fields
+// without a column are left zero.
+//
+// ScanAll and ScanOne use reflection and are meant for convenience in code
+// that is not performance sensitive; hot paths should keep explicit Scan calls.
+func ScanAll(rows *sql.Rows, dest any) error {
+	defer rows.Close()
+
+	slice := reflect.ValueOf(dest)
+	if slice.Kind() != reflect.Pointer || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("db: ScanAll needs a pointer to a slice, got %T", dest)
+	}
+	slice = slice.Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Pointer
+	structType := elemType
+	if isPtr {
+		structType = elemType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return fmt.Errorf("db: ScanAll needs a slice of structs, got %T", dest)
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	fields := columnFields(structType, columns)
+
+	for rows.Next() {
+		elem := reflect.New(structType)
+		if err := rows.Scan(scanTargets(elem.Elem(), fields)...); err != nil {
+			return err
+		}
+		if isPtr {
+			slice.Set(reflect.Append(slice, elem))
+		} else {
+			slice.Set(reflect.Append(slice, elem.Elem()))
+		}
+	}
+	return rows.Err()
+}
+
+// ScanOne reads the first row of rows into dest, a pointer to a struct, as
+// ScanAll does, and closes rows. It returns sql.ErrNoRows if there is none.
+func ScanOne(rows *sql.Rows, dest any) error {
+	defer rows.Close()
+
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("db: ScanOne needs a pointer to a struct, got %T", dest)
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	if err := rows.Scan(scanTargets(v.Elem(), columnFields(v.Elem().Type(), columns))...); err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// columnFields returns, for each column, the index of the struct field
+// tagged with its name, or nil if there is no such field.
+func columnFields(structType reflect.Type, columns []string) [][]int {
+	byTag := make(map[string][]int)
+	for _, f := range reflect.VisibleFields(structType) {
+		if tag := f.Tag.Get("db"); tag != "" && tag != "-" && f.IsExported() {
+			byTag[tag] = f.Index
+		}
+	}
+	fields := make([][]int, len(columns))
+	for i, col := range columns {
+		fields[i] = byTag[col]
+	}
+	return fields
+}
+
+// scanTargets returns the Scan destinations for a row into v.
+func scanTargets(v reflect.Value, fields [][]int) []any {
+	targets := make([]any, len(fields))
+	for i, index := range fields {
+		if index == nil {
+			targets[i] = new(any) // Discarded
+			continue
+		}
+		targets[i] = v.FieldByIndex(index).Addr().Interface()
+	}
+	return targets
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+type testFolder struct {
+	ID          int64  `db:"id"`
+	Path        string `db:"path"`
+	LibraryType string `db:"library_type"`
+	Unmapped    string // No tag, left zero
+}
+
+type testFile struct {
+	ID       int64          `db:"id"`
+	FolderID int64          `db:"folder_id"`
+	Filename string         `db:"filename"`
+	Size     int64          `db:"size"`
+	Hash     sql.NullString `db:"hash"`
+}
+
+func setupScanTables(t *testing.T) *DB {
+	t.Helper()
+	db, cleanup := setupTestDB(t)
+	t.Cleanup(cleanup)
+
+	for _, stmt := range []string{
+		"CREATE TABLE folders (id INTEGER PRIMARY KEY, path TEXT, library_type TEXT, created_at INTEGER)",
+		"CREATE TABLE files (id INTEGER PRIMARY KEY, folder_id INTEGER, filename TEXT, size INTEGER, hash TEXT)",
+		"INSERT INTO folders (path, library_type, created_at) VALUES ('/music', 'music', 1), ('/photos', 'photos', 2)",
+		"INSERT INTO files (folder_id, filename, size) VALUES (2, 'beach.jpg', 1024)",
+	} {
+		if result := db.Write(stmt); result.Err != nil {
+			t.Fatalf("%s: %v", stmt, result.Err)
+		}
+	}
+	return db
+}
+
+func TestScanAll(t *testing.T) {
+	db := setupScanTables(t)
+
+	rows, err := db.Query("SELECT * FROM folders ORDER BY path")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	var folders []testFolder
+	if err := ScanAll(rows, &folders); err != nil {
+		t.Fatalf("ScanAll failed: %v", err)
+	}
+	if len(folders) != 2 {
+		t.Fatalf("Expected 2 folders, got %d", len(folders))
+	}
+	if f := folders[1]; f.ID != 2 || f.Path != "/photos" || f.LibraryType != "photos" || f.Unmapped != "" {
+		t.Errorf("Unexpected folder %+v", f)
+	}
+
+	// Slices of pointers work too
+	rows, err = db.Query("SELECT id, path FROM folders")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	var ptrs []*testFolder
+	if err := ScanAll(rows, &ptrs); err != nil {
+		t.Fatalf("ScanAll failed: %v", err)
+	}
+	if len(ptrs) != 2 || ptrs[0].Path != "/music" {
+		t.Errorf("Unexpected folders %+v", ptrs)
+	}
+
+	rows, err = db.Query("SELECT id FROM folders")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if err := ScanAll(rows, &folders[0]); err == nil {
+		t.Error("Expected an error for a non-slice destination")
+	}
+}
+
+func TestScanOne(t *testing.T) {
+	db := setupScanTables(t)
+
+	rows, err := db.Query("SELECT id, folder_id, filename, size, hash FROM files WHERE filename = ?", "beach.jpg")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	var file testFile
+	if err := ScanOne(rows, &file); err != nil {
+		t.Fatalf("ScanOne failed: %v", err)
+	}
+	if file.FolderID != 2 || file.Filename != "beach.jpg" || file.Size != 1024 || file.Hash.Valid {
+		t.Errorf("Unexpected file %+v", file)
+	}
+
+	rows, err = db.Query("SELECT * FROM files WHERE filename = ?", "missing.jpg")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if err := ScanOne(rows, &file); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows, got %v", err)
+	}
+}
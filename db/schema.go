@@ -0,0 +1,66 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Table names a table and the columns the code expects it to have.
+type Table struct {
+	Name    string
+	Columns []string
+}
+
+// ValidateSchema checks that every table in expected exists with its
+// columns, so a half-applied migration or a hand-edited database is reported
+// at startup rather than as confusing errors later. Extra tables and columns
+// are allowed. The error lists every discrepancy found.
+func (db *DB) ValidateSchema(expected []Table) error {
+	rows, err := db.Query(`
+		SELECT m.name, p.name
+		FROM sqlite_master m JOIN pragma_table_info(m.name) p
+		WHERE m.type = 'table'
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to read schema: %w", err)
+	}
+	defer rows.Close()
+
+	actual := make(map[string]map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return fmt.Errorf("failed to read schema: %w", err)
+		}
+		if actual[table] == nil {
+			actual[table] = make(map[string]bool)
+		}
+		actual[table][column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read schema: %w", err)
+	}
+
+	var problems []string
+	for _, t := range expected {
+		columns, ok := actual[t.Name]
+		if !ok {
+			problems = append(problems, "missing table "+t.Name)
+			continue
+		}
+		var missing []string
+		for _, c := range t.Columns {
+			if !columns[c] {
+				missing = append(missing, c)
+			}
+		}
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("table %s is missing columns %s", t.Name, strings.Join(missing, ", ")))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("database schema does not match this version of q2: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
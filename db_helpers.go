@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"io/fs"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -12,12 +14,15 @@ import (
 	"time"
 
 	"jukel.org/q2/db"
+	"jukel.org/q2/files"
+	"jukel.org/q2/folders"
+	"jukel.org/q2/media"
+	"jukel.org/q2/migrations"
+	"jukel.org/q2/monitor"
+	"jukel.org/q2/scanner"
 )
 
-const (
-	q2Dir  = ".q2"
-	dbFile = "q2.db"
-)
+const dbFile = "q2.db"
 
 // Metadata refresh progress state
 var (
@@ -107,11 +112,11 @@ func upsertFile(database *db.DB, folderID int64, filePath string, info os.FileIn
 	var existingID int64
 	row := database.QueryRow("SELECT id FROM files WHERE path = ?", normalizedPath)
 	if err := row.Scan(&existingID); err == nil {
-		// File exists, update it
+		// File exists, update it; one found missing before is back
 		result := database.Write(`
 			UPDATE files SET
 				filename = ?, extension = ?, mediatype = ?,
-				size = ?, modified_at = ?, indexed_at = CURRENT_TIMESTAMP
+				size = ?, modified_at = ?, indexed_at = CURRENT_TIMESTAMP, deleted_at = NULL
 			WHERE id = ?`,
 			filename, ext, mediaType, info.Size(), info.ModTime(), existingID)
 		if result.Err != nil {
@@ -134,12 +139,19 @@ func upsertFile(database *db.DB, folderID int64, filePath string, info os.FileIn
 
 // updateFileThumbnails updates the thumbnail paths for a file in the database.
 func updateFileThumbnails(database *db.DB, fileID int64, smallPath, largePath string) {
+	files.NewRepository(database).SetThumbnails(fileID, smallPath, largePath)
+}
+
+// updateImageThumbnails records the thumbnails of an image and how they were
+// made, keeping the recorded method when the thumbnails were already up to date.
+func updateImageThumbnails(database *db.DB, fileID int64, result media.ThumbnailResult) {
 	database.Write(`
 		UPDATE files SET
 			thumbnail_small_path = ?,
-			thumbnail_large_path = ?
+			thumbnail_large_path = ?,
+			thumbnail_method = COALESCE(NULLIF(?, ''), thumbnail_method)
 		WHERE id = ?`,
-		smallPath, largePath, fileID)
+		result.SmallPath, result.LargePath, result.Method, fileID)
 }
 
 // getMonitoredFolders returns all monitored folder paths from the database.
@@ -248,7 +260,7 @@ func enrichEntriesWithMetadata(database *db.DB, dirPath string, entries []FileEn
 		args[i] = p
 	}
 	query := `
-		SELECT f.path, f.thumbnail_small_path, f.thumbnail_large_path,
+		SELECT f.path, f.thumbnail_small_path, f.thumbnail_large_path, f.blurhash,
 		       am.title, am.artist, am.album, am.duration_seconds
 		FROM files f
 		LEFT JOIN audio_metadata am ON f.id = am.file_id
@@ -262,9 +274,9 @@ func enrichEntriesWithMetadata(database *db.DB, dirPath string, entries []FileEn
 
 	for rows.Next() {
 		var normPath string
-		var thumbSmall, thumbLarge, title, artist, album *string
+		var thumbSmall, thumbLarge, blurHash, title, artist, album *string
 		var duration *int
-		if err := rows.Scan(&normPath, &thumbSmall, &thumbLarge, &title, &artist, &album, &duration); err != nil {
+		if err := rows.Scan(&normPath, &thumbSmall, &thumbLarge, &blurHash, &title, &artist, &album, &duration); err != nil {
 			continue
 		}
 		i, ok := pathToIdx[normPath]
@@ -279,6 +291,9 @@ func enrichEntriesWithMetadata(database *db.DB, dirPath string, entries []FileEn
 		if thumbLarge != nil && *thumbLarge != "" {
 			entry.ThumbnailLarge = "/api/thumbnail?path=" + url.QueryEscape(fullPath) + "&size=large"
 		}
+		if blurHash != nil {
+			entry.BlurHash = *blurHash
+		}
 		if title != nil {
 			entry.Title = *title
 		}
@@ -296,7 +311,7 @@ func enrichEntriesWithMetadata(database *db.DB, dirPath string, entries []FileEn
 
 // initDB initializes the database and runs migrations.
 func initDB(baseDir string) (*db.DB, error) {
-	// Ensure .q2 directory exists
+	// Ensure the data directory exists
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create directory %s: %w", baseDir, err)
 	}
@@ -312,14 +327,31 @@ func initDB(baseDir string) (*db.DB, error) {
 		return nil, fmt.Errorf("failed to run migrations: %w", err)
 	}
 
+	if err := database.ValidateSchema(migrations.Schema); err != nil {
+		database.Close()
+		return nil, fmt.Errorf("%w (database %s; restore a backup or move it aside to start afresh)", err, dbPath)
+	}
+
+	if err := scanner.LoadFolderCase(database); err != nil {
+		database.Close()
+		return nil, fmt.Errorf("failed to detect folder case sensitivity: %w", err)
+	}
+
 	return database, nil
 }
 
-// addFolder adds the given folder path to the database.
+// addFolder adds the given folder path to the database as a mixed library.
 // It ensures the folder exists and no duplicate entries are added.
-// Case sensitivity matches the platform (case-insensitive on Windows, case-sensitive on Linux).
+// Paths are compared without case on Windows and on case-insensitive volumes.
 // Returns an error if the folder is empty, doesn't exist, or a database error occurs.
 func addFolder(folder string, database *db.DB) error {
+	return addFolderWithType(folder, "", database)
+}
+
+// addFolderWithType adds a folder with the given library type.
+// An empty libraryType stores new folders as mixed and leaves existing folders unchanged;
+// a non-empty libraryType also updates the type of an existing folder.
+func addFolderWithType(folder string, libraryType scanner.LibraryType, database *db.DB) error {
 	folder, ok := cleanPath(folder)
 	if !ok {
 		return errors.New("folder cannot be empty")
@@ -337,53 +369,307 @@ func addFolder(folder string, database *db.DB) error {
 		return fmt.Errorf("path is not a directory: %s", folder)
 	}
 
-	// Normalize path for storage (lowercase on Windows)
+	// Normalize path for storage (lowercase on Windows and case-insensitive volumes)
+	caseInsensitive := detectFolderCase(folder)
 	normalizedPath := normalizePath(folder)
 
-	// Try to insert - will fail if duplicate due to UNIQUE constraint
+	insertType := libraryType
+	if insertType == "" {
+		insertType = scanner.LibraryMixed
+	}
+
+	// The UNIQUE constraint on path reports a folder that is already monitored
 	result := database.Write(
-		"INSERT OR IGNORE INTO folders (path) VALUES (?)",
-		normalizedPath,
+		"INSERT INTO folders (path, library_type, case_insensitive) VALUES (?, ?, ?)",
+		normalizedPath, string(insertType), caseInsensitive,
 	)
-	if result.Err != nil {
+	if result.Err == nil {
+		fmt.Printf("Folder %s added (%s library)\n", folder, insertType)
+		return nil
+	}
+	if !errors.Is(result.Err, db.ErrUniqueViolation) {
 		return result.Err
 	}
 
-	if result.RowsAffected == 0 {
+	if libraryType == "" {
 		fmt.Printf("Folder %s already exists\n", folder)
-	} else {
-		fmt.Printf("Folder %s added\n", folder)
+		return nil
 	}
 
+	if err := setFolderLibraryType(database, normalizedPath, libraryType); err != nil {
+		return err
+	}
+	fmt.Printf("Folder %s already exists, library type set to %s\n", folder, libraryType)
+
 	return nil
 }
 
-// removeFolder removes a folder from the database.
-// Returns an error if the folder is empty or not found.
-func removeFolder(folder string, database *db.DB) error {
+// setFolderLibraryType changes the library type of the monitored folder at
+// normalizedPath. Adding a folder that is already monitored with an explicit
+// library type uses it, from the CLI and the API alike.
+func setFolderLibraryType(database *db.DB, normalizedPath string, libraryType scanner.LibraryType) error {
+	return database.Write(
+		"UPDATE folders SET library_type = ? WHERE path = ?",
+		string(libraryType), normalizedPath,
+	).Err
+}
+
+// parseLimits builds indexing limits from the -max-files and -max-size flags.
+func parseLimits(maxFiles int, maxSize string) (scanner.Limits, error) {
+	if maxFiles < 0 {
+		return scanner.Limits{}, errors.New("max-files cannot be negative")
+	}
+	maxBytes, err := scanner.ParseSize(maxSize)
+	if err != nil {
+		return scanner.Limits{}, err
+	}
+	return scanner.Limits{MaxFiles: maxFiles, MaxBytes: maxBytes}, nil
+}
+
+// checkFolderSize refuses a folder that exceeds limits unless force is set,
+// so that adding / or a home directory doesn't start an unbounded scan.
+// Errors other than the folder being too large are left for the caller to report.
+func checkFolderSize(folder string, limits scanner.Limits, force bool) error {
+	if force {
+		return nil
+	}
+	folder, ok := cleanPath(folder)
+	if !ok {
+		return nil
+	}
+
+	err := scanner.CheckFolderSize(folder, limits)
+	var tooLarge *scanner.FolderTooLargeError
+	if errors.As(err, &tooLarge) {
+		return fmt.Errorf("%w; use -force to index it anyway", err)
+	}
+	return nil
+}
+
+// previewFolder prints how many files of each media type a folder contains,
+// without adding or indexing it.
+func previewFolder(folder string) error {
 	folder, ok := cleanPath(folder)
 	if !ok {
 		return errors.New("folder cannot be empty")
 	}
 
+	info, err := os.Stat(folder)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("folder does not exist: %s", folder)
+		}
+		return fmt.Errorf("cannot access folder: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("path is not a directory: %s", folder)
+	}
+
+	p, err := scanner.PreviewFolder(folder)
+	if err != nil {
+		return fmt.Errorf("cannot read folder: %w", err)
+	}
+
+	fmt.Printf("Preview of %s:\n", folder)
+	fmt.Printf("  Images: %d\n", p.Images)
+	fmt.Printf("  Videos: %d\n", p.Videos)
+	fmt.Printf("  Audio:  %d\n", p.Audio)
+	fmt.Printf("  Other:  %d\n", p.Other)
+	fmt.Printf("  Total:  %d files in %d subfolders\n", p.Total(), p.Folders)
+	fmt.Printf("Estimated index size: %s (excluding thumbnails)\n", scanner.FormatSize(p.EstimatedIndexBytes()))
+	fmt.Println("Nothing was added; run without -preview to add the folder")
+
+	return nil
+}
+
+// setFolderWatchMode stores how a folder's changes are detected by serve.
+// An empty mode leaves the mode unchanged; a zero interval leaves the poll
+// interval unchanged.
+func setFolderWatchMode(folder string, mode monitor.Mode, pollInterval time.Duration, database *db.DB) error {
+	folder, ok := cleanPath(folder)
+	if !ok {
+		return errors.New("folder cannot be empty")
+	}
+	if pollInterval != 0 && pollInterval < monitor.MinPollInterval {
+		return fmt.Errorf("poll interval must be at least %s", monitor.MinPollInterval)
+	}
+
 	normalizedPath := normalizePath(folder)
 
-	result := database.Write("DELETE FROM folders WHERE path = ?", normalizedPath)
+	result := database.Write(`
+		UPDATE folders SET
+			watch_mode = COALESCE(NULLIF(?, ''), watch_mode),
+			poll_interval = CASE WHEN ? > 0 THEN ? ELSE poll_interval END
+		WHERE path = ?
+	`, string(mode), int64(pollInterval/time.Second), int64(pollInterval/time.Second), normalizedPath)
 	if result.Err != nil {
 		return result.Err
 	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("folder not found: %s", folder)
+	}
+
+	var storedMode string
+	var seconds int64
+	row := database.QueryRow("SELECT watch_mode, poll_interval FROM folders WHERE path = ?", normalizedPath)
+	if err := row.Scan(&storedMode, &seconds); err != nil {
+		return err
+	}
+	fmt.Printf("Folder %s watch mode set to %s\n", folder, describeWatchMode(storedMode, seconds))
 
+	return nil
+}
+
+// describeWatchMode formats a folder's watch settings for display.
+func describeWatchMode(mode string, pollSeconds int64) string {
+	if monitor.Mode(mode) != monitor.ModePoll {
+		return mode
+	}
+	if pollSeconds <= 0 {
+		return "poll (default interval)"
+	}
+	return fmt.Sprintf("poll every %s", time.Duration(pollSeconds)*time.Second)
+}
+
+// setFolderDebounce stores how long a watched folder's events settle before
+// serve processes them, e.g. longer for a folder that receives bulk imports.
+func setFolderDebounce(folder string, debounce time.Duration, database *db.DB) error {
+	folder, ok := cleanPath(folder)
+	if !ok {
+		return errors.New("folder cannot be empty")
+	}
+	if debounce < monitor.MinDebounceTime {
+		return fmt.Errorf("debounce must be at least %s", monitor.MinDebounceTime)
+	}
+
+	result := database.Write("UPDATE folders SET debounce_ms = ? WHERE path = ?", debounce.Milliseconds(), normalizePath(folder))
+	if result.Err != nil {
+		return result.Err
+	}
 	if result.RowsAffected == 0 {
 		return fmt.Errorf("folder not found: %s", folder)
 	}
 
-	fmt.Printf("Folder %s removed\n", folder)
+	fmt.Printf("Folder %s debounce set to %s\n", folder, debounce)
 	return nil
 }
 
+// errFolderNotFound is returned when removing a folder that is not stored.
+var errFolderNotFound = errors.New("folder not found")
+
+// removeFolder removes a folder and everything indexed under it.
+// Returns an error if the folder is empty or not found.
+func removeFolder(folder string, database *db.DB, baseDir string) error {
+	removed, err := removeFolderFull(database, nil, folder, baseDir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Folder %s removed (%d files)\n", folder, removed)
+	return nil
+}
+
+// relocateFolder moves the stored folder oldPath to newPath with
+// folders.Relocate, after the library itself was moved there.
+func relocateFolder(oldPath, newPath string, database *db.DB) error {
+	oldPath, ok := cleanPath(oldPath)
+	newPath, newOK := cleanPath(newPath)
+	if !ok || !newOK {
+		return errors.New("folder cannot be empty")
+	}
+
+	moved, err := folders.Relocate(database, normalizePath(oldPath), normalizePath(newPath))
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return fmt.Errorf("%w: %s", errFolderNotFound, oldPath)
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("folder does not exist: %s", newPath)
+	case errors.Is(err, folders.ErrNotDirectory):
+		return fmt.Errorf("path is not a directory: %s", newPath)
+	case errors.Is(err, db.ErrUniqueViolation):
+		return fmt.Errorf("folder already stored: %s", newPath)
+	case err != nil:
+		return err
+	}
+
+	fmt.Printf("Folder %s moved to %s (%d files)\n", oldPath, newPath, moved)
+	return nil
+}
+
+// removeFolderFull removes a folder, its files and their metadata, album
+// entries, lyrics and play history in one transaction, then deletes the
+// files' thumbnails from q2Dir (or their sidecar folders). The folder's queued
+// scans are cancelled and, when mon is non-nil, it stops being monitored
+// first, so no scan or watch event indexes files into it while its rows are
+// being deleted. Dependents are deleted explicitly, as SQLite does not enforce
+// the schema's ON DELETE CASCADE without PRAGMA foreign_keys. Returns the
+// number of files removed.
+func removeFolderFull(database *db.DB, mon *monitor.Monitor, folder, q2Dir string) (int64, error) {
+	folder, ok := cleanPath(folder)
+	if !ok {
+		return 0, errors.New("folder cannot be empty")
+	}
+
+	normalizedPath := normalizePath(folder)
+
+	var folderID int64
+	if err := database.QueryRow("SELECT id FROM folders WHERE path = ?", normalizedPath).Scan(&folderID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("%w: %s", errFolderNotFound, folder)
+		}
+		return 0, err
+	}
+
+	// Read before the rows go, so the files can be deleted afterwards
+	var removed int64
+	var thumbnails []string
+	rows, err := database.Query("SELECT thumbnail_small_path, thumbnail_large_path FROM files WHERE folder_id = ?", folderID)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var small, large sql.NullString
+		if err := rows.Scan(&small, &large); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		removed++
+		thumbnails = append(thumbnails, small.String, large.String)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if mon != nil {
+		mon.RemoveFolder(normalizedPath)
+	} else if _, err := scanner.CancelScans(database, normalizedPath); err != nil {
+		return 0, err
+	}
+
+	const folderFiles = "file_id IN (SELECT id FROM files WHERE folder_id = ?)"
+	var stmts []db.Statement
+	for _, table := range []string{"image_metadata", "image_tags", "audio_metadata", "album_items", "lyrics", "play_history"} {
+		stmts = append(stmts, db.Statement{Query: "DELETE FROM " + table + " WHERE " + folderFiles, Args: []interface{}{folderID}})
+	}
+	stmts = append(stmts,
+		db.Statement{Query: "DELETE FROM files WHERE folder_id = ?", Args: []interface{}{folderID}},
+		db.Statement{Query: "DELETE FROM scan_progress WHERE folder_id = ?", Args: []interface{}{folderID}},
+		db.Statement{Query: "DELETE FROM folders WHERE id = ?", Args: []interface{}{folderID}},
+	)
+	if err := database.WriteTransaction(stmts); err != nil {
+		return 0, err
+	}
+
+	for _, thumb := range thumbnails {
+		media.DeleteThumbnail(thumb, q2Dir)
+	}
+	return removed, nil
+}
+
 // listFolders retrieves and displays all stored folders from the database.
 func listFolders(database *db.DB) error {
-	rows, err := database.Query("SELECT path FROM folders ORDER BY path")
+	rows, err := database.Query("SELECT path, library_type, watch_mode, poll_interval, COALESCE(case_insensitive, 0), last_scanned_at FROM folders ORDER BY path")
 	if err != nil {
 		return fmt.Errorf("failed to query folders: %w", err)
 	}
@@ -391,11 +677,26 @@ func listFolders(database *db.DB) error {
 
 	count := 0
 	for rows.Next() {
-		var path string
-		if err := rows.Scan(&path); err != nil {
+		var path, libraryType, watchMode string
+		var pollSeconds int64
+		var caseInsensitive bool
+		var scanned sql.NullTime
+		if err := rows.Scan(&path, &libraryType, &watchMode, &pollSeconds, &caseInsensitive, &scanned); err != nil {
 			return fmt.Errorf("failed to read folder: %w", err)
 		}
-		fmt.Println(path)
+		details := []string{libraryType}
+		if watchMode != string(monitor.ModeAuto) {
+			details = append(details, describeWatchMode(watchMode, pollSeconds))
+		}
+		if caseInsensitive {
+			details = append(details, "case-insensitive")
+		}
+		if scanned.Valid {
+			details = append(details, "scanned "+scanned.Time.Local().Format("2006-01-02 15:04"))
+		} else {
+			details = append(details, "never scanned")
+		}
+		fmt.Printf("%s\t[%s]\n", path, strings.Join(details, ", "))
 		count++
 	}
 
@@ -410,6 +711,14 @@ func listFolders(database *db.DB) error {
 	return nil
 }
 
+// detectFolderCase checks once whether folder is on a case-insensitive
+// volume, so its paths are normalized accordingly before it is stored.
+func detectFolderCase(folder string) bool {
+	insensitive := scanner.DetectCaseInsensitive(folder)
+	scanner.SetCaseInsensitive(folder, insensitive)
+	return insensitive
+}
+
 // ensurePlaylistsFolder creates the playlists directory and adds it as a monitored folder.
 func ensurePlaylistsFolder(baseDir string, database *db.DB) (string, error) {
 	playlistDir := filepath.Join(baseDir, "playlists")
@@ -425,12 +734,12 @@ func ensurePlaylistsFolder(baseDir string, database *db.DB) (string, error) {
 		return "", fmt.Errorf("failed to resolve playlists path: %w", err)
 	}
 
-	// Add as monitored folder (silently ignore if already exists)
+	// Add as monitored folder, unless it already is
 	normalizedPath := normalizePath(absPath)
-	database.Write(
-		"INSERT OR IGNORE INTO folders (path) VALUES (?)",
-		normalizedPath,
-	)
+	result := database.Write("INSERT INTO folders (path) VALUES (?)", normalizedPath)
+	if result.Err != nil && !errors.Is(result.Err, db.ErrUniqueViolation) {
+		return "", fmt.Errorf("failed to add playlists folder: %w", result.Err)
+	}
 
 	return absPath, nil
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/folders"
+)
+
+// doctorReport is what the doctor command found.
+type doctorReport struct {
+	Invalid []folders.Invalid // Stored folders that are not directories on disk
+	Pruned  []string          // Paths of the missing folders -prune removed
+	FFmpeg  string            // The ffmpeg in use; empty if none resolves
+}
+
+// healthy reports whether every stored folder is usable once pruning is
+// done. A missing ffmpeg is not counted, as it is downloaded when needed.
+func (r doctorReport) healthy() bool {
+	return len(r.Invalid) == len(r.Pruned)
+}
+
+// runDoctor checks that the stored folders still exist and that ffmpeg
+// resolves, writing what it finds to w. With prune, missing folders are
+// removed as removefolder removes them, with their files and thumbnails in
+// baseDir. Folders that exist but cannot be used are only reported.
+func runDoctor(database *db.DB, baseDir string, ffmpegMgr *ffmpeg.Manager, prune bool, w io.Writer) (doctorReport, error) {
+	var report doctorReport
+	invalid, err := folders.Validate(database)
+	if err != nil {
+		return report, err
+	}
+	report.Invalid = invalid
+
+	if len(invalid) == 0 {
+		fmt.Fprintln(w, "Folders: all present")
+	}
+	for _, f := range invalid {
+		switch {
+		case f.Missing() && prune:
+			removed, err := removeFolderFull(database, nil, f.Path, baseDir)
+			if err != nil {
+				return report, fmt.Errorf("removing %s: %w", f.Path, err)
+			}
+			report.Pruned = append(report.Pruned, f.Path)
+			fmt.Fprintf(w, "Folder missing: %s (removed, %d files)\n", f.Path, removed)
+		case f.Missing():
+			fmt.Fprintf(w, "Folder missing: %s\n", f.Path)
+		case errors.Is(f.Err, folders.ErrNotDirectory):
+			fmt.Fprintf(w, "Folder is not a directory: %s\n", f.Path)
+		default:
+			fmt.Fprintf(w, "Folder unreadable: %s: %v\n", f.Path, f.Err)
+		}
+	}
+	if !prune {
+		for _, f := range invalid {
+			if f.Missing() {
+				fmt.Fprintln(w, "Run with -prune to remove missing folders and everything indexed in them")
+				break
+			}
+		}
+	}
+
+	report.FFmpeg = ffmpegMgr.FindFFmpeg()
+	if report.FFmpeg != "" {
+		fmt.Fprintln(w, "ffmpeg:", report.FFmpeg)
+	} else {
+		fmt.Fprintln(w, "ffmpeg: not found; serve downloads it when a video first needs it")
+	}
+	return report, nil
+}
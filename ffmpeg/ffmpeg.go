@@ -4,19 +4,26 @@ package ffmpeg
 
 import (
 	"archive/zip"
+	"bufio"
+	"cmp"
+	"container/list"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // FFmpeg download URL for Windows (gyan.dev essentials build - smaller, has what we need)
@@ -41,11 +48,82 @@ var (
 type Manager struct {
 	// BinDir is the directory where ffmpeg binaries are stored/downloaded
 	BinDir string
+
+	// MaxConcurrent bounds how many ffmpeg/ffprobe processes run at once;
+	// zero or less means no limit. Set it before the first operation.
+	MaxConcurrent int
+
+	// Logger receives progress messages, such as the first-run download;
+	// nil uses slog.Default(). Extraction details are logged at debug level.
+	Logger *slog.Logger
+
+	// VideoPreset and VideoCRF tune the H.264 encoding of TranscodeVideo: a
+	// faster preset keeps up with playback on a slower machine, a lower CRF
+	// looks better at a higher bit rate. Empty and zero use
+	// DefaultVideoPreset and DefaultVideoCRF; see ValidateVideoEncoding.
+	VideoPreset string
+	VideoCRF    int
+
+	// ProbeCacheSize bounds how many Probe results are kept for files that
+	// have not changed since; zero uses DefaultProbeCacheSize and a negative
+	// size turns the cache off. Set it before the first operation.
+	ProbeCacheSize int
+
+	semOnce sync.Once
+	sem     chan struct{}
+
+	probeMu    sync.Mutex
+	probeCache map[string]*list.Element // Of *probeEntry, by path
+	probeOrder *list.List               // Most recently used first
+
+	encodersMu sync.Mutex      // Guards encoders and decoders
+	encoders   map[string]bool // Listed by ffmpeg -encoders; nil until read
+	decoders   map[string]bool // Listed by ffmpeg -decoders; nil until read
+}
+
+// DefaultProbeCacheSize is how many Probe results a Manager keeps by default.
+const DefaultProbeCacheSize = 1024
+
+// probeEntry is a cached Probe result and the file it describes.
+type probeEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	result  *ProbeResult
 }
 
-// NewManager creates a new FFmpeg manager with binaries in the specified directory
+// NewManager creates a new FFmpeg manager with binaries in the specified directory.
+// At most one process per CPU runs at a time.
 func NewManager(binDir string) *Manager {
-	return &Manager{BinDir: binDir}
+	return &Manager{BinDir: binDir, MaxConcurrent: runtime.NumCPU()}
+}
+
+func (m *Manager) logger() *slog.Logger {
+	if m.Logger != nil {
+		return m.Logger
+	}
+	return slog.Default()
+}
+
+// acquire waits for a free process slot, or for ctx to be cancelled.
+// The returned function releases the slot.
+func (m *Manager) acquire(ctx context.Context) (func(), error) {
+	m.semOnce.Do(func() {
+		if m.MaxConcurrent > 0 {
+			m.sem = make(chan struct{}, m.MaxConcurrent)
+		}
+	})
+	if m.sem == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case m.sem <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-m.sem }) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 // GetFFmpegPath returns the path to ffmpeg, downloading if necessary
@@ -83,6 +161,28 @@ func (m *Manager) GetFFprobePath(ctx context.Context) (string, error) {
 	return path, nil
 }
 
+// FindFFmpeg returns the path ffmpeg runs from, looking in BinDir and then
+// PATH like GetFFmpegPath but never downloading it; empty if it is in neither.
+func (m *Manager) FindFFmpeg() string {
+	pathMutex.RLock()
+	path := cachedFFmpegPath
+	pathMutex.RUnlock()
+	if path != "" {
+		return path
+	}
+
+	ext := ""
+	if runtime.GOOS == "windows" {
+		ext = ".exe"
+	}
+	local := filepath.Join(m.BinDir, "ffmpeg"+ext)
+	if _, err := os.Stat(local); err == nil {
+		return local
+	}
+	path, _ = exec.LookPath("ffmpeg" + ext)
+	return path
+}
+
 // findOrDownloadFFmpeg locates ffmpeg or downloads it
 func (m *Manager) findOrDownloadFFmpeg(ctx context.Context) (string, error) {
 	pathMutex.Lock()
@@ -141,6 +241,7 @@ func (m *Manager) downloadFFmpegWindows(ctx context.Context) error {
 	}
 
 	// Download to temp file
+	m.logger().Info("downloading ffmpeg; this only happens on first run", "url", windowsFFmpegURL)
 	zipPath := filepath.Join(m.BinDir, "ffmpeg-download.zip")
 	defer os.Remove(zipPath) // Clean up zip after extraction
 
@@ -187,7 +288,7 @@ func (m *Manager) extractFFmpegFromZip(zipPath string) error {
 		"ffprobe.exe": filepath.Join(m.BinDir, "ffprobe.exe"),
 	}
 
-	// Debug: log all files in zip to find the binaries
+	// Log all files in zip to find the binaries
 	var foundFiles []string
 	for _, f := range r.File {
 		name := path.Base(f.Name)
@@ -195,7 +296,7 @@ func (m *Manager) extractFFmpegFromZip(zipPath string) error {
 			foundFiles = append(foundFiles, f.Name)
 		}
 	}
-	fmt.Printf("[ffmpeg] Found binaries in zip: %v\n", foundFiles)
+	m.logger().Debug("found ffmpeg binaries in zip", "files", foundFiles)
 
 	extracted := 0
 	for _, f := range r.File {
@@ -211,7 +312,7 @@ func (m *Manager) extractFFmpegFromZip(zipPath string) error {
 			continue
 		}
 
-		fmt.Printf("[ffmpeg] Extracting %s to %s\n", f.Name, destPath)
+		m.logger().Debug("extracting ffmpeg binary", "name", f.Name, "dest", destPath)
 
 		src, err := f.Open()
 		if err != nil {
@@ -230,7 +331,7 @@ func (m *Manager) extractFFmpegFromZip(zipPath string) error {
 		if err != nil {
 			return fmt.Errorf("failed to extract %s: %w", name, err)
 		}
-		fmt.Printf("[ffmpeg] Wrote %d bytes to %s\n", written, destPath)
+		m.logger().Debug("extracted ffmpeg binary", "dest", destPath, "bytes", written)
 
 		extracted++
 		if extracted == len(binaries) {
@@ -253,10 +354,15 @@ type ProbeResult struct {
 
 // StreamInfo contains information about a single stream
 type StreamInfo struct {
-	Index     int    `json:"index"`
-	CodecName string `json:"codec_name"`
-	CodecType string `json:"codec_type"` // "video", "audio", "subtitle"
-	Channels  int    `json:"channels,omitempty"`
+	Index         int               `json:"index"`
+	CodecName     string            `json:"codec_name"`
+	CodecType     string            `json:"codec_type"` // "video", "audio", "subtitle"
+	Channels      int               `json:"channels,omitempty"`
+	ChannelLayout string            `json:"channel_layout,omitempty"` // e.g. "stereo", "5.1(side)"
+	SampleRate    string            `json:"sample_rate,omitempty"`    // Hz, e.g. "48000"; audio only
+	BitRate       string            `json:"bit_rate,omitempty"`       // Bits per second; missing for some containers
+	Disposition   map[string]int    `json:"disposition,omitempty"`    // e.g. "default", "attached_pic" (cover art)
+	Tags          map[string]string `json:"tags,omitempty"`           // e.g. "language", "title"
 }
 
 // FormatInfo contains format-level information
@@ -264,15 +370,89 @@ type FormatInfo struct {
 	Filename   string `json:"filename"`
 	FormatName string `json:"format_name"`
 	Duration   string `json:"duration"`
+	BitRate    string `json:"bit_rate"` // Bits per second
 }
 
-// Probe runs ffprobe on the given file and returns information about its streams
+// Probe runs ffprobe on the given file and returns information about its
+// streams. Results are cached while the file's size and modification time
+// stay the same, and shared between callers, who must not modify them.
 func (m *Manager) Probe(ctx context.Context, filePath string) (*ProbeResult, error) {
+	info, statErr := os.Stat(filePath)
+	if statErr == nil {
+		if result := m.cachedProbe(filePath, info); result != nil {
+			return result, nil
+		}
+	}
+
+	result, err := m.runProbe(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if statErr == nil {
+		m.cacheProbe(filePath, info, result)
+	}
+	return result, nil
+}
+
+// cachedProbe returns the cached result for the file, or nil if there is
+// none or the file changed since, dropping it then.
+func (m *Manager) cachedProbe(filePath string, info os.FileInfo) *ProbeResult {
+	m.probeMu.Lock()
+	defer m.probeMu.Unlock()
+	elem, ok := m.probeCache[filePath]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*probeEntry)
+	if entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+		m.probeOrder.Remove(elem)
+		delete(m.probeCache, filePath)
+		return nil
+	}
+	m.probeOrder.MoveToFront(elem)
+	return entry.result
+}
+
+// cacheProbe keeps result for the file as info describes it, evicting the
+// least recently used results beyond ProbeCacheSize.
+func (m *Manager) cacheProbe(filePath string, info os.FileInfo, result *ProbeResult) {
+	size := cmp.Or(m.ProbeCacheSize, DefaultProbeCacheSize)
+	if size < 0 {
+		return
+	}
+	m.probeMu.Lock()
+	defer m.probeMu.Unlock()
+	if m.probeCache == nil {
+		m.probeCache = make(map[string]*list.Element)
+		m.probeOrder = list.New()
+	}
+	entry := &probeEntry{path: filePath, size: info.Size(), modTime: info.ModTime(), result: result}
+	if elem, ok := m.probeCache[filePath]; ok {
+		elem.Value = entry
+		m.probeOrder.MoveToFront(elem)
+	} else {
+		m.probeCache[filePath] = m.probeOrder.PushFront(entry)
+	}
+	for m.probeOrder.Len() > size {
+		oldest := m.probeOrder.Back()
+		m.probeOrder.Remove(oldest)
+		delete(m.probeCache, oldest.Value.(*probeEntry).path)
+	}
+}
+
+// runProbe runs ffprobe on the file.
+func (m *Manager) runProbe(ctx context.Context, filePath string) (*ProbeResult, error) {
 	ffprobePath, err := m.GetFFprobePath(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	cmd := exec.CommandContext(ctx, ffprobePath,
 		"-v", "quiet",
 		"-print_format", "json",
@@ -296,86 +476,325 @@ func (m *Manager) Probe(ctx context.Context, filePath string) (*ProbeResult, err
 
 // GetAudioCodec returns the codec of the first audio stream, or empty string if none
 func (p *ProbeResult) GetAudioCodec() string {
+	if s := p.GetAudioStreamInfo(); s != nil {
+		return s.CodecName
+	}
+	return ""
+}
+
+// GetAudioStreamInfo returns the first audio stream, or nil if there is none
+func (p *ProbeResult) GetAudioStreamInfo() *StreamInfo {
+	for i := range p.Streams {
+		if p.Streams[i].CodecType == "audio" {
+			return &p.Streams[i]
+		}
+	}
+	return nil
+}
+
+// SubtitleStreams returns the subtitle streams in file order
+func (p *ProbeResult) SubtitleStreams() []StreamInfo {
+	var streams []StreamInfo
 	for _, s := range p.Streams {
-		if s.CodecType == "audio" {
-			return s.CodecName
+		if s.CodecType == "subtitle" {
+			streams = append(streams, s)
 		}
 	}
-	return ""
+	return streams
 }
 
-// NeedsTranscoding returns true if the audio codec is not browser-compatible
-func (p *ProbeResult) NeedsTranscoding() bool {
-	codec := strings.ToLower(p.GetAudioCodec())
-	if codec == "" {
-		return false // No audio, no transcoding needed
+// DefaultCompatibleAudioCodecs are the audio codecs browsers play in MP4 and
+// WebM containers, used when no other set is configured.
+var DefaultCompatibleAudioCodecs = []string{"aac", "mp3", "opus", "flac"} // Some browsers support FLAC
+
+// ParseCodecList parses a comma-separated list of codec names, such as the
+// compatible_audio_codecs setting, into lowercase names. Blank entries are
+// skipped; a list naming no codec is an error.
+func ParseCodecList(s string) ([]string, error) {
+	var codecs []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			codecs = append(codecs, name)
+		}
+	}
+	if len(codecs) == 0 {
+		return nil, fmt.Errorf("codec list %q names no codec", s)
+	}
+	return codecs, nil
+}
+
+// DefaultCompatibleVideoCodecs are the video codecs browsers decode.
+// HEVC, MPEG-2 and the WMV codecs are not among them.
+var DefaultCompatibleVideoCodecs = []string{"h264", "vp8", "vp9", "av1"}
+
+// compatibleContainers are the file extensions of the containers browsers
+// play. ffprobe names Matroska and WebM alike, so the extension decides.
+var compatibleContainers = map[string]bool{".mp4": true, ".m4v": true, ".webm": true, ".mov": true}
+
+// TranscodeContainer is the container transcoded output is streamed in:
+// fragmented MP4, which plays while it is written.
+const TranscodeContainer = "mp4"
+
+// TranscodePlan is what a video needs before a playback target can play it.
+type TranscodePlan struct {
+	TranscodeAudio bool   // The audio codec is not one the target plays
+	TranscodeVideo bool   // The video codec is not one browsers decode
+	Container      string // TranscodeContainer to remux into, or empty to keep the file's own
+}
+
+// Needed reports whether the file cannot be served as it is.
+func (t TranscodePlan) Needed() bool {
+	return t.TranscodeAudio || t.TranscodeVideo || t.Container != ""
+}
+
+// GetVideoStreamInfo returns the first video stream that is not cover art,
+// or nil if there is none
+func (p *ProbeResult) GetVideoStreamInfo() *StreamInfo {
+	for i := range p.Streams {
+		if p.Streams[i].CodecType == "video" && p.Streams[i].Disposition["attached_pic"] == 0 {
+			return &p.Streams[i]
+		}
+	}
+	return nil
+}
+
+// GetVideoCodec returns the codec of the first video stream that is not
+// cover art, or empty string if none
+func (p *ProbeResult) GetVideoCodec() string {
+	if s := p.GetVideoStreamInfo(); s != nil {
+		return s.CodecName
 	}
+	return ""
+}
 
-	// Browser-compatible audio codecs in MP4/WebM containers
-	compatible := map[string]bool{
-		"aac":  true,
-		"mp3":  true,
-		"opus": true,
-		"flac": true, // Some browsers support FLAC
+// PlanTranscode works out what the file needs to play: transcoding audio not
+// in compatibleAudio (lowercase; nil uses DefaultCompatibleAudioCodecs),
+// transcoding video not in DefaultCompatibleVideoCodecs, and remuxing a
+// container browsers do not play. Streams and containers ffprobe did not
+// name are assumed to play.
+func (p *ProbeResult) PlanTranscode(compatibleAudio []string) TranscodePlan {
+	if compatibleAudio == nil {
+		compatibleAudio = DefaultCompatibleAudioCodecs
+	}
+	var plan TranscodePlan
+	if codec := strings.ToLower(p.GetAudioCodec()); codec != "" {
+		plan.TranscodeAudio = !slices.Contains(compatibleAudio, codec)
 	}
+	if codec := strings.ToLower(p.GetVideoCodec()); codec != "" {
+		plan.TranscodeVideo = !slices.Contains(DefaultCompatibleVideoCodecs, codec)
+	}
+	ext := strings.ToLower(filepath.Ext(p.Format.Filename))
+	if plan.TranscodeAudio || plan.TranscodeVideo || (ext != "" && !compatibleContainers[ext]) {
+		plan.Container = TranscodeContainer
+	}
+	return plan
+}
 
-	return !compatible[codec]
+// NeedsTranscoding returns true if the file does not play in a browser as it is
+func (p *ProbeResult) NeedsTranscoding() bool {
+	return p.NeedsTranscodingFor(nil)
+}
+
+// NeedsTranscodingFor returns true if the file does not play as it is on a
+// target playing the audio codecs in compatible; see PlanTranscode.
+func (p *ProbeResult) NeedsTranscodingFor(compatible []string) bool {
+	return p.PlanTranscode(compatible).Needed()
 }
 
 // TranscodeAudio starts FFmpeg to transcode audio while copying video.
 // Returns a reader for the transcoded output and a cleanup function.
-func (m *Manager) TranscodeAudio(ctx context.Context, filePath string) (io.ReadCloser, error) {
+func (m *Manager) TranscodeAudio(ctx context.Context, filePath string) (*TranscodeReader, error) {
+	return m.TranscodeVideo(ctx, filePath, TranscodePlan{TranscodeAudio: true, Container: TranscodeContainer})
+}
+
+// maxTranscodeWidth bounds the width of transcoded video, so 4K sources
+// encode in real time.
+const maxTranscodeWidth = 1920
+
+// Defaults of Manager.VideoPreset and Manager.VideoCRF.
+const (
+	DefaultVideoPreset = "veryfast"
+	DefaultVideoCRF    = 23
+)
+
+// videoPresets are the x264 presets, fastest first.
+var videoPresets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow"}
+
+// ValidateVideoEncoding reports a preset x264 does not have or a CRF outside
+// 0-51. An empty preset and a zero CRF mean the defaults.
+func ValidateVideoEncoding(preset string, crf int) error {
+	if preset != "" && !slices.Contains(videoPresets, preset) {
+		return fmt.Errorf("invalid video preset %q (use one of %s)", preset, strings.Join(videoPresets, ", "))
+	}
+	if crf < 0 || crf > 51 {
+		return fmt.Errorf("video CRF must be between 0 and 51, got %d", crf)
+	}
+	return nil
+}
+
+// TranscodeVideo starts FFmpeg to stream the file as plan says: video to
+// H.264 at most maxTranscodeWidth wide, with the Manager's preset and CRF,
+// audio to AAC, each stream copied otherwise, in fragmented MP4.
+// Subtitles are left out; they are served on their own. Returns a reader for
+// the output that stops FFmpeg when closed, and reports its progress.
+func (m *Manager) TranscodeVideo(ctx context.Context, filePath string, plan TranscodePlan) (*TranscodeReader, error) {
 	ffmpegPath, err := m.GetFFmpegPath(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	cmd := exec.CommandContext(ctx, ffmpegPath,
-		"-i", filePath,
-		"-c:v", "copy",      // Copy video stream (no re-encoding)
-		"-c:a", "aac",       // Transcode audio to AAC
-		"-b:a", "192k",      // Audio bitrate
+	// Progress is reported as a percentage of this; without it, only as time
+	duration, err := m.GetVideoDuration(ctx, filePath)
+	if err != nil {
+		m.logger().Debug("cannot get duration for transcode progress", "path", filePath, "error", err)
+	}
+
+	// The slot is held until the reader is closed
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-v", "error", "-nostats", "-progress", "pipe:2", "-i", filePath, "-sn"}
+	if plan.TranscodeVideo {
+		preset, crf := cmp.Or(m.VideoPreset, DefaultVideoPreset), cmp.Or(m.VideoCRF, DefaultVideoCRF)
+		args = append(args,
+			"-c:v", "libx264",
+			"-preset", preset,
+			"-crf", strconv.Itoa(crf),
+			"-pix_fmt", "yuv420p", // 10-bit sources otherwise stay 10-bit, which browsers can't play
+			"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", maxTranscodeWidth))
+	} else {
+		args = append(args, "-c:v", "copy") // Copy video stream (no re-encoding)
+	}
+	if plan.TranscodeAudio {
+		args = append(args, "-c:a", "aac", "-b:a", "192k")
+	} else {
+		args = append(args, "-c:a", "copy")
+	}
+	args = append(args,
 		"-movflags", "frag_keyframe+empty_moov+faststart", // Enable streaming
-		"-f", "mp4",         // Output format
-		"pipe:1",            // Output to stdout
+		"-f", TranscodeContainer,
+		"pipe:1", // Output to stdout
 	)
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
+		release()
 		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
 	}
 
-	// Capture stderr for debugging
-	cmd.Stderr = io.Discard
+	// Progress comes on stderr, with any errors
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
 
 	if err := cmd.Start(); err != nil {
+		release()
 		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
 	}
 
 	// Return a wrapper that waits for the command to finish when closed
-	return &transcodeReader{
-		reader: stdout,
-		cmd:    cmd,
-	}, nil
+	t := &TranscodeReader{
+		reader:       stdout,
+		cmd:          cmd,
+		release:      release,
+		progress:     make(chan TranscodeProgress, 1),
+		progressDone: make(chan struct{}),
+	}
+	go func() {
+		defer close(t.progressDone)
+		parseProgress(stderr, duration, t.progress)
+	}()
+	return t, nil
+}
+
+// TranscodeProgress is how far a transcode has got.
+type TranscodeProgress struct {
+	OutTime time.Duration // Position in the output reached
+	Speed   float64       // Multiple of playback speed, e.g. 2.5; 0 if not known yet
+	Percent float64       // Of the source's duration, 0-100; 0 if the duration is not known
+	Done    bool          // FFmpeg finished writing the output
+}
+
+// parseProgress reads the key=value blocks of ffmpeg's -progress output
+// from r, sending an update on ch at the end of each block, until r ends;
+// then it closes ch. duration is the source's length in seconds, or 0 if
+// not known. An update the receiver has not taken yet is replaced by the
+// next, so a caller that never reads never holds ffmpeg up. Other lines,
+// such as errors, are skipped.
+func parseProgress(r io.Reader, duration float64, ch chan TranscodeProgress) {
+	defer close(ch)
+	var p TranscodeProgress
+	lines := bufio.NewScanner(r)
+	for lines.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(lines.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "out_time_us", "out_time_ms": // Both are microseconds
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				p.OutTime = time.Duration(us) * time.Microsecond
+			}
+		case "speed":
+			if speed, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "x"), 64); err == nil {
+				p.Speed = speed
+			}
+		case "progress":
+			p.Done = value == "end"
+			if duration > 0 {
+				p.Percent = min(100, p.OutTime.Seconds()/duration*100)
+			}
+			if p.Done {
+				p.Percent = 100
+			}
+			select {
+			case ch <- p:
+			default:
+				// Replace the update not taken yet; only this goroutine sends
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- p
+			}
+		}
+	}
 }
 
-// transcodeReader wraps the stdout pipe and ensures the command is cleaned up
-type transcodeReader struct {
-	reader io.ReadCloser
-	cmd    *exec.Cmd
+// TranscodeReader streams a transcode's output and ensures the command is
+// cleaned up when closed.
+type TranscodeReader struct {
+	reader       io.ReadCloser
+	cmd          *exec.Cmd
+	release      func() // Frees the Manager's process slot
+	progress     chan TranscodeProgress
+	progressDone chan struct{} // Closed once stderr is read to the end
 }
 
-func (t *transcodeReader) Read(p []byte) (n int, err error) {
+func (t *TranscodeReader) Read(p []byte) (n int, err error) {
 	return t.reader.Read(p)
 }
 
-func (t *transcodeReader) Close() error {
+// Progress returns a channel of the transcode's progress, holding the latest
+// update not taken yet. It is closed when the process exits.
+func (t *TranscodeReader) Progress() <-chan TranscodeProgress {
+	return t.progress
+}
+
+func (t *TranscodeReader) Close() error {
 	t.reader.Close()
 	// Kill the process if still running (e.g., client disconnected)
 	if t.cmd.Process != nil {
 		t.cmd.Process.Kill()
 	}
+	<-t.progressDone // Wait must not close stderr while it is read
 	t.cmd.Wait()
+	t.release()
 	return nil
 }
 
@@ -385,26 +804,214 @@ func (m *Manager) IsAvailable(ctx context.Context) bool {
 	return err == nil
 }
 
-// GenerateThumbnail creates a thumbnail image using FFmpeg.
-// The thumbnail fits within a bounding box of the specified size while maintaining aspect ratio.
+// OrientationFilter returns the filter that turns an image with the given
+// EXIF Orientation value (1-8) upright, or "" when no change is needed.
+func OrientationFilter(orientation int) string {
+	switch orientation {
+	case 2:
+		return "hflip" // Mirrored horizontally
+	case 3:
+		return "hflip,vflip" // Rotated 180
+	case 4:
+		return "vflip" // Mirrored vertically
+	case 5:
+		return "transpose=0" // Transposed (mirrored across the main diagonal)
+	case 6:
+		return "transpose=1" // Rotated 90 CW
+	case 7:
+		return "transpose=3" // Transversed (mirrored across the other diagonal)
+	case 8:
+		return "transpose=2" // Rotated 90 CCW
+	}
+	return ""
+}
+
+// ThumbnailFilter returns the filter that scales a picture down to size
+// without upscaling: to fit within a size x size box keeping its aspect ratio,
+// or with crop, center-cropped to a square first so it fills the box.
+func ThumbnailFilter(size int, crop bool) string {
+	// The expression scales the larger dimension to 'size' and calculates the other proportionally
+	scale := fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease", size, size)
+	if crop {
+		return "crop='min(iw,ih)':'min(iw,ih)'," + scale
+	}
+	return scale
+}
+
+// Thumbnail formats GenerateThumbnail and ExtractVideoFrame can write,
+// chosen by the extension of the output path.
+const (
+	ThumbnailJPEG = "jpeg"
+	ThumbnailWebP = "webp"
+	ThumbnailAVIF = "avif"
+)
+
+// thumbnailEncoders names the encoder each thumbnail format is written with.
+var thumbnailEncoders = map[string]string{
+	ThumbnailJPEG: "mjpeg",
+	ThumbnailWebP: "libwebp",
+	ThumbnailAVIF: "libaom-av1",
+}
+
+// ThumbnailExtension returns the file extension, with the dot, of a
+// thumbnail in format. Unknown formats are JPEG.
+func ThumbnailExtension(format string) string {
+	switch format {
+	case ThumbnailWebP:
+		return ".webp"
+	case ThumbnailAVIF:
+		return ".avif"
+	}
+	return ".jpg"
+}
+
+// thumbnailFormat returns the thumbnail format written to outputPath,
+// by its extension.
+func thumbnailFormat(outputPath string) string {
+	switch strings.ToLower(filepath.Ext(outputPath)) {
+	case ".webp":
+		return ThumbnailWebP
+	case ".avif":
+		return ThumbnailAVIF
+	}
+	return ThumbnailJPEG
+}
+
+// thumbnailEncodeArgs returns the output options writing a single picture to
+// outputPath. Quality is the JPEG qscale; WebP and AVIF use fixed settings
+// that look about as good as the default at a fraction of the size.
+func thumbnailEncodeArgs(outputPath string, quality int) []string {
+	switch format := thumbnailFormat(outputPath); format {
+	case ThumbnailWebP:
+		return []string{"-frames:v", "1", "-c:v", thumbnailEncoders[format], "-quality", "80"}
+	case ThumbnailAVIF:
+		return []string{"-frames:v", "1", "-c:v", thumbnailEncoders[format], "-still-picture", "1",
+			"-crf", "32", "-cpu-used", "6", "-pix_fmt", "yuv420p"}
+	}
+	return []string{"-qscale:v", fmt.Sprintf("%d", quality)} // JPEG quality (2-5 is high quality)
+}
+
+// SupportsThumbnailFormat reports whether the ffmpeg in use has the encoder
+// thumbnails in format are written with. JPEG is always supported; builds
+// without libwebp or libaom lack the others. The encoder list is read once.
+func (m *Manager) SupportsThumbnailFormat(ctx context.Context, format string) bool {
+	if format == ThumbnailJPEG {
+		return true
+	}
+	encoder, ok := thumbnailEncoders[format]
+	if !ok {
+		return false
+	}
+
+	m.encodersMu.Lock()
+	defer m.encodersMu.Unlock()
+	if m.encoders == nil {
+		encoders, err := m.listEncoders(ctx)
+		if err != nil {
+			m.logger().Debug("cannot list ffmpeg encoders", "error", err)
+			return false // Tried again next time
+		}
+		m.encoders = encoders
+	}
+	return m.encoders[encoder]
+}
+
+// SupportsHEIF reports whether the ffmpeg in use can decode HEIC and HEIF
+// images, whose pictures are HEVC-coded. Builds without the hevc decoder
+// cannot. The decoder list is read once.
+func (m *Manager) SupportsHEIF(ctx context.Context) bool {
+	m.encodersMu.Lock()
+	defer m.encodersMu.Unlock()
+	if m.decoders == nil {
+		decoders, err := m.listCoders(ctx, "-decoders")
+		if err != nil {
+			m.logger().Debug("cannot list ffmpeg decoders", "error", err)
+			return false // Tried again next time
+		}
+		m.decoders = decoders
+	}
+	return m.decoders["hevc"]
+}
+
+// listEncoders runs ffmpeg -encoders, returning the names it lists.
+func (m *Manager) listEncoders(ctx context.Context) (map[string]bool, error) {
+	return m.listCoders(ctx, "-encoders")
+}
+
+// listCoders runs ffmpeg with flag, -encoders or -decoders, returning the
+// names it lists.
+func (m *Manager) listCoders(ctx context.Context, flag string) (map[string]bool, error) {
+	ffmpegPath, err := m.GetFFmpegPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	output, err := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", flag).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg %s failed: %w", flag, err)
+	}
+	return parseEncoders(string(output)), nil
+}
+
+// parseEncoders reads the names from the output of ffmpeg -encoders, or
+// -decoders, laid out the same: a legend, a dashed line, then a line per
+// coder of its capability flags, name and description.
+func parseEncoders(output string) map[string]bool {
+	encoders := make(map[string]bool)
+	listed := false
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 1 && strings.HasPrefix(fields[0], "---"):
+			listed = true
+		case listed && len(fields) >= 2:
+			encoders[fields[1]] = true
+		}
+	}
+	return encoders
+}
+
+// GenerateThumbnail creates a thumbnail image using FFmpeg, in the format
+// named by the extension of outputPath: JPEG, WebP (.webp) or AVIF (.avif).
+// The thumbnail fits within a bounding box of the specified size while maintaining aspect ratio,
+// or with crop, is center-cropped to a square of that size.
 // Quality is 2-31 where 2 is best (for JPEG, maps to ~85% quality at value 2-5).
-func (m *Manager) GenerateThumbnail(ctx context.Context, inputPath, outputPath string, size int, quality int) error {
+// Orientation is the source's EXIF Orientation value; the thumbnail is rotated upright.
+func (m *Manager) GenerateThumbnail(ctx context.Context, inputPath, outputPath string, size int, quality int, orientation int, crop bool) error {
 	ffmpegPath, err := m.GetFFmpegPath(ctx)
 	if err != nil {
 		return err
 	}
 
-	// Scale filter: fit within bounding box, maintain aspect ratio, don't upscale
-	// The expression scales the larger dimension to 'size' and calculates the other proportionally
-	scaleFilter := fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease", size, size)
+	// Rotate first, so a crop keeps the middle of the upright picture
+	scaleFilter := ThumbnailFilter(size, crop)
+	if rotate := OrientationFilter(orientation); rotate != "" {
+		scaleFilter = rotate + "," + scaleFilter
+	}
 
-	cmd := exec.CommandContext(ctx, ffmpegPath,
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	args := []string{
+		"-noautorotate", // Orientation is applied explicitly above
 		"-i", inputPath,
 		"-vf", scaleFilter,
-		"-qscale:v", fmt.Sprintf("%d", quality), // JPEG quality (2-5 is high quality)
+	}
+	args = append(args, thumbnailEncodeArgs(outputPath, quality)...)
+	args = append(args,
 		"-y", // Overwrite output
 		outputPath,
 	)
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -414,26 +1021,53 @@ func (m *Manager) GenerateThumbnail(ctx context.Context, inputPath, outputPath s
 	return nil
 }
 
-// GetVideoDuration returns the duration of a video file in seconds.
-func (m *Manager) GetVideoDuration(ctx context.Context, videoPath string) (float64, error) {
-	ffprobePath, err := m.GetFFprobePath(ctx)
+// RotateImage writes the image at inputPath to outputPath turned upright
+// according to orientation, its EXIF Orientation value, at full size as a
+// JPEG of quality (as GenerateThumbnail takes it). Metadata is not copied,
+// so viewers that honor the tag do not turn the picture again.
+func (m *Manager) RotateImage(ctx context.Context, inputPath, outputPath string, orientation int, quality int) error {
+	ffmpegPath, err := m.GetFFmpegPath(ctx)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	cmd := exec.CommandContext(ctx, ffprobePath,
-		"-v", "error",
-		"-show_entries", "format=duration",
-		"-of", "default=noprint_wrappers=1:nokey=1",
-		videoPath,
+	args := []string{
+		"-noautorotate", // Orientation is applied explicitly, as builds differ on stills
+		"-i", inputPath,
+	}
+	if rotate := OrientationFilter(orientation); rotate != "" {
+		args = append(args, "-vf", rotate)
+	}
+
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	args = append(args,
+		"-map_metadata", "-1", // Drop the EXIF Orientation with the rest
+		"-frames:v", "1",
+		"-qscale:v", fmt.Sprintf("%d", quality),
+		"-y",
+		outputPath,
 	)
+	output, err := exec.CommandContext(ctx, ffmpegPath, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg rotate failed: %w: %s", err, string(output))
+	}
 
-	output, err := cmd.Output()
+	return nil
+}
+
+// GetVideoDuration returns the duration of a video file in seconds.
+func (m *Manager) GetVideoDuration(ctx context.Context, videoPath string) (float64, error) {
+	probe, err := m.Probe(ctx, videoPath)
 	if err != nil {
-		return 0, fmt.Errorf("ffprobe duration failed: %w", err)
+		return 0, fmt.Errorf("failed to get duration: %w", err)
 	}
 
-	durationStr := strings.TrimSpace(string(output))
+	durationStr := strings.TrimSpace(probe.Format.Duration)
 	var duration float64
 	if _, err := fmt.Sscanf(durationStr, "%f", &duration); err != nil {
 		return 0, fmt.Errorf("failed to parse duration '%s': %w", durationStr, err)
@@ -442,9 +1076,12 @@ func (m *Manager) GetVideoDuration(ctx context.Context, videoPath string) (float
 	return duration, nil
 }
 
-// ExtractVideoFrame extracts a single frame from a video at the specified timestamp.
-// The frame is scaled to fit within the bounding box size while maintaining aspect ratio.
-func (m *Manager) ExtractVideoFrame(ctx context.Context, videoPath, outputPath string, timestampSec float64, size int, quality int) error {
+// ExtractVideoFrame extracts a single frame from a video at the specified
+// timestamp, in the format named by the extension of outputPath as
+// GenerateThumbnail writes it.
+// The frame is scaled to fit within the bounding box size while maintaining aspect ratio,
+// or with crop, center-cropped to a square of that size.
+func (m *Manager) ExtractVideoFrame(ctx context.Context, videoPath, outputPath string, timestampSec float64, size int, quality int, crop bool) error {
 	ffmpegPath, err := m.GetFFmpegPath(ctx)
 	if err != nil {
 		return err
@@ -453,18 +1090,26 @@ func (m *Manager) ExtractVideoFrame(ctx context.Context, videoPath, outputPath s
 	// Format timestamp as HH:MM:SS.mmm
 	timestamp := fmt.Sprintf("%.3f", timestampSec)
 
-	// Scale filter: fit within bounding box, maintain aspect ratio
-	scaleFilter := fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease", size, size)
+	scaleFilter := ThumbnailFilter(size, crop)
 
-	cmd := exec.CommandContext(ctx, ffmpegPath,
-		"-ss", timestamp,        // Seek to timestamp (before -i for faster seeking)
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	args := []string{
+		"-ss", timestamp, // Seek to timestamp (before -i for faster seeking)
 		"-i", videoPath,
-		"-vframes", "1",         // Extract only 1 frame
+		"-vframes", "1", // Extract only 1 frame
 		"-vf", scaleFilter,
-		"-qscale:v", fmt.Sprintf("%d", quality),
-		"-y",                    // Overwrite output
+	}
+	args = append(args, thumbnailEncodeArgs(outputPath, quality)...)
+	args = append(args,
+		"-y", // Overwrite output
 		outputPath,
 	)
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -473,3 +1118,141 @@ func (m *Manager) ExtractVideoFrame(ctx context.Context, videoPath, outputPath s
 
 	return nil
 }
+
+// GenerateStoryboard writes a sprite sheet of cols x rows frames sampled evenly
+// across the video, each scaled to thumbWidth pixels wide, as one JPEG.
+// Returns the timestamp in seconds of each cell, in row-major order, so a
+// player can map a hover position to the matching cell.
+func (m *Manager) GenerateStoryboard(ctx context.Context, videoPath, outputPath string, cols, rows, thumbWidth int) ([]float64, error) {
+	if cols <= 0 || rows <= 0 || thumbWidth <= 0 {
+		return nil, fmt.Errorf("invalid storyboard layout %dx%d at width %d", cols, rows, thumbWidth)
+	}
+
+	ffmpegPath, err := m.GetFFmpegPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := m.GetVideoDuration(ctx, videoPath)
+	if err != nil {
+		return nil, err
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("video has no duration")
+	}
+
+	// One frame per interval, starting at the first frame
+	cells := cols * rows
+	interval := duration / float64(cells)
+	times := make([]float64, cells)
+	for i := range times {
+		times[i] = float64(i) * interval
+	}
+
+	// Even height keeps the JPEG encoder happy with odd aspect ratios
+	filter := fmt.Sprintf("fps=fps=1/%f,scale=%d:-2,tile=%dx%d", interval, thumbWidth, cols, rows)
+
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-i", videoPath,
+		"-vf", filter,
+		"-frames:v", "1", // The single tiled image
+		"-qscale:v", "4",
+		"-y",
+		outputPath,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg storyboard failed: %w: %s", err, string(output))
+	}
+
+	return times, nil
+}
+
+// bitmapSubtitleCodecs are image-based subtitle formats that can't be converted to WebVTT
+var bitmapSubtitleCodecs = map[string]bool{
+	"hdmv_pgs_subtitle": true,
+	"dvd_subtitle":      true,
+	"dvb_subtitle":      true,
+	"xsub":              true,
+}
+
+// SubtitleTrack describes a subtitle stream extracted to a WebVTT file
+type SubtitleTrack struct {
+	Index    int    `json:"index"`  // Position among the file's subtitle streams
+	Stream   int    `json:"stream"` // ffprobe stream index
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Path     string `json:"-"` // Extracted .vtt file
+}
+
+// ExtractSubtitles extracts every text subtitle stream in inputPath to
+// outDir/<index>.vtt, where index is the stream's position among the file's
+// subtitle streams. Image-based subtitle streams are skipped.
+// Returns the extracted tracks; an empty slice means there were none.
+func (m *Manager) ExtractSubtitles(ctx context.Context, inputPath, outDir string) ([]SubtitleTrack, error) {
+	probe, err := m.Probe(ctx, inputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	streams := probe.SubtitleStreams()
+	if len(streams) == 0 {
+		return nil, nil
+	}
+
+	ffmpegPath, err := m.GetFFmpegPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create subtitle directory: %w", err)
+	}
+
+	var tracks []SubtitleTrack
+	for i, stream := range streams {
+		if bitmapSubtitleCodecs[stream.CodecName] {
+			continue
+		}
+
+		release, err := m.acquire(ctx)
+		if err != nil {
+			return tracks, err
+		}
+
+		outPath := filepath.Join(outDir, fmt.Sprintf("%d.vtt", i))
+		cmd := exec.CommandContext(ctx, ffmpegPath,
+			"-i", inputPath,
+			"-map", fmt.Sprintf("0:%d", stream.Index),
+			"-c:s", "webvtt",
+			"-f", "webvtt",
+			"-y",
+			outPath,
+		)
+
+		output, err := cmd.CombinedOutput()
+		release()
+		if err != nil {
+			return tracks, fmt.Errorf("ffmpeg subtitle extraction failed for stream %d: %w: %s", stream.Index, err, string(output))
+		}
+
+		tracks = append(tracks, SubtitleTrack{
+			Index:    i,
+			Stream:   stream.Index,
+			Codec:    stream.CodecName,
+			Language: stream.Tags["language"],
+			Title:    stream.Tags["title"],
+			Path:     outPath,
+		})
+	}
+
+	return tracks, nil
+}
@@ -0,0 +1,627 @@
+package ffmpeg
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// requireFFmpeg skips the test unless ffmpeg and ffprobe are on PATH.
+func requireFFmpeg(t *testing.T) {
+	t.Helper()
+	for _, bin := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not installed", bin)
+		}
+	}
+}
+
+func TestExtractSubtitles_OneTrack(t *testing.T) {
+	requireFFmpeg(t)
+	dir := t.TempDir()
+
+	srt := filepath.Join(dir, "subs.srt")
+	if err := os.WriteFile(srt, []byte("1\n00:00:00,000 --> 00:00:01,000\nHello there\n"), 0644); err != nil {
+		t.Fatalf("Failed to write srt: %v", err)
+	}
+
+	// Two-second clip with one embedded English subtitle track
+	clip := filepath.Join(dir, "clip.mkv")
+	cmd := exec.Command("ffmpeg", "-v", "error",
+		"-f", "lavfi", "-i", "color=c=black:s=64x64:d=2",
+		"-i", srt,
+		"-c:v", "mpeg4", "-c:s", "srt",
+		"-metadata:s:s:0", "language=eng",
+		"-y", clip,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to create clip: %v: %s", err, out)
+	}
+
+	m := NewManager(filepath.Join(dir, "bin"))
+	outDir := filepath.Join(dir, "subs")
+	tracks, err := m.ExtractSubtitles(context.Background(), clip, outDir)
+	if err != nil {
+		t.Fatalf("ExtractSubtitles failed: %v", err)
+	}
+	if len(tracks) != 1 {
+		t.Fatalf("Expected 1 track, got %d", len(tracks))
+	}
+	if tracks[0].Index != 0 || tracks[0].Language != "eng" {
+		t.Errorf("Unexpected track: %+v", tracks[0])
+	}
+
+	data, err := os.ReadFile(tracks[0].Path)
+	if err != nil {
+		t.Fatalf("Failed to read vtt: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "WEBVTT") || !strings.Contains(string(data), "Hello there") {
+		t.Errorf("Unexpected WebVTT output:\n%s", data)
+	}
+}
+
+func TestExtractSubtitles_NoSubtitleStreams(t *testing.T) {
+	requireFFmpeg(t)
+	dir := t.TempDir()
+
+	clip := filepath.Join(dir, "clip.mp4")
+	cmd := exec.Command("ffmpeg", "-v", "error",
+		"-f", "lavfi", "-i", "color=c=black:s=64x64:d=1",
+		"-c:v", "mpeg4", "-y", clip,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to create clip: %v: %s", err, out)
+	}
+
+	m := NewManager(filepath.Join(dir, "bin"))
+	tracks, err := m.ExtractSubtitles(context.Background(), clip, filepath.Join(dir, "subs"))
+	if err != nil {
+		t.Fatalf("ExtractSubtitles failed: %v", err)
+	}
+	if len(tracks) != 0 {
+		t.Errorf("Expected no tracks, got %+v", tracks)
+	}
+}
+
+func TestGetAudioStreamInfo(t *testing.T) {
+	// Trimmed from ffprobe -print_format json -show_format -show_streams
+	output := `{
+		"streams": [
+			{"index": 0, "codec_name": "h264", "codec_type": "video", "width": 1920, "height": 1080, "bit_rate": "4500000"},
+			{"index": 1, "codec_name": "ac3", "codec_type": "audio", "sample_fmt": "fltp", "sample_rate": "48000",
+				"channels": 2, "channel_layout": "stereo", "bits_per_sample": 0, "bit_rate": "192000",
+				"tags": {"language": "eng"}}
+		],
+		"format": {"filename": "movie.mkv", "format_name": "matroska,webm", "duration": "5400.000000", "bit_rate": "4700000"}
+	}`
+	var p ProbeResult
+	if err := json.Unmarshal([]byte(output), &p); err != nil {
+		t.Fatalf("Failed to parse ffprobe output: %v", err)
+	}
+
+	audio := p.GetAudioStreamInfo()
+	if audio == nil {
+		t.Fatal("Expected an audio stream")
+	}
+	if audio.Index != 1 || audio.CodecName != "ac3" || audio.SampleRate != "48000" || audio.Channels != 2 ||
+		audio.ChannelLayout != "stereo" || audio.BitRate != "192000" || audio.Tags["language"] != "eng" {
+		t.Errorf("Unexpected audio stream: %+v", audio)
+	}
+	if p.GetAudioCodec() != "ac3" {
+		t.Errorf("Expected GetAudioCodec to agree, got %q", p.GetAudioCodec())
+	}
+
+	if (&ProbeResult{Streams: []StreamInfo{{CodecType: "video"}}}).GetAudioStreamInfo() != nil {
+		t.Error("Expected no audio stream in a silent video")
+	}
+}
+
+func TestPlanTranscode(t *testing.T) {
+	probe := func(file, video, audio string) *ProbeResult {
+		return &ProbeResult{
+			Streams: []StreamInfo{{CodecType: "video", CodecName: video}, {CodecType: "audio", CodecName: audio}},
+			Format:  FormatInfo{Filename: file},
+		}
+	}
+
+	if plan := probe("/v/clip.mp4", "h264", "aac").PlanTranscode(nil); plan.Needed() || plan != (TranscodePlan{}) {
+		t.Errorf("Expected H.264 and AAC in MP4 to need nothing, got %+v", plan)
+	}
+	want := TranscodePlan{TranscodeVideo: true, Container: TranscodeContainer}
+	if plan := probe("/v/4k.mkv", "hevc", "aac").PlanTranscode(nil); plan != want {
+		t.Errorf("Expected HEVC to need its video transcoded, got %+v", plan)
+	}
+	want = TranscodePlan{TranscodeAudio: true, Container: TranscodeContainer}
+	if plan := probe("/v/film.mp4", "h264", "ac3").PlanTranscode(nil); plan != want {
+		t.Errorf("Expected only AC-3 audio transcoded, got %+v", plan)
+	}
+	if plan := probe("/v/film.mp4", "h264", "ac3").PlanTranscode([]string{"aac", "ac3"}); plan.Needed() {
+		t.Errorf("Expected AC-3 kept for a target that plays it, got %+v", plan)
+	}
+	want = TranscodePlan{Container: TranscodeContainer}
+	if plan := probe("/v/show.MKV", "h264", "aac").PlanTranscode(nil); plan != want {
+		t.Errorf("Expected Matroska remuxed without transcoding, got %+v", plan)
+	}
+	if plan := probe("/v/clip.webm", "VP9", "opus").PlanTranscode(nil); plan.Needed() {
+		t.Errorf("Expected VP9 and Opus in WebM to need nothing, got %+v", plan)
+	}
+
+	// Cover art is not the video
+	withCover := probe("/v/clip.mp4", "h264", "aac")
+	withCover.Streams = append([]StreamInfo{{CodecType: "video", CodecName: "mjpeg", Disposition: map[string]int{"attached_pic": 1}}}, withCover.Streams...)
+	if withCover.GetVideoCodec() != "h264" || withCover.NeedsTranscoding() {
+		t.Errorf("Expected cover art ignored, got video codec %q", withCover.GetVideoCodec())
+	}
+}
+
+func TestTranscodeVideo_HEVC(t *testing.T) {
+	requireFFmpeg(t)
+	dir := t.TempDir()
+
+	// One-second HEVC clip with MP2 audio, neither of which browsers play
+	clip := filepath.Join(dir, "clip.mkv")
+	out, err := exec.Command("ffmpeg", "-v", "error",
+		"-f", "lavfi", "-i", "testsrc=size=320x240:rate=10:d=1",
+		"-f", "lavfi", "-i", "sine=d=1",
+		"-c:v", "libx265", "-c:a", "mp2", "-y", clip,
+	).CombinedOutput()
+	if err != nil {
+		t.Skipf("ffmpeg cannot encode HEVC: %v: %s", err, out)
+	}
+
+	m := NewManager(filepath.Join(dir, "bin"))
+	m.VideoPreset, m.VideoCRF = "ultrafast", 35
+	probe, err := m.Probe(context.Background(), clip)
+	if err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+	plan := probe.PlanTranscode(nil)
+	if !plan.TranscodeVideo || !plan.TranscodeAudio {
+		t.Fatalf("Expected HEVC and MP2 to need transcoding, got %+v", plan)
+	}
+
+	reader, err := m.TranscodeVideo(context.Background(), clip, plan)
+	if err != nil {
+		t.Fatalf("TranscodeVideo failed: %v", err)
+	}
+	stream, err := io.ReadAll(reader)
+	var last TranscodeProgress
+	for p := range reader.Progress() { // Closed as ffmpeg exits
+		last = p
+	}
+	reader.Close()
+	if err != nil {
+		t.Fatalf("Failed to read the stream: %v", err)
+	}
+	if !last.Done || last.Percent != 100 {
+		t.Errorf("Expected the last progress update to be complete, got %+v", last)
+	}
+	if len(stream) < 8 || string(stream[4:8]) != "ftyp" {
+		t.Fatalf("Expected an MP4 stream starting with ftyp, got %d bytes", len(stream))
+	}
+
+	streamed := filepath.Join(dir, "streamed.mp4")
+	if err := os.WriteFile(streamed, stream, 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := m.Probe(context.Background(), streamed)
+	if err != nil {
+		t.Fatalf("Probe of the stream failed: %v", err)
+	}
+	if result.GetVideoCodec() != "h264" || result.GetAudioCodec() != "aac" || result.NeedsTranscoding() {
+		t.Errorf("Expected H.264 and AAC that play as they are, got %q and %q", result.GetVideoCodec(), result.GetAudioCodec())
+	}
+}
+
+func TestParseProgress(t *testing.T) {
+	// As ffmpeg -progress writes it, with an error line mixed in
+	output := `frame=48
+fps=24.0
+out_time_us=2000000
+out_time_ms=2000000
+out_time=00:00:02.000000
+speed=1.98x
+progress=continue
+[aac @ 0x1] Too many bits
+frame=120
+out_time_us=5000000
+out_time_ms=5000000
+speed=2.5x
+progress=continue
+out_time_us=10000000
+out_time_ms=10000000
+speed=N/A
+progress=end
+`
+	// A buffer large enough that no update is replaced
+	ch := make(chan TranscodeProgress, 8)
+	parseProgress(strings.NewReader(output), 10, ch)
+
+	var updates []TranscodeProgress
+	for p := range ch {
+		updates = append(updates, p)
+	}
+	want := []TranscodeProgress{
+		{OutTime: 2 * time.Second, Speed: 1.98, Percent: 20},
+		{OutTime: 5 * time.Second, Speed: 2.5, Percent: 50},
+		{OutTime: 10 * time.Second, Speed: 2.5, Percent: 100, Done: true},
+	}
+	if !slices.Equal(updates, want) {
+		t.Errorf("Expected %+v, got %+v", want, updates)
+	}
+
+	// Without a duration only the time is known; an unread update is replaced
+	ch = make(chan TranscodeProgress, 1)
+	parseProgress(strings.NewReader(output), 0, ch)
+	if p, ok := <-ch; !ok || p.Percent != 100 || !p.Done || p.OutTime != 10*time.Second {
+		t.Errorf("Expected only the final update kept, got %+v", p)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("Expected the channel closed at the end of the output")
+	}
+}
+
+func TestValidateVideoEncoding(t *testing.T) {
+	for _, ok := range []struct {
+		preset string
+		crf    int
+	}{{"", 0}, {"veryfast", 23}, {"slow", 51}} {
+		if err := ValidateVideoEncoding(ok.preset, ok.crf); err != nil {
+			t.Errorf("%q, %d: unexpected error %v", ok.preset, ok.crf, err)
+		}
+	}
+	if ValidateVideoEncoding("quick", 23) == nil || ValidateVideoEncoding("fast", 52) == nil || ValidateVideoEncoding("fast", -1) == nil {
+		t.Error("Expected an unknown preset and out of range CRFs rejected")
+	}
+}
+
+func TestSubtitleStreams(t *testing.T) {
+	p := &ProbeResult{Streams: []StreamInfo{
+		{Index: 0, CodecType: "video"},
+		{Index: 1, CodecType: "audio"},
+		{Index: 2, CodecType: "subtitle", CodecName: "subrip"},
+		{Index: 3, CodecType: "subtitle", CodecName: "ass"},
+	}}
+
+	streams := p.SubtitleStreams()
+	if len(streams) != 2 || streams[0].Index != 2 || streams[1].Index != 3 {
+		t.Errorf("Unexpected subtitle streams: %+v", streams)
+	}
+}
+
+func TestNeedsTranscodingFor(t *testing.T) {
+	probe := func(codec string) *ProbeResult {
+		return &ProbeResult{Streams: []StreamInfo{{CodecType: "video"}, {CodecType: "audio", CodecName: codec}}}
+	}
+	if probe("AAC").NeedsTranscoding() || probe("flac").NeedsTranscoding() {
+		t.Error("Expected AAC and FLAC to play by default")
+	}
+	if !probe("ac3").NeedsTranscoding() {
+		t.Error("Expected AC-3 to need transcoding by default")
+	}
+	// A target without FLAC support transcodes it; one with AC-3 does not
+	if !probe("flac").NeedsTranscodingFor([]string{"aac", "mp3"}) {
+		t.Error("Expected FLAC to need transcoding for an AAC/MP3 target")
+	}
+	if probe("ac3").NeedsTranscodingFor([]string{"aac", "ac3"}) {
+		t.Error("Expected AC-3 to play on a target listing it")
+	}
+	if (&ProbeResult{Streams: []StreamInfo{{CodecType: "video"}}}).NeedsTranscodingFor([]string{"aac"}) {
+		t.Error("Expected a silent video never to need transcoding")
+	}
+}
+
+func TestParseCodecList(t *testing.T) {
+	codecs, err := ParseCodecList(" AAC, mp3,,opus ")
+	if err != nil || !slices.Equal(codecs, []string{"aac", "mp3", "opus"}) {
+		t.Errorf("Expected [aac mp3 opus], got %v (%v)", codecs, err)
+	}
+	for _, s := range []string{"", " , "} {
+		if _, err := ParseCodecList(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+}
+
+func TestParseEncoders(t *testing.T) {
+	output := `Encoders:
+ V..... = Video
+ A..... = Audio
+ ------
+ V....D libwebp              libwebp WebP image (codec webp)
+ V....D mjpeg                MJPEG (Motion JPEG)
+ A....D aac                  AAC (Advanced Audio Coding)
+`
+	encoders := parseEncoders(output)
+	for _, name := range []string{"libwebp", "mjpeg", "aac"} {
+		if !encoders[name] {
+			t.Errorf("Expected %s to be listed", name)
+		}
+	}
+	if encoders["libaom-av1"] || encoders["="] || encoders["V....."] {
+		t.Errorf("Unexpected encoders %v", encoders)
+	}
+}
+
+func TestThumbnailEncodeArgs(t *testing.T) {
+	if args := thumbnailEncodeArgs("/t/a_500.jpg", 3); !slices.Equal(args, []string{"-qscale:v", "3"}) {
+		t.Errorf("JPEG: got %v", args)
+	}
+	if args := thumbnailEncodeArgs("/t/a_500.webp", 3); !slices.Contains(args, "libwebp") {
+		t.Errorf("WebP: expected libwebp, got %v", args)
+	}
+	if args := thumbnailEncodeArgs("/t/a_500_crop.AVIF", 3); !slices.Contains(args, "libaom-av1") {
+		t.Errorf("AVIF: expected libaom-av1, got %v", args)
+	}
+}
+
+func TestOrientationFilter(t *testing.T) {
+	if f := OrientationFilter(1); f != "" {
+		t.Errorf("Expected no filter for upright images, got %q", f)
+	}
+	if f := OrientationFilter(0); f != "" {
+		t.Errorf("Expected no filter for a missing tag, got %q", f)
+	}
+	// Orientations 5-8 turn the image by 90 degrees
+	for o := 5; o <= 8; o++ {
+		if f := OrientationFilter(o); !strings.HasPrefix(f, "transpose=") {
+			t.Errorf("Orientation %d: expected a transpose, got %q", o, f)
+		}
+	}
+	for o := 2; o <= 4; o++ {
+		if f := OrientationFilter(o); f == "" || strings.Contains(f, "transpose") {
+			t.Errorf("Orientation %d: expected a flip, got %q", o, f)
+		}
+	}
+}
+
+func TestThumbnailFilter(t *testing.T) {
+	fit := ThumbnailFilter(500, false)
+	if strings.Contains(fit, "crop") || !strings.Contains(fit, "min(500,iw)") {
+		t.Errorf("Expected a plain scale to 500, got %q", fit)
+	}
+	// Cropping to a square comes before scaling
+	if crop := ThumbnailFilter(500, true); crop != "crop='min(iw,ih)':'min(iw,ih)',"+fit {
+		t.Errorf("Expected a center crop before the scale, got %q", crop)
+	}
+}
+
+func TestGenerateStoryboard_TiledDimensions(t *testing.T) {
+	requireFFmpeg(t)
+	dir := t.TempDir()
+
+	video := filepath.Join(dir, "clip.mp4")
+	out, err := exec.Command("ffmpeg", "-v", "error",
+		"-f", "lavfi", "-i", "testsrc=size=320x240:rate=10", "-t", "6",
+		"-pix_fmt", "yuv420p", video,
+	).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to create test video: %v: %s", err, out)
+	}
+
+	sheet := filepath.Join(dir, "storyboard.jpg")
+	m := NewManager(filepath.Join(dir, "bin"))
+	times, err := m.GenerateStoryboard(context.Background(), video, sheet, 4, 3, 80)
+	if err != nil {
+		t.Fatalf("GenerateStoryboard failed: %v", err)
+	}
+
+	if len(times) != 12 {
+		t.Fatalf("Expected 12 cell timestamps, got %d", len(times))
+	}
+	if times[0] != 0 || times[1] != 0.5 || times[11] != 5.5 {
+		t.Errorf("Expected cells every 0.5s, got %v", times)
+	}
+
+	f, err := os.Open(sheet)
+	if err != nil {
+		t.Fatalf("Storyboard not written: %v", err)
+	}
+	defer f.Close()
+	cfg, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		t.Fatalf("Storyboard is not a JPEG: %v", err)
+	}
+	// 4 columns of 80px cells, 3 rows of 60px (4:3 source)
+	if cfg.Width != 320 || cfg.Height != 180 {
+		t.Errorf("Expected 320x180 sprite sheet, got %dx%d", cfg.Width, cfg.Height)
+	}
+}
+
+func TestGenerateStoryboard_InvalidLayout(t *testing.T) {
+	m := NewManager(t.TempDir())
+	if _, err := m.GenerateStoryboard(context.Background(), "in.mp4", "out.jpg", 0, 3, 80); err == nil {
+		t.Error("Expected error for zero columns")
+	}
+}
+
+// useFakeFFmpeg points the cached ffmpeg and ffprobe paths at a shell script
+// for the duration of the test.
+func useFakeFFmpeg(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg script needs a POSIX shell")
+	}
+
+	bin := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatalf("Failed to write fake ffmpeg: %v", err)
+	}
+
+	pathMutex.Lock()
+	origFFmpeg, origFFprobe := cachedFFmpegPath, cachedFFprobePath
+	cachedFFmpegPath, cachedFFprobePath = bin, bin
+	pathMutex.Unlock()
+
+	t.Cleanup(func() {
+		pathMutex.Lock()
+		cachedFFmpegPath, cachedFFprobePath = origFFmpeg, origFFprobe
+		pathMutex.Unlock()
+	})
+}
+
+func TestMaxConcurrent_SerializesCalls(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "calls.log")
+	useFakeFFmpeg(t, fmt.Sprintf("echo start >> %q\nsleep 0.2\necho end >> %q\n", log, log))
+
+	m := NewManager(t.TempDir())
+	m.MaxConcurrent = 1
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.GenerateThumbnail(context.Background(), "in.jpg", "out.jpg", 100, 3, 1, false); err != nil {
+				t.Errorf("GenerateThumbnail failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatalf("Failed to read call log: %v", err)
+	}
+	if got := strings.Fields(string(data)); strings.Join(got, " ") != "start end start end" {
+		t.Errorf("Expected calls to run one after the other, got %v", got)
+	}
+}
+
+func TestMaxConcurrent_WaitRespectsContext(t *testing.T) {
+	useFakeFFmpeg(t, "exit 0\n")
+
+	m := NewManager(t.TempDir())
+	m.MaxConcurrent = 1
+
+	release, err := m.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := m.Probe(ctx, "in.mp4"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Probe to give up waiting for a slot, got %v", err)
+	}
+}
+
+func TestProbe_CachesUnchangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls.log")
+	useFakeFFmpeg(t, fmt.Sprintf("echo probe >> %q\necho '{\"streams\": [{\"index\": 0, \"codec_type\": \"audio\", \"codec_name\": \"aac\"}], \"format\": {\"duration\": \"12.5\"}}'\n", calls))
+	probes := func() int {
+		data, _ := os.ReadFile(calls)
+		return strings.Count(string(data), "probe")
+	}
+
+	clip, other := filepath.Join(dir, "clip.mp4"), filepath.Join(dir, "other.mp4")
+	for _, path := range []string{clip, other} {
+		if err := os.WriteFile(path, []byte("video"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewManager(t.TempDir())
+	ctx := context.Background()
+	first, err := m.Probe(ctx, clip)
+	if err != nil || first.GetAudioCodec() != "aac" {
+		t.Fatalf("Probe failed: %v", err)
+	}
+	second, err := m.Probe(ctx, clip)
+	if err != nil || second != first || probes() != 1 {
+		t.Errorf("Expected the second Probe served from the cache, ffprobe ran %d times (%v)", probes(), err)
+	}
+	if duration, err := m.GetVideoDuration(ctx, clip); err != nil || duration != 12.5 || probes() != 1 {
+		t.Errorf("Expected the duration from the cache, got %v (%v) after %d runs", duration, err, probes())
+	}
+
+	// A changed file is probed again
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(clip, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Probe(ctx, clip); err != nil || probes() != 2 {
+		t.Errorf("Expected a modified file probed again, ffprobe ran %d times (%v)", probes(), err)
+	}
+
+	// The least recently used result goes first
+	m.ProbeCacheSize = 1
+	m.Probe(ctx, other)
+	m.Probe(ctx, clip)
+	if probes() != 4 {
+		t.Errorf("Expected the evicted result probed again, ffprobe ran %d times", probes())
+	}
+
+	m.ProbeCacheSize = -1
+	m.Probe(ctx, other)
+	m.Probe(ctx, other)
+	if probes() != 6 {
+		t.Errorf("Expected no caching with a negative size, ffprobe ran %d times", probes())
+	}
+}
+
+// writeFFmpegZip writes a zip laid out like the Windows ffmpeg build.
+func writeFFmpegZip(t *testing.T, zipPath string) {
+	t.Helper()
+	f, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to create zip: %v", err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"ffmpeg-7.1-essentials_build/bin/ffmpeg.exe", "ffmpeg-7.1-essentials_build/bin/ffprobe.exe", "ffmpeg-7.1-essentials_build/README.txt"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("Failed to add %s: %v", name, err)
+		}
+		w.Write([]byte("binary"))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to write zip: %v", err)
+	}
+}
+
+func TestExtractFFmpegFromZip_LogsAtDebugLevel(t *testing.T) {
+	for _, level := range []slog.Level{slog.LevelInfo, slog.LevelDebug} {
+		dir := t.TempDir()
+		zipPath := filepath.Join(dir, "ffmpeg-download.zip")
+		writeFFmpegZip(t, zipPath)
+
+		var logs bytes.Buffer
+		m := NewManager(dir)
+		m.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: level}))
+		if err := m.extractFFmpegFromZip(zipPath); err != nil {
+			t.Fatalf("extractFFmpegFromZip failed: %v", err)
+		}
+		for _, name := range []string{"ffmpeg.exe", "ffprobe.exe"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				t.Errorf("Expected %s extracted: %v", name, err)
+			}
+		}
+
+		extracting := strings.Contains(logs.String(), "extracting ffmpeg binary")
+		if level == slog.LevelInfo && logs.Len() > 0 {
+			t.Errorf("Expected no extraction output at info level, got %q", logs.String())
+		}
+		if level == slog.LevelDebug && !extracting {
+			t.Errorf("Expected extraction details at debug level, got %q", logs.String())
+		}
+	}
+}
@@ -0,0 +1,322 @@
+// Package files reads and writes rows of the files table, so callers share
+// one column list instead of each writing their own SQL against it.
+package files
+
+import (
+	"database/sql"
+	"time"
+
+	"jukel.org/q2/db"
+)
+
+// File is a row of the files table. Empty strings and zero times and
+// counters are stored as NULL.
+type File struct {
+	ID                 int64
+	FolderID           int64  // The monitored folder, however deep the file is within it
+	Path               string // Normalized as the scanner indexes it
+	Filename           string
+	Extension          string // Lowercase, with the dot
+	MediaType          string // IMG, AUD or VID (image, audio or video if indexed by a metadata refresh), or empty
+	Size               int64
+	CreatedAt          time.Time
+	ModifiedAt         time.Time
+	IndexedAt          time.Time // Set by the database on Insert and Update
+	ThumbnailSmallPath string
+	ThumbnailLargePath string
+	XXHash             string
+	SeenAt             int64 // The scan pass that last found the file, in Unix nanoseconds
+	EnrichedAt         int64 // Unix seconds thumbnail enrichment last tried the file
+	ThumbnailMethod    string
+	BlurHash           string
+	DeletedAt          int64 // Unix seconds the file was found missing from disk; 0 while it is there
+}
+
+// columns lists the files columns in the order scanFile reads them.
+const columns = `id, folder_id, path, filename, extension, mediatype, size, created_at, modified_at, indexed_at,
+	thumbnail_small_path, thumbnail_large_path, xxhash, seen_at, enriched_at, thumbnail_method, blurhash, deleted_at`
+
+// Repository reads and writes files rows.
+type Repository struct {
+	db *db.DB
+}
+
+// NewRepository returns a Repository using database.
+func NewRepository(database *db.DB) *Repository {
+	return &Repository{db: database}
+}
+
+// Insert adds f, setting its ID. A path already indexed fails with
+// db.ErrUniqueViolation.
+func (r *Repository) Insert(f *File) error {
+	result := r.db.Write(`
+		INSERT INTO files (folder_id, path, filename, extension, mediatype, size, created_at, modified_at,
+			thumbnail_small_path, thumbnail_large_path, xxhash, seen_at, enriched_at, thumbnail_method, blurhash, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		f.FolderID, f.Path, f.Filename, nullString(f.Extension), nullString(f.MediaType), f.Size,
+		nullTime(f.CreatedAt), nullTime(f.ModifiedAt), nullString(f.ThumbnailSmallPath), nullString(f.ThumbnailLargePath),
+		nullString(f.XXHash), nullInt(f.SeenAt), nullInt(f.EnrichedAt), nullString(f.ThumbnailMethod), nullString(f.BlurHash),
+		nullInt(f.DeletedAt))
+	if result.Err != nil {
+		return result.Err
+	}
+	f.ID = result.LastInsertID
+	return nil
+}
+
+// Update writes every column of f to the row with its ID, stamping
+// indexed_at. Reports db.ErrNotFound if there is no such row.
+func (r *Repository) Update(f File) error {
+	result := r.db.Write(`
+		UPDATE files SET
+			folder_id = ?, path = ?, filename = ?, extension = ?, mediatype = ?, size = ?,
+			created_at = ?, modified_at = ?, indexed_at = CURRENT_TIMESTAMP,
+			thumbnail_small_path = ?, thumbnail_large_path = ?, xxhash = ?,
+			seen_at = ?, enriched_at = ?, thumbnail_method = ?, blurhash = ?, deleted_at = ?
+		WHERE id = ?`,
+		f.FolderID, f.Path, f.Filename, nullString(f.Extension), nullString(f.MediaType), f.Size,
+		nullTime(f.CreatedAt), nullTime(f.ModifiedAt), nullString(f.ThumbnailSmallPath), nullString(f.ThumbnailLargePath),
+		nullString(f.XXHash), nullInt(f.SeenAt), nullInt(f.EnrichedAt), nullString(f.ThumbnailMethod), nullString(f.BlurHash),
+		nullInt(f.DeletedAt), f.ID)
+	if result.Err != nil {
+		return result.Err
+	}
+	if result.RowsAffected == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// GetByID returns the file with id, or db.ErrNotFound. Files missing from
+// disk are returned too, with DeletedAt set, as GetByPath returns them.
+func (r *Repository) GetByID(id int64) (File, error) {
+	return scanFile(r.db.QueryRow("SELECT "+columns+" FROM files WHERE id = ?", id))
+}
+
+// GetByPath returns the file indexed at path, which must be normalized as
+// the scanner normalizes it, or db.ErrNotFound.
+func (r *Repository) GetByPath(path string) (File, error) {
+	return scanFile(r.db.QueryRow("SELECT "+columns+" FROM files WHERE path = ?", path))
+}
+
+// ListByFolder returns the files of the monitored folder folderID, at any
+// depth, ordered by path. Like every listing, it leaves out files missing
+// from disk.
+func (r *Repository) ListByFolder(folderID int64) ([]File, error) {
+	rows, err := r.db.Query("SELECT "+columns+" FROM files WHERE folder_id = ? AND deleted_at IS NULL ORDER BY path", folderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []File{}
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// Filter narrows ListAfter to matching files. The zero Filter matches
+// every file on disk.
+type Filter struct {
+	FolderID int64  // Files of this monitored folder, at any depth; 0 for any
+	Tag      string // An XMP keyword of the file, matched without regard to case
+}
+
+// ListAfter returns a page of up to limit files matching filter, ordered by
+// ID, starting after the file with ID after (0 for the first page), and the
+// cursor to pass as after for the next page, or 0 if this is the last.
+//
+// Paging by cursor rather than OFFSET keeps every page as cheap as the first:
+// the query seeks to the cursor through the primary key, where OFFSET reads
+// and discards every row before the page, which is slow in libraries of
+// 100k+ files. Files indexed while paging get higher IDs, so they turn up on
+// a later page, and none are repeated or skipped as rows come and go. The
+// cost is that pages can only be walked forward from a cursor, not jumped to
+// by number, and the order is the order files were indexed, not their path.
+func (r *Repository) ListAfter(after int64, limit int, filter Filter) ([]File, int64, error) {
+	limit = max(limit, 1)
+	query := "SELECT " + columns + " FROM files WHERE id > ? AND deleted_at IS NULL"
+	args := []any{after}
+	if filter.FolderID != 0 {
+		query += " AND folder_id = ?"
+		args = append(args, filter.FolderID)
+	}
+	if filter.Tag != "" {
+		query += ` AND id IN (
+			SELECT it.file_id FROM image_tags it JOIN tags t ON t.id = it.tag_id WHERE t.name = ?)`
+		args = append(args, filter.Tag)
+	}
+	// One row more than the page tells whether another page follows
+	query += " ORDER BY id LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	files := []File{}
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		files = append(files, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	var next int64
+	if len(files) > limit {
+		files = files[:limit]
+		next = files[limit-1].ID
+	}
+	return files, next, nil
+}
+
+// MediaCounts summarizes the indexed files by media type.
+type MediaCounts struct {
+	Images  int64 `json:"images"`
+	Videos  int64 `json:"videos"`
+	Audio   int64 `json:"audio"`
+	Unknown int64 `json:"unknown"` // Files without a media type
+	Total   int64 `json:"total"`
+	Bytes   int64 `json:"bytes"` // The size of every file together
+}
+
+// Counts returns how many files of each media type are on disk, and their
+// total size, in one query grouped by media type. The scanner's IMG, VID
+// and AUD count the same as a metadata refresh's image, video and audio.
+func (r *Repository) Counts() (MediaCounts, error) {
+	rows, err := r.db.Query(`
+		SELECT COALESCE(mediatype, ''), COUNT(*), COALESCE(SUM(size), 0) FROM files
+		WHERE deleted_at IS NULL
+		GROUP BY mediatype`)
+	if err != nil {
+		return MediaCounts{}, err
+	}
+	defer rows.Close()
+
+	var counts MediaCounts
+	for rows.Next() {
+		var mediaType string
+		var n, bytes int64
+		if err := rows.Scan(&mediaType, &n, &bytes); err != nil {
+			return MediaCounts{}, err
+		}
+		switch mediaType {
+		case "IMG", "image":
+			counts.Images += n
+		case "VID", "video":
+			counts.Videos += n
+		case "AUD", "audio":
+			counts.Audio += n
+		default:
+			counts.Unknown += n
+		}
+		counts.Total += n
+		counts.Bytes += bytes
+	}
+	return counts, rows.Err()
+}
+
+// Delete removes the file with id. Rows of other tables referring to it are
+// left to the caller. Reports db.ErrNotFound if there is no such row.
+func (r *Repository) Delete(id int64) error {
+	result := r.db.Write("DELETE FROM files WHERE id = ?", id)
+	if result.Err != nil {
+		return result.Err
+	}
+	if result.RowsAffected == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// Restore marks the file with id as back on disk, so it is listed again
+// with the albums, metadata and thumbnails it had before it went missing.
+// Reports db.ErrNotFound if there is no such row, e.g. one already purged.
+func (r *Repository) Restore(id int64) error {
+	result := r.db.Write("UPDATE files SET deleted_at = NULL WHERE id = ?", id)
+	if result.Err != nil {
+		return result.Err
+	}
+	if result.RowsAffected == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// fileTables are the tables with rows for each file, by file_id.
+var fileTables = []string{"image_metadata", "image_tags", "audio_metadata", "album_items", "lyrics", "play_history"}
+
+// PurgeDeleted deletes the files found missing from disk before before,
+// with their rows in the other tables, in one transaction. Their
+// thumbnails are left to media.GCThumbnails. Returns the number purged.
+func (r *Repository) PurgeDeleted(before time.Time) (int64, error) {
+	cutoff := before.Unix()
+	var n int64
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM files WHERE deleted_at < ?", cutoff).Scan(&n); err != nil || n == 0 {
+		return 0, db.Classify(err)
+	}
+
+	const purged = "file_id IN (SELECT id FROM files WHERE deleted_at < ?)"
+	var stmts []db.Statement
+	for _, table := range fileTables {
+		stmts = append(stmts, db.Statement{Query: "DELETE FROM " + table + " WHERE " + purged, Args: []interface{}{cutoff}})
+	}
+	stmts = append(stmts, db.Statement{Query: "DELETE FROM files WHERE deleted_at < ?", Args: []interface{}{cutoff}})
+	if err := r.db.WriteTransaction(stmts); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// SetThumbnails records the paths of the file's small and large thumbnails.
+func (r *Repository) SetThumbnails(id int64, smallPath, largePath string) error {
+	return r.db.Write("UPDATE files SET thumbnail_small_path = ?, thumbnail_large_path = ? WHERE id = ?",
+		smallPath, largePath, id).Err
+}
+
+// scanner is a *sql.Row or *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanFile reads a row of columns.
+func scanFile(row scanner) (File, error) {
+	var f File
+	var extension, mediaType, small, large, xxhash, method, blurHash sql.NullString
+	var created, modified, indexed sql.NullTime
+	var seen, enriched, deleted sql.NullInt64
+	err := row.Scan(&f.ID, &f.FolderID, &f.Path, &f.Filename, &extension, &mediaType, &f.Size,
+		&created, &modified, &indexed, &small, &large, &xxhash, &seen, &enriched, &method, &blurHash, &deleted)
+	if err != nil {
+		return File{}, db.Classify(err)
+	}
+	f.Extension, f.MediaType = extension.String, mediaType.String
+	f.CreatedAt, f.ModifiedAt, f.IndexedAt = created.Time, modified.Time, indexed.Time
+	f.ThumbnailSmallPath, f.ThumbnailLargePath = small.String, large.String
+	f.XXHash, f.ThumbnailMethod, f.BlurHash = xxhash.String, method.String, blurHash.String
+	f.SeenAt, f.EnrichedAt, f.DeletedAt = seen.Int64, enriched.Int64, deleted.Int64
+	return f, nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func nullInt(n int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: n, Valid: n != 0}
+}
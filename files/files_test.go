@@ -0,0 +1,294 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"jukel.org/q2/db"
+	_ "jukel.org/q2/migrations"
+)
+
+func openTestDB(t *testing.T) (*db.DB, int64) {
+	t.Helper()
+	database, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+	folder := database.Write("INSERT INTO folders (path) VALUES ('/photos')")
+	if folder.Err != nil {
+		t.Fatalf("Failed to insert folder: %v", folder.Err)
+	}
+	return database, folder.LastInsertID
+}
+
+func TestRepository_RoundTrip(t *testing.T) {
+	database, folderID := openTestDB(t)
+	repo := NewRepository(database)
+
+	modified := time.Date(2024, time.June, 3, 12, 30, 15, 250, time.UTC)
+	f := File{
+		FolderID:           folderID,
+		Path:               "/photos/trip/beach.jpg",
+		Filename:           "beach.jpg",
+		Extension:          ".jpg",
+		MediaType:          "IMG",
+		Size:               2048,
+		CreatedAt:          modified.Add(-time.Hour),
+		ModifiedAt:         modified,
+		ThumbnailSmallPath: "thumbnails/ab/ab_500.jpg",
+		ThumbnailLargePath: "thumbnails/ab/ab_1800.jpg",
+		XXHash:             "0123456789abcdef",
+		SeenAt:             modified.UnixNano(),
+		EnrichedAt:         modified.Unix(),
+		ThumbnailMethod:    "decode",
+		BlurHash:           "L00000fQfQfQfQfQfQfQfQfQfQfQ",
+	}
+	if err := repo.Insert(&f); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if f.ID == 0 {
+		t.Fatal("Expected Insert to set the ID")
+	}
+
+	got, err := repo.GetByID(f.ID)
+	if err != nil {
+		t.Fatalf("GetByID failed: %v", err)
+	}
+	if got.IndexedAt.IsZero() {
+		t.Error("Expected the database to stamp indexed_at")
+	}
+	got.IndexedAt = time.Time{}
+	if !got.CreatedAt.Equal(f.CreatedAt) || !got.ModifiedAt.Equal(f.ModifiedAt) {
+		t.Errorf("Expected times %v and %v, got %v and %v", f.CreatedAt, f.ModifiedAt, got.CreatedAt, got.ModifiedAt)
+	}
+	got.CreatedAt, got.ModifiedAt = f.CreatedAt, f.ModifiedAt
+	if got != f {
+		t.Errorf("Round trip changed the file:\n got %+v\nwant %+v", got, f)
+	}
+
+	if byPath, err := repo.GetByPath(f.Path); err != nil || byPath.ID != f.ID {
+		t.Errorf("Expected GetByPath to find file %d, got %d (%v)", f.ID, byPath.ID, err)
+	}
+
+	// Empty values are stored as NULL and read back empty
+	bare := File{FolderID: folderID, Path: "/photos/notes", Filename: "notes"}
+	if err := repo.Insert(&bare); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	var nulls int
+	database.QueryRow(`SELECT (extension IS NULL) + (mediatype IS NULL) + (modified_at IS NULL) + (seen_at IS NULL) + (blurhash IS NULL)
+		FROM files WHERE id = ?`, bare.ID).Scan(&nulls)
+	if nulls != 5 {
+		t.Errorf("Expected empty fields stored as NULL, got %d of 5", nulls)
+	}
+	if got, err := repo.GetByID(bare.ID); err != nil || got.MediaType != "" || !got.ModifiedAt.IsZero() {
+		t.Errorf("Expected an empty file back, got %+v (%v)", got, err)
+	}
+
+	if err := repo.Insert(&File{FolderID: folderID, Path: f.Path, Filename: "again.jpg"}); !errors.Is(err, db.ErrUniqueViolation) {
+		t.Errorf("Expected ErrUniqueViolation for an indexed path, got %v", err)
+	}
+}
+
+func TestRepository_UpdateListDelete(t *testing.T) {
+	database, folderID := openTestDB(t)
+	repo := NewRepository(database)
+
+	for _, path := range []string{"/photos/b.jpg", "/photos/a.jpg"} {
+		if err := repo.Insert(&File{FolderID: folderID, Path: path, Filename: filepath.Base(path), Size: 1}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	list, err := repo.ListByFolder(folderID)
+	if err != nil {
+		t.Fatalf("ListByFolder failed: %v", err)
+	}
+	if len(list) != 2 || list[0].Path != "/photos/a.jpg" {
+		t.Fatalf("Expected both files ordered by path, got %+v", list)
+	}
+
+	a := list[0]
+	a.Size, a.MediaType = 99, "IMG"
+	if err := repo.Update(a); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := repo.SetThumbnails(a.ID, "small.jpg", "large.jpg"); err != nil {
+		t.Fatalf("SetThumbnails failed: %v", err)
+	}
+	got, _ := repo.GetByID(a.ID)
+	if got.Size != 99 || got.MediaType != "IMG" || got.ThumbnailSmallPath != "small.jpg" || got.ThumbnailLargePath != "large.jpg" {
+		t.Errorf("Expected the update and thumbnails, got %+v", got)
+	}
+
+	if err := repo.Delete(a.ID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := repo.GetByID(a.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after Delete, got %v", err)
+	}
+	if err := repo.Delete(a.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound deleting twice, got %v", err)
+	}
+	if err := repo.Update(a); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound updating a deleted file, got %v", err)
+	}
+	if _, err := repo.GetByPath("/photos/missing.jpg"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unindexed path, got %v", err)
+	}
+}
+
+func TestRepository_ListAfter(t *testing.T) {
+	database, folderID := openTestDB(t)
+	repo := NewRepository(database)
+
+	insert := func(n int) {
+		t.Helper()
+		for range n {
+			var count int
+			database.QueryRow("SELECT COUNT(*) FROM files").Scan(&count)
+			path := fmt.Sprintf("/photos/%03d.jpg", count)
+			if err := repo.Insert(&File{FolderID: folderID, Path: path, Filename: filepath.Base(path), Size: 1}); err != nil {
+				t.Fatalf("Insert failed: %v", err)
+			}
+		}
+	}
+	insert(23)
+
+	// Files indexed while paging turn up on a later page
+	seen := make(map[int64]int)
+	var after int64
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatal("Paging did not end")
+		}
+		page, next, err := repo.ListAfter(after, 5, Filter{})
+		if err != nil {
+			t.Fatalf("ListAfter failed: %v", err)
+		}
+		for _, f := range page {
+			seen[f.ID]++
+		}
+		if pages == 1 {
+			insert(4)
+		}
+		if next == 0 {
+			break
+		}
+		after = next
+	}
+
+	var total int
+	database.QueryRow("SELECT COUNT(*) FROM files").Scan(&total)
+	if len(seen) != total {
+		t.Errorf("Expected every one of %d files visited, got %d", total, len(seen))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("File %d visited %d times", id, n)
+		}
+	}
+
+	// A full last page has no next cursor
+	if page, next, _ := repo.ListAfter(0, total, Filter{}); len(page) != total || next != 0 {
+		t.Errorf("Expected all %d files and no next page, got %d and %d", total, len(page), next)
+	}
+
+	database.Write("INSERT INTO tags (name) VALUES ('sunset')")
+	database.Write("INSERT INTO image_tags (file_id, tag_id) VALUES (3, 1), (7, 1)")
+	page, _, err := repo.ListAfter(0, 10, Filter{FolderID: folderID, Tag: "SUNSET"})
+	if err != nil || len(page) != 2 || page[0].ID != 3 || page[1].ID != 7 {
+		t.Errorf("Expected files 3 and 7 tagged sunset, got %+v (%v)", page, err)
+	}
+	if page, _, _ := repo.ListAfter(0, 10, Filter{FolderID: folderID + 1}); len(page) != 0 {
+		t.Errorf("Expected no files in another folder, got %d", len(page))
+	}
+}
+
+func TestRepository_Counts(t *testing.T) {
+	database, folderID := openTestDB(t)
+	repo := NewRepository(database)
+
+	for i, f := range []struct {
+		mediaType string
+		size      int64
+	}{
+		{"IMG", 100}, {"IMG", 200}, {"image", 50},
+		{"VID", 5000},
+		{"AUD", 300}, {"audio", 400},
+		{"", 7},
+	} {
+		path := fmt.Sprintf("/photos/%d", i)
+		if err := repo.Insert(&File{FolderID: folderID, Path: path, Filename: filepath.Base(path), MediaType: f.mediaType, Size: f.size}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	counts, err := repo.Counts()
+	if err != nil {
+		t.Fatalf("Counts failed: %v", err)
+	}
+	want := MediaCounts{Images: 3, Videos: 1, Audio: 2, Unknown: 1, Total: 7, Bytes: 6057}
+	if counts != want {
+		t.Errorf("Expected %+v, got %+v", want, counts)
+	}
+
+	empty, _ := openTestDB(t)
+	if counts, err := NewRepository(empty).Counts(); err != nil || counts != (MediaCounts{}) {
+		t.Errorf("Expected zero counts for an empty library, got %+v (%v)", counts, err)
+	}
+}
+
+func TestRepository_RestoreAndPurge(t *testing.T) {
+	database, folderID := openTestDB(t)
+	repo := NewRepository(database)
+
+	var ids []int64
+	for _, name := range []string{"kept.jpg", "gone.jpg", "recent.jpg"} {
+		f := &File{FolderID: folderID, Path: "/photos/" + name, Filename: name, Size: 1}
+		if err := repo.Insert(f); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		database.Write("INSERT INTO image_metadata (file_id, camera_model) VALUES (?, 'X100')", f.ID)
+		ids = append(ids, f.ID)
+	}
+	now := time.Now()
+	database.Write("UPDATE files SET deleted_at = ? WHERE id = ?", now.Add(-48*time.Hour).Unix(), ids[1])
+	database.Write("UPDATE files SET deleted_at = ? WHERE id = ?", now.Unix(), ids[2])
+
+	if list, _ := repo.ListByFolder(folderID); len(list) != 1 || list[0].ID != ids[0] {
+		t.Errorf("Expected only the file on disk listed, got %+v", list)
+	}
+	if f, err := repo.GetByID(ids[2]); err != nil || f.DeletedAt != now.Unix() {
+		t.Errorf("Expected GetByID to return the deleted file, got %+v (%v)", f, err)
+	}
+
+	purged, err := repo.PurgeDeleted(now.Add(-24 * time.Hour))
+	if err != nil || purged != 1 {
+		t.Fatalf("Expected 1 file purged, got %d (%v)", purged, err)
+	}
+	if _, err := repo.GetByID(ids[1]); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected the old deletion purged, got %v", err)
+	}
+	var metadata int
+	database.QueryRow("SELECT COUNT(*) FROM image_metadata").Scan(&metadata)
+	if metadata != 2 {
+		t.Errorf("Expected the purged file's metadata gone, got %d rows", metadata)
+	}
+
+	if err := repo.Restore(ids[2]); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if list, _ := repo.ListByFolder(folderID); len(list) != 2 {
+		t.Errorf("Expected the restored file listed again, got %d files", len(list))
+	}
+	if err := repo.Restore(ids[1]); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound restoring a purged file, got %v", err)
+	}
+}
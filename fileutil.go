@@ -39,6 +39,14 @@ var imageContentTypes = map[string]string{
 	".ico":  "image/x-icon",
 }
 
+// heifContentTypes maps the HEIC and HEIF extensions, which /api/image also
+// serves (and converts to JPEG for browsers that cannot show them), to their
+// MIME types.
+var heifContentTypes = map[string]string{
+	".heic": "image/heic",
+	".heif": "image/heif",
+}
+
 // isImageFile checks if the file extension is a supported image format.
 func isImageFile(path string) bool {
 	ext := strings.ToLower(filepath.Ext(path))
@@ -0,0 +1,178 @@
+// Package folders records the scan state of monitored folders, checks that
+// they still exist and moves them.
+package folders
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"jukel.org/q2/db"
+)
+
+// MarkScanned records that a scan of the whole folder id completed now.
+// Reports db.ErrNotFound if there is no such folder.
+func MarkScanned(database *db.DB, id int64) error {
+	result := database.Write("UPDATE folders SET last_scanned_at = ? WHERE id = ?", time.Now().UTC(), id)
+	if result.Err != nil {
+		return result.Err
+	}
+	if result.RowsAffected == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// LastScanned returns when a scan of the folder id last completed, or the
+// zero time if none has. Reports db.ErrNotFound if there is no such folder.
+func LastScanned(database *db.DB, id int64) (time.Time, error) {
+	var scanned sql.NullTime
+	if err := database.QueryRow("SELECT last_scanned_at FROM folders WHERE id = ?", id).Scan(&scanned); err != nil {
+		return time.Time{}, db.Classify(err)
+	}
+	return scanned.Time, nil
+}
+
+// NeedsScan reports whether the folder id is stale: it has never been
+// scanned, or its last completed scan is more than maxAge old.
+func NeedsScan(database *db.DB, id int64, maxAge time.Duration) (bool, error) {
+	scanned, err := LastScanned(database, id)
+	if err != nil {
+		return false, err
+	}
+	return scanned.IsZero() || time.Since(scanned) > maxAge, nil
+}
+
+// ErrNotDirectory reports a folder whose path is a file.
+var ErrNotDirectory = errors.New("not a directory")
+
+// Invalid is a stored folder whose path cannot be monitored.
+type Invalid struct {
+	ID   int64
+	Path string
+	Err  error // From os.Stat, e.g. one matching fs.ErrNotExist, or ErrNotDirectory
+}
+
+// Missing reports whether the folder no longer exists on disk.
+func (f Invalid) Missing() bool {
+	return errors.Is(f.Err, fs.ErrNotExist)
+}
+
+// Validate checks that each stored folder is still a directory on disk,
+// returning those that are not, ordered by path. The watcher cannot tell a
+// folder deleted after it was added from an empty one, so this is how to
+// find them.
+func Validate(database *db.DB) ([]Invalid, error) {
+	rows, err := database.Query("SELECT id, path FROM folders ORDER BY path")
+	if err != nil {
+		return nil, err
+	}
+	var stored []Invalid
+	for rows.Next() {
+		var f Invalid
+		if err := rows.Scan(&f.ID, &f.Path); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stored = append(stored, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Stat after reading, so slow disks don't hold the query open
+	var invalid []Invalid
+	for _, f := range stored {
+		info, err := os.Stat(f.Path)
+		switch {
+		case err != nil:
+			f.Err = err
+		case !info.IsDir():
+			f.Err = ErrNotDirectory
+		default:
+			continue
+		}
+		invalid = append(invalid, f)
+	}
+	return invalid, nil
+}
+
+// Relocate moves the stored folder at oldPath to newPath, e.g. after the
+// library was copied to another disk, so it need not be removed and indexed
+// again. In one transaction it rewrites the path of the folder, of every
+// file under it and of sidecar thumbnails and album covers there, keeping
+// metadata, albums and history. Both paths must be normalized as the scanner
+// normalizes them. An interrupted scan of the folder starts over.
+//
+// Reports db.ErrNotFound if no folder is stored at oldPath, ErrNotDirectory
+// if newPath is not a directory, and db.ErrUniqueViolation if it is stored
+// already. Returns the number of files moved.
+func Relocate(database *db.DB, oldPath, newPath string) (int64, error) {
+	info, err := os.Stat(newPath)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return 0, ErrNotDirectory
+	}
+
+	// Child paths start with the folder's path and a separator; the next
+	// byte up bounds them, so the updates can use idx_files_path
+	oldPrefix, newPrefix := withSeparator(oldPath), withSeparator(newPath)
+	end := oldPrefix[:len(oldPrefix)-1] + string(filepath.Separator+1)
+	rest := len([]rune(oldPrefix)) + 1 // SQLite's substr counts characters
+
+	var moved int64
+	err = database.Transaction(func(tx *db.DB) error {
+		var id int64
+		if err := tx.QueryRow("SELECT id FROM folders WHERE path = ?", oldPath).Scan(&id); err != nil {
+			return db.Classify(err)
+		}
+		if err := tx.Write("UPDATE folders SET path = ? WHERE id = ?", newPath, id).Err; err != nil {
+			return err
+		}
+
+		result := tx.Write("UPDATE files SET path = ? || substr(path, ?) WHERE path >= ? AND path < ?",
+			newPrefix, rest, oldPrefix, end)
+		if result.Err != nil {
+			return result.Err
+		}
+		moved = result.RowsAffected
+
+		// Sidecar thumbnails are recorded by absolute path; cached ones are
+		// relative to the data directory and stay put
+		for _, column := range []string{"thumbnail_small_path", "thumbnail_large_path"} {
+			if err := tx.Write("UPDATE files SET "+column+" = ? || substr("+column+", ?) WHERE "+column+" >= ? AND "+column+" < ?",
+				newPrefix, rest, oldPrefix, end).Err; err != nil {
+				return err
+			}
+		}
+		if err := tx.Write("UPDATE albums SET cover_path = ? || substr(cover_path, ?) WHERE cover_path >= ? AND cover_path < ?",
+			newPrefix, rest, oldPrefix, end).Err; err != nil {
+			return err
+		}
+
+		// A queued scan follows the folder; a checkpoint names paths under the old one
+		if err := tx.Write("UPDATE OR REPLACE scan_queue SET path = ? WHERE path = ?", newPath, oldPath).Err; err != nil {
+			return err
+		}
+		return tx.Write("DELETE FROM scan_progress WHERE folder_id = ?", id).Err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
+
+// withSeparator returns path ending in a path separator.
+func withSeparator(path string) string {
+	if strings.HasSuffix(path, string(filepath.Separator)) {
+		return path
+	}
+	return path + string(filepath.Separator)
+}
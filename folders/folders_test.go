@@ -0,0 +1,195 @@
+package folders
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"jukel.org/q2/db"
+	_ "jukel.org/q2/migrations"
+)
+
+func TestNeedsScan(t *testing.T) {
+	database, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+	folder := database.Write("INSERT INTO folders (path) VALUES ('/photos')")
+	if folder.Err != nil {
+		t.Fatalf("Failed to insert folder: %v", folder.Err)
+	}
+	id := folder.LastInsertID
+
+	// Never scanned: stale however long it may be
+	if stale, err := NeedsScan(database, id, 24*time.Hour); err != nil || !stale {
+		t.Errorf("Expected a folder never scanned to need a scan, got %v (%v)", stale, err)
+	}
+
+	if err := MarkScanned(database, id); err != nil {
+		t.Fatalf("MarkScanned failed: %v", err)
+	}
+	scanned, err := LastScanned(database, id)
+	if err != nil || time.Since(scanned) > time.Minute {
+		t.Errorf("Expected the scan recorded as just now, got %v (%v)", scanned, err)
+	}
+	if stale, err := NeedsScan(database, id, time.Hour); err != nil || stale {
+		t.Errorf("Expected a folder just scanned to be fresh, got %v (%v)", stale, err)
+	}
+
+	// A scan from two hours ago is stale after one hour but not after three
+	database.Write("UPDATE folders SET last_scanned_at = ? WHERE id = ?", time.Now().Add(-2*time.Hour).UTC(), id)
+	if stale, _ := NeedsScan(database, id, time.Hour); !stale {
+		t.Error("Expected a scan older than maxAge to be stale")
+	}
+	if stale, _ := NeedsScan(database, id, 3*time.Hour); stale {
+		t.Error("Expected a scan within maxAge to be fresh")
+	}
+
+	if _, err := NeedsScan(database, id+1, time.Hour); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown folder, got %v", err)
+	}
+	if err := MarkScanned(database, id+1); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound marking an unknown folder, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	database, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+
+	dir := t.TempDir()
+	present := filepath.Join(dir, "present")
+	missing := filepath.Join(dir, "missing")
+	file := filepath.Join(dir, "file")
+	if err := os.Mkdir(present, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{present, missing, file} {
+		if err := database.Write("INSERT INTO folders (path) VALUES (?)", path).Err; err != nil {
+			t.Fatalf("Failed to insert folder: %v", err)
+		}
+	}
+
+	invalid, err := Validate(database)
+	if err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if len(invalid) != 2 {
+		t.Fatalf("Expected 2 invalid folders, got %v", invalid)
+	}
+	if invalid[0].Path != file || !errors.Is(invalid[0].Err, ErrNotDirectory) || invalid[0].Missing() {
+		t.Errorf("Expected %s reported as not a directory, got %+v", file, invalid[0])
+	}
+	if invalid[1].Path != missing || !invalid[1].Missing() {
+		t.Errorf("Expected %s reported missing, got %+v", missing, invalid[1])
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	database, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+
+	disk := t.TempDir()
+	oldPath, newPath := filepath.Join(disk, "photos"), filepath.Join(disk, "moved")
+	sibling := filepath.Join(disk, "photos2") // Shares oldPath as a string prefix
+	if err := os.Mkdir(newPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	folder := database.Write("INSERT INTO folders (path) VALUES (?)", oldPath)
+	other := database.Write("INSERT INTO folders (path) VALUES (?)", sibling)
+	if folder.Err != nil || other.Err != nil {
+		t.Fatalf("Failed to insert folders: %v, %v", folder.Err, other.Err)
+	}
+
+	sidecar := filepath.Join(oldPath, "2024", ".q2thumbs", "b.jpg_300.jpg")
+	paths := map[string]string{
+		filepath.Join(oldPath, "a.jpg"):                 filepath.Join(newPath, "a.jpg"),
+		filepath.Join(oldPath, "2024", "b.jpg"):         filepath.Join(newPath, "2024", "b.jpg"),
+		filepath.Join(oldPath, "2024", "trip", "c.mp4"): filepath.Join(newPath, "2024", "trip", "c.mp4"),
+		filepath.Join(sibling, "d.jpg"):                 filepath.Join(sibling, "d.jpg"),
+	}
+	for path := range paths {
+		folderID := folder.LastInsertID
+		if filepath.Dir(path) == sibling {
+			folderID = other.LastInsertID
+		}
+		if err := database.Write("INSERT INTO files (folder_id, path, filename, size, thumbnail_small_path, thumbnail_large_path) VALUES (?, ?, ?, 1, ?, 'thumbnails/ab/cd.jpg')",
+			folderID, path, filepath.Base(path), sidecar).Err; err != nil {
+			t.Fatalf("Failed to insert file: %v", err)
+		}
+	}
+	if err := database.Write("INSERT INTO albums (name, cover_path) VALUES ('Trip', ?)", filepath.Join(oldPath, "a.jpg")).Err; err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := Relocate(database, oldPath, newPath)
+	if err != nil || moved != 3 {
+		t.Fatalf("Expected 3 files moved, got %d (%v)", moved, err)
+	}
+	var stored string
+	database.QueryRow("SELECT path FROM folders WHERE id = ?", folder.LastInsertID).Scan(&stored)
+	if stored != newPath {
+		t.Errorf("Expected the folder at %s, got %s", newPath, stored)
+	}
+	for before, after := range paths {
+		var small, large string
+		err := database.QueryRow("SELECT thumbnail_small_path, thumbnail_large_path FROM files WHERE path = ?", after).Scan(&small, &large)
+		if err != nil {
+			t.Errorf("Expected %s at %s: %v", before, after, err)
+			continue
+		}
+		if large != "thumbnails/ab/cd.jpg" {
+			t.Errorf("Expected the cached thumbnail of %s kept, got %s", after, large)
+		}
+	}
+	var small, cover string
+	database.QueryRow("SELECT thumbnail_small_path FROM files WHERE path = ?", filepath.Join(newPath, "a.jpg")).Scan(&small)
+	database.QueryRow("SELECT cover_path FROM albums").Scan(&cover)
+	if want := filepath.Join(newPath, "2024", ".q2thumbs", "b.jpg_300.jpg"); small != want {
+		t.Errorf("Expected the sidecar thumbnail moved to %s, got %s", want, small)
+	}
+	if cover != filepath.Join(newPath, "a.jpg") {
+		t.Errorf("Expected the album cover moved, got %s", cover)
+	}
+
+	// Nothing is left half-moved when the move fails
+	if _, err := Relocate(database, oldPath, newPath); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a folder no longer stored, got %v", err)
+	}
+	if _, err := Relocate(database, newPath, filepath.Join(disk, "absent")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected a missing destination rejected, got %v", err)
+	}
+	if err := os.Mkdir(sibling, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Relocate(database, newPath, sibling); !errors.Is(err, db.ErrUniqueViolation) {
+		t.Errorf("Expected ErrUniqueViolation moving onto a stored folder, got %v", err)
+	}
+	var count int
+	database.QueryRow("SELECT COUNT(*) FROM files WHERE path >= ? AND path < ?", newPath+string(filepath.Separator), newPath+string(filepath.Separator+1)).Scan(&count)
+	if count != 3 {
+		t.Errorf("Expected a failed move to leave the files in place, got %d", count)
+	}
+}
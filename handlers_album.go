@@ -19,7 +19,8 @@ func makeAlbumsHandler(database *db.DB) http.HandlerFunc {
 
 		rows, err := database.Query(`
 			SELECT a.id, a.name, a.cover_path, a.created_at, a.updated_at,
-			       (SELECT COUNT(*) FROM album_items WHERE album_id = a.id) as item_count
+			       (SELECT COUNT(*) FROM album_items ai JOIN files f ON f.id = ai.file_id
+			        WHERE ai.album_id = a.id AND f.deleted_at IS NULL) as item_count
 			FROM albums a
 			ORDER BY a.name
 		`)
@@ -78,7 +79,8 @@ func makeAlbumHandler(database *db.DB) http.HandlerFunc {
 			var coverPath, createdAt, updatedAt *string
 			row := database.QueryRow(`
 				SELECT a.id, a.name, a.cover_path, a.created_at, a.updated_at,
-				       (SELECT COUNT(*) FROM album_items WHERE album_id = a.id) as item_count
+				       (SELECT COUNT(*) FROM album_items ai JOIN files f ON f.id = ai.file_id
+				        WHERE ai.album_id = a.id AND f.deleted_at IS NULL) as item_count
 				FROM albums a WHERE a.id = ?`, id)
 			if err := row.Scan(&album.ID, &album.Name, &coverPath, &createdAt, &updatedAt, &album.ItemCount); err != nil {
 				writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "album not found"})
@@ -97,10 +99,10 @@ func makeAlbumHandler(database *db.DB) http.HandlerFunc {
 			// Get album items
 			rows, err := database.Query(`
 				SELECT ai.id, ai.file_id, ai.position, f.path, f.filename,
-				       f.thumbnail_small_path, f.thumbnail_large_path
+				       f.thumbnail_small_path, f.thumbnail_large_path, COALESCE(f.blurhash, '')
 				FROM album_items ai
 				JOIN files f ON ai.file_id = f.id
-				WHERE ai.album_id = ?
+				WHERE ai.album_id = ? AND f.deleted_at IS NULL
 				ORDER BY ai.position`, id)
 			if err != nil {
 				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to query album items"})
@@ -112,7 +114,7 @@ func makeAlbumHandler(database *db.DB) http.HandlerFunc {
 			for rows.Next() {
 				var item AlbumItem
 				var thumbSmall, thumbLarge *string
-				if err := rows.Scan(&item.ID, &item.FileID, &item.Position, &item.Path, &item.Filename, &thumbSmall, &thumbLarge); err != nil {
+				if err := rows.Scan(&item.ID, &item.FileID, &item.Position, &item.Path, &item.Filename, &thumbSmall, &thumbLarge, &item.BlurHash); err != nil {
 					continue
 				}
 				if thumbSmall != nil && *thumbSmall != "" {
@@ -363,7 +365,8 @@ func makeAlbumCheckHandler(database *db.DB) http.HandlerFunc {
 			// File not in database - just return all albums with contains=false
 			rows, err := database.Query(`
 				SELECT a.id, a.name, a.cover_path,
-				       (SELECT COUNT(*) FROM album_items WHERE album_id = a.id) as item_count
+				       (SELECT COUNT(*) FROM album_items ai JOIN files f ON f.id = ai.file_id
+				        WHERE ai.album_id = a.id AND f.deleted_at IS NULL) as item_count
 				FROM albums a ORDER BY a.name
 			`)
 			if err != nil {
@@ -395,7 +398,8 @@ func makeAlbumCheckHandler(database *db.DB) http.HandlerFunc {
 		// Get all albums with contains flag
 		rows, err := database.Query(`
 			SELECT a.id, a.name, a.cover_path,
-			       (SELECT COUNT(*) FROM album_items WHERE album_id = a.id) as item_count,
+			       (SELECT COUNT(*) FROM album_items ai JOIN files f ON f.id = ai.file_id
+			        WHERE ai.album_id = a.id AND f.deleted_at IS NULL) as item_count,
 			       EXISTS(SELECT 1 FROM album_items WHERE album_id = a.id AND file_id = ?) as contains
 			FROM albums a ORDER BY a.name
 		`, fileID)
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"cmp"
+	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"jukel.org/q2/db"
@@ -130,7 +134,16 @@ func makeStreamHandler(database *db.DB) http.HandlerFunc {
 }
 
 // makeImageHandler creates a handler for /api/image that serves image files.
-func makeImageHandler(database *db.DB) http.HandlerFunc {
+// With w, a thumbnail fitting w pixels is served instead, made on first
+// request at the nearest of media.ThumbnailSizes. With upright, an image
+// whose EXIF Orientation turns it is served as a JPEG copy already turned,
+// without EXIF, so every browser shows it the same way. With convert=jpeg, a
+// HEIC or HEIF image is served as a full-size upright JPEG, converted on
+// first request and cached by content hash (501 if ffmpeg cannot decode it);
+// JPEGs are served as they are.
+// Query params: path, w (optional), upright (optional, true or false),
+// convert (optional, jpeg)
+func makeImageHandler(database *db.DB, q2Dir string, ffmpegMgr *ffmpeg.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
@@ -178,14 +191,69 @@ func makeImageHandler(database *db.DB) http.HandlerFunc {
 			return
 		}
 
-		if !isImageFile(path) {
+		if !isImageFile(path) && !media.IsHEIF(path) {
 			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "not an image file"})
 			return
 		}
 
+		if param := r.URL.Query().Get("w"); param != "" {
+			width, err := strconv.Atoi(param)
+			if err != nil || width <= 0 {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "w must be a positive number of pixels"})
+				return
+			}
+			serveImageThumbnail(w, r, path, media.NearestThumbnailSize(width), thumbnailStore(database, q2Dir), ffmpegMgr)
+			return
+		}
+
+		if convert := r.URL.Query().Get("convert"); convert != "" {
+			if convert != "jpeg" {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "convert must be jpeg"})
+				return
+			}
+			if media.IsHEIF(path) {
+				rel, err := media.ConvertToJPEG(r.Context(), path, indexedXXHash(database, path), q2Dir, imageOrientation(database, path), ffmpegMgr)
+				if errors.Is(err, media.ErrHEIFUnsupported) {
+					writeJSON(w, http.StatusNotImplemented, ErrorResponse{Error: "this ffmpeg build cannot decode HEIC/HEIF images"})
+					return
+				} else if err != nil {
+					writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to convert image"})
+					return
+				}
+				path = filepath.Join(q2Dir, rel)
+				if info, err = os.Stat(path); err != nil {
+					writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "cannot access file"})
+					return
+				}
+			} else if ext := strings.ToLower(filepath.Ext(path)); ext != ".jpg" && ext != ".jpeg" {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "only HEIC and HEIF images can be converted"})
+				return
+			}
+		}
+
+		if param := r.URL.Query().Get("upright"); param != "" {
+			upright, err := strconv.ParseBool(param)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "upright must be true or false"})
+				return
+			}
+			if orientation := imageOrientation(database, path); upright && orientation != 1 {
+				rel, err := media.GenerateUprightImage(r.Context(), path, q2Dir, orientation, ffmpegMgr)
+				if err != nil {
+					writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to rotate image"})
+					return
+				}
+				path = filepath.Join(q2Dir, rel)
+				if info, err = os.Stat(path); err != nil {
+					writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "cannot access file"})
+					return
+				}
+			}
+		}
+
 		// Get content type
 		ext := strings.ToLower(filepath.Ext(path))
-		contentType := imageContentTypes[ext]
+		contentType := cmp.Or(imageContentTypes[ext], heifContentTypes[ext])
 
 		// Open the file
 		file, err := os.Open(path)
@@ -205,9 +273,71 @@ func makeImageHandler(database *db.DB) http.HandlerFunc {
 	}
 }
 
+// indexedXXHash returns the content hash stored for the indexed file at
+// path, or "" if it is not indexed or not hashed yet.
+func indexedXXHash(database *db.DB, path string) string {
+	var hash sql.NullString
+	database.QueryRow("SELECT xxhash FROM files WHERE path = ?", normalizePath(path)).Scan(&hash)
+	return hash.String
+}
+
+// imageOrientation returns the EXIF Orientation of the image at path: as
+// indexed, or read from the file if it has not been. Images without the
+// tag are upright (1).
+func imageOrientation(database *db.DB, path string) int {
+	var orientation sql.NullInt64
+	err := database.QueryRow(`
+		SELECT m.orientation FROM image_metadata m JOIN files f ON f.id = m.file_id
+		WHERE f.path = ?`, normalizePath(path)).Scan(&orientation)
+	if err == nil {
+		return cmp.Or(int(orientation.Int64), 1)
+	}
+	if meta, err := media.ExtractEXIF(path); err == nil && meta.Orientation != nil {
+		return *meta.Orientation
+	}
+	return 1
+}
+
+// serveImageThumbnail serves the fit thumbnail of the image at path at size,
+// generating it if it is missing or older than the image.
+func serveImageThumbnail(w http.ResponseWriter, r *http.Request, path string, size int, store media.ThumbnailStore, ffmpegMgr *ffmpeg.Manager) {
+	paths, err := media.GenerateThumbnailSizes(r.Context(), path, store, []int{size}, ffmpegMgr)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to generate thumbnail"})
+		return
+	}
+	thumbFullPath := store.FullPath(paths[size])
+
+	file, err := os.Open(thumbFullPath)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "cannot open thumbnail"})
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "cannot access thumbnail"})
+		return
+	}
+
+	w.Header().Set("Content-Type", thumbnailContentTypes[strings.ToLower(filepath.Ext(thumbFullPath))])
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	http.ServeContent(w, r, filepath.Base(thumbFullPath), info.ModTime(), file)
+}
+
+// thumbnailContentTypes maps the extensions of the thumbnail formats to their MIME types.
+var thumbnailContentTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".webp": "image/webp",
+	".avif": "image/avif",
+}
+
 // makeThumbnailHandler creates a handler for /api/thumbnail that serves image thumbnails.
-// Query params: path (original image path), size (small or large)
-func makeThumbnailHandler(database *db.DB, q2Dir string) http.HandlerFunc {
+// A thumbnail recorded in the database but missing from the cache is regenerated.
+// Cropped thumbnails of files that have thumbnails are made on first request.
+// Query params: path (original image path), size (small or large),
+// mode (fit or crop; defaults to the thumbnail_mode setting)
+func makeThumbnailHandler(database *db.DB, q2Dir string, ffmpegMgr *ffmpeg.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
@@ -248,11 +378,36 @@ func makeThumbnailHandler(database *db.DB, q2Dir string) http.HandlerFunc {
 			size = media.SmallThumbnailSize
 		}
 
-		// Get the thumbnail path
-		thumbRelPath := media.GetThumbnailPath(originalPath, size)
-		thumbFullPath := filepath.Join(q2Dir, thumbRelPath)
+		mode := thumbnailMode(database)
+		if param := r.URL.Query().Get("mode"); param != "" {
+			if mode, err = media.ParseThumbnailMode(param); err != nil {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+				return
+			}
+		}
+
+		// Find the thumbnail wherever the store keeps it
+		store := thumbnailStore(database, q2Dir)
+		recorded, found := store.Find(originalPath, size)
+		if !found {
+			if restored, restoreErr := restoreThumbnails(r.Context(), database, q2Dir, ffmpegMgr, originalPath); restored && restoreErr == nil {
+				recorded, found = store.Find(originalPath, size)
+			}
+		}
+
+		// Other modes sit beside the fit thumbnail, and are only made for files
+		// that have one; album art, nearly always square already, is served as is
+		if found && mode != media.ThumbnailModeFit && !isAudioFile(originalPath) {
+			recorded = media.ThumbnailModePath(recorded, mode)
+			if _, err := os.Stat(store.FullPath(recorded)); err != nil {
+				if recorded, err = generateModeThumbnail(r.Context(), originalPath, store, size, mode, ffmpegMgr); err != nil {
+					writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to generate thumbnail"})
+					return
+				}
+			}
+		}
+		thumbFullPath := store.FullPath(recorded)
 
-		// Check if thumbnail exists
 		info, err := os.Stat(thumbFullPath)
 		if err != nil {
 			if os.IsNotExist(err) {
@@ -270,14 +425,31 @@ func makeThumbnailHandler(database *db.DB, q2Dir string) http.HandlerFunc {
 		}
 		defer file.Close()
 
-		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Type", thumbnailContentTypes[strings.ToLower(filepath.Ext(thumbFullPath))])
 		w.Header().Set("Cache-Control", "public, max-age=31536000") // Cache for 1 year
 		http.ServeContent(w, r, filepath.Base(thumbFullPath), info.ModTime(), file)
 	}
 }
 
+// compatibleAudioCodecs returns the audio codecs chosen by the
+// compatible_audio_codecs setting, or nil (the ffmpeg defaults) if it is
+// unset or invalid.
+func compatibleAudioCodecs(database *db.DB) []string {
+	var setting string
+	database.QueryRow("SELECT value FROM settings WHERE key = 'compatible_audio_codecs'").Scan(&setting)
+	codecs, err := ffmpeg.ParseCodecList(setting)
+	if err != nil {
+		return nil
+	}
+	return codecs
+}
+
 // makeVideoHandler creates a handler for /api/video that serves video files.
-// Supports Range requests for seeking. Automatically transcodes incompatible audio codecs.
+// Supports Range requests for seeking. Automatically transcodes audio codecs
+// the playback target cannot play: those named by codecs (e.g. codecs=aac,mp3
+// for a picky cast device), else by the compatible_audio_codecs setting.
+// Video codecs and containers browsers cannot play are transcoded or remuxed
+// too (ffmpeg.PlanTranscode).
 func makeVideoHandler(database *db.DB, ffmpegMgr *ffmpeg.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Handle CORS preflight for Chromecast
@@ -300,6 +472,16 @@ func makeVideoHandler(database *db.DB, ffmpegMgr *ffmpeg.Manager) http.HandlerFu
 			return
 		}
 
+		var compatible []string
+		if param := r.URL.Query().Get("codecs"); param != "" {
+			codecs, err := ffmpeg.ParseCodecList(param)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+				return
+			}
+			compatible = codecs
+		}
+
 		path, ok := cleanPath(path)
 		if !ok {
 			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid path"})
@@ -338,16 +520,19 @@ func makeVideoHandler(database *db.DB, ffmpegMgr *ffmpeg.Manager) http.HandlerFu
 
 		// Check if transcoding is needed
 		ctx := r.Context()
-		needsTranscode := false
+		var plan ffmpeg.TranscodePlan
 		if ffmpegMgr != nil {
+			if compatible == nil {
+				compatible = compatibleAudioCodecs(database)
+			}
 			probe, err := ffmpegMgr.Probe(ctx, path)
 			if err != nil {
 				fmt.Printf("[video] Probe error (will serve directly): %v\n", err)
-			} else if probe.NeedsTranscoding() {
-				fmt.Printf("[video] Audio codec %q needs transcoding\n", probe.GetAudioCodec())
-				needsTranscode = true
+			} else if plan = probe.PlanTranscode(compatible); plan.Needed() {
+				fmt.Printf("[video] Transcoding (audio %q: %v, video %q: %v) into %s\n", probe.GetAudioCodec(), plan.TranscodeAudio,
+					probe.GetVideoCodec(), plan.TranscodeVideo, plan.Container)
 			} else {
-				fmt.Printf("[video] Audio codec %q is browser-compatible\n", probe.GetAudioCodec())
+				fmt.Printf("[video] Audio codec %q and video codec %q are browser-compatible\n", probe.GetAudioCodec(), probe.GetVideoCodec())
 			}
 		}
 
@@ -355,13 +540,13 @@ func makeVideoHandler(database *db.DB, ffmpegMgr *ffmpeg.Manager) http.HandlerFu
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range")
 
-		if needsTranscode {
-			// Transcode audio on the fly
+		if plan.Needed() {
+			// Transcode on the fly
 			w.Header().Set("Content-Type", "video/mp4")
 			// Cannot use Range requests with transcoding
 			w.Header().Set("Accept-Ranges", "none")
 
-			reader, err := ffmpegMgr.TranscodeAudio(ctx, path)
+			reader, err := ffmpegMgr.TranscodeVideo(ctx, path, plan)
 			if err != nil {
 				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "transcoding failed: " + err.Error()})
 				return
@@ -472,3 +657,26 @@ func makeBrowseHandler(database *db.DB, q2Dir string) http.HandlerFunc {
 	}
 }
 
+// makeTimelineHandler creates a handler for GET /api/timeline, which counts
+// photos per year, month or day taken, newest first.
+// Query params: granularity (year, month or day; defaults to month)
+func makeTimelineHandler(database *db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		granularity := cmp.Or(strings.ToLower(strings.TrimSpace(r.URL.Query().Get("granularity"))), media.TimelineMonth)
+		periods, err := media.Timeline(database, granularity)
+		if errors.Is(err, media.ErrInvalidGranularity) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"granularity": granularity, "periods": periods})
+	}
+}
@@ -2,16 +2,48 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"jukel.org/q2/cast"
 )
 
+// Discovery timeouts for /api/cast/devices.
+const (
+	defaultCastDiscoveryTimeout = 10 * time.Second
+	maxCastDiscoveryTimeout     = 30 * time.Second
+)
+
+// parseDiscoveryTimeout parses a ?timeout= value, a duration such as "3s" or
+// a number of seconds, capped at maxCastDiscoveryTimeout. Empty gives the default.
+func parseDiscoveryTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultCastDiscoveryTimeout, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		secs, convErr := strconv.ParseFloat(s, 64)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid timeout %q", s)
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timeout must be positive")
+	}
+	return min(d, maxCastDiscoveryTimeout), nil
+}
+
 // makeCastDevicesHandler creates a handler for /api/cast/devices.
 // Supports ?type=audio to filter for audio-only devices, ?type=video for video devices.
+// Devices are served from the manager's cache while fresh; ?refresh=1 forces a new search,
+// which lasts ?timeout= (default 10s, at most 30s).
 func makeCastDevicesHandler(castMgr *cast.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -19,9 +51,18 @@ func makeCastDevicesHandler(castMgr *cast.Manager) http.HandlerFunc {
 			return
 		}
 
-		// Discover devices (10 second timeout for better discovery)
+		timeout, err := parseDiscoveryTimeout(r.URL.Query().Get("timeout"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+
 		ctx := r.Context()
-		allDevices, err := castMgr.DiscoverDevices(ctx, 10*time.Second)
+		discover := castMgr.DiscoverDevices
+		if refresh := r.URL.Query().Get("refresh"); refresh == "1" || refresh == "true" {
+			discover = castMgr.RefreshDevices
+		}
+		allDevices, err := discover(ctx, timeout)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
 			return
@@ -51,7 +92,9 @@ func makeCastDevicesHandler(castMgr *cast.Manager) http.HandlerFunc {
 	}
 }
 
-// makeCastConnectHandler creates a handler for /api/cast/connect.
+// makeCastConnectHandler creates a handler for /api/cast/connect, which
+// connects to a device by "uuid" or, failing that, by friendly "name".
+// Devices are discovered first if none are known yet.
 func makeCastConnectHandler(castMgr *cast.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -65,12 +108,32 @@ func makeCastConnectHandler(castMgr *cast.Manager) http.HandlerFunc {
 			return
 		}
 
-		if req.UUID == "" {
-			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "uuid required"})
+		if req.UUID == "" && strings.TrimSpace(req.Name) == "" {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "uuid or name required"})
 			return
 		}
 
-		if err := castMgr.Connect(req.UUID); err != nil {
+		if len(castMgr.GetDevices()) == 0 {
+			if _, err := castMgr.DiscoverDevices(r.Context(), defaultCastDiscoveryTimeout); err != nil {
+				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+				return
+			}
+		}
+
+		var err error
+		if req.UUID != "" {
+			err = castMgr.Connect(req.UUID)
+		} else {
+			err = castMgr.ConnectByName(req.Name)
+		}
+		switch {
+		case errors.Is(err, cast.ErrDeviceNotFound):
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: err.Error()})
+			return
+		case errors.Is(err, cast.ErrAmbiguousDevice):
+			writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
+			return
+		case err != nil:
 			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
 			return
 		}
@@ -101,8 +164,31 @@ func makeCastDisconnectHandler(castMgr *cast.Manager) http.HandlerFunc {
 	}
 }
 
+// castPlayer is the part of cast.Manager the playback control handlers use,
+// so they can be tested without a device.
+type castPlayer interface {
+	PlayMedia(filePath, contentType, title string) (string, error)
+	Pause() error
+	Resume() error
+	Stop() error
+	Seek(position float64) error
+	SetVolume(level float64) error
+	SetMuted(muted bool) error
+	GetStatus() cast.Status
+}
+
+// writeCastError reports a failed playback command: 409 when no device is
+// connected, 500 otherwise.
+func writeCastError(w http.ResponseWriter, err error) {
+	if errors.Is(err, cast.ErrNotConnected) {
+		writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+}
+
 // makeCastPlayHandler creates a handler for /api/cast/play.
-func makeCastPlayHandler(castMgr *cast.Manager) http.HandlerFunc {
+func makeCastPlayHandler(castMgr castPlayer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
@@ -134,7 +220,7 @@ func makeCastPlayHandler(castMgr *cast.Manager) http.HandlerFunc {
 
 		mediaURL, err := castMgr.PlayMedia(req.Path, req.ContentType, req.Title)
 		if err != nil {
-			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			writeCastError(w, err)
 			return
 		}
 
@@ -145,16 +231,17 @@ func makeCastPlayHandler(castMgr *cast.Manager) http.HandlerFunc {
 	}
 }
 
-// makeCastPauseHandler creates a handler for /api/cast/pause.
-func makeCastPauseHandler(castMgr *cast.Manager) http.HandlerFunc {
+// makeCastCommandHandler creates a handler that runs a playback command
+// taking no arguments, for /api/cast/pause, /api/cast/resume and /api/cast/stop.
+func makeCastCommandHandler(command func() error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
 			return
 		}
 
-		if err := castMgr.Pause(); err != nil {
-			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		if err := command(); err != nil {
+			writeCastError(w, err)
 			return
 		}
 
@@ -164,46 +251,33 @@ func makeCastPauseHandler(castMgr *cast.Manager) http.HandlerFunc {
 	}
 }
 
-// makeCastResumeHandler creates a handler for /api/cast/resume.
-func makeCastResumeHandler(castMgr *cast.Manager) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
-			return
-		}
-
-		if err := castMgr.Resume(); err != nil {
-			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
-			return
-		}
+// makeCastPauseHandler creates a handler for /api/cast/pause.
+func makeCastPauseHandler(castMgr castPlayer) http.HandlerFunc {
+	return makeCastCommandHandler(castMgr.Pause)
+}
 
-		writeJSON(w, http.StatusOK, map[string]interface{}{
-			"success": true,
-		})
-	}
+// makeCastResumeHandler creates a handler for /api/cast/resume.
+func makeCastResumeHandler(castMgr castPlayer) http.HandlerFunc {
+	return makeCastCommandHandler(castMgr.Resume)
 }
 
 // makeCastStopHandler creates a handler for /api/cast/stop.
-func makeCastStopHandler(castMgr *cast.Manager) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
-			return
-		}
-
-		if err := castMgr.Stop(); err != nil {
-			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
-			return
-		}
+func makeCastStopHandler(castMgr castPlayer) http.HandlerFunc {
+	return makeCastCommandHandler(castMgr.Stop)
+}
 
-		writeJSON(w, http.StatusOK, map[string]interface{}{
-			"success": true,
-		})
+// parseCastFloat parses a finite number from a query parameter.
+func parseCastFloat(name, s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
 	}
+	return v, nil
 }
 
-// makeCastSeekHandler creates a handler for /api/cast/seek.
-func makeCastSeekHandler(castMgr *cast.Manager) http.HandlerFunc {
+// makeCastSeekHandler creates a handler for /api/cast/seek, which seeks to
+// ?pos= seconds or, without it, the body's "position".
+func makeCastSeekHandler(castMgr castPlayer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
@@ -211,13 +285,24 @@ func makeCastSeekHandler(castMgr *cast.Manager) http.HandlerFunc {
 		}
 
 		var req CastSeekRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if pos := r.URL.Query().Get("pos"); pos != "" {
+			var err error
+			if req.Position, err = parseCastFloat("pos", pos); err != nil {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+				return
+			}
+		} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
 			return
 		}
 
+		if req.Position < 0 {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "position must not be negative"})
+			return
+		}
+
 		if err := castMgr.Seek(req.Position); err != nil {
-			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			writeCastError(w, err)
 			return
 		}
 
@@ -227,8 +312,10 @@ func makeCastSeekHandler(castMgr *cast.Manager) http.HandlerFunc {
 	}
 }
 
-// makeCastVolumeHandler creates a handler for /api/cast/volume.
-func makeCastVolumeHandler(castMgr *cast.Manager) http.HandlerFunc {
+// makeCastVolumeHandler creates a handler for /api/cast/volume, which sets
+// the volume to ?level= or the body's "level", from 0 to 1, and mutes or
+// unmutes with the body's "muted".
+func makeCastVolumeHandler(castMgr castPlayer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
@@ -236,19 +323,37 @@ func makeCastVolumeHandler(castMgr *cast.Manager) http.HandlerFunc {
 		}
 
 		var req CastVolumeRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if level := r.URL.Query().Get("level"); level != "" {
+			v, err := parseCastFloat("level", level)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+				return
+			}
+			req.Level = &v
+		} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
 			return
 		}
 
-		if err := castMgr.SetVolume(req.Level); err != nil {
-			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		if req.Level == nil && req.Muted == nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "level or muted required"})
+			return
+		}
+		if req.Level != nil && (*req.Level < 0 || *req.Level > 1) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "level must be between 0 and 1"})
 			return
 		}
 
+		if req.Level != nil {
+			if err := castMgr.SetVolume(*req.Level); err != nil {
+				writeCastError(w, err)
+				return
+			}
+		}
+
 		if req.Muted != nil {
 			if err := castMgr.SetMuted(*req.Muted); err != nil {
-				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+				writeCastError(w, err)
 				return
 			}
 		}
@@ -260,7 +365,7 @@ func makeCastVolumeHandler(castMgr *cast.Manager) http.HandlerFunc {
 }
 
 // makeCastStatusHandler creates a handler for /api/cast/status.
-func makeCastStatusHandler(castMgr *cast.Manager) http.HandlerFunc {
+func makeCastStatusHandler(castMgr castPlayer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
@@ -270,4 +375,3 @@ func makeCastStatusHandler(castMgr *cast.Manager) http.HandlerFunc {
 		writeJSON(w, http.StatusOK, castMgr.GetStatus())
 	}
 }
-
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"jukel.org/q2/db"
+)
+
+// maxZipFiles is the most files one /api/download/zip request may archive.
+const maxZipFiles = 10000
+
+// zipEntry is a file to archive and its name inside the archive.
+type zipEntry struct {
+	path string
+	name string
+	info os.FileInfo
+}
+
+// parseDownloadZipRequest reads the file IDs and archive name from a JSON
+// body, or from a form (ids given repeatedly or comma-separated), so a plain
+// HTML form can trigger the download.
+func parseDownloadZipRequest(r *http.Request) (DownloadZipRequest, error) {
+	var req DownloadZipRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, fmt.Errorf("invalid JSON")
+		}
+		return req, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return req, fmt.Errorf("invalid form")
+	}
+	req.Name = r.PostForm.Get("name")
+	for _, value := range r.PostForm["ids"] {
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return req, fmt.Errorf("invalid file id %q", s)
+			}
+			req.IDs = append(req.IDs, id)
+		}
+	}
+	return req, nil
+}
+
+// zipArchiveName returns a safe download name for the archive, ending in .zip.
+func zipArchiveName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" || strings.Trim(name, ".") == "" {
+		name = "q2-download"
+	}
+	if !strings.EqualFold(filepath.Ext(name), ".zip") {
+		name += ".zip"
+	}
+	return name
+}
+
+// zipEntryNames names each entry after its file, numbering repeated names
+// ("photo.jpg", "photo (2).jpg") as a file manager would.
+func zipEntryNames(entries []zipEntry) {
+	used := make(map[string]bool, len(entries))
+	for i := range entries {
+		base := filepath.Base(entries[i].path)
+		name := base
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			name = numberedName(base, n)
+		}
+		used[strings.ToLower(name)] = true
+		entries[i].name = name
+	}
+}
+
+// lookupZipEntries returns the files with the given IDs, in order and
+// without repeats, checking that each is indexed, inside a monitored folder,
+// and still on disk. The returned status and message describe the first problem.
+func lookupZipEntries(database *db.DB, ids []int64) ([]zipEntry, int, string) {
+	roots, err := getMonitoredFolders(database)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "database error"
+	}
+
+	var entries []zipEntry
+	seen := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		var path string
+		err := db.Classify(database.QueryRow("SELECT path FROM files WHERE id = ?", id).Scan(&path))
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, http.StatusNotFound, fmt.Sprintf("file %d not found", id)
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, "database error"
+		}
+		if isPathWithinRoots(path, roots) == "" {
+			return nil, http.StatusForbidden, fmt.Sprintf("file %d is not within monitored folders", id)
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			return nil, http.StatusNotFound, fmt.Sprintf("file %d is missing from disk", id)
+		}
+		entries = append(entries, zipEntry{path: path, info: info})
+	}
+	return entries, http.StatusOK, ""
+}
+
+// makeDownloadZipHandler creates a handler for POST /api/download/zip, which
+// streams the requested files to the client as a ZIP archive. Entries are
+// written straight to the response as they are read, so nothing is buffered
+// or staged on disk however large the archive; media is stored as is, since
+// it is already compressed. A client that disconnects ends the download.
+func makeDownloadZipHandler(database *db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		req, err := parseDownloadZipRequest(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if len(req.IDs) == 0 {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "ids are required"})
+			return
+		}
+		if len(req.IDs) > maxZipFiles {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("at most %d files can be downloaded at once", maxZipFiles)})
+			return
+		}
+
+		entries, status, msg := lookupZipEntries(database, req.IDs)
+		if status != http.StatusOK {
+			writeJSON(w, status, ErrorResponse{Error: msg})
+			return
+		}
+		zipEntryNames(entries)
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": zipArchiveName(req.Name)}))
+
+		// Headers are sent from here on, so failures can only cut the archive short
+		zw := zip.NewWriter(w)
+		for _, e := range entries {
+			if r.Context().Err() != nil {
+				return // Client went away
+			}
+			if err := writeZipEntry(zw, e); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: zip download stopped at %s: %v\n", e.path, err)
+				return
+			}
+		}
+		zw.Close()
+	}
+}
+
+// writeZipEntry copies one file into the archive.
+func writeZipEntry(zw *zip.Writer, e zipEntry) error {
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: e.info.ModTime()}
+	if isImageFile(e.path) || isVideoFile(e.path) || isAudioFile(e.path) {
+		header.Method = zip.Store
+	}
+	header.SetMode(e.info.Mode())
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, f)
+	return err
+}
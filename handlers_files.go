@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/files"
+)
+
+// Page sizes of GET /api/files.
+const (
+	defaultFilesLimit = 100
+	maxFilesLimit     = 1000
+)
+
+// FilesResponse is the body of GET /api/files: a page of the indexed files
+// matching its filter.
+type FilesResponse struct {
+	Tag   string     `json:"tag,omitempty"`
+	Files []TreeFile `json:"files"`
+	Next  string     `json:"next,omitempty"` // Pass as after for the next page; empty on the last
+}
+
+// treeFile converts an indexed file to its API form.
+func treeFile(f files.File) TreeFile {
+	t := TreeFile{ID: f.ID, Name: f.Filename, Path: f.Path, MediaType: f.MediaType, Size: f.Size, BlurHash: f.BlurHash}
+	if mediaType, ok := treeMediaTypes[t.MediaType]; ok {
+		t.MediaType = mediaType
+	}
+	return t
+}
+
+// makeFilesHandler creates a handler for GET /api/files, which pages
+// through the indexed files matching a filter, in the order they were
+// indexed. Pages are keyed by cursor (see files.Repository.ListAfter): a
+// response's next is passed as after to get the page that follows it.
+// Query params: tag (an XMP keyword, e.g. sunset; optional), folder_id
+// (optional), after (optional cursor), limit (optional, default 100, max 1000)
+func makeFilesHandler(database *db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		query := r.URL.Query()
+		filter := files.Filter{Tag: strings.TrimSpace(query.Get("tag"))}
+		if param := query.Get("folder_id"); param != "" {
+			id, err := strconv.ParseInt(param, 10, 64)
+			if err != nil || id <= 0 {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid folder_id"})
+				return
+			}
+			filter.FolderID = id
+		}
+		var after int64
+		if param := query.Get("after"); param != "" {
+			cursor, err := strconv.ParseInt(param, 10, 64)
+			if err != nil || cursor < 0 {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid after cursor"})
+				return
+			}
+			after = cursor
+		}
+		limit := defaultFilesLimit
+		if param := query.Get("limit"); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "limit must be a positive number"})
+				return
+			}
+			limit = min(n, maxFilesLimit)
+		}
+
+		page, next, err := files.NewRepository(database).ListAfter(after, limit, filter)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+			return
+		}
+		resp := FilesResponse{Tag: filter.Tag, Files: make([]TreeFile, len(page))}
+		for i, f := range page {
+			resp.Files[i] = treeFile(f)
+		}
+		if next != 0 {
+			resp.Next = strconv.FormatInt(next, 10)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/monitor"
+	"jukel.org/q2/scanner"
+	"jukel.org/q2/serverauth"
+)
+
+// FolderResponse describes a monitored folder.
+type FolderResponse struct {
+	ID              int64      `json:"id"`
+	Path            string     `json:"path"`
+	LibraryType     string     `json:"library_type"`
+	WatchMode       string     `json:"watch_mode"`
+	PollInterval    int64      `json:"poll_interval"`    // Seconds; 0 uses the server default
+	CaseInsensitive bool       `json:"case_insensitive"` // The folder's volume ignores case
+	LastScannedAt   *time.Time `json:"last_scanned_at"`  // When a full scan last completed; null if none has
+	Status          string     `json:"status,omitempty"`
+}
+
+// authorized reports whether r may change the library. A request that passed
+// serve's -require-api-key check with a valid API key is allowed. Otherwise,
+// with an API token configured the request must send it as
+// "Authorization: Bearer <token>"; without one, only requests from the server
+// host itself are allowed.
+func authorized(r *http.Request, apiToken string) bool {
+	if serverauth.Authenticated(r) {
+		return true
+	}
+	if apiToken != "" {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(got), []byte(apiToken)) == 1
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// makeFoldersHandler creates a handler for /api/folders.
+// GET lists the monitored folders with their IDs.
+// POST adds a folder, starts monitoring it and, unless "scan" is false, queues a scan.
+func makeFoldersHandler(database *db.DB, mon *monitor.Monitor, apiToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			folders, err := listFolderRecords(database)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"folders": folders})
+			return
+		case http.MethodPost:
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		if !authorized(r, apiToken) {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "unauthorized"})
+			return
+		}
+
+		var req struct {
+			Path         string `json:"path"`
+			LibraryType  string `json:"library_type"`
+			WatchMode    string `json:"watch_mode"`
+			PollInterval int64  `json:"poll_interval"` // Seconds; 0 uses the server default
+			Scan         *bool  `json:"scan"`          // Defaults to true
+			Force        bool   `json:"force"`         // Skip the folder size check
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid JSON"})
+			return
+		}
+
+		folder, ok := cleanPath(req.Path)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "path is required"})
+			return
+		}
+
+		libraryType, err := scanner.ParseLibraryType(req.LibraryType)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		watchMode, err := monitor.ParseMode(req.WatchMode)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if req.PollInterval < 0 || (req.PollInterval > 0 && time.Duration(req.PollInterval)*time.Second < monitor.MinPollInterval) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("poll_interval must be at least %d seconds", int64(monitor.MinPollInterval/time.Second))})
+			return
+		}
+
+		info, err := os.Stat(folder)
+		if err != nil {
+			if os.IsNotExist(err) {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "folder does not exist"})
+				return
+			}
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "cannot access folder"})
+			return
+		}
+		if !info.IsDir() {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "path is not a directory"})
+			return
+		}
+
+		// An existing folder is reported as such, taking a given library type, as addfolder does
+		caseInsensitive := detectFolderCase(folder)
+		normalizedPath := normalizePath(folder)
+		if existing, err := getFolderRecord(database, "path = ?", normalizedPath); err == nil {
+			if req.LibraryType != "" && existing.LibraryType != string(libraryType) {
+				if err := setFolderLibraryType(database, normalizedPath, libraryType); err != nil {
+					writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+					return
+				}
+				existing.LibraryType = string(libraryType)
+			}
+			existing.Status = "already exists"
+			writeJSON(w, http.StatusOK, existing)
+			return
+		}
+
+		if !req.Force {
+			err := scanner.CheckFolderSize(folder, scanner.DefaultLimits())
+			var tooLarge *scanner.FolderTooLargeError
+			if errors.As(err, &tooLarge) {
+				writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error() + "; resend with force to add it anyway"})
+				return
+			}
+		}
+
+		result := database.Write(
+			"INSERT INTO folders (path, library_type, watch_mode, poll_interval, case_insensitive) VALUES (?, ?, ?, ?, ?)",
+			normalizedPath, string(libraryType), string(watchMode), req.PollInterval, caseInsensitive,
+		)
+		if result.Err != nil && !errors.Is(result.Err, db.ErrUniqueViolation) {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+			return
+		}
+
+		added, err := getFolderRecord(database, "path = ?", normalizedPath)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+			return
+		}
+		if result.Err != nil {
+			// Added by another request since the check above
+			added.Status = "already exists"
+			writeJSON(w, http.StatusOK, added)
+			return
+		}
+
+		if mon != nil {
+			mon.AddFolder(added.ID, added.Path)
+			if req.Scan == nil || *req.Scan {
+				mon.QueueScan(added.Path)
+			}
+		}
+
+		added.Status = "added"
+		writeJSON(w, http.StatusCreated, added)
+	}
+}
+
+// makeFolderHandler creates a handler for DELETE /api/folders/{id}, which
+// stops monitoring a folder and removes it with its files, as removefolder does.
+func makeFolderHandler(database *db.DB, mon *monitor.Monitor, q2Dir, apiToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		if !authorized(r, apiToken) {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "unauthorized"})
+			return
+		}
+
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/folders/"), 10, 64)
+		if err != nil || id <= 0 {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid folder id"})
+			return
+		}
+
+		folder, err := getFolderRecord(database, "id = ?", id)
+		if errors.Is(err, db.ErrNotFound) {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "folder not found"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+			return
+		}
+
+		removed, err := removeFolderFull(database, mon, folder.Path, q2Dir)
+		if errors.Is(err, errFolderNotFound) {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "folder not found"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "files_removed": removed})
+	}
+}
+
+// getFolderRecord returns the folder matching where, e.g. "id = ?", or
+// db.ErrNotFound.
+func getFolderRecord(database *db.DB, where string, arg interface{}) (FolderResponse, error) {
+	var f FolderResponse
+	row := database.QueryRow("SELECT id, path, library_type, watch_mode, poll_interval, COALESCE(case_insensitive, 0) FROM folders WHERE "+where, arg)
+	err := row.Scan(&f.ID, &f.Path, &f.LibraryType, &f.WatchMode, &f.PollInterval, &f.CaseInsensitive)
+	return f, db.Classify(err)
+}
+
+// listFolderRecords returns all monitored folders ordered by path.
+func listFolderRecords(database *db.DB) ([]FolderResponse, error) {
+	rows, err := database.Query("SELECT id, path, library_type, watch_mode, poll_interval, COALESCE(case_insensitive, 0), last_scanned_at FROM folders ORDER BY path")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := []FolderResponse{}
+	for rows.Next() {
+		var f FolderResponse
+		var scanned sql.NullTime
+		if err := rows.Scan(&f.ID, &f.Path, &f.LibraryType, &f.WatchMode, &f.PollInterval, &f.CaseInsensitive, &scanned); err != nil {
+			return nil, err
+		}
+		if scanned.Valid {
+			f.LastScannedAt = &scanned.Time
+		}
+		folders = append(folders, f)
+	}
+	return folders, rows.Err()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/media"
+)
+
+// MapFile is a geotagged image placed on the map.
+type MapFile struct {
+	ID   int64   `json:"id"`
+	Name string  `json:"name"`
+	Path string  `json:"path"`
+	Lat  float64 `json:"lat"`
+	Lon  float64 `json:"lon"`
+}
+
+// MapResponse is the body of GET /api/map.
+type MapResponse struct {
+	Files []MapFile `json:"files"`
+}
+
+// parseBBox parses a bbox parameter of four comma-separated numbers:
+// minLat,minLon,maxLat,maxLon.
+func parseBBox(s string) (bounds [4]float64, ok bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != len(bounds) {
+		return bounds, false
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return bounds, false
+		}
+		bounds[i] = v
+	}
+	return bounds, true
+}
+
+// makeMapHandler creates a handler for GET /api/map, which lists the
+// geotagged images inside a rectangle for a map view, ordered by path.
+// Query params: bbox (minLat,minLon,maxLat,maxLon, e.g. 51.2,-0.5,51.7,0.3;
+// required). A minLon greater than maxLon spans the antimeridian.
+func makeMapHandler(database *db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		bbox := r.URL.Query().Get("bbox")
+		if bbox == "" {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "bbox parameter required"})
+			return
+		}
+		b, ok := parseBBox(bbox)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "bbox must be minLat,minLon,maxLat,maxLon"})
+			return
+		}
+
+		found, err := media.FilesInBounds(database, b[0], b[1], b[2], b[3])
+		if err != nil {
+			if errors.Is(err, media.ErrInvalidBounds) {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+			return
+		}
+
+		files := make([]MapFile, len(found))
+		for i, f := range found {
+			files[i] = MapFile{ID: f.FileID, Name: filepath.Base(f.Path), Path: f.Path, Lat: f.Lat, Lon: f.Lon}
+		}
+		writeJSON(w, http.StatusOK, MapResponse{Files: files})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+
+	"jukel.org/q2/monitor"
+)
+
+// makeMonitorStatusHandler creates a handler for GET /api/monitor/status.
+// It reports whether each folder is watched or polled, and recent activity.
+func makeMonitorStatusHandler(mon *monitor.Monitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, mon.Status())
+	}
+}
+
+// makeScanHandler creates a handler for DELETE /api/scan?path=, which cancels
+// a scan: a queued scan is removed from the queue ("dequeued"), and a running
+// one is stopped ("cancelled").
+func makeScanHandler(mon *monitor.Monitor, apiToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		if !authorized(r, apiToken) {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "unauthorized"})
+			return
+		}
+
+		path, ok := cleanPath(r.URL.Query().Get("path"))
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "path is required"})
+			return
+		}
+		if mon == nil {
+			writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{Error: "folder monitoring is not running"})
+			return
+		}
+
+		state, err := mon.CancelScan(path)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+			return
+		}
+		if state == monitor.CancelNotFound {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "no queued or running scan of that path"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"path": normalizePath(path), "state": string(state)})
+	}
+}
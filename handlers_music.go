@@ -21,7 +21,7 @@ func makeMusicArtistsHandler(database *db.DB) http.HandlerFunc {
 			SELECT COALESCE(am.artist, '') as artist, COUNT(*) as song_count
 			FROM audio_metadata am
 			JOIN files f ON f.id = am.file_id
-			WHERE am.artist IS NOT NULL AND am.artist != ''
+			WHERE am.artist IS NOT NULL AND am.artist != '' AND f.deleted_at IS NULL
 			GROUP BY am.artist
 			ORDER BY am.artist COLLATE NOCASE`)
 		if err != nil {
@@ -64,7 +64,7 @@ func makeMusicAlbumsHandler(database *db.DB) http.HandlerFunc {
 				       COUNT(*) as song_count, COALESCE(am.year, 0) as year
 				FROM audio_metadata am
 				JOIN files f ON f.id = am.file_id
-				WHERE am.album IS NOT NULL AND am.album != '' AND am.artist = ?
+				WHERE am.album IS NOT NULL AND am.album != '' AND am.artist = ? AND f.deleted_at IS NULL
 				GROUP BY am.album, am.artist
 				ORDER BY am.year DESC, am.album COLLATE NOCASE`, artist)
 			rows = rows2
@@ -75,7 +75,7 @@ func makeMusicAlbumsHandler(database *db.DB) http.HandlerFunc {
 				       COUNT(*) as song_count, COALESCE(am.year, 0) as year
 				FROM audio_metadata am
 				JOIN files f ON f.id = am.file_id
-				WHERE am.album IS NOT NULL AND am.album != ''
+				WHERE am.album IS NOT NULL AND am.album != '' AND f.deleted_at IS NULL
 				GROUP BY am.album, am.artist
 				ORDER BY am.album COLLATE NOCASE`)
 			rows = rows2
@@ -118,7 +118,7 @@ func makeMusicGenresHandler(database *db.DB) http.HandlerFunc {
 			SELECT COALESCE(am.genre, '') as genre, COUNT(*) as song_count
 			FROM audio_metadata am
 			JOIN files f ON f.id = am.file_id
-			WHERE am.genre IS NOT NULL AND am.genre != ''
+			WHERE am.genre IS NOT NULL AND am.genre != '' AND f.deleted_at IS NULL
 			GROUP BY am.genre
 			ORDER BY am.genre COLLATE NOCASE`)
 		if err != nil {
@@ -165,7 +165,7 @@ func makeMusicSongsHandler(database *db.DB) http.HandlerFunc {
 			FROM audio_metadata am
 			JOIN files f ON f.id = am.file_id`
 
-		var conditions []string
+		conditions := []string{"f.deleted_at IS NULL"}
 		var args []interface{}
 		if artist != "" {
 			conditions = append(conditions, "am.artist = ?")
@@ -179,9 +179,7 @@ func makeMusicSongsHandler(database *db.DB) http.HandlerFunc {
 			conditions = append(conditions, "am.genre = ?")
 			args = append(args, genre)
 		}
-		if len(conditions) > 0 {
-			query += " WHERE " + strings.Join(conditions, " AND ")
-		}
+		query += " WHERE " + strings.Join(conditions, " AND ")
 		query += " ORDER BY am.artist COLLATE NOCASE, am.album COLLATE NOCASE, am.track_number, am.title COLLATE NOCASE"
 
 		rows, err := database.Query(query, args...)
@@ -309,7 +307,7 @@ func makeTopSongsHandler(database *db.DB) http.HandlerFunc {
 			FROM play_history ph
 			JOIN files f ON f.id = ph.file_id
 			LEFT JOIN audio_metadata am ON am.file_id = ph.file_id
-			WHERE ph.played_at >= datetime('now', '-3 months')
+			WHERE ph.played_at >= datetime('now', '-3 months') AND f.deleted_at IS NULL
 			GROUP BY ph.file_id
 			ORDER BY play_count DESC
 			LIMIT 50
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/monitor"
+)
+
+// Runtime settings, kept in the settings table and applied to a running
+// server without a restart. Stored values override serve's flags.
+const (
+	settingWatchDebounce    = "watch_debounce_ms"
+	settingScanConcurrency  = "scan_concurrency"
+	settingThumbnailWorkers = "thumbnail_workers"
+	settingLogLevel         = "log_level"
+)
+
+// Upper limits of the runtime settings.
+const (
+	maxWatchDebounce    = time.Minute
+	maxThumbnailWorkers = 32
+)
+
+// thumbnailWorkers is how many files background thumbnail generation works
+// on at once; 0 uses ffmpeg's process limit.
+var thumbnailWorkers atomic.Int64
+
+// serverLogLevel is the level of serve's logger, so it can change while the
+// server runs.
+var serverLogLevel slog.LevelVar
+
+// currentThumbnailWorkers returns the thumbnail worker count for media.EnrichThumbnails.
+func currentThumbnailWorkers() int {
+	return int(thumbnailWorkers.Load())
+}
+
+// RuntimeSettings is the body of /api/settings/runtime. In a request, fields
+// left out are not changed.
+type RuntimeSettings struct {
+	WatchDebounceMS  *int64  `json:"watch_debounce_ms,omitempty"` // Events settle this long before indexing
+	ScanConcurrency  *int    `json:"scan_concurrency,omitempty"`  // Folders scanned at once
+	ThumbnailWorkers *int    `json:"thumbnail_workers,omitempty"` // Files given thumbnails at once; 0 uses the ffmpeg limit
+	LogLevel         *string `json:"log_level,omitempty"`         // debug, info, warn or error
+}
+
+// validate reports values outside the supported ranges.
+func (s RuntimeSettings) validate() error {
+	if d := s.WatchDebounceMS; d != nil && (time.Duration(*d)*time.Millisecond < monitor.MinDebounceTime || time.Duration(*d)*time.Millisecond > maxWatchDebounce) {
+		return fmt.Errorf("watch_debounce_ms must be between %d and %d", monitor.MinDebounceTime.Milliseconds(), maxWatchDebounce.Milliseconds())
+	}
+	if n := s.ScanConcurrency; n != nil && (*n < 1 || *n > monitor.MaxScanConcurrency) {
+		return fmt.Errorf("scan_concurrency must be between 1 and %d", monitor.MaxScanConcurrency)
+	}
+	if n := s.ThumbnailWorkers; n != nil && (*n < 0 || *n > maxThumbnailWorkers) {
+		return fmt.Errorf("thumbnail_workers must be between 0 and %d", maxThumbnailWorkers)
+	}
+	if s.LogLevel != nil {
+		if _, err := parseLogLevel(*s.LogLevel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRuntimeSettings reads the stored runtime settings. Unset, unreadable
+// and out of range ones are left nil.
+func loadRuntimeSettings(database *db.DB) RuntimeSettings {
+	var s RuntimeSettings
+	rows, err := database.Query("SELECT key, value FROM settings WHERE key IN (?, ?, ?, ?)",
+		settingWatchDebounce, settingScanConcurrency, settingThumbnailWorkers, settingLogLevel)
+	if err != nil {
+		return s
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		if rows.Scan(&key, &value) != nil {
+			continue
+		}
+		if key == settingLogLevel {
+			if _, err := parseLogLevel(value); err == nil {
+				s.LogLevel = &value
+			}
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		v := int(n)
+		var one RuntimeSettings
+		switch key {
+		case settingWatchDebounce:
+			one.WatchDebounceMS = &n
+		case settingScanConcurrency:
+			one.ScanConcurrency = &v
+		case settingThumbnailWorkers:
+			one.ThumbnailWorkers = &v
+		}
+		if one.validate() != nil {
+			continue
+		}
+		s.WatchDebounceMS = cmp.Or(one.WatchDebounceMS, s.WatchDebounceMS)
+		s.ScanConcurrency = cmp.Or(one.ScanConcurrency, s.ScanConcurrency)
+		s.ThumbnailWorkers = cmp.Or(one.ThumbnailWorkers, s.ThumbnailWorkers)
+	}
+	return s
+}
+
+// applyRuntimeSettings applies the validated settings that are set to the
+// monitor, if any, the thumbnail workers and the log level.
+func applyRuntimeSettings(mon *monitor.Monitor, s RuntimeSettings) {
+	if s.WatchDebounceMS != nil && mon != nil {
+		mon.SetDebounce(time.Duration(*s.WatchDebounceMS) * time.Millisecond)
+	}
+	if s.ScanConcurrency != nil && mon != nil {
+		mon.SetScanConcurrency(*s.ScanConcurrency)
+	}
+	if s.ThumbnailWorkers != nil {
+		thumbnailWorkers.Store(int64(*s.ThumbnailWorkers))
+	}
+	if s.LogLevel != nil {
+		level, _ := parseLogLevel(*s.LogLevel)
+		serverLogLevel.Set(level)
+	}
+}
+
+// currentRuntimeSettings returns the runtime settings in effect.
+func currentRuntimeSettings(mon *monitor.Monitor, ffmpegMgr *ffmpeg.Manager) RuntimeSettings {
+	debounce := mon.Debounce().Milliseconds()
+	concurrency := mon.ScanConcurrency()
+	workers := currentThumbnailWorkers()
+	if workers == 0 && ffmpegMgr != nil {
+		workers = ffmpegMgr.MaxConcurrent
+	}
+	level := strings.ToLower(serverLogLevel.Level().String())
+	return RuntimeSettings{WatchDebounceMS: &debounce, ScanConcurrency: &concurrency, ThumbnailWorkers: &workers, LogLevel: &level}
+}
+
+// makeRuntimeSettingsHandler creates a handler for /api/settings/runtime.
+// GET reports the settings in effect. POST validates, stores and applies
+// the settings given, so a running server can be tuned, e.g. while a large
+// import swamps it, and keeps them across restarts.
+func makeRuntimeSettingsHandler(database *db.DB, mon *monitor.Monitor, ffmpegMgr *ffmpeg.Manager, apiToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodPost:
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+		if mon == nil {
+			writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{Error: "folder monitoring is not running"})
+			return
+		}
+		if r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, currentRuntimeSettings(mon, ffmpegMgr))
+			return
+		}
+
+		if !authorized(r, apiToken) {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "unauthorized"})
+			return
+		}
+
+		var req RuntimeSettings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid JSON"})
+			return
+		}
+		if err := req.validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		var stmts []db.Statement
+		store := func(key, value string) {
+			stmts = append(stmts, db.Statement{
+				Query: "INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value",
+				Args:  []interface{}{key, value},
+			})
+		}
+		if req.WatchDebounceMS != nil {
+			store(settingWatchDebounce, strconv.FormatInt(*req.WatchDebounceMS, 10))
+		}
+		if req.ScanConcurrency != nil {
+			store(settingScanConcurrency, strconv.Itoa(*req.ScanConcurrency))
+		}
+		if req.ThumbnailWorkers != nil {
+			store(settingThumbnailWorkers, strconv.Itoa(*req.ThumbnailWorkers))
+		}
+		if req.LogLevel != nil {
+			store(settingLogLevel, *req.LogLevel)
+		}
+		if len(stmts) > 0 {
+			if err := database.WriteTransaction(stmts); err != nil {
+				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+				return
+			}
+		}
+
+		applyRuntimeSettings(mon, req)
+		writeJSON(w, http.StatusOK, currentRuntimeSettings(mon, ffmpegMgr))
+	}
+}
+
+// ThumbnailStatus is the body of /api/thumbnails/status.
+type ThumbnailStatus struct {
+	Workers        int    `json:"workers"`                // Background thumbnail workers in use now
+	MaxWorkers     int    `json:"max_workers"`            // Workers used while the server is idle
+	Throttled      bool   `json:"throttled"`              // Held to one worker by recent requests
+	ActiveRequests int64  `json:"active_requests"`        // Requests being handled, not counting status polls
+	LastRequest    string `json:"last_request,omitempty"` // When the server last handled a request (RFC 3339)
+}
+
+// makeThumbnailStatusHandler creates a handler for /api/thumbnails/status,
+// which reports how fast background thumbnail generation is running.
+func makeThumbnailStatusHandler(ffmpegMgr *ffmpeg.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		now := time.Now()
+		status := ThumbnailStatus{
+			MaxWorkers:     currentThumbnailWorkers(),
+			Throttled:      thumbnailThrottled(now),
+			ActiveRequests: serverActivity.inFlight.Load(),
+		}
+		if status.MaxWorkers == 0 && ffmpegMgr != nil {
+			status.MaxWorkers = ffmpegMgr.MaxConcurrent
+		}
+		if status.MaxWorkers == 0 {
+			status.MaxWorkers = runtime.NumCPU() // As media.EnrichThumbnails does
+		}
+		status.Workers = status.MaxWorkers
+		if status.Throttled {
+			status.Workers = 1
+		}
+		if last := serverActivity.last.Load(); last != 0 {
+			status.LastRequest = time.Unix(0, last).Format(time.RFC3339)
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
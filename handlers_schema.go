@@ -202,3 +202,16 @@ func makeSchemaHandler(database *db.DB) http.HandlerFunc {
 
 
 // makeSettingsGetHandler creates a handler for GET /api/settings.
+
+// makeDBStatsHandler creates a handler for GET /api/db/stats, which reports
+// the write queue depth and latency for debugging slow indexing.
+func makeDBStatsHandler(database *db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, database.Stats())
+	}
+}
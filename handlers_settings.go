@@ -3,16 +3,20 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"jukel.org/q2/db"
 	"jukel.org/q2/ffmpeg"
 	"jukel.org/q2/media"
+	"jukel.org/q2/monitor"
+	"jukel.org/q2/scanner"
 )
 
 func makeSettingsGetHandler(database *db.DB) http.HandlerFunc {
@@ -55,6 +59,41 @@ func makeSettingsPostHandler(database *db.DB) http.HandlerFunc {
 			return
 		}
 
+		for _, key := range []string{settingWatchDebounce, settingScanConcurrency, settingThumbnailWorkers} {
+			if _, ok := settings[key]; ok {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: key + " is set through /api/settings/runtime"})
+				return
+			}
+		}
+
+		if placement, ok := settings["thumbnail_store"]; ok {
+			if _, err := media.NewThumbnailStore(placement, "", ""); err != nil {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+				return
+			}
+		}
+
+		if mode, ok := settings["thumbnail_mode"]; ok {
+			if _, err := media.ParseThumbnailMode(mode); err != nil {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+				return
+			}
+		}
+
+		if format, ok := settings["thumbnail_format"]; ok {
+			if _, err := media.ParseThumbnailFormat(format); err != nil {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+				return
+			}
+		}
+
+		if codecs, ok := settings["compatible_audio_codecs"]; ok {
+			if _, err := ffmpeg.ParseCodecList(codecs); err != nil {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+				return
+			}
+		}
+
 		for key, value := range settings {
 			result := database.Write(
 				"INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value",
@@ -71,15 +110,26 @@ func makeSettingsPostHandler(database *db.DB) http.HandlerFunc {
 }
 
 // makeFolderAddHandler creates a handler for POST /api/folders/add.
-func makeFolderAddHandler(database *db.DB) http.HandlerFunc {
+// New folders are monitored and scanned straight away; for a folder already
+// monitored, a given library_type replaces its own. Requests must pass
+// authorized, as for POST /api/folders.
+func makeFolderAddHandler(database *db.DB, mon *monitor.Monitor, apiToken string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
 			return
 		}
+		if !authorized(r, apiToken) {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "unauthorized"})
+			return
+		}
 
 		var req struct {
-			Path string `json:"path"`
+			Path         string `json:"path"`
+			LibraryType  string `json:"library_type"`
+			WatchMode    string `json:"watch_mode"`
+			PollInterval int64  `json:"poll_interval"` // Seconds; 0 uses the server default
+			Force        bool   `json:"force"`         // Skip the folder size check
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid JSON"})
@@ -91,6 +141,22 @@ func makeFolderAddHandler(database *db.DB) http.HandlerFunc {
 			return
 		}
 
+		libraryType, err := scanner.ParseLibraryType(req.LibraryType)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		watchMode, err := monitor.ParseMode(req.WatchMode)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if req.PollInterval < 0 || (req.PollInterval > 0 && time.Duration(req.PollInterval)*time.Second < monitor.MinPollInterval) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("poll_interval must be at least %d seconds", int64(monitor.MinPollInterval/time.Second))})
+			return
+		}
+
 		cleaned, ok := cleanPath(req.Path)
 		if !ok {
 			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid path"})
@@ -111,28 +177,58 @@ func makeFolderAddHandler(database *db.DB) http.HandlerFunc {
 			return
 		}
 
+		if !req.Force {
+			err := scanner.CheckFolderSize(cleaned, scanner.DefaultLimits())
+			var tooLarge *scanner.FolderTooLargeError
+			if errors.As(err, &tooLarge) {
+				writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error() + "; resend with force to add it anyway"})
+				return
+			}
+		}
+
+		caseInsensitive := detectFolderCase(cleaned)
 		normalizedPath := normalizePath(cleaned)
-		result := database.Write("INSERT OR IGNORE INTO folders (path) VALUES (?)", normalizedPath)
-		if result.Err != nil {
+		result := database.Write(
+			"INSERT INTO folders (path, library_type, watch_mode, poll_interval, case_insensitive) VALUES (?, ?, ?, ?, ?)",
+			normalizedPath, string(libraryType), string(watchMode), req.PollInterval, caseInsensitive,
+		)
+		if result.Err != nil && !errors.Is(result.Err, db.ErrUniqueViolation) {
 			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
 			return
 		}
 
 		msg := "added"
-		if result.RowsAffected == 0 {
+		if result.Err != nil {
+			// An explicit library type applies to the existing folder, as addfolder does
+			if req.LibraryType != "" {
+				if err := setFolderLibraryType(database, normalizedPath, libraryType); err != nil {
+					writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+					return
+				}
+			}
 			msg = "already exists"
+		} else if mon != nil {
+			mon.AddFolder(result.LastInsertID, normalizedPath)
+			mon.QueueScan(normalizedPath)
 		}
 		writeJSON(w, http.StatusOK, map[string]string{"status": msg, "path": normalizedPath})
 	}
 }
 
 // makeFolderRemoveHandler creates a handler for POST /api/folders/remove.
-func makeFolderRemoveHandler(database *db.DB) http.HandlerFunc {
+// The folder stops being monitored, its queued scans are cancelled, and its
+// files are removed from the index along with their thumbnails. Requests
+// must pass authorized, as for DELETE /api/folders/{id}.
+func makeFolderRemoveHandler(database *db.DB, mon *monitor.Monitor, q2Dir, apiToken string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
 			return
 		}
+		if !authorized(r, apiToken) {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "unauthorized"})
+			return
+		}
 
 		var req struct {
 			Path string `json:"path"`
@@ -147,19 +243,17 @@ func makeFolderRemoveHandler(database *db.DB) http.HandlerFunc {
 			return
 		}
 
-		normalizedPath := normalizePath(req.Path)
-		result := database.Write("DELETE FROM folders WHERE path = ?", normalizedPath)
-		if result.Err != nil {
-			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+		removed, err := removeFolderFull(database, mon, req.Path, q2Dir)
+		if errors.Is(err, errFolderNotFound) {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "folder not found"})
 			return
 		}
-
-		if result.RowsAffected == 0 {
-			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "folder not found"})
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
 			return
 		}
 
-		writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "files_removed": removed})
 	}
 }
 
@@ -265,19 +359,11 @@ func processInboxFile(ctx context.Context, fh *multipart.FileHeader, audioDest s
 	dst.Close()
 
 	// Extract metadata
-	meta, err := media.ExtractAudioMetadata(tmpFile)
+	meta, err := media.ExtractAudioMetadata(ctx, tmpFile, ffmpegMgr)
 	if err != nil {
 		meta = &media.AudioMetadata{}
 	}
 
-	// Get duration via ffprobe
-	if ffmpegMgr != nil {
-		if dur, err := ffmpegMgr.GetVideoDuration(ctx, tmpFile); err == nil {
-			d := int(dur)
-			meta.DurationSeconds = &d
-		}
-	}
-
 	// Determine artist and album folder names
 	artist := "Unknown Artist"
 	album := "Unknown Album"
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/files"
+	"jukel.org/q2/monitor"
+)
+
+// StatsResponse is the body of GET /api/stats: a summary of the library.
+type StatsResponse struct {
+	Folders int               `json:"folders"`
+	Files   files.MediaCounts `json:"files"`
+	Monitor *monitor.Status   `json:"monitor,omitempty"` // Absent when folders are not being monitored
+}
+
+// makeStatsHandler creates a handler for GET /api/stats, which summarizes
+// the library: how many folders are monitored, how many files of each
+// media type are indexed and their total size, and the monitor's status.
+func makeStatsHandler(database *db.DB, mon *monitor.Monitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		var resp StatsResponse
+		if err := database.QueryRow("SELECT COUNT(*) FROM folders").Scan(&resp.Folders); err != nil {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+			return
+		}
+		counts, err := files.NewRepository(database).Counts()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+			return
+		}
+		resp.Files = counts
+		if mon != nil {
+			status := mon.Status()
+			resp.Monitor = &status
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
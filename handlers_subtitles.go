@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/media"
+)
+
+// subtitleManifest is the cached list of tracks extracted from a video.
+const subtitleManifest = "tracks.json"
+
+// makeSubtitlesHandler creates a handler for /api/subtitles.
+// GET ?path=<video> lists the video's text subtitle tracks;
+// GET ?path=<video>&index=N serves track N as WebVTT.
+// Tracks are extracted once into .q2/subtitles and re-extracted when the video changes.
+func makeSubtitlesHandler(database *db.DB, q2Dir string, ffmpegMgr *ffmpeg.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "path parameter required"})
+			return
+		}
+
+		path, ok := cleanPath(path)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid path"})
+			return
+		}
+
+		index := -1
+		if s := r.URL.Query().Get("index"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid index"})
+				return
+			}
+			index = n
+		}
+
+		roots, err := getMonitoredFolders(database)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+			return
+		}
+
+		if isPathWithinRoots(path, roots) == "" {
+			writeJSON(w, http.StatusForbidden, ErrorResponse{Error: "path not within monitored folders"})
+			return
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "file not found"})
+			} else {
+				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "cannot access file"})
+			}
+			return
+		}
+		if info.IsDir() || !isVideoFile(path) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "not a video file"})
+			return
+		}
+
+		tracks, err := loadSubtitles(r, q2Dir, ffmpegMgr, path, info)
+		if err != nil {
+			if errors.Is(err, ffmpeg.ErrFFmpegNotFound) {
+				writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{Error: "ffmpeg not available"})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "subtitle extraction failed: " + err.Error()})
+			return
+		}
+
+		if index < 0 {
+			if tracks == nil {
+				tracks = []ffmpeg.SubtitleTrack{}
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"tracks": tracks})
+			return
+		}
+
+		if len(tracks) == 0 {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "no subtitle streams"})
+			return
+		}
+
+		var track *ffmpeg.SubtitleTrack
+		for i := range tracks {
+			if tracks[i].Index == index {
+				track = &tracks[i]
+				break
+			}
+		}
+		if track == nil {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "subtitle track not found"})
+			return
+		}
+
+		file, err := os.Open(track.Path)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "cannot open subtitles"})
+			return
+		}
+		defer file.Close()
+
+		// CORS for Chromecast, which fetches text tracks from the receiver
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		http.ServeContent(w, r, filepath.Base(track.Path), info.ModTime(), file)
+	}
+}
+
+// loadSubtitles returns the extracted subtitle tracks for a video, extracting
+// them when there is no cached manifest newer than the video.
+func loadSubtitles(r *http.Request, q2Dir string, ffmpegMgr *ffmpeg.Manager, videoPath string, info os.FileInfo) ([]ffmpeg.SubtitleTrack, error) {
+	outDir := filepath.Join(q2Dir, "subtitles", media.HashString(normalizePath(videoPath)))
+	manifestPath := filepath.Join(outDir, subtitleManifest)
+
+	if mi, err := os.Stat(manifestPath); err == nil && !mi.ModTime().Before(info.ModTime()) {
+		if data, err := os.ReadFile(manifestPath); err == nil {
+			var tracks []ffmpeg.SubtitleTrack
+			if err := json.Unmarshal(data, &tracks); err == nil {
+				for i := range tracks {
+					tracks[i].Path = filepath.Join(outDir, strconv.Itoa(tracks[i].Index)+".vtt")
+				}
+				return tracks, nil
+			}
+		}
+	}
+
+	if ffmpegMgr == nil {
+		return nil, ffmpeg.ErrFFmpegNotFound
+	}
+
+	os.RemoveAll(outDir)
+	tracks, err := ffmpegMgr.ExtractSubtitles(r.Context(), videoPath, outDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return tracks, nil // Serve this time, extract again next time
+	}
+	if data, err := json.Marshal(tracks); err == nil {
+		os.WriteFile(manifestPath, data, 0644)
+	}
+
+	return tracks, nil
+}
@@ -2,49 +2,182 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"jukel.org/q2/cast"
 	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/media"
 	_ "jukel.org/q2/migrations"
+	"jukel.org/q2/monitor"
 	"jukel.org/q2/scanner"
+	"jukel.org/q2/serverauth"
 )
 
+// serveFlags are the options of the serve command, which the config command
+// also takes to report what serve would run with.
+type serveFlags struct {
+	fs *flag.FlagSet
+
+	port                *int
+	castCacheTTL        *time.Duration
+	pollInterval        *time.Duration
+	folderSyncInterval  *time.Duration
+	startupScanAge      *time.Duration
+	watchDebounce       *time.Duration
+	maxActivities       *int
+	scanConcurrency     *int
+	watchBurst          *int
+	apiToken            *string
+	ffmpegMaxConcurrent *int
+	transcodePreset     *string
+	transcodeCRF        *int
+	checkpointInterval  *time.Duration
+	trashGrace          *time.Duration
+	quiet               *bool
+	thumbnailInterval   *time.Duration
+	logLevel            *string
+	thumbnailIdle       *time.Duration
+	requireAPIKey       *bool
+	authAllow           *string
+	corsOrigin          *string
+	geocode             *bool
+	tlsCert             *string
+	tlsKey              *string
+	tlsSelfSigned       *bool
+}
+
+// newServeFlags defines the serve options on a new flag set.
+func newServeFlags() *serveFlags {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	return &serveFlags{
+		fs:                  fs,
+		port:                fs.Int("port", 8090, "Port to listen on"),
+		castCacheTTL:        fs.Duration("cast-cache-ttl", time.Minute, "How long discovered cast devices are cached (0 disables)"),
+		pollInterval:        fs.Duration("poll-interval", monitor.DefaultPollInterval, "How often to rescan folders that cannot be watched (network filesystems)"),
+		folderSyncInterval:  fs.Duration("folder-sync-interval", monitor.DefaultReconcileInterval, "How often to pick up folders added or removed with addfolder/removefolder"),
+		startupScanAge:      fs.Duration("startup-scan-age", monitor.DefaultStartupScanAge, "Folders fully scanned more recently than this are not rescanned at startup (0 rescans every folder)"),
+		watchDebounce:       fs.Duration("watch-debounce", monitor.DefaultDebounceTime, "How long file change events settle before indexing (raise for slow network filesystems)"),
+		maxActivities:       fs.Int("max-activities", monitor.DefaultMaxActivities, "How many recent monitor activities /api/monitor/status keeps"),
+		scanConcurrency:     fs.Int("scan-concurrency", monitor.DefaultScanConcurrency, fmt.Sprintf("How many folders are scanned at once (1-%d)", monitor.MaxScanConcurrency)),
+		watchBurst:          fs.Int("watch-burst", monitor.DefaultBurstEvents, "Events in one folder before they settle above which the folder is rescanned instead of indexed file by file"),
+		apiToken:            fs.String("api-token", os.Getenv("Q2_API_TOKEN"), "Token required to add or remove folders over HTTP (default $Q2_API_TOKEN; unset allows only local requests)"),
+		ffmpegMaxConcurrent: fs.Int("ffmpeg-max-concurrent", runtime.NumCPU(), "Maximum ffmpeg/ffprobe processes running at once (0 for no limit)"),
+		transcodePreset:     fs.String("transcode-preset", ffmpeg.DefaultVideoPreset, "x264 preset for videos whose codec browsers can't play; faster ones keep up on slower machines"),
+		transcodeCRF:        fs.Int("transcode-crf", ffmpeg.DefaultVideoCRF, "x264 quality for transcoded video, 1-51; lower looks better at a higher bit rate"),
+		checkpointInterval:  fs.Duration("checkpoint-interval", 10*time.Minute, "How often to truncate the database WAL file (0 disables)"),
+		trashGrace:          fs.Duration("trash-grace", 30*24*time.Hour, "How long files missing from disk keep their albums and metadata in case they come back, e.g. after a NAS remounts (0 keeps them forever)"),
+		quiet:               fs.Bool("quiet", false, "Don't report ffmpeg download progress"),
+		thumbnailInterval:   fs.Duration("thumbnail-interval", time.Minute, "How often to generate missing thumbnails for newly indexed images and videos (0 disables)"),
+		logLevel:            fs.String("log-level", "info", "Log level: debug (adds an access log of every request), info, warn or error"),
+		thumbnailIdle:       fs.Duration("thumbnail-idle-after", 10*time.Second, "Generate background thumbnails with one worker until the server has had no requests for this long (0 never throttles)"),
+		requireAPIKey:       fs.Bool("require-api-key", false, "Require an API key (see apikey create) on every request except -auth-allow paths"),
+		authAllow:           fs.String("auth-allow", strings.Join(serverauth.DefaultAllow, ","), "Comma-separated paths served without an API key; entries ending in / cover the paths under them"),
+		corsOrigin:          fs.String("cors-origin", "", "Comma-separated origins allowed to call the API from a browser, e.g. http://localhost:5173 (* for any; default same-origin only)"),
+		geocode:             fs.Bool("geocode", false, "Look up place names for geotagged photos (sends GPS coordinates to OpenStreetMap Nominatim)"),
+		tlsCert:             fs.String("tls-cert", "", "Certificate file (PEM) to serve HTTPS with; needs -tls-key"),
+		tlsKey:              fs.String("tls-key", "", "Private key file (PEM) for -tls-cert"),
+		tlsSelfSigned:       fs.Bool("tls-selfsigned", false, "Serve HTTPS with a self-signed certificate, generated in the data directory on first run"),
+	}
+}
+
+// dataDirEnv names the environment variable -data-dir defaults to.
+const dataDirEnv = "Q2_DATA_DIR"
+
+// dataDirFlag defines -data-dir on fs: where the database, thumbnail cache,
+// ffmpeg and everything else Q2 keeps live. It defaults to $Q2_DATA_DIR,
+// then .q2 in the home directory, so every command uses the same database
+// whatever directory it is run from.
+func dataDirFlag(fs *flag.FlagSet) *string {
+	dir := os.Getenv(dataDirEnv)
+	if dir == "" {
+		dir = ".q2"
+		if home, err := os.UserHomeDir(); err == nil {
+			dir = filepath.Join(home, ".q2")
+		}
+	}
+	return fs.String("data-dir", dir, "Directory holding the database, thumbnails and ffmpeg (env "+dataDirEnv+")")
+}
+
+// warnOldDataDir points out a database in ./.q2, where Q2 kept its data
+// before -data-dir, when dataDir is somewhere else.
+func warnOldDataDir(dataDir string) {
+	old, err := filepath.Abs(".q2")
+	if err != nil {
+		return
+	}
+	if current, err := filepath.Abs(dataDir); err != nil || current == old {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(old, dbFile)); err == nil {
+		fmt.Fprintf(os.Stderr, "Note: using the data directory %s, not %s; pass -data-dir .q2 to use the database there\n", dataDir, old)
+	}
+}
 
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage:\n")
-		fmt.Fprintf(os.Stderr, "  %s <command> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [-data-dir dir] <command> [options]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Commands:\n")
 		fmt.Fprintf(os.Stderr, "  addfolder	Add a folder to Q2\n")
 		fmt.Fprintf(os.Stderr, "  removefolder	Remove a folder from Q2\n")
+		fmt.Fprintf(os.Stderr, "  relocatefolder	Point a folder at where its files were moved\n")
 		fmt.Fprintf(os.Stderr, "  listfolders	List stored folders\n")
 		fmt.Fprintf(os.Stderr, "  scan		Scan a folder for files\n")
-		fmt.Fprintf(os.Stderr, "  serve		Start serving Q2\n")
+		fmt.Fprintf(os.Stderr, "  verify-thumbnails	Regenerate thumbnails missing from the cache\n")
+		fmt.Fprintf(os.Stderr, "  refresh-metadata	Read EXIF, XMP and audio tags of indexed files again\n")
+		fmt.Fprintf(os.Stderr, "  coverage	Count files still missing metadata, thumbnails or hashes\n")
+		fmt.Fprintf(os.Stderr, "  exportalbum	Copy an album's files into a directory\n")
+		fmt.Fprintf(os.Stderr, "  backup		Write a snapshot of the database to a file\n")
+		fmt.Fprintf(os.Stderr, "  migrate	Apply, roll back or list database migrations\n")
+		fmt.Fprintf(os.Stderr, "  config		Show the configuration serve would run with\n")
+		fmt.Fprintf(os.Stderr, "  doctor		Check for folders deleted from disk and a missing ffmpeg\n")
+		fmt.Fprintf(os.Stderr, "  apikey		Create API keys for serve -require-api-key\n")
+		fmt.Fprintf(os.Stderr, "  serve		Start serving Q2\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
 	}
 
-	if len(os.Args) < 2 {
+	dataDir := dataDirFlag(flag.CommandLine)
+	flag.Parse()
+	cmdArgs := flag.Args()
+	if len(cmdArgs) < 1 {
 		flag.Usage()
 		os.Exit(1)
 	}
+	q2Dir := *dataDir
+	warnOldDataDir(q2Dir)
 
-	switch os.Args[1] {
+	switch cmdArgs[0] {
 	case "addfolder":
 		addFolderCmd := flag.NewFlagSet("addfolder", flag.ContinueOnError)
+		libraryTypeFlag := addFolderCmd.String("type", "", "Library type: mixed, photos, music or videos (default mixed)")
+		watchModeFlag := addFolderCmd.String("watch", "", "How serve detects changes: auto, watch or poll (default auto)")
+		pollIntervalFlag := addFolderCmd.Duration("poll-interval", 0, "Rescan interval for poll mode (default: serve's -poll-interval)")
+		debounceFlag := addFolderCmd.Duration("debounce", 0, "How long this folder's file events settle before indexing (default: serve's -watch-debounce)")
+		previewFlag := addFolderCmd.Bool("preview", false, "Only report how many files of each media type the folder contains")
+		forceFlag := addFolderCmd.Bool("force", false, "Add the folder even if it exceeds -max-files or -max-size")
+		maxFilesFlag := addFolderCmd.Int("max-files", scanner.DefaultMaxFiles, "Refuse folders with more files than this without -force (0 disables)")
+		maxSizeFlag := addFolderCmd.String("max-size", scanner.FormatSize(scanner.DefaultMaxBytes), "Refuse folders larger than this without -force, e.g. 500G (0 disables)")
 
 		addFolderCmd.Usage = func() {
 			fmt.Fprintf(os.Stderr, "Usage: \n")
-			fmt.Fprintf(os.Stderr, "  %s addfolder <folder>\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "  %s addfolder [options] <folder>\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Options:\n")
 			addFolderCmd.PrintDefaults()
 		}
-		if err := addFolderCmd.Parse(os.Args[2:]); err != nil {
+		if err := addFolderCmd.Parse(cmdArgs[1:]); err != nil {
 			addFolderCmd.Usage()
 			os.Exit(2)
 		}
@@ -59,6 +192,53 @@ func main() {
 
 		folder := args[0]
 
+		var libraryType scanner.LibraryType
+		if *libraryTypeFlag != "" {
+			lt, err := scanner.ParseLibraryType(*libraryTypeFlag)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(2)
+			}
+			libraryType = lt
+		}
+
+		var watchMode monitor.Mode
+		if *watchModeFlag != "" {
+			wm, err := monitor.ParseMode(*watchModeFlag)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(2)
+			}
+			watchMode = wm
+		}
+		if *pollIntervalFlag != 0 && *pollIntervalFlag < monitor.MinPollInterval {
+			fmt.Fprintf(os.Stderr, "Error: poll interval must be at least %s\n", monitor.MinPollInterval)
+			os.Exit(2)
+		}
+		if *debounceFlag != 0 && *debounceFlag < monitor.MinDebounceTime {
+			fmt.Fprintf(os.Stderr, "Error: debounce must be at least %s\n", monitor.MinDebounceTime)
+			os.Exit(2)
+		}
+
+		if *previewFlag {
+			if err := previewFolder(folder); err != nil {
+				fmt.Fprintln(os.Stderr, "Error previewing folder:", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		limits, err := parseLimits(*maxFilesFlag, *maxSizeFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(2)
+		}
+		if err := checkFolderSize(folder, limits, *forceFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			fmt.Fprintln(os.Stderr, "Run with -preview to see what the folder contains")
+			os.Exit(1)
+		}
+
 		database, err := initDB(q2Dir)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "Error initializing database:", err)
@@ -66,11 +246,24 @@ func main() {
 		}
 		defer database.Close()
 
-		if err := addFolder(folder, database); err != nil {
+		if err := addFolderWithType(folder, libraryType, database); err != nil {
 			fmt.Fprintln(os.Stderr, "Error adding folder:", err)
 			os.Exit(1)
 		}
 
+		if watchMode != "" || *pollIntervalFlag != 0 {
+			if err := setFolderWatchMode(folder, watchMode, *pollIntervalFlag, database); err != nil {
+				fmt.Fprintln(os.Stderr, "Error setting watch mode:", err)
+				os.Exit(1)
+			}
+		}
+		if *debounceFlag != 0 {
+			if err := setFolderDebounce(folder, *debounceFlag, database); err != nil {
+				fmt.Fprintln(os.Stderr, "Error setting debounce:", err)
+				os.Exit(1)
+			}
+		}
+
 	case "removefolder":
 		removeFolderCmd := flag.NewFlagSet("removefolder", flag.ContinueOnError)
 
@@ -79,7 +272,7 @@ func main() {
 			fmt.Fprintf(os.Stderr, "  %s removefolder <folder>\n\n", os.Args[0])
 			removeFolderCmd.PrintDefaults()
 		}
-		if err := removeFolderCmd.Parse(os.Args[2:]); err != nil {
+		if err := removeFolderCmd.Parse(cmdArgs[1:]); err != nil {
 			removeFolderCmd.Usage()
 			os.Exit(2)
 		}
@@ -101,11 +294,46 @@ func main() {
 		}
 		defer database.Close()
 
-		if err := removeFolder(folder, database); err != nil {
+		if err := removeFolder(folder, database, q2Dir); err != nil {
 			fmt.Fprintln(os.Stderr, "Error removing folder:", err)
 			os.Exit(1)
 		}
 
+	case "relocatefolder":
+		relocateFolderCmd := flag.NewFlagSet("relocatefolder", flag.ContinueOnError)
+
+		relocateFolderCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: \n")
+			fmt.Fprintf(os.Stderr, "  %s relocatefolder <folder> <new folder>\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Points a stored folder at where its files were moved, keeping everything\n")
+			fmt.Fprintf(os.Stderr, "indexed about them, instead of removing it and adding the new folder.\n")
+			relocateFolderCmd.PrintDefaults()
+		}
+		if err := relocateFolderCmd.Parse(cmdArgs[1:]); err != nil {
+			relocateFolderCmd.Usage()
+			os.Exit(2)
+		}
+
+		args := relocateFolderCmd.Args()
+
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "relocatefolder requires a <folder> and a <new folder>")
+			relocateFolderCmd.Usage()
+			os.Exit(2)
+		}
+
+		database, err := initDB(q2Dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error initializing database:", err)
+			os.Exit(1)
+		}
+		defer database.Close()
+
+		if err := relocateFolder(args[0], args[1], database); err != nil {
+			fmt.Fprintln(os.Stderr, "Error moving folder:", err)
+			os.Exit(1)
+		}
+
 	case "listfolders":
 		database, err := initDB(q2Dir)
 		if err != nil {
@@ -121,16 +349,21 @@ func main() {
 
 	case "scan":
 		scanCmd := flag.NewFlagSet("scan", flag.ContinueOnError)
+		forceFlag := scanCmd.Bool("force", false, "Scan the folder even if it exceeds -max-files or -max-size")
+		maxFilesFlag := scanCmd.Int("max-files", scanner.DefaultMaxFiles, "Refuse folders with more files than this without -force (0 disables)")
+		maxSizeFlag := scanCmd.String("max-size", scanner.FormatSize(scanner.DefaultMaxBytes), "Refuse folders larger than this without -force, e.g. 500G (0 disables)")
+		thumbnailsFlag := scanCmd.Bool("thumbnails", false, "Generate missing thumbnails for indexed images and videos after scanning")
 
 		scanCmd.Usage = func() {
 			fmt.Fprintf(os.Stderr, "Usage: \n")
-			fmt.Fprintf(os.Stderr, "  %s scan <folder>\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "  %s scan [options] <folder>\n\n", os.Args[0])
 			fmt.Fprintf(os.Stderr, "Scans a folder for files and adds them to the database.\n")
 			fmt.Fprintf(os.Stderr, "The folder must be within a monitored folder.\n\n")
+			fmt.Fprintf(os.Stderr, "Options:\n")
 			scanCmd.PrintDefaults()
 		}
 
-		if err := scanCmd.Parse(os.Args[2:]); err != nil {
+		if err := scanCmd.Parse(cmdArgs[1:]); err != nil {
 			scanCmd.Usage()
 			os.Exit(2)
 		}
@@ -167,6 +400,16 @@ func main() {
 			os.Exit(1)
 		}
 
+		limits, err := parseLimits(*maxFilesFlag, *maxSizeFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(2)
+		}
+		if err := checkFolderSize(folder, limits, *forceFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+
 		database, err := initDB(q2Dir)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "Error initializing database:", err)
@@ -183,16 +426,29 @@ func main() {
 
 		fmt.Printf("Scanning %s (monitored folder: %s)...\n", folder, parentPath)
 
-		// Perform the scan
-		result, err := scanner.ScanFolder(database, folder, folderID)
+		// Perform the scan; Ctrl-C stops it at a checkpoint the next scan resumes from
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		progress := newScanProgressPrinter(os.Stdout)
+		result, err := scanner.ScanFolderContext(ctx, database, folder, folderID, progress.update)
+		progress.finish()
+		stop()
+		if err != nil && ctx.Err() != nil {
+			fmt.Fprintf(os.Stderr, "Scan interrupted after %d added, %d updated; run scan again to continue where it stopped\n",
+				result.FilesAdded, result.FilesUpdated)
+			os.Exit(1)
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error scanning folder: %v\n", err)
 			os.Exit(1)
 		}
 
 		// Report results
-		fmt.Printf("Scan complete: %d added, %d updated, %d removed\n",
-			result.FilesAdded, result.FilesUpdated, result.FilesRemoved)
+		resumed := ""
+		if result.Resumed {
+			resumed = " (resumed from an interrupted scan)"
+		}
+		fmt.Printf("Scan complete%s: %d added, %d updated, %d removed\n",
+			resumed, result.FilesAdded, result.FilesUpdated, result.FilesRemoved)
 
 		if len(result.Errors) > 0 {
 			fmt.Printf("%d errors encountered:\n", len(result.Errors))
@@ -201,9 +457,350 @@ func main() {
 			}
 		}
 
+		if *thumbnailsFlag {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			ffmpegMgr := ffmpeg.NewManager(filepath.Join(q2Dir, "bin"))
+			applyRuntimeSettings(nil, loadRuntimeSettings(database))
+			enriched, err := media.EnrichThumbnails(ctx, database, thumbnailStore(database, q2Dir), ffmpegMgr, currentThumbnailWorkers)
+			stop()
+			if err != nil && ctx.Err() != nil {
+				fmt.Fprintf(os.Stderr, "Thumbnail generation interrupted after %d files; run scan -thumbnails again to continue\n", enriched.Enriched)
+				os.Exit(1)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error generating thumbnails: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Thumbnails: %d generated, %d failed\n", enriched.Enriched, enriched.Failed)
+		}
+
+	case "verify-thumbnails":
+		verifyCmd := flag.NewFlagSet("verify-thumbnails", flag.ContinueOnError)
+		dryRunFlag := verifyCmd.Bool("dry-run", false, "Only list files whose thumbnails are missing")
+		quietFlag := verifyCmd.Bool("quiet", false, "Don't report ffmpeg download progress")
+		gcFlag := verifyCmd.Bool("gc", false, "Also delete cached thumbnails of files no longer indexed (not with -dry-run)")
+
+		verifyCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: \n")
+			fmt.Fprintf(os.Stderr, "  %s verify-thumbnails [options]\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Checks every thumbnail recorded in the database exists on disk and\n")
+			fmt.Fprintf(os.Stderr, "regenerates missing ones, e.g. after the thumbnail cache was cleared.\n")
+			fmt.Fprintf(os.Stderr, "Thumbnails that cannot be regenerated are removed from the database.\n\n")
+			fmt.Fprintf(os.Stderr, "Options:\n")
+			verifyCmd.PrintDefaults()
+		}
+
+		if err := verifyCmd.Parse(cmdArgs[1:]); err != nil {
+			verifyCmd.Usage()
+			os.Exit(2)
+		}
+
+		database, err := initDB(q2Dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error initializing database:", err)
+			os.Exit(1)
+		}
+		defer database.Close()
+
+		ffmpegMgr := ffmpeg.NewManager(filepath.Join(q2Dir, "bin"))
+		ffmpegMgr.Logger = ffmpegLogger(*quietFlag)
+		check, err := verifyThumbnails(context.Background(), database, q2Dir, ffmpegMgr, *dryRunFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error verifying thumbnails: %v\n", err)
+			os.Exit(1)
+		}
+
+		if *dryRunFlag {
+			fmt.Printf("Checked %d files: %d with missing thumbnails\n", check.Checked, check.Missing)
+		} else {
+			fmt.Printf("Checked %d files: %d missing, %d regenerated, %d cleared\n",
+				check.Checked, check.Missing, check.Regenerated, check.Cleared)
+		}
+
+		if *gcFlag && !*dryRunFlag {
+			removed, bytes, err := media.GCThumbnails(database, q2Dir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error removing unused thumbnails: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Removed %d unused thumbnails (%s)\n", removed, scanner.FormatSize(bytes))
+		}
+
+	case "refresh-metadata":
+		refreshCmd := flag.NewFlagSet("refresh-metadata", flag.ContinueOnError)
+		quietFlag := refreshCmd.Bool("quiet", false, "Don't report ffmpeg download progress")
+		refreshCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: \n")
+			fmt.Fprintf(os.Stderr, "  %s refresh-metadata [options] [path]\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Reads the metadata of indexed files again, replacing what was stored,\n")
+			fmt.Fprintf(os.Stderr, "so edits to a photo's EXIF or keywords or a track's tags show up.\n")
+			fmt.Fprintf(os.Stderr, "path is a file or a directory; without one, every folder is read.\n\n")
+			fmt.Fprintf(os.Stderr, "Options:\n")
+			refreshCmd.PrintDefaults()
+		}
+		if err := refreshCmd.Parse(cmdArgs[1:]); err != nil || refreshCmd.NArg() > 1 {
+			refreshCmd.Usage()
+			os.Exit(2)
+		}
+
+		database, err := initDB(q2Dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error initializing database:", err)
+			os.Exit(1)
+		}
+		defer database.Close()
+
+		ffmpegMgr := ffmpeg.NewManager(filepath.Join(q2Dir, "bin"))
+		ffmpegMgr.Logger = ffmpegLogger(*quietFlag)
+		result, err := rereadMetadata(context.Background(), database, ffmpegMgr, refreshCmd.Arg(0), os.Stderr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error refreshing metadata: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Refreshed %d files, %d without metadata, %d failed\n", result.Refreshed, result.Skipped, result.Failed)
+
+	case "coverage":
+		database, err := initDB(q2Dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error initializing database:", err)
+			os.Exit(1)
+		}
+		defer database.Close()
+
+		if err := printCoverage(database); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+
+	case "exportalbum":
+		exportCmd := flag.NewFlagSet("exportalbum", flag.ContinueOnError)
+		linkFlag := exportCmd.Bool("link", false, "Hard-link files instead of copying them where the destination is on the same filesystem")
+		exportCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: \n")
+			fmt.Fprintf(os.Stderr, "  %s exportalbum [options] <album id> <directory>\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Copies an album's files into <directory>, created if missing, numbered in album order.\n")
+			fmt.Fprintf(os.Stderr, "Existing files are kept; clashing names get a \" (2)\" suffix.\n\n")
+			fmt.Fprintf(os.Stderr, "Options:\n")
+			exportCmd.PrintDefaults()
+		}
+		if err := exportCmd.Parse(cmdArgs[1:]); err != nil {
+			exportCmd.Usage()
+			os.Exit(2)
+		}
+
+		args := exportCmd.Args()
+		if len(args) != 2 {
+			exportCmd.Usage()
+			os.Exit(2)
+		}
+		albumID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil || albumID <= 0 {
+			fmt.Fprintln(os.Stderr, "Error: invalid album id", args[0])
+			os.Exit(2)
+		}
+
+		database, err := initDB(q2Dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error initializing database:", err)
+			os.Exit(1)
+		}
+		defer database.Close()
+
+		result, err := exportAlbum(database, albumID, args[1], *linkFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error exporting album:", err)
+			os.Exit(1)
+		}
+		for _, path := range result.Missing {
+			fmt.Fprintln(os.Stderr, "Warning: skipped missing file", path)
+		}
+		fmt.Printf("Exported %d files to %s", len(result.Files), result.Dest)
+		if *linkFlag {
+			fmt.Printf(" (%d hard-linked, %d copied)", result.Linked, len(result.Files)-result.Linked)
+		}
+		fmt.Println()
+
+	case "backup":
+		backupCmd := flag.NewFlagSet("backup", flag.ContinueOnError)
+		backupCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: \n")
+			fmt.Fprintf(os.Stderr, "  %s backup <file>\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Writes a consistent copy of the database to <file>, which must not exist.\n")
+			fmt.Fprintf(os.Stderr, "Safe to run while q2 is serving.\n")
+		}
+		if err := backupCmd.Parse(cmdArgs[1:]); err != nil {
+			backupCmd.Usage()
+			os.Exit(2)
+		}
+
+		args := backupCmd.Args()
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "backup requires exactly one <file>")
+			backupCmd.Usage()
+			os.Exit(2)
+		}
+		dest, err := filepath.Abs(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+
+		database, err := initDB(q2Dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error initializing database:", err)
+			os.Exit(1)
+		}
+		defer database.Close()
+
+		if err := database.Backup(dest); err != nil {
+			fmt.Fprintln(os.Stderr, "Error backing up database:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Database backed up to %s\n", dest)
+
+	case "migrate":
+		migrateCmd := flag.NewFlagSet("migrate", flag.ContinueOnError)
+		dryRunFlag := migrateCmd.Bool("dry-run", false, "List the pending migrations in the order they would run, without applying them")
+		migrateCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: \n")
+			fmt.Fprintf(os.Stderr, "  %s migrate [options]\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "  %s migrate down [n]\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "  %s migrate status\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Applies pending database migrations, as every command does on start.\n")
+			fmt.Fprintf(os.Stderr, "down rolls back the last n (default 1) to go back to an older q2; any other\n")
+			fmt.Fprintf(os.Stderr, "command of this version applies them again. status lists applied and pending ones.\n\n")
+			fmt.Fprintf(os.Stderr, "Options:\n")
+			migrateCmd.PrintDefaults()
+		}
+		if err := migrateCmd.Parse(cmdArgs[1:]); err != nil {
+			migrateCmd.Usage()
+			os.Exit(2)
+		}
+
+		args := migrateCmd.Args()
+		var err error
+		switch {
+		case len(args) == 0:
+			err = migrateUp(q2Dir, *dryRunFlag, os.Stdout)
+		case args[0] == "down" && len(args) <= 2:
+			n := 1
+			if len(args) == 2 {
+				if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+					fmt.Fprintln(os.Stderr, "Error: invalid migration count", args[1])
+					os.Exit(2)
+				}
+			}
+			err = migrateDown(q2Dir, n, os.Stdout)
+		case args[0] == "status" && len(args) == 1:
+			err = migrateStatus(q2Dir, os.Stdout)
+		default:
+			migrateCmd.Usage()
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error migrating database:", err)
+			os.Exit(1)
+		}
+
+	case "doctor":
+		doctorCmd := flag.NewFlagSet("doctor", flag.ContinueOnError)
+		pruneFlag := doctorCmd.Bool("prune", false, "Remove missing folders with their files and thumbnails")
+		doctorCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: \n")
+			fmt.Fprintf(os.Stderr, "  %s doctor [options]\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Checks that stored folders still exist and that ffmpeg resolves.\n")
+			fmt.Fprintf(os.Stderr, "Exits with status 1 while a folder cannot be used.\n\n")
+			fmt.Fprintf(os.Stderr, "Options:\n")
+			doctorCmd.PrintDefaults()
+		}
+		if err := doctorCmd.Parse(cmdArgs[1:]); err != nil || doctorCmd.NArg() != 0 {
+			doctorCmd.Usage()
+			os.Exit(2)
+		}
+
+		database, err := initDB(q2Dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error initializing database:", err)
+			os.Exit(1)
+		}
+		defer database.Close()
+
+		report, err := runDoctor(database, q2Dir, ffmpeg.NewManager(filepath.Join(q2Dir, "bin")), *pruneFlag, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		if !report.healthy() {
+			os.Exit(1)
+		}
+
+	case "config":
+		opts := newServeFlags()
+		opts.fs.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: \n")
+			fmt.Fprintf(os.Stderr, "  %s config [serve options]\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Shows the configuration serve would run with given the same options: each value\n")
+			fmt.Fprintf(os.Stderr, "and whether it is a default, from the environment, a flag, stored in settings\n")
+			fmt.Fprintf(os.Stderr, "(overriding the flag) or derived. Secrets are redacted.\n\n")
+			fmt.Fprintf(os.Stderr, "Options:\n")
+			opts.fs.PrintDefaults()
+		}
+		if err := opts.fs.Parse(cmdArgs[1:]); err != nil || opts.fs.NArg() != 0 {
+			opts.fs.Usage()
+			os.Exit(2)
+		}
+
+		database, err := initDB(q2Dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error initializing database:", err)
+			os.Exit(1)
+		}
+		defer database.Close()
+
+		printConfig(os.Stdout, effectiveConfig(opts, database, q2Dir, ffmpeg.NewManager(filepath.Join(q2Dir, "bin"))))
+
+	case "apikey":
+		apikeyCmd := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		nameFlag := apikeyCmd.String("name", "", "Label to tell the key apart, e.g. the device using it")
+		apikeyCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: \n")
+			fmt.Fprintf(os.Stderr, "  %s apikey create [options]\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Generates an API key for serve -require-api-key and prints it.\n")
+			fmt.Fprintf(os.Stderr, "Only a hash is stored, so the key is shown this once.\n\n")
+			fmt.Fprintf(os.Stderr, "Options:\n")
+			apikeyCmd.PrintDefaults()
+		}
+		if len(cmdArgs) < 2 || cmdArgs[1] != "create" {
+			apikeyCmd.Usage()
+			os.Exit(2)
+		}
+		if err := apikeyCmd.Parse(cmdArgs[2:]); err != nil {
+			apikeyCmd.Usage()
+			os.Exit(2)
+		}
+		if apikeyCmd.NArg() != 0 {
+			apikeyCmd.Usage()
+			os.Exit(2)
+		}
+
+		database, err := initDB(q2Dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error initializing database:", err)
+			os.Exit(1)
+		}
+		defer database.Close()
+
+		key, err := serverauth.CreateKey(database, *nameFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating API key:", err)
+			os.Exit(1)
+		}
+		fmt.Println(key)
+		fmt.Fprintln(os.Stderr, "Store this key now; it cannot be shown again. Send it as the X-API-Key header or the api_key query parameter.")
+
 	case "serve":
-		serveCmd := flag.NewFlagSet("serve", flag.ContinueOnError)
-		port := serveCmd.Int("port", 8090, "Port to listen on")
+		opts := newServeFlags()
+		serveCmd := opts.fs
 
 		serveCmd.Usage = func() {
 			fmt.Fprintf(os.Stderr, "Usage: \n")
@@ -212,10 +809,55 @@ func main() {
 			serveCmd.PrintDefaults()
 		}
 
-		if err := serveCmd.Parse(os.Args[2:]); err != nil {
+		if err := serveCmd.Parse(cmdArgs[1:]); err != nil {
 			serveCmd.Usage()
 			os.Exit(2)
 		}
+		level, err := parseLogLevel(*opts.logLevel)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		serverLogLevel.Set(level)
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: &serverLogLevel})))
+
+		watcherConfig := monitor.WatcherConfig{DebounceTime: *opts.watchDebounce, MaxActivities: *opts.maxActivities, BurstEvents: *opts.watchBurst}
+		if err := watcherConfig.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		if err := ffmpeg.ValidateVideoEncoding(*opts.transcodePreset, *opts.transcodeCRF); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		if *opts.scanConcurrency < 1 || *opts.scanConcurrency > monitor.MaxScanConcurrency {
+			fmt.Fprintf(os.Stderr, "Error: scan concurrency must be between 1 and %d\n", monitor.MaxScanConcurrency)
+			os.Exit(2)
+		}
+		if (*opts.tlsCert == "") != (*opts.tlsKey == "") {
+			fmt.Fprintln(os.Stderr, "Error: -tls-cert and -tls-key must be given together")
+			os.Exit(2)
+		}
+		if *opts.tlsSelfSigned && *opts.tlsCert != "" {
+			fmt.Fprintln(os.Stderr, "Error: -tls-selfsigned cannot be combined with -tls-cert")
+			os.Exit(2)
+		}
+
+		certFile, keyFile := *opts.tlsCert, *opts.tlsKey
+		if *opts.tlsSelfSigned {
+			var err error
+			if certFile, keyFile, err = ensureSelfSignedCert(q2Dir); err != nil {
+				fmt.Fprintln(os.Stderr, "Error creating self-signed certificate:", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Using self-signed certificate %s; browsers will warn about it, and cast devices won't load media from it\n", certFile)
+		}
+		if certFile != "" {
+			if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+				fmt.Fprintln(os.Stderr, "Error loading TLS certificate:", err)
+				os.Exit(1)
+			}
+		}
 
 		database, err := initDB(q2Dir)
 		if err != nil {
@@ -224,6 +866,13 @@ func main() {
 		}
 		defer database.Close()
 
+		if *opts.requireAPIKey {
+			if n, err := serverauth.CountKeys(database); err != nil || n == 0 {
+				fmt.Fprintf(os.Stderr, "Error: -require-api-key needs an API key; create one with %s apikey create\n", os.Args[0])
+				os.Exit(1)
+			}
+		}
+
 		fmt.Println("Q2")
 
 		// Ensure playlists folder exists and is monitored
@@ -235,10 +884,80 @@ func main() {
 
 		// Create cast manager - base URL will be set when first request comes in
 		castMgr := cast.NewManager("")
+		castMgr.DeviceTTL = *opts.castCacheTTL
+
+		// Watch monitored folders for changes (polling those that can't be watched)
+		mon := monitor.New(database, monitor.Config{
+			PollInterval:      *opts.pollInterval,
+			ReconcileInterval: *opts.folderSyncInterval,
+			ScanConcurrency:   *opts.scanConcurrency,
+			StartupScanAge:    *opts.startupScanAge,
+			Watcher:           watcherConfig,
+		})
+		// Settings changed through /api/settings/runtime outlast the flags
+		applyRuntimeSettings(mon, loadRuntimeSettings(database))
+		if err := mon.Start(); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: could not start folder monitor:", err)
+		}
+
+		// Resolve place names for geotagged photos in the background
+		enrichCtx, stopEnrich := context.WithCancel(context.Background())
+		enrichDone := make(chan struct{})
+		if *opts.geocode {
+			go func() {
+				defer close(enrichDone)
+				runLocationEnrichment(enrichCtx, database, &media.NominatimGeocoder{}, 10*time.Minute)
+			}()
+		} else {
+			close(enrichDone)
+		}
+
+		// Keep the WAL from growing while the monitor writes continuously
+		checkpointCtx, stopCheckpoints := context.WithCancel(context.Background())
+		checkpointsDone := make(chan struct{})
+		if *opts.checkpointInterval > 0 {
+			go func() {
+				defer close(checkpointsDone)
+				runWALCheckpoints(checkpointCtx, database, *opts.checkpointInterval)
+			}()
+		} else {
+			close(checkpointsDone)
+		}
+
+		// Purge files that stayed missing from disk past the grace period
+		purgeCtx, stopPurge := context.WithCancel(context.Background())
+		purgeDone := make(chan struct{})
+		if *opts.trashGrace > 0 {
+			go func() {
+				defer close(purgeDone)
+				runTrashPurge(purgeCtx, database, *opts.trashGrace)
+			}()
+		} else {
+			close(purgeDone)
+		}
 
 		// Create ffmpeg manager for video transcoding
 		ffmpegBinDir := filepath.Join(q2Dir, "bin")
 		ffmpegMgr := ffmpeg.NewManager(ffmpegBinDir)
+		ffmpegMgr.MaxConcurrent = *opts.ffmpegMaxConcurrent
+		ffmpegMgr.VideoPreset, ffmpegMgr.VideoCRF = *opts.transcodePreset, *opts.transcodeCRF
+		ffmpegMgr.Logger = ffmpegLogger(*opts.quiet)
+
+		// Reload the runtime settings on SIGHUP, e.g. after editing the settings table directly
+		stopReload := reloadOnHangup(database, mon, ffmpegMgr)
+
+		// Generate thumbnails for newly indexed files in the background, yielding to requests
+		thumbnailIdleAfter.Store(int64(*opts.thumbnailIdle))
+		thumbnailCtx, stopThumbnails := context.WithCancel(context.Background())
+		thumbnailsDone := make(chan struct{})
+		if *opts.thumbnailInterval > 0 {
+			go func() {
+				defer close(thumbnailsDone)
+				runThumbnailEnrichment(thumbnailCtx, database, q2Dir, ffmpegMgr, *opts.thumbnailInterval)
+			}()
+		} else {
+			close(thumbnailsDone)
+		}
 
 		// Set up HTTP handlers
 		mux := http.NewServeMux()
@@ -249,10 +968,15 @@ func main() {
 		mux.HandleFunc("/schema", makeSchemaHandler(database))
 		mux.HandleFunc("/api/roots", makeRootsHandler(database))
 		mux.HandleFunc("/api/browse", makeBrowseHandler(database, q2Dir))
+		mux.HandleFunc("/api/tree", makeTreeHandler(database))
+		mux.HandleFunc("/api/timeline", makeTimelineHandler(database))
+		mux.HandleFunc("/api/files", makeFilesHandler(database))
+		mux.HandleFunc("/api/map", makeMapHandler(database))
 		mux.HandleFunc("/api/stream", makeStreamHandler(database))
-		mux.HandleFunc("/api/image", makeImageHandler(database))
-		mux.HandleFunc("/api/thumbnail", makeThumbnailHandler(database, q2Dir))
+		mux.HandleFunc("/api/image", makeImageHandler(database, q2Dir, ffmpegMgr))
+		mux.HandleFunc("/api/thumbnail", makeThumbnailHandler(database, q2Dir, ffmpegMgr))
 		mux.HandleFunc("/api/video", makeVideoHandler(database, ffmpegMgr))
+		mux.HandleFunc("/api/subtitles", makeSubtitlesHandler(database, q2Dir, ffmpegMgr))
 
 		// Cast API endpoints
 		mux.HandleFunc("/api/cast/devices", makeCastDevicesHandler(castMgr))
@@ -281,6 +1005,7 @@ func main() {
 		mux.HandleFunc("/api/album/remove", makeAlbumRemoveHandler(database))
 		mux.HandleFunc("/api/album/reorder", makeAlbumReorderHandler(database))
 		mux.HandleFunc("/api/album/check", makeAlbumCheckHandler(database))
+		mux.HandleFunc("/api/album/export", makeAlbumExportHandler(database, *opts.apiToken))
 
 		// Music library API endpoints
 		mux.HandleFunc("/api/music/artists", makeMusicArtistsHandler(database))
@@ -310,14 +1035,39 @@ func main() {
 				settingsPost(w, r)
 			}
 		})
-		mux.HandleFunc("/api/folders/add", makeFolderAddHandler(database))
-		mux.HandleFunc("/api/folders/remove", makeFolderRemoveHandler(database))
+		mux.HandleFunc("/api/settings/runtime", makeRuntimeSettingsHandler(database, mon, ffmpegMgr, *opts.apiToken))
+		mux.HandleFunc("/api/config", makeConfigHandler(opts, database, q2Dir, ffmpegMgr))
+		mux.HandleFunc("/api/folders/add", makeFolderAddHandler(database, mon, *opts.apiToken))
+		mux.HandleFunc("/api/folders/remove", makeFolderRemoveHandler(database, mon, q2Dir, *opts.apiToken))
+		mux.HandleFunc("/api/folders", makeFoldersHandler(database, mon, *opts.apiToken))
+		mux.HandleFunc("/api/folders/", makeFolderHandler(database, mon, q2Dir, *opts.apiToken))
+		mux.HandleFunc("/api/monitor/status", makeMonitorStatusHandler(mon))
+		mux.HandleFunc("/api/thumbnails/status", makeThumbnailStatusHandler(ffmpegMgr))
+		mux.HandleFunc("/api/scan", makeScanHandler(mon, *opts.apiToken))
+		mux.HandleFunc("/api/db/stats", makeDBStatsHandler(database))
+		mux.HandleFunc("/api/stats", makeStatsHandler(database, mon))
+		mux.HandleFunc("/api/coverage", makeCoverageHandler(database))
+		mux.HandleFunc("/api/download/zip", makeDownloadZipHandler(database))
 
 		// Inbox endpoints
 		mux.HandleFunc("/api/inbox/upload", makeInboxUploadHandler(database, q2Dir, ffmpegMgr))
 		mux.HandleFunc("/api/inbox/status", makeInboxStatusHandler())
 		mux.HandleFunc("/api/inbox/clear", makeInboxClearHandler())
 
+		// Middleware: require an API key if asked to
+		var routes http.Handler = mux
+		if *opts.requireAPIKey {
+			routes = serverauth.Middleware(database, serverauth.ParseAllow(*opts.authAllow), mux)
+		}
+
+		// Middleware: gzip JSON and text responses for clients that accept it
+		routes = gzipMiddleware(routes)
+
+		// Middleware: let other origins call the API if asked to; preflights skip authentication
+		if origins := parseOrigins(*opts.corsOrigin); len(origins) > 0 {
+			routes = corsMiddleware(origins, routes)
+		}
+
 		// Middleware: keep the cast manager's base URL in sync with each request's host.
 		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			scheme := "http"
@@ -325,13 +1075,13 @@ func main() {
 				scheme = "https"
 			}
 			castMgr.SetBaseURL(fmt.Sprintf("%s://%s", scheme, r.Host))
-			mux.ServeHTTP(w, r)
+			routes.ServeHTTP(w, r)
 		})
 
-		addr := fmt.Sprintf(":%d", *port)
+		addr := fmt.Sprintf(":%d", *opts.port)
 		server := &http.Server{
 			Addr:    addr,
-			Handler: handler,
+			Handler: accessLogMiddleware(slog.Default(), serverActivity.middleware(handler)),
 		}
 
 		// Handle shutdown signals
@@ -340,13 +1090,23 @@ func main() {
 
 		// Start server in goroutine
 		go func() {
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			var err error
+			if certFile != "" {
+				err = server.ListenAndServeTLS(certFile, keyFile)
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
 				fmt.Fprintln(os.Stderr, "Server error:", err)
 				os.Exit(1)
 			}
 		}()
 
-		fmt.Printf("Listening on port %s\n", addr)
+		if certFile != "" {
+			fmt.Printf("Listening on port %s (HTTPS)\n", addr)
+		} else {
+			fmt.Printf("Listening on port %s\n", addr)
+		}
 
 		// Wait for shutdown signal
 		<-sigChan
@@ -359,10 +1119,22 @@ func main() {
 			fmt.Fprintln(os.Stderr, "Server shutdown error:", err)
 		}
 
+		// Stop background work before the deferred database close
+		stopReload()
+		stopEnrich()
+		<-enrichDone
+		stopThumbnails()
+		<-thumbnailsDone
+		mon.Stop()
+		stopCheckpoints()
+		<-checkpointsDone
+		stopPurge()
+		<-purgeDone
+
 		fmt.Println("Shutdown complete")
 
 	default:
-		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", os.Args[1])
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", cmdArgs[0])
 		flag.Usage()
 		os.Exit(2)
 
@@ -1,22 +1,46 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"jukel.org/q2/cast"
 	"jukel.org/q2/db"
+	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/media"
 	_ "jukel.org/q2/migrations"
+	"jukel.org/q2/monitor"
+	"jukel.org/q2/scanner"
+	"jukel.org/q2/serverauth"
 )
 
 // setupTestEnv creates a temporary directory structure for testing.
 // Returns the database, a test folder path, and a cleanup function.
-func setupTestEnv(t *testing.T) (*db.DB, string, func()) {
+func setupTestEnv(t testing.TB) (*db.DB, string, func()) {
 	tmpDir, err := os.MkdirTemp("", "q2-test-*")
 	if err != nil {
 		t.Fatalf("Failed to create temp dir: %v", err)
@@ -286,6 +310,237 @@ func TestAddFolder_WhitespaceHandling(t *testing.T) {
 	}
 }
 
+func TestAddFolderWithType_StoresLibraryType(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	if err := addFolderWithType(testFolder, scanner.LibraryMusic, database); err != nil {
+		t.Fatalf("addFolderWithType failed: %v", err)
+	}
+
+	var libraryType string
+	row := database.QueryRow("SELECT library_type FROM folders WHERE path = ?", normalizePath(testFolder))
+	if err := row.Scan(&libraryType); err != nil {
+		t.Fatalf("Failed to read library type: %v", err)
+	}
+	if libraryType != string(scanner.LibraryMusic) {
+		t.Errorf("Expected library type %q, got %q", scanner.LibraryMusic, libraryType)
+	}
+}
+
+func TestAddFolderWithType_DefaultsAndUpdates(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+
+	readType := func() string {
+		var lt string
+		row := database.QueryRow("SELECT library_type FROM folders WHERE path = ?", normalizePath(testFolder))
+		if err := row.Scan(&lt); err != nil {
+			t.Fatalf("Failed to read library type: %v", err)
+		}
+		return lt
+	}
+
+	if lt := readType(); lt != string(scanner.LibraryMixed) {
+		t.Errorf("Expected default library type %q, got %q", scanner.LibraryMixed, lt)
+	}
+
+	// Re-adding with an explicit type updates the existing folder
+	if err := addFolderWithType(testFolder, scanner.LibraryPhotos, database); err != nil {
+		t.Fatalf("addFolderWithType failed: %v", err)
+	}
+	if lt := readType(); lt != string(scanner.LibraryPhotos) {
+		t.Errorf("Expected library type %q after update, got %q", scanner.LibraryPhotos, lt)
+	}
+
+	// Re-adding without a type leaves it unchanged
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	if lt := readType(); lt != string(scanner.LibraryPhotos) {
+		t.Errorf("Expected library type to stay %q, got %q", scanner.LibraryPhotos, lt)
+	}
+}
+
+func TestSetFolderWatchMode(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+
+	readMode := func() (string, int64) {
+		var mode string
+		var seconds int64
+		row := database.QueryRow("SELECT watch_mode, poll_interval FROM folders WHERE path = ?", normalizePath(testFolder))
+		if err := row.Scan(&mode, &seconds); err != nil {
+			t.Fatalf("Failed to read watch mode: %v", err)
+		}
+		return mode, seconds
+	}
+
+	if mode, seconds := readMode(); mode != "auto" || seconds != 0 {
+		t.Errorf("Expected default auto/0, got %s/%d", mode, seconds)
+	}
+
+	if err := setFolderWatchMode(testFolder, monitor.ModePoll, 5*time.Minute, database); err != nil {
+		t.Fatalf("setFolderWatchMode failed: %v", err)
+	}
+	if mode, seconds := readMode(); mode != "poll" || seconds != 300 {
+		t.Errorf("Expected poll/300, got %s/%d", mode, seconds)
+	}
+
+	// A zero interval keeps the stored one
+	if err := setFolderWatchMode(testFolder, monitor.ModeWatch, 0, database); err != nil {
+		t.Fatalf("setFolderWatchMode failed: %v", err)
+	}
+	if mode, seconds := readMode(); mode != "watch" || seconds != 300 {
+		t.Errorf("Expected watch/300, got %s/%d", mode, seconds)
+	}
+
+	if err := setFolderWatchMode(testFolder, monitor.ModePoll, time.Second, database); err == nil {
+		t.Error("Expected error for a poll interval below the minimum")
+	}
+	if err := setFolderWatchMode(filepath.Join(testFolder, "missing"), monitor.ModePoll, 0, database); err == nil {
+		t.Error("Expected error for a folder that is not stored")
+	}
+}
+
+func TestSetFolderDebounce(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	folderID := addTestFolder(t, database, testFolder)
+	if err := setFolderDebounce(testFolder, 2*time.Second, database); err != nil {
+		t.Fatalf("setFolderDebounce failed: %v", err)
+	}
+
+	// The monitor applies it to the watched folder
+	mon := monitor.New(database, monitor.Config{})
+	if err := mon.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer mon.Stop()
+	if st := mon.Status().Folders[0]; st.ID != folderID || (st.Mode == monitor.ModeWatch && st.Debounce != "2s") {
+		t.Errorf("Expected a 2s debounce in status, got %+v", st)
+	}
+
+	if err := setFolderDebounce(testFolder, time.Millisecond, database); err == nil {
+		t.Error("Expected error for a debounce below the minimum")
+	}
+	if err := setFolderDebounce(filepath.Join(testFolder, "missing"), time.Second, database); err == nil {
+		t.Error("Expected error for a folder that is not stored")
+	}
+}
+
+func TestCheckFolderSize(t *testing.T) {
+	_, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	for i := 0; i < 5; i++ {
+		name := filepath.Join(testFolder, fmt.Sprintf("file%d.jpg", i))
+		if err := os.WriteFile(name, make([]byte, 1000), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	if err := checkFolderSize(testFolder, scanner.Limits{MaxFiles: 10, MaxBytes: 10000}, false); err != nil {
+		t.Errorf("Expected folder within limits to pass, got %v", err)
+	}
+
+	err := checkFolderSize(testFolder, scanner.Limits{MaxFiles: 3}, false)
+	if err == nil || !strings.Contains(err.Error(), "-force") {
+		t.Errorf("Expected file count error mentioning -force, got %v", err)
+	}
+	if err := checkFolderSize(testFolder, scanner.Limits{MaxBytes: 2500}, false); err == nil {
+		t.Error("Expected size error")
+	}
+	if err := checkFolderSize(testFolder, scanner.Limits{MaxFiles: 3}, true); err != nil {
+		t.Errorf("Expected -force to skip the check, got %v", err)
+	}
+
+	// Counting stops at the first file over the limit
+	est, err := scanner.EstimateFolder(testFolder, scanner.Limits{MaxFiles: 2})
+	if err != nil || !est.Exceeded || est.Files != 3 {
+		t.Errorf("Expected early exit after 3 files, got %+v, %v", est, err)
+	}
+}
+
+func TestPreviewFolder(t *testing.T) {
+	_, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	files := []string{"a.jpg", "b.PNG", "sub/c.mp4", "sub/d.mp3", "sub/deeper/e.flac", "notes.txt"}
+	for _, f := range files {
+		path := filepath.Join(testFolder, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	p, err := scanner.PreviewFolder(testFolder)
+	if err != nil {
+		t.Fatalf("PreviewFolder failed: %v", err)
+	}
+	want := scanner.Preview{Images: 2, Videos: 1, Audio: 2, Other: 1, Folders: 2}
+	if p != want {
+		t.Errorf("Expected %+v, got %+v", want, p)
+	}
+	if p.Total() != len(files) || p.EstimatedIndexBytes() <= 0 {
+		t.Errorf("Unexpected total %d or estimate %d", p.Total(), p.EstimatedIndexBytes())
+	}
+
+	if err := previewFolder(testFolder); err != nil {
+		t.Errorf("previewFolder failed: %v", err)
+	}
+	if err := previewFolder(filepath.Join(testFolder, "missing")); err == nil {
+		t.Error("Expected error for a missing folder")
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	tests := map[string]int64{"0": 0, "500": 500, "2K": 2048, "1.5G": 3 << 29, "2TB": 2 << 40, "2.0 TiB": 2 << 40}
+	for in, want := range tests {
+		limits, err := parseLimits(100, in)
+		if err != nil || limits.MaxBytes != want || limits.MaxFiles != 100 {
+			t.Errorf("parseLimits(100, %q) = %+v, %v; want %d bytes", in, limits, err, want)
+		}
+	}
+	if _, err := parseLimits(100, "lots"); err == nil {
+		t.Error("Expected error for invalid size")
+	}
+	if _, err := parseLimits(-1, "0"); err == nil {
+		t.Error("Expected error for negative file count")
+	}
+}
+
+func TestLibraryTypeFeatures(t *testing.T) {
+	music := scanner.LibraryMusic.Features()
+	if !music.AudioMetadata || music.VideoThumbnails || music.EXIF {
+		t.Errorf("Unexpected music library features: %+v", music)
+	}
+
+	photos := scanner.LibraryPhotos.Features()
+	if !photos.EXIF || photos.AudioMetadata {
+		t.Errorf("Unexpected photos library features: %+v", photos)
+	}
+
+	if _, err := scanner.ParseLibraryType("podcasts"); err == nil {
+		t.Error("Expected error for unknown library type")
+	}
+	if lt, err := scanner.ParseLibraryType(" Music "); err != nil || lt != scanner.LibraryMusic {
+		t.Errorf("ParseLibraryType(\" Music \") = %q, %v", lt, err)
+	}
+}
+
 func TestNormalizePath(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -328,6 +583,83 @@ func TestNormalizePath_CaseSensitivity(t *testing.T) {
 	}
 }
 
+func TestFolderCaseDetection(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+	want := scanner.DetectCaseInsensitive(testFolder)
+	defer scanner.SetCaseInsensitive(testFolder, false)
+
+	// Folders added by addfolder are probed as they are stored
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	added, err := getFolderRecord(database, "path = ?", normalizePath(testFolder))
+	if err != nil {
+		t.Fatalf("Folder not stored: %v", err)
+	}
+	if added.CaseInsensitive != want {
+		t.Errorf("Expected case_insensitive %v, got %v", want, added.CaseInsensitive)
+	}
+	entries, _ := os.ReadDir(testFolder)
+	if len(entries) != 0 {
+		t.Errorf("Expected the probe file removed, found %d entries", len(entries))
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	database, _, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	t.Setenv("Q2_API_TOKEN", "s3cret")
+	opts := newServeFlags()
+	if err := opts.fs.Parse([]string{"-port", "9000", "-scan-concurrency", "2"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	for key, value := range map[string]string{"scan_concurrency": "3", "thumbnail_mode": "crop"} {
+		if r := database.Write("INSERT INTO settings (key, value) VALUES (?, ?)", key, value); r.Err != nil {
+			t.Fatalf("Failed to store setting: %v", r.Err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	makeConfigHandler(opts, database, t.TempDir(), ffmpeg.NewManager(t.TempDir()))(rec, httptest.NewRequest(http.MethodGet, "/api/config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "s3cret") {
+		t.Error("Expected the API token redacted")
+	}
+	var config []ConfigValue
+	if err := json.Unmarshal(rec.Body.Bytes(), &config); err != nil {
+		t.Fatalf("Failed to decode config: %v", err)
+	}
+	got := map[string]ConfigValue{}
+	for _, v := range config {
+		got[v.Name] = v
+	}
+	for _, want := range []ConfigValue{
+		{"port", "9000", configFlag},
+		{"api-token", redacted, configEnv},
+		{"scan-concurrency", "3", configSettings}, // The stored setting wins over the flag
+		{"log-level", "info", configDefault},
+		{"thumbnail_mode", "crop", configSettings},
+		{"thumbnail_store", "central", configDefault},
+	} {
+		if got[want.Name] != want {
+			t.Errorf("Expected %+v, got %+v", want, got[want.Name])
+		}
+	}
+	if v := got["ffmpeg"]; v.Source != configDerived || v.Value == "" {
+		t.Errorf("Expected the derived ffmpeg path, got %+v", v)
+	}
+
+	var out strings.Builder
+	printConfig(&out, config)
+	if !strings.Contains(out.String(), "port ") || !strings.Contains(out.String(), " 9000 (flag)\n") {
+		t.Errorf("Expected one aligned line per value, got %q", out.String())
+	}
+}
+
 func TestInitDB(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "q2-initdb-test-*")
 	if err != nil {
@@ -362,6 +694,113 @@ func TestInitDB(t *testing.T) {
 	}
 }
 
+func TestInitDB_SchemaDrift(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	database, err := initDB(tmpDir)
+	if err != nil {
+		t.Fatalf("initDB failed: %v", err)
+	}
+	// A hand edit the migrations don't know about
+	if r := database.Write("ALTER TABLE files DROP COLUMN enriched_at"); r.Err != nil {
+		t.Fatalf("Failed to drop column: %v", r.Err)
+	}
+	database.Close()
+
+	database, err = initDB(tmpDir)
+	if err == nil {
+		database.Close()
+		t.Fatal("Expected initDB to reject the drifted schema")
+	}
+	if !strings.Contains(err.Error(), "table files is missing columns enriched_at") {
+		t.Errorf("Expected the missing column in the error, got %v", err)
+	}
+}
+
+func TestPlanMigrations(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	plan, err := planMigrations(tmpDir)
+	if err != nil {
+		t.Fatalf("planMigrations failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, dbFile)); !os.IsNotExist(err) {
+		t.Error("Expected planning not to create the database")
+	}
+
+	database, err := initDB(tmpDir)
+	if err != nil {
+		t.Fatalf("initDB failed: %v", err)
+	}
+	applied, err := database.GetAppliedMigrations()
+	database.Close()
+	if err != nil {
+		t.Fatalf("GetAppliedMigrations failed: %v", err)
+	}
+	if len(plan) == 0 || !slices.Equal(plan, applied) {
+		t.Errorf("Expected the plan to list every migration initDB applied:\n plan %v\n applied %v", plan, applied)
+	}
+
+	if plan, err := planMigrations(tmpDir); err != nil || len(plan) != 0 {
+		t.Errorf("Expected nothing to plan once migrated, got %v (%v)", plan, err)
+	}
+}
+
+func TestMigrateCommands(t *testing.T) {
+	tmpDir := t.TempDir()
+	plan, err := planMigrations(tmpDir)
+	if err != nil || len(plan) < 2 {
+		t.Fatalf("planMigrations failed: %v (%v)", plan, err)
+	}
+	last := plan[len(plan)-1]
+
+	var out strings.Builder
+	if err := migrateDown(tmpDir, 1, &out); !errors.Is(err, errNoDatabase) {
+		t.Errorf("Expected errNoDatabase rolling back a missing database, got %v", err)
+	}
+	if err := migrateStatus(tmpDir, &out); err != nil || !strings.HasSuffix(out.String(), fmt.Sprintf("0 applied, %d pending\n", len(plan))) {
+		t.Errorf("Expected every migration pending, got %q (%v)", out.String(), err)
+	}
+
+	out.Reset()
+	if err := migrateUp(tmpDir, false, &out); err != nil {
+		t.Fatalf("migrateUp failed: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != len(plan) || lines[len(lines)-1] != "Applied "+last {
+		t.Errorf("Expected every migration applied in order, got %q", out.String())
+	}
+
+	out.Reset()
+	if err := migrateDown(tmpDir, 2, &out); err != nil {
+		t.Fatalf("migrateDown failed: %v", err)
+	}
+	if want := fmt.Sprintf("Rolled back %s\nRolled back %s\n", last, plan[len(plan)-2]); out.String() != want {
+		t.Errorf("Expected the last two rolled back, newest first, got %q", out.String())
+	}
+	if err := migrateDown(tmpDir, 0, &out); err == nil {
+		t.Error("Expected an error rolling back no migrations")
+	}
+
+	out.Reset()
+	if err := migrateStatus(tmpDir, &out); err != nil {
+		t.Fatalf("migrateStatus failed: %v", err)
+	}
+	status := out.String()
+	if !strings.Contains(status, "applied  "+plan[0]+"\n") || !strings.Contains(status, "pending  "+last+"\n") ||
+		!strings.HasSuffix(status, fmt.Sprintf("%d applied, 2 pending\n", len(plan)-2)) {
+		t.Errorf("Expected the rolled back migrations pending, got %q", status)
+	}
+
+	out.Reset()
+	if err := migrateUp(tmpDir, true, &out); err != nil || !strings.HasPrefix(out.String(), "2 migrations would run:") {
+		t.Errorf("Expected a dry run listing 2 migrations, got %q (%v)", out.String(), err)
+	}
+	out.Reset()
+	if err := migrateUp(tmpDir, false, &out); err != nil || !strings.HasSuffix(out.String(), "Applied "+last+"\n") {
+		t.Errorf("Expected the rolled back migrations applied again, got %q (%v)", out.String(), err)
+	}
+}
+
 func TestInitDB_MigrationsApplied(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "q2-migrations-test-*")
 	if err != nil {
@@ -422,7 +861,7 @@ func TestRemoveFolder_Success(t *testing.T) {
 	}
 
 	// Remove it
-	err = removeFolder(testFolder, database)
+	err = removeFolder(testFolder, database, t.TempDir())
 	if err != nil {
 		t.Fatalf("removeFolder failed: %v", err)
 	}
@@ -434,11 +873,96 @@ func TestRemoveFolder_Success(t *testing.T) {
 	}
 }
 
+func TestDataDirFlag(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv(dataDirEnv, "")
+
+	parse := func(args ...string) (string, []string) {
+		fs := flag.NewFlagSet("q2", flag.ContinueOnError)
+		dataDir := dataDirFlag(fs)
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return *dataDir, fs.Args()
+	}
+
+	if dir, _ := parse("listfolders"); dir != filepath.Join(home, ".q2") {
+		t.Errorf("Expected the home directory's .q2 by default, got %s", dir)
+	}
+	envDir := t.TempDir()
+	t.Setenv(dataDirEnv, envDir)
+	if dir, _ := parse("listfolders"); dir != envDir {
+		t.Errorf("Expected $%s, got %s", dataDirEnv, dir)
+	}
+
+	// The flag overrides the environment and moves the database
+	flagDir := filepath.Join(t.TempDir(), "data")
+	dir, rest := parse("-data-dir", flagDir, "listfolders", "-x")
+	if dir != flagDir || !slices.Equal(rest, []string{"listfolders", "-x"}) {
+		t.Fatalf("Expected %s and the command, got %s and %v", flagDir, dir, rest)
+	}
+	database, err := initDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+	if _, err := os.Stat(filepath.Join(flagDir, dbFile)); err != nil {
+		t.Errorf("Expected the database in -data-dir: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(envDir, dbFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected no database in $%s, got %v", dataDirEnv, err)
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	folderID := addTestFolder(t, database, testFolder)
+	if err := database.Write("INSERT INTO files (folder_id, path, filename, size) VALUES (?, ?, 'a.jpg', 1)",
+		folderID, filepath.Join(testFolder, "a.jpg")).Err; err != nil {
+		t.Fatal(err)
+	}
+	ffmpegMgr := ffmpeg.NewManager(t.TempDir())
+
+	var out bytes.Buffer
+	report, err := runDoctor(database, t.TempDir(), ffmpegMgr, false, &out)
+	if err != nil || len(report.Invalid) != 0 || !report.healthy() {
+		t.Fatalf("Expected a present folder to pass, got %+v (%v)", report, err)
+	}
+
+	// Deleted from disk: reported, and kept until pruned
+	if err := os.RemoveAll(testFolder); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	report, err = runDoctor(database, t.TempDir(), ffmpegMgr, false, &out)
+	if err != nil || len(report.Invalid) != 1 || report.healthy() || !strings.Contains(out.String(), "Folder missing: "+testFolder) {
+		t.Fatalf("Expected the deleted folder reported, got %+v (%v): %s", report, err, out.String())
+	}
+	if len(getFolders(t, database)) != 1 {
+		t.Error("Expected the folder kept without -prune")
+	}
+
+	out.Reset()
+	report, err = runDoctor(database, t.TempDir(), ffmpegMgr, true, &out)
+	if err != nil || !slices.Equal(report.Pruned, []string{testFolder}) || !report.healthy() {
+		t.Fatalf("Expected the deleted folder pruned, got %+v (%v): %s", report, err, out.String())
+	}
+	var files int
+	database.QueryRow("SELECT COUNT(*) FROM files").Scan(&files)
+	if len(getFolders(t, database)) != 0 || files != 0 {
+		t.Errorf("Expected the folder and its files removed, got %d folders and %d files", len(getFolders(t, database)), files)
+	}
+}
+
 func TestRemoveFolder_NotFound(t *testing.T) {
 	database, _, cleanup := setupTestEnv(t)
 	defer cleanup()
 
-	err := removeFolder("/nonexistent/folder", database)
+	err := removeFolder("/nonexistent/folder", database, t.TempDir())
 	if err == nil {
 		t.Fatal("Expected error for non-existent folder, got nil")
 	}
@@ -451,7 +975,7 @@ func TestRemoveFolder_EmptyFolder(t *testing.T) {
 	database, _, cleanup := setupTestEnv(t)
 	defer cleanup()
 
-	err := removeFolder("", database)
+	err := removeFolder("", database, t.TempDir())
 	if err == nil {
 		t.Fatal("Expected error for empty folder, got nil")
 	}
@@ -476,7 +1000,7 @@ func TestRemoveFolder_CaseHandlingOnWindows(t *testing.T) {
 
 	// Remove with different case (should work on Windows)
 	upperFolder := strings.ToUpper(testFolder)
-	err = removeFolder(upperFolder, database)
+	err = removeFolder(upperFolder, database, t.TempDir())
 	if err != nil {
 		t.Fatalf("removeFolder with different case failed: %v", err)
 	}
@@ -488,6 +1012,100 @@ func TestRemoveFolder_CaseHandlingOnWindows(t *testing.T) {
 	}
 }
 
+func TestRemoveFolderFull_RemovesFilesMetadataAndThumbnails(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+	q2 := t.TempDir()
+
+	folderID := addTestFolder(t, database, testFolder)
+	other := filepath.Join(filepath.Dir(testFolder), "other")
+	os.MkdirAll(other, 0755)
+	otherID := addTestFolder(t, database, other)
+
+	mon := monitor.New(database, monitor.Config{})
+	mon.AddFolder(folderID, testFolder)
+
+	// Two indexed photos with metadata and thumbnails, and one in another folder
+	var thumbs []string
+	insert := func(folderID int64, path string) {
+		small := media.GetThumbnailPath(path, media.SmallThumbnailSize, media.ThumbnailFormatJPEG)
+		large := media.GetThumbnailPath(path, media.LargeThumbnailSize, media.ThumbnailFormatJPEG)
+		for _, thumb := range []string{small, large} {
+			full := filepath.Join(q2, thumb)
+			os.MkdirAll(filepath.Dir(full), 0755)
+			if err := os.WriteFile(full, []byte("jpeg"), 0644); err != nil {
+				t.Fatalf("Failed to write thumbnail: %v", err)
+			}
+			thumbs = append(thumbs, full)
+		}
+		result := database.Write(
+			"INSERT INTO files (folder_id, path, filename, size, thumbnail_small_path, thumbnail_large_path) VALUES (?, ?, ?, 4, ?, ?)",
+			folderID, normalizePath(path), filepath.Base(path), small, large,
+		)
+		if result.Err != nil {
+			t.Fatalf("Failed to insert file: %v", result.Err)
+		}
+		if result := database.Write("INSERT INTO image_metadata (file_id, width) VALUES (?, 800)", result.LastInsertID); result.Err != nil {
+			t.Fatalf("Failed to insert metadata: %v", result.Err)
+		}
+	}
+	insert(folderID, filepath.Join(testFolder, "a.jpg"))
+	insert(folderID, filepath.Join(testFolder, "b.jpg"))
+	insert(otherID, filepath.Join(other, "c.jpg"))
+
+	removed, err := removeFolderFull(database, mon, testFolder, q2)
+	if err != nil {
+		t.Fatalf("removeFolderFull failed: %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("Expected 2 files removed, got %d", removed)
+	}
+
+	count := func(query string) int {
+		var n int
+		if err := database.QueryRow(query).Scan(&n); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return n
+	}
+	if n := count("SELECT COUNT(*) FROM files"); n != 1 {
+		t.Errorf("Expected only the other folder's file left, got %d files", n)
+	}
+	if n := count("SELECT COUNT(*) FROM image_metadata"); n != 1 {
+		t.Errorf("Expected only the other folder's metadata left, got %d rows", n)
+	}
+	for i, thumb := range thumbs {
+		_, err := os.Stat(thumb)
+		if kept := i >= 4; kept != (err == nil) {
+			t.Errorf("Thumbnail %s: kept %v, stat error %v", thumb, kept, err)
+		}
+	}
+	if n := len(mon.Status().Folders); n != 0 {
+		t.Errorf("Expected the folder no longer monitored, got %d", n)
+	}
+
+	if _, err := removeFolderFull(database, mon, testFolder, q2); !errors.Is(err, errFolderNotFound) {
+		t.Errorf("Expected errFolderNotFound removing again, got %v", err)
+	}
+}
+
+func TestRemoveFolderFull_CancelsQueuedScans(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+	addTestFolder(t, database, testFolder)
+
+	// Without a monitor, as from the CLI, queued scans are still cancelled
+	if err := scanner.QueueScan(database, testFolder); err != nil {
+		t.Fatalf("QueueScan failed: %v", err)
+	}
+	if _, err := removeFolderFull(database, nil, testFolder, t.TempDir()); err != nil {
+		t.Fatalf("removeFolderFull failed: %v", err)
+	}
+	if pending, _ := scanner.GetPendingScans(database); len(pending) != 0 {
+		t.Errorf("Expected queued scan cancelled, got %v", pending)
+	}
+}
+
 func TestListFolders_Empty(t *testing.T) {
 	database, _, cleanup := setupTestEnv(t)
 	defer cleanup()
@@ -1008,3 +1626,2202 @@ func TestBrowseHandler_MethodNotAllowed(t *testing.T) {
 		t.Errorf("Expected status 405, got %d", w.Code)
 	}
 }
+
+func TestTreeHandler(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	folderID, err := scanner.GetFolderID(database, testFolder)
+	if err != nil {
+		t.Fatalf("GetFolderID failed: %v", err)
+	}
+	root := normalizePath(testFolder)
+	for path, mediaType := range map[string]string{
+		"cover.jpg":                  "IMG",
+		"2023/beach.jpg":             "image",
+		"2023/clip.mp4":              "VID",
+		"2023/summer/pool.jpg":       "IMG",
+		"2023/summer/deep/dive.jpg":  "IMG",
+		"music/song.mp3":             "AUD",
+		"music_extra/notes.txt":      "",
+		"2023 archive/old/photo.jpg": "IMG",
+	} {
+		full := filepath.Join(root, filepath.FromSlash(path))
+		if r := database.Write("INSERT INTO files (folder_id, path, filename, size, mediatype) VALUES (?, ?, ?, 1, ?)",
+			folderID, full, filepath.Base(full), mediaType); r.Err != nil {
+			t.Fatalf("Failed to insert %s: %v", path, r.Err)
+		}
+	}
+
+	handler := makeTreeHandler(database)
+	get := func(query string) (*httptest.ResponseRecorder, TreeResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/api/tree?"+query, nil))
+		var tree TreeResponse
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &tree); err != nil {
+				t.Fatalf("Failed to decode tree: %v", err)
+			}
+		}
+		return rec, tree
+	}
+	dirNames := func(tree TreeResponse) []string {
+		names := []string{}
+		for _, d := range tree.Dirs {
+			names = append(names, d.Name)
+		}
+		return names
+	}
+
+	// The root holds its own file and one entry per top-level directory
+	rec, tree := get(fmt.Sprintf("folder_id=%d", folderID))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := strings.Join(dirNames(tree), ","); got != "2023,2023 archive,music,music_extra" {
+		t.Errorf("Expected the top-level directories, got %s", got)
+	}
+	if len(tree.Files) != 1 || tree.Files[0].Name != "cover.jpg" || tree.Files[0].MediaType != "image" {
+		t.Errorf("Expected cover.jpg as the only root file, got %+v", tree.Files)
+	}
+	if tree.Parent != nil {
+		t.Errorf("Expected no parent at the root, got %q", *tree.Parent)
+	}
+	if want := (TreeCounts{Files: 8, Images: 5, Audio: 1, Videos: 1}); tree.Counts != want {
+		t.Errorf("Expected root counts %+v, got %+v", want, tree.Counts)
+	}
+	if d := tree.Dirs[0]; d.Path != filepath.Join(root, "2023") || d.TreeCounts != (TreeCounts{Files: 4, Images: 3, Videos: 1}) {
+		t.Errorf("Unexpected 2023 entry: %+v", d)
+	}
+
+	// One level down, nested directories are counted but not listed
+	year := filepath.Join(root, "2023")
+	_, tree = get(fmt.Sprintf("folder_id=%d&path=%s", folderID, url.QueryEscape(year)))
+	if got := strings.Join(dirNames(tree), ","); got != "summer" {
+		t.Errorf("Expected only summer under 2023, got %s", got)
+	}
+	if tree.Dirs[0].Files != 2 || len(tree.Files) != 2 {
+		t.Errorf("Expected summer with 2 files and 2 files in 2023, got %+v and %+v", tree.Dirs, tree.Files)
+	}
+	if tree.Parent == nil || *tree.Parent != root {
+		t.Errorf("Expected the root as parent, got %v", tree.Parent)
+	}
+
+	// A directory without subdirectories lists only files
+	_, tree = get(fmt.Sprintf("folder_id=%d&path=%s", folderID, url.QueryEscape(filepath.Join(year, "summer", "deep"))))
+	if len(tree.Dirs) != 0 || len(tree.Files) != 1 || tree.Files[0].Name != "dive.jpg" {
+		t.Errorf("Expected just dive.jpg, got %+v and %+v", tree.Dirs, tree.Files)
+	}
+
+	// A path alone finds its monitored folder
+	_, byPath := get("path=" + url.QueryEscape(year))
+	if byPath.FolderID != folderID || strings.Join(dirNames(byPath), ",") != "summer" {
+		t.Errorf("Expected the 2023 level of folder %d, got %+v", folderID, byPath)
+	}
+
+	for query, want := range map[string]int{
+		"path=" + url.QueryEscape(filepath.Dir(root)): http.StatusForbidden,
+		"":              http.StatusBadRequest,
+		"folder_id=x":   http.StatusBadRequest,
+		"folder_id=999": http.StatusNotFound,
+		fmt.Sprintf("folder_id=%d&path=%s", folderID, url.QueryEscape(filepath.Dir(root))): http.StatusBadRequest,
+		fmt.Sprintf("folder_id=%d&path=%s", folderID, url.QueryEscape(root+"-other")):      http.StatusBadRequest,
+	} {
+		if rec, _ := get(query); rec.Code != want {
+			t.Errorf("%q: expected %d, got %d", query, want, rec.Code)
+		}
+	}
+}
+
+func TestListFilesUnder(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	folderID, err := scanner.GetFolderID(database, testFolder)
+	if err != nil {
+		t.Fatalf("GetFolderID failed: %v", err)
+	}
+	root := normalizePath(testFolder)
+	// Siblings sorting either side of "photos/": "photos-old" before, "photos0" right after
+	for _, rel := range []string{"photos/a.jpg", "photos/trip/b.jpg", "photos/trip/day 2/c.jpg", "photos-old/d.jpg", "photos0/e.jpg", "f.jpg"} {
+		full := filepath.Join(root, filepath.FromSlash(rel))
+		if r := database.Write("INSERT INTO files (folder_id, path, filename, size) VALUES (?, ?, ?, 1)", folderID, full, filepath.Base(full)); r.Err != nil {
+			t.Fatalf("Failed to insert %s: %v", rel, r.Err)
+		}
+	}
+	names := func(files []scanner.IndexedFile) string {
+		var got []string
+		for _, f := range files {
+			rel, _ := filepath.Rel(root, f.Path)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return strings.Join(got, ",")
+	}
+
+	photos := filepath.Join(testFolder, "photos")
+	under, err := scanner.ListFilesUnder(database, photos)
+	if err != nil {
+		t.Fatalf("ListFilesUnder failed: %v", err)
+	}
+	if got := names(under); got != "photos/a.jpg,photos/trip/b.jpg,photos/trip/day 2/c.jpg" {
+		t.Errorf("Expected every file under photos, got %s", got)
+	}
+	if under[0].FolderID != folderID || under[0].Filename != "a.jpg" {
+		t.Errorf("Unexpected file: %+v", under[0])
+	}
+
+	in, err := scanner.ListFilesIn(database, photos+string(filepath.Separator))
+	if err != nil {
+		t.Fatalf("ListFilesIn failed: %v", err)
+	}
+	if got := names(in); got != "photos/a.jpg" {
+		t.Errorf("Expected only the file directly in photos, got %s", got)
+	}
+
+	if all, _ := scanner.ListFilesUnder(database, testFolder); len(all) != 6 {
+		t.Errorf("Expected all 6 files under the folder, got %d", len(all))
+	}
+	if none, err := scanner.ListFilesUnder(database, filepath.Join(testFolder, "missing")); err != nil || len(none) != 0 {
+		t.Errorf("Expected no files under a missing directory, got %v (%v)", none, err)
+	}
+}
+
+func TestTimelineHandler(t *testing.T) {
+	database, _, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	folder := database.Write("INSERT INTO folders (path) VALUES ('/photos')")
+	if r := database.Write("INSERT INTO files (folder_id, path, filename, mediatype, size, created_at) VALUES (?, '/photos/a.jpg', 'a.jpg', 'IMG', 0, ?)",
+		folder.LastInsertID, time.Date(2024, time.June, 3, 12, 0, 0, 0, time.UTC)); r.Err != nil {
+		t.Fatalf("Failed to insert photo: %v", r.Err)
+	}
+
+	handler := makeTimelineHandler(database)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api/timeline", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Granularity string                 `json:"granularity"`
+		Periods     []media.TimelinePeriod `json:"periods"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Granularity != "month" || len(resp.Periods) != 1 || resp.Periods[0] != (media.TimelinePeriod{Period: "2024-06", Count: 1}) {
+		t.Errorf("Expected one June 2024 photo by month, got %+v", resp)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api/timeline?granularity=week", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown granularity, got %d", rec.Code)
+	}
+}
+
+func TestFilesHandler(t *testing.T) {
+	database, _, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	folder := database.Write("INSERT INTO folders (path) VALUES ('/photos')")
+	for _, name := range []string{"beach.jpg", "city.jpg"} {
+		database.Write("INSERT INTO files (folder_id, path, filename, mediatype, size) VALUES (?, ?, ?, 'IMG', 1)",
+			folder.LastInsertID, "/photos/"+name, name)
+	}
+	media.SaveImageTags(database, 1, &media.XMPMetadata{Keywords: []string{"Sunset", "beach"}})
+	media.SaveImageTags(database, 2, &media.XMPMetadata{Keywords: []string{"night"}})
+
+	handler := makeFilesHandler(database)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api/files?tag=sunset", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp FilesResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if len(resp.Files) != 1 || resp.Files[0].Name != "beach.jpg" || resp.Files[0].MediaType != "image" {
+		t.Errorf("Expected only beach.jpg tagged sunset, got %+v", resp.Files)
+	}
+
+	// Without a tag every file is listed, a page at a time
+	var paths []string
+	next := ""
+	for range 3 {
+		rec = httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/api/files?limit=1&after="+next, nil))
+		resp = FilesResponse{}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		for _, f := range resp.Files {
+			paths = append(paths, f.Path)
+		}
+		if next = resp.Next; next == "" {
+			break
+		}
+	}
+	if len(paths) != 2 || paths[0] != "/photos/beach.jpg" || paths[1] != "/photos/city.jpg" {
+		t.Errorf("Expected both files over two pages, got %v", paths)
+	}
+
+	for _, query := range []string{"limit=0", "after=x", "folder_id=-1"} {
+		rec = httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/api/files?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", query, rec.Code)
+		}
+	}
+}
+
+func TestMapHandler_BBox(t *testing.T) {
+	database, _, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	folder := database.Write("INSERT INTO folders (path) VALUES ('/photos')")
+	database.Write("INSERT INTO files (folder_id, path, filename, size) VALUES (?, '/photos/fiji.jpg', 'fiji.jpg', 1)", folder.LastInsertID)
+	lat, lon := -17.7134, 178.065
+	media.SaveImageMetadata(database, 1, &media.ImageMetadata{GPSLatitude: &lat, GPSLongitude: &lon})
+
+	handler := makeMapHandler(database)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api/map?bbox=-25,170,-10,-170", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp MapResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if len(resp.Files) != 1 || resp.Files[0].Name != "fiji.jpg" || resp.Files[0].Lon != lon {
+		t.Errorf("Expected fiji.jpg across the antimeridian, got %+v", resp.Files)
+	}
+
+	for _, bbox := range []string{"", "1,2,3", "-25,170,-10,-190", "a,b,c,d"} {
+		rec = httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/api/map?bbox="+bbox, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for bbox %q, got %d", bbox, rec.Code)
+		}
+	}
+}
+
+func TestImageHandler_ConvertJPEG(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	photo := filepath.Join(testFolder, "photo.jpg")
+	os.WriteFile(photo, []byte("\xff\xd8jpeg"), 0644)
+	heic := filepath.Join(testFolder, "IMG_0001.heic")
+	os.WriteFile(heic, []byte("heic"), 0644)
+	png := filepath.Join(testFolder, "chart.png")
+	os.WriteFile(png, []byte("png"), 0644)
+
+	q2Dir := t.TempDir()
+	handler := makeImageHandler(database, q2Dir, ffmpeg.NewManager(filepath.Join(q2Dir, "bin")))
+	get := func(path, convert string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/api/image?path="+url.QueryEscape(path)+"&convert="+convert, nil))
+		return rec
+	}
+
+	// JPEGs need no conversion
+	if rec := get(photo, "jpeg"); rec.Code != http.StatusOK || rec.Body.String() != "\xff\xd8jpeg" {
+		t.Errorf("Expected the JPEG served as it is, got %d", rec.Code)
+	}
+	if rec := get(png, "jpeg"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 converting a PNG, got %d", rec.Code)
+	}
+	if rec := get(heic, "png"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for convert=png, got %d", rec.Code)
+	}
+
+	if _, err := exec.LookPath("ffmpeg"); err == nil {
+		return // Whether it decodes HEIF depends on the build
+	}
+	if rec := get(heic, "jpeg"); rec.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 without ffmpeg, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	for i, mediaType := range []string{"IMG", "IMG", "VID"} {
+		database.Write("INSERT INTO files (folder_id, path, filename, mediatype, size) VALUES (1, ?, ?, ?, 10)",
+			fmt.Sprintf("/photos/%d", i), fmt.Sprint(i), mediaType)
+	}
+
+	rec := httptest.NewRecorder()
+	makeStatsHandler(database, nil)(rec, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp StatsResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Folders != 1 || resp.Files.Images != 2 || resp.Files.Videos != 1 || resp.Files.Bytes != 30 || resp.Monitor != nil {
+		t.Errorf("Unexpected stats: %+v", resp)
+	}
+}
+
+// Tests for /api/subtitles handler
+
+// seedSubtitleCache writes a cached track manifest (and .vtt files) for a video
+// so the handler can be exercised without ffmpeg.
+func seedSubtitleCache(t *testing.T, q2 string, video string, vtts map[int]string) {
+	t.Helper()
+	outDir := filepath.Join(q2, "subtitles", media.HashString(normalizePath(video)))
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		t.Fatalf("Failed to create subtitle dir: %v", err)
+	}
+	tracks := []ffmpeg.SubtitleTrack{}
+	for i, body := range vtts {
+		if err := os.WriteFile(filepath.Join(outDir, fmt.Sprintf("%d.vtt", i)), []byte(body), 0644); err != nil {
+			t.Fatalf("Failed to write vtt: %v", err)
+		}
+		tracks = append(tracks, ffmpeg.SubtitleTrack{Index: i, Codec: "subrip"})
+	}
+	data, _ := json.Marshal(tracks)
+	if err := os.WriteFile(filepath.Join(outDir, subtitleManifest), data, 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+}
+
+func TestSubtitlesHandler_ServesTrack(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+
+	video := filepath.Join(testFolder, "movie.mkv")
+	if err := os.WriteFile(video, []byte("video"), 0644); err != nil {
+		t.Fatalf("Failed to create video: %v", err)
+	}
+	q2 := t.TempDir()
+	seedSubtitleCache(t, q2, video, map[int]string{0: "WEBVTT\n\n00:00.000 --> 00:01.000\nHi\n"})
+
+	handler := makeSubtitlesHandler(database, q2, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/subtitles?path="+video+"&index=0", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/vtt") {
+		t.Errorf("Expected text/vtt content type, got %q", ct)
+	}
+	if !strings.Contains(w.Body.String(), "Hi") {
+		t.Errorf("Unexpected body: %s", w.Body.String())
+	}
+
+	// Out-of-range index
+	req = httptest.NewRequest(http.MethodGet, "/api/subtitles?path="+video+"&index=3", nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for missing track, got %d", w.Code)
+	}
+}
+
+func TestSubtitlesHandler_NoSubtitleStreams(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+
+	video := filepath.Join(testFolder, "plain.mp4")
+	if err := os.WriteFile(video, []byte("video"), 0644); err != nil {
+		t.Fatalf("Failed to create video: %v", err)
+	}
+	q2 := t.TempDir()
+	seedSubtitleCache(t, q2, video, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/subtitles?path="+video+"&index=0", nil)
+	w := httptest.NewRecorder()
+	makeSubtitlesHandler(database, q2, nil)(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSubtitlesHandler_PathOutsideRoots(t *testing.T) {
+	database, _, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	outside := filepath.Join(t.TempDir(), "movie.mkv")
+	if err := os.WriteFile(outside, []byte("video"), 0644); err != nil {
+		t.Fatalf("Failed to create video: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/subtitles?path="+outside+"&index=0", nil)
+	w := httptest.NewRecorder()
+	makeSubtitlesHandler(database, t.TempDir(), nil)(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", w.Code)
+	}
+}
+
+func TestFoldersHandler_AddAndDelete(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	mon := monitor.New(database, monitor.Config{})
+	handler := makeFoldersHandler(database, mon, "secret")
+
+	post := func(body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/folders", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	body := fmt.Sprintf(`{"path": %q, "library_type": "photos"}`, testFolder)
+	if w := post(body, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", w.Code)
+	}
+	if w := post(body, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with wrong token, got %d", w.Code)
+	}
+
+	w := post(body, "secret")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var added FolderResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &added); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if added.ID == 0 || added.Path != normalizePath(testFolder) || added.LibraryType != "photos" || added.Status != "added" {
+		t.Errorf("Unexpected response: %+v", added)
+	}
+
+	// The folder is monitored and a scan is queued
+	if n := len(mon.Status().Folders); n != 1 {
+		t.Errorf("Expected 1 monitored folder, got %d", n)
+	}
+	pending, err := scanner.GetPendingScans(database)
+	if err != nil || len(pending) != 1 {
+		t.Errorf("Expected 1 queued scan, got %v, %v", pending, err)
+	}
+
+	// Adding again (trailing slash included) reports the existing folder
+	w = post(fmt.Sprintf(`{"path": %q}`, testFolder+string(filepath.Separator)), "secret")
+	var again FolderResponse
+	json.Unmarshal(w.Body.Bytes(), &again)
+	if w.Code != http.StatusOK || again.ID != added.ID || again.Status != "already exists" {
+		t.Errorf("Expected existing folder, got %d %+v", w.Code, again)
+	}
+	w = post(fmt.Sprintf(`{"path": %q, "library_type": "music"}`, testFolder), "secret")
+	json.Unmarshal(w.Body.Bytes(), &again)
+	if w.Code != http.StatusOK || again.LibraryType != "music" || again.Status != "already exists" {
+		t.Errorf("Expected the existing folder's library type changed, got %d %+v", w.Code, again)
+	}
+
+	if w := post(`{"path": "/does/not/exist"}`, "secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for missing folder, got %d", w.Code)
+	}
+
+	del := makeFolderHandler(database, mon, t.TempDir(), "secret")
+	deleteReq := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		del(w, req)
+		return w
+	}
+
+	if w := deleteReq("/api/folders/abc"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for bad id, got %d", w.Code)
+	}
+	if w := deleteReq(fmt.Sprintf("/api/folders/%d", added.ID)); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if folders := getFolders(t, database); len(folders) != 0 {
+		t.Errorf("Expected folder removed, got %v", folders)
+	}
+	if n := len(mon.Status().Folders); n != 0 {
+		t.Errorf("Expected folder no longer monitored, got %d", n)
+	}
+	if w := deleteReq(fmt.Sprintf("/api/folders/%d", added.ID)); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for removed folder, got %d", w.Code)
+	}
+}
+
+func TestScanHandler_CancelQueuedScan(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	mon := monitor.New(database, monitor.Config{})
+	handler := makeScanHandler(mon, "secret")
+	cancel := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/api/scan?path="+url.QueryEscape(path), nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	if err := scanner.QueueScan(database, testFolder); err != nil {
+		t.Fatalf("QueueScan failed: %v", err)
+	}
+	if w := cancel(testFolder, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", w.Code)
+	}
+	if w := cancel("", "secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without path, got %d", w.Code)
+	}
+
+	w := cancel(testFolder, "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp["state"] != string(monitor.CancelDequeued) || resp["path"] != normalizePath(testFolder) {
+		t.Errorf("Unexpected response: %v", resp)
+	}
+	if pending, _ := scanner.GetPendingScans(database); len(pending) != 0 {
+		t.Errorf("Expected the scan dequeued, got %v", pending)
+	}
+
+	if w := cancel(testFolder, "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 with nothing queued, got %d", w.Code)
+	}
+}
+
+func TestRuntimeSettingsHandler(t *testing.T) {
+	database, _, cleanup := setupTestEnv(t)
+	defer cleanup()
+	defer thumbnailWorkers.Store(0)
+
+	mon := monitor.New(database, monitor.Config{})
+	handler := makeRuntimeSettingsHandler(database, mon, nil, "secret")
+	send := func(method, body, token string) (*httptest.ResponseRecorder, map[string]int64) {
+		req := httptest.NewRequest(method, "/api/settings/runtime", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		var resp map[string]int64
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp
+	}
+
+	w, resp := send(http.MethodGet, "", "")
+	if w.Code != http.StatusOK || resp["watch_debounce_ms"] != monitor.DefaultDebounceTime.Milliseconds() || resp["scan_concurrency"] != monitor.DefaultScanConcurrency {
+		t.Errorf("Expected the defaults, got %d: %v", w.Code, resp)
+	}
+
+	if w, _ := send(http.MethodPost, `{"scan_concurrency": 2}`, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", w.Code)
+	}
+	for _, body := range []string{`{"watch_debounce_ms": 1}`, `{"watch_debounce_ms": 3600000}`, `{"scan_concurrency": 0}`, `{"thumbnail_workers": -1}`, `{"scan_concurrency": 2, "thumbnail_workers": 1000}`} {
+		if w, _ := send(http.MethodPost, body, "secret"); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+	if mon.ScanConcurrency() != monitor.DefaultScanConcurrency {
+		t.Error("Expected a rejected request to change nothing")
+	}
+
+	// Changes apply to the running server and are stored
+	w, resp = send(http.MethodPost, `{"watch_debounce_ms": 2000, "scan_concurrency": 3, "thumbnail_workers": 4}`, "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if resp["watch_debounce_ms"] != 2000 || resp["scan_concurrency"] != 3 || resp["thumbnail_workers"] != 4 {
+		t.Errorf("Unexpected response: %v", resp)
+	}
+	if mon.Debounce() != 2*time.Second || mon.ScanConcurrency() != 3 || currentThumbnailWorkers() != 4 {
+		t.Errorf("Expected settings applied, got %s, %d, %d", mon.Debounce(), mon.ScanConcurrency(), currentThumbnailWorkers())
+	}
+
+	// A partial update keeps the rest, and a restart picks the stored values up
+	send(http.MethodPost, `{"scan_concurrency": 1}`, "secret")
+	restarted := monitor.New(database, monitor.Config{})
+	applyRuntimeSettings(restarted, loadRuntimeSettings(database))
+	if restarted.Debounce() != 2*time.Second || restarted.ScanConcurrency() != 1 {
+		t.Errorf("Expected stored settings applied on restart, got %s, %d", restarted.Debounce(), restarted.ScanConcurrency())
+	}
+}
+
+func TestReloadRuntimeSettings(t *testing.T) {
+	database, _, cleanup := setupTestEnv(t)
+	defer cleanup()
+	defer thumbnailWorkers.Store(0)
+	defer serverLogLevel.Set(slog.LevelInfo)
+
+	mon := monitor.New(database, monitor.Config{})
+	if changes := reloadRuntimeSettings(database, mon, nil); len(changes) != 0 {
+		t.Errorf("Expected no changes without stored settings, got %v", changes)
+	}
+
+	// Settings edited in the database apply on reload, as on SIGHUP
+	for key, value := range map[string]string{settingScanConcurrency: "3", settingLogLevel: "debug", settingThumbnailWorkers: "-1"} {
+		if err := database.Write("INSERT INTO settings (key, value) VALUES (?, ?)", key, value).Err; err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes := reloadRuntimeSettings(database, mon, nil)
+	want := []settingChange{
+		{Name: settingScanConcurrency, From: fmt.Sprint(monitor.DefaultScanConcurrency), To: "3"},
+		{Name: settingLogLevel, From: "info", To: "debug"},
+	}
+	if !slices.Equal(changes, want) {
+		t.Errorf("Expected changes %v, got %v", want, changes)
+	}
+	if mon.ScanConcurrency() != 3 || serverLogLevel.Level() != slog.LevelDebug || currentThumbnailWorkers() != 0 {
+		t.Errorf("Expected valid settings applied and invalid ones ignored, got %d, %s, %d",
+			mon.ScanConcurrency(), serverLogLevel.Level(), currentThumbnailWorkers())
+	}
+
+	// The API reports the reloaded state, and a reload picks its changes up unchanged
+	w := httptest.NewRecorder()
+	makeRuntimeSettingsHandler(database, mon, nil, "")(w, httptest.NewRequest(http.MethodGet, "/api/settings/runtime", nil))
+	if !strings.Contains(w.Body.String(), `"log_level":"debug"`) {
+		t.Errorf("Expected the reloaded log level reported, got %s", w.Body.String())
+	}
+	if changes := reloadRuntimeSettings(database, mon, nil); len(changes) != 0 {
+		t.Errorf("Expected nothing to change on a second reload, got %v", changes)
+	}
+}
+
+func TestFoldersHandler_LastScannedAt(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	folderID := addTestFolder(t, database, testFolder)
+	list := func() FolderResponse {
+		w := httptest.NewRecorder()
+		makeFoldersHandler(database, nil, "")(w, httptest.NewRequest(http.MethodGet, "/api/folders", nil))
+		var resp struct {
+			Folders []FolderResponse `json:"folders"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Folders) != 1 {
+			t.Fatalf("Expected one folder, got %s (%v)", w.Body.String(), err)
+		}
+		return resp.Folders[0]
+	}
+
+	if f := list(); f.LastScannedAt != nil {
+		t.Errorf("Expected no scan time before scanning, got %v", f.LastScannedAt)
+	}
+	if _, err := scanner.ScanFolder(database, testFolder, folderID); err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	if f := list(); f.LastScannedAt == nil || time.Since(*f.LastScannedAt) > time.Minute {
+		t.Errorf("Expected the completed scan's time, got %v", f.LastScannedAt)
+	}
+}
+
+func TestFoldersHandler_LocalOnlyWithoutToken(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	handler := makeFoldersHandler(database, nil, "")
+	body := fmt.Sprintf(`{"path": %q, "scan": false}`, testFolder)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/folders", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for remote request, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/folders", strings.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:50000"
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected 201 for local request, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Listing needs no token
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/api/folders", nil))
+	var resp struct {
+		Folders []FolderResponse `json:"folders"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Folders) != 1 {
+		t.Errorf("Expected 1 listed folder, got %s", w.Body.String())
+	}
+}
+
+func TestFoldersHandler_AcceptsAPIKey(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	key, err := serverauth.CreateKey(database, "test")
+	if err != nil {
+		t.Fatalf("CreateKey failed: %v", err)
+	}
+	// As serve wires it with -require-api-key and -api-token both set
+	handler := serverauth.Middleware(database, nil, makeFoldersHandler(database, nil, "secret"))
+
+	// A valid X-API-Key is enough without the -api-token bearer token
+	req := httptest.NewRequest(http.MethodPost, "/api/folders", strings.NewReader(fmt.Sprintf(`{"path": %q, "scan": false}`, testFolder)))
+	req.Header.Set(serverauth.HeaderName, key)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected 201 with a valid API key, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestFolderAddRemoveHandlers_UpdateMonitor(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	mon := monitor.New(database, monitor.Config{})
+	add := makeFolderAddHandler(database, mon, "secret")
+	remove := makeFolderRemoveHandler(database, mon, t.TempDir(), "secret")
+	post := func(handler http.HandlerFunc, url, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	// Both need the API token, as /api/folders does
+	body := fmt.Sprintf(`{"path": %q}`, testFolder)
+	if w := post(add, "/api/folders/add", body, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 adding without a token, got %d", w.Code)
+	}
+	if w := post(remove, "/api/folders/remove", body, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 removing with a wrong token, got %d", w.Code)
+	}
+	if n := len(mon.Status().Folders); n != 0 {
+		t.Fatalf("Expected no folders after unauthorized requests, got %d", n)
+	}
+
+	w := post(add, "/api/folders/add", body, "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if n := len(mon.Status().Folders); n != 1 {
+		t.Errorf("Expected folder to be monitored, got %d folders", n)
+	}
+	if pending, _ := scanner.GetPendingScans(database); len(pending) != 1 {
+		t.Errorf("Expected a queued scan, got %v", pending)
+	}
+
+	// Adding it again with a library type changes the folder's, as addfolder does
+	retyped := fmt.Sprintf(`{"path": %q, "library_type": "photos"}`, testFolder)
+	w = post(add, "/api/folders/add", retyped, "secret")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "already exists") {
+		t.Fatalf("Expected the existing folder, got %d: %s", w.Code, w.Body.String())
+	}
+	var libraryType string
+	database.QueryRow("SELECT library_type FROM folders WHERE path = ?", normalizePath(testFolder)).Scan(&libraryType)
+	if libraryType != "photos" {
+		t.Errorf("Expected library type photos, got %q", libraryType)
+	}
+
+	w = post(remove, "/api/folders/remove", body, "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if n := len(mon.Status().Folders); n != 0 {
+		t.Errorf("Expected folder no longer monitored, got %d folders", n)
+	}
+	if pending, _ := scanner.GetPendingScans(database); len(pending) != 0 {
+		t.Errorf("Expected queued scan cancelled, got %v", pending)
+	}
+}
+
+func TestCLIFolderChanges_ReachRunningMonitor(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	mon := monitor.New(database, monitor.Config{ReconcileInterval: 50 * time.Millisecond})
+	if err := mon.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer mon.Stop()
+
+	monitored := func() int { return len(mon.Status().Folders) }
+	waitUntil := func(cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("condition not met before timeout")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// addfolder and removefolder write the folders table from another process
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	waitUntil(func() bool { return monitored() == 1 })
+
+	if err := removeFolder(testFolder, database, t.TempDir()); err != nil {
+		t.Fatalf("removeFolder failed: %v", err)
+	}
+	waitUntil(func() bool { return monitored() == 0 })
+
+	if mon.Status().LastReconcile == nil {
+		t.Error("Expected status to report the last reconcile")
+	}
+}
+
+func TestScanFolder_RestoresRemovedFile(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	photo := filepath.Join(testFolder, "photo.jpg")
+	if err := os.WriteFile(photo, []byte("jpeg"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	folderID := addTestFolder(t, database, testFolder)
+	if _, err := scanner.ScanFolder(database, testFolder, folderID); err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	var fileID int64
+	database.QueryRow("SELECT id FROM files WHERE path = ?", normalizePath(photo)).Scan(&fileID)
+	albumID := database.Write("INSERT INTO albums (name) VALUES ('Holiday')").LastInsertID
+	database.Write("INSERT INTO album_items (album_id, file_id, position) VALUES (?, ?, 0)", albumID, fileID)
+
+	albumItems := func() int {
+		rec := httptest.NewRecorder()
+		makeAlbumHandler(database)(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/album?id=%d", albumID), nil))
+		var resp AlbumResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if len(resp.Items) != resp.Album.ItemCount {
+			t.Errorf("Album lists %d items but counts %d", len(resp.Items), resp.Album.ItemCount)
+		}
+		return len(resp.Items)
+	}
+
+	// The share is unmounted: the file goes missing but keeps its row
+	os.Remove(photo)
+	result, err := scanner.ScanFolder(database, testFolder, folderID)
+	if err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	if result.FilesRemoved != 1 || isFileIndexed(database, photo) {
+		t.Errorf("Expected the file removed from the index, got %+v", result)
+	}
+	if n := albumItems(); n != 0 {
+		t.Errorf("Expected the missing file left out of the album, got %d items", n)
+	}
+
+	// Remounted: the file is back with its album membership
+	if err := os.WriteFile(photo, []byte("jpeg"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if result, err = scanner.ScanFolder(database, testFolder, folderID); err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	var restoredID int64
+	database.QueryRow("SELECT id FROM files WHERE path = ? AND deleted_at IS NULL", normalizePath(photo)).Scan(&restoredID)
+	if result.FilesAdded != 1 || restoredID != fileID {
+		t.Errorf("Expected file %d restored, got ID %d and %+v", fileID, restoredID, result)
+	}
+	if n := albumItems(); n != 1 {
+		t.Errorf("Expected the restored file back in the album, got %d items", n)
+	}
+}
+
+func TestScanFolder_LongWindowsPath(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("MAX_PATH only applies on Windows")
+	}
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	// Nest folders until the file path is well past MAX_PATH
+	deep := testFolder
+	for i := 0; len(deep) < 300; i++ {
+		deep = filepath.Join(deep, fmt.Sprintf("nested-photo-folder-%02d", i))
+	}
+	if err := os.MkdirAll(scanner.LongPath(deep), 0755); err != nil {
+		t.Fatalf("Failed to create deep folder: %v", err)
+	}
+	photo := filepath.Join(deep, "photo.jpg")
+	if err := os.WriteFile(scanner.LongPath(photo), []byte("jpeg"), 0644); err != nil {
+		t.Fatalf("Failed to write photo: %v", err)
+	}
+
+	if got := scanner.LongPath(photo); !strings.HasPrefix(got, `\\?\`) {
+		t.Errorf("Expected long-path prefix for %d-char path, got %q", len(photo), got)
+	}
+
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	folderID, err := scanner.GetFolderID(database, testFolder)
+	if err != nil {
+		t.Fatalf("GetFolderID failed: %v", err)
+	}
+	result, err := scanner.ScanFolder(database, testFolder, folderID)
+	if err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	if len(result.Errors) > 0 {
+		t.Errorf("Unexpected scan errors: %v", result.Errors)
+	}
+
+	// Indexed under the path as the folder was added, not the \\?\ form
+	var count int
+	database.QueryRow("SELECT COUNT(*) FROM files WHERE path = ?", normalizePath(photo)).Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected deep photo to be indexed, got %d rows", count)
+	}
+}
+
+func TestNormalizePath_KeepsLongPathPrefix(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("long-path prefix is Windows-only")
+	}
+	tests := map[string]string{
+		`\\?\C:\Photos\Trip`:       `\\?\c:\photos\trip`,
+		`\\?\UNC\NAS\Photos\Trip\`: `\\?\UNC\nas\photos\trip`,
+		`"\\?\D:\Music\Album"`:     `\\?\d:\music\album`,
+	}
+	for input, want := range tests {
+		if got := normalizePath(input); got != want {
+			t.Errorf("normalizePath(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestNormalizePath_UNC(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("UNC paths are Windows-only")
+	}
+	tests := map[string]string{
+		`\\NAS\Photos`:              `\\nas\photos`,
+		`\\NAS\Photos\`:             `\\nas\photos`,
+		`//NAS/Photos/`:             `\\nas\photos`,
+		`"\\NAS\Photos\Trip 2024\"`: `\\nas\photos\trip 2024`,
+		`\\?\UNC\NAS\Photos\`:       `\\?\UNC\nas\photos`,
+		`C:\`:                       `c:\`,
+		`\\?\C:\`:                   `\\?\c:\`,
+	}
+	for input, want := range tests {
+		if got := normalizePath(input); got != want {
+			t.Errorf("normalizePath(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestFindParentFolder_UNC(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("UNC paths are Windows-only")
+	}
+	database, _, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	// The share root is stored with a trailing separator as typed by the user
+	result := database.Write("INSERT INTO folders (path) VALUES (?)", normalizePath(`\\NAS\Photos\`))
+	if result.Err != nil {
+		t.Fatalf("Failed to insert folder: %v", result.Err)
+	}
+
+	for _, path := range []string{`\\NAS\Photos\2024\beach.jpg`, `\\nas\photos\beach.jpg`, `//nas/Photos/beach.jpg`} {
+		folder, id, err := scanner.FindParentFolder(database, path)
+		if err != nil {
+			t.Errorf("FindParentFolder(%q) failed: %v", path, err)
+			continue
+		}
+		if folder != `\\nas\photos` || id != result.LastInsertID {
+			t.Errorf("FindParentFolder(%q) = %q, %d", path, folder, id)
+		}
+	}
+
+	for _, path := range []string{`\\NAS\PhotosArchive\beach.jpg`, `\\OtherNAS\Photos\beach.jpg`} {
+		if _, _, err := scanner.FindParentFolder(database, path); err == nil {
+			t.Errorf("Expected %q to be outside the monitored share", path)
+		}
+	}
+}
+
+func TestAddAndScanFolder_UNC(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("UNC paths are Windows-only")
+	}
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	// Reach the test folder through the administrative share of its drive
+	vol := filepath.VolumeName(testFolder)
+	if len(vol) != 2 || vol[1] != ':' {
+		t.Skipf("test folder %s is not on a drive letter", testFolder)
+	}
+	unc := `\\localhost\` + vol[:1] + `$` + testFolder[len(vol):]
+	if _, err := os.Stat(unc); err != nil {
+		t.Skipf("administrative share not available: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(testFolder, "photo.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatalf("Failed to write photo: %v", err)
+	}
+
+	if err := addFolder(unc+`\`, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	if err := addFolder(strings.ToUpper(unc), database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	if folders := getFolders(t, database); len(folders) != 1 || folders[0] != normalizePath(unc) {
+		t.Fatalf("Expected the share added once as %q, got %v", normalizePath(unc), folders)
+	}
+
+	folderID, err := scanner.GetFolderID(database, unc)
+	if err != nil {
+		t.Fatalf("GetFolderID failed: %v", err)
+	}
+	if _, err := scanner.ScanFolder(database, unc, folderID); err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+
+	photo := filepath.Join(unc, "photo.jpg")
+	_, id, err := scanner.FindParentFolder(database, photo)
+	if err != nil || id != folderID {
+		t.Errorf("FindParentFolder(%q) = %d, %v; want %d", photo, id, err, folderID)
+	}
+	var count int
+	database.QueryRow("SELECT COUNT(*) FROM files WHERE path = ?", normalizePath(photo)).Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected photo indexed under the UNC path, got %d rows", count)
+	}
+}
+
+// recordFileWithThumbnails indexes path and records the given thumbnail paths for it.
+func recordFileWithThumbnails(t *testing.T, database *db.DB, folderID int64, path, smallPath, largePath string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %v", path, err)
+	}
+	fileID, err := upsertFile(database, folderID, path, info)
+	if err != nil {
+		t.Fatalf("upsertFile failed: %v", err)
+	}
+	updateFileThumbnails(database, fileID, smallPath, largePath)
+}
+
+func recordedThumbnail(t *testing.T, database *db.DB, path string) string {
+	t.Helper()
+	var small *string
+	if err := database.QueryRow("SELECT thumbnail_small_path FROM files WHERE path = ?", normalizePath(path)).Scan(&small); err != nil {
+		t.Fatalf("Failed to read thumbnail path: %v", err)
+	}
+	if small == nil {
+		return ""
+	}
+	return *small
+}
+
+func TestVerifyThumbnails(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+	q2Dir := t.TempDir()
+
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	folderID, err := scanner.GetFolderID(database, testFolder)
+	if err != nil {
+		t.Fatalf("GetFolderID failed: %v", err)
+	}
+
+	// One file whose thumbnails are still cached
+	cached := filepath.Join(testFolder, "cached.jpg")
+	cachedSmall := media.GetThumbnailPath(cached, media.SmallThumbnailSize, media.ThumbnailFormatJPEG)
+	cachedLarge := media.GetThumbnailPath(cached, media.LargeThumbnailSize, media.ThumbnailFormatJPEG)
+	recordFileWithThumbnails(t, database, folderID, cached, cachedSmall, cachedLarge)
+	for _, rel := range []string{cachedSmall, cachedLarge} {
+		os.MkdirAll(filepath.Dir(filepath.Join(q2Dir, rel)), 0755)
+		if err := os.WriteFile(filepath.Join(q2Dir, rel), []byte("jpeg"), 0644); err != nil {
+			t.Fatalf("Failed to write thumbnail: %v", err)
+		}
+	}
+
+	// Two whose cache entries are gone and cannot be rebuilt: a track
+	// without cover art, and an image with no ffmpeg to scale it
+	song := filepath.Join(testFolder, "song.mp3")
+	recordFileWithThumbnails(t, database, folderID, song,
+		media.GetThumbnailPath(song, media.SmallThumbnailSize, media.ThumbnailFormatJPEG), media.GetThumbnailPath(song, media.LargeThumbnailSize, media.ThumbnailFormatJPEG))
+	photo := filepath.Join(testFolder, "photo.jpg")
+	recordFileWithThumbnails(t, database, folderID, photo,
+		media.GetThumbnailPath(photo, media.SmallThumbnailSize, media.ThumbnailFormatJPEG), media.GetThumbnailPath(photo, media.LargeThumbnailSize, media.ThumbnailFormatJPEG))
+
+	check, err := verifyThumbnails(context.Background(), database, q2Dir, nil, true)
+	if err != nil {
+		t.Fatalf("verifyThumbnails failed: %v", err)
+	}
+	if check.Checked != 3 || check.Missing != 2 || check.Cleared != 0 {
+		t.Errorf("Dry run: got %+v", check)
+	}
+	if recordedThumbnail(t, database, song) == "" {
+		t.Error("Expected dry run to leave the database unchanged")
+	}
+
+	check, err = verifyThumbnails(context.Background(), database, q2Dir, nil, false)
+	if err != nil {
+		t.Fatalf("verifyThumbnails failed: %v", err)
+	}
+	if check.Missing != 2 || check.Regenerated != 0 || check.Cleared != 2 {
+		t.Errorf("Expected both missing thumbnails cleared, got %+v", check)
+	}
+	for _, path := range []string{song, photo} {
+		if got := recordedThumbnail(t, database, path); got != "" {
+			t.Errorf("Expected thumbnail of %s cleared, got %q", path, got)
+		}
+	}
+	if got := recordedThumbnail(t, database, cached); got != cachedSmall {
+		t.Errorf("Expected cached thumbnail kept, got %q", got)
+	}
+
+	// Nothing left to fix
+	check, _ = verifyThumbnails(context.Background(), database, q2Dir, nil, false)
+	if check.Checked != 1 || check.Missing != 0 {
+		t.Errorf("Expected a clean second run, got %+v", check)
+	}
+}
+
+func TestThumbnailHandler_RegeneratesMissingThumbnail(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not installed")
+	}
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+	q2Dir := t.TempDir()
+	ffmpegMgr := ffmpeg.NewManager(filepath.Join(q2Dir, "bin"))
+
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	folderID, err := scanner.GetFolderID(database, testFolder)
+	if err != nil {
+		t.Fatalf("GetFolderID failed: %v", err)
+	}
+
+	photo := filepath.Join(testFolder, "photo.jpg")
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 64, 48)), nil); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	if err := os.WriteFile(photo, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write photo: %v", err)
+	}
+	info, _ := os.Stat(photo)
+	fileID, err := upsertFile(database, folderID, photo, info)
+	if err != nil {
+		t.Fatalf("upsertFile failed: %v", err)
+	}
+	small, large, err := generateThumbnails(context.Background(), photo, media.CentralStore{Dir: q2Dir}, ffmpegMgr)
+	if err != nil {
+		t.Fatalf("generateThumbnails failed: %v", err)
+	}
+	updateFileThumbnails(database, fileID, small, large)
+
+	// The cache is cleared behind the database's back
+	if err := os.RemoveAll(filepath.Join(q2Dir, media.ThumbnailDir)); err != nil {
+		t.Fatalf("Failed to clear cache: %v", err)
+	}
+
+	handler := makeThumbnailHandler(database, q2Dir, ffmpegMgr)
+	req := httptest.NewRequest(http.MethodGet, "/api/thumbnail?path="+url.QueryEscape(photo)+"&size=small", nil)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 after regeneration, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(q2Dir, small)); err != nil {
+		t.Errorf("Expected thumbnail back on disk: %v", err)
+	}
+}
+
+func TestThumbnailHandler_Modes(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+	q2Dir := t.TempDir()
+
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	photo := filepath.Join(testFolder, "photo.jpg")
+	if err := os.WriteFile(photo, []byte("jpeg"), 0644); err != nil {
+		t.Fatalf("Failed to write photo: %v", err)
+	}
+	fit := media.GetThumbnailPath(photo, media.SmallThumbnailSize, media.ThumbnailFormatJPEG)
+	crop := media.ThumbnailModePath(fit, media.ThumbnailModeCrop)
+	for rel, content := range map[string]string{fit: "fit", crop: "crop"} {
+		full := filepath.Join(q2Dir, rel)
+		os.MkdirAll(filepath.Dir(full), 0755)
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write thumbnail: %v", err)
+		}
+	}
+
+	handler := makeThumbnailHandler(database, q2Dir, nil)
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/api/thumbnail?path="+url.QueryEscape(photo)+query, nil))
+		return rec
+	}
+	for query, want := range map[string]string{"": "fit", "&mode=fit": "fit", "&mode=crop": "crop"} {
+		if rec := get(query); rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("%q: expected the %s thumbnail, got %d %q", query, want, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := get("&mode=stretch"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown mode, got %d", rec.Code)
+	}
+
+	// The thumbnail_mode setting picks the mode when a request names none
+	settings := makeSettingsPostHandler(database)
+	rec := httptest.NewRecorder()
+	settings(rec, httptest.NewRequest(http.MethodPost, "/api/settings", strings.NewReader(`{"thumbnail_mode": "stretch"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown mode setting, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	settings(rec, httptest.NewRequest(http.MethodPost, "/api/settings", strings.NewReader(`{"thumbnail_mode": "crop"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to save setting: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := get(""); rec.Body.String() != "crop" {
+		t.Errorf("Expected the setting's cropped thumbnail, got %q", rec.Body.String())
+	}
+	if rec := get("&mode=fit"); rec.Body.String() != "fit" {
+		t.Errorf("Expected the request's mode to win over the setting, got %q", rec.Body.String())
+	}
+}
+
+func TestCompatibleAudioCodecs(t *testing.T) {
+	database, _, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	if codecs := compatibleAudioCodecs(database); codecs != nil {
+		t.Errorf("Expected the ffmpeg defaults without a setting, got %v", codecs)
+	}
+
+	settings := makeSettingsPostHandler(database)
+	rec := httptest.NewRecorder()
+	settings(rec, httptest.NewRequest(http.MethodPost, "/api/settings", strings.NewReader(`{"compatible_audio_codecs": " , "}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a codec list naming no codec, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	settings(rec, httptest.NewRequest(http.MethodPost, "/api/settings", strings.NewReader(`{"compatible_audio_codecs": "AAC, mp3"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to save setting: %d %s", rec.Code, rec.Body.String())
+	}
+	if codecs := compatibleAudioCodecs(database); !slices.Equal(codecs, []string{"aac", "mp3"}) {
+		t.Errorf("Expected the setting's codecs, got %v", codecs)
+	}
+
+	rec = httptest.NewRecorder()
+	makeVideoHandler(database, nil)(rec, httptest.NewRequest(http.MethodGet, "/api/video?path=/clip.mp4&codecs=,", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a codecs parameter naming no codec, got %d", rec.Code)
+	}
+}
+
+func TestThumbnailHandler_ServesSidecarThumbnails(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+	q2Dir := t.TempDir()
+
+	if err := addFolder(testFolder, database); err != nil {
+		t.Fatalf("addFolder failed: %v", err)
+	}
+	photo := filepath.Join(testFolder, "photo.jpg")
+	if err := os.WriteFile(photo, []byte("jpeg"), 0644); err != nil {
+		t.Fatalf("Failed to write photo: %v", err)
+	}
+
+	// An unknown placement is rejected
+	settings := makeSettingsPostHandler(database)
+	rec := httptest.NewRecorder()
+	settings(rec, httptest.NewRequest(http.MethodPost, "/api/settings", strings.NewReader(`{"thumbnail_store": "nearby"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown placement, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	settings(rec, httptest.NewRequest(http.MethodPost, "/api/settings", strings.NewReader(`{"thumbnail_store": "sidecar"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to save setting: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := thumbnailStore(database, q2Dir).(media.SidecarStore); !ok {
+		t.Fatal("Expected the sidecar store after saving the setting")
+	}
+
+	sidecar := media.SidecarThumbnailPath(photo, media.SmallThumbnailSize, media.ThumbnailFormatJPEG)
+	os.MkdirAll(filepath.Dir(sidecar), 0755)
+	if err := os.WriteFile(sidecar, []byte("sidecar"), 0644); err != nil {
+		t.Fatalf("Failed to write sidecar thumbnail: %v", err)
+	}
+
+	handler := makeThumbnailHandler(database, q2Dir, nil)
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api/thumbnail?path="+url.QueryEscape(photo)+"&size=small", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "sidecar" {
+		t.Errorf("Expected the sidecar thumbnail, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Sidecar folders are not indexed as media
+	folderID, _ := scanner.GetFolderID(database, testFolder)
+	if _, err := scanner.ScanFolder(database, testFolder, folderID); err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	var count int
+	database.QueryRow("SELECT COUNT(*) FROM files WHERE path LIKE ?", "%"+scanner.ThumbnailSidecarDir+"%").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected sidecar thumbnails to be skipped by the scanner, got %d rows", count)
+	}
+}
+
+// createBenchmarkTree writes n small media files under dir, 100 per folder.
+func createBenchmarkTree(b *testing.B, dir string, n int) {
+	b.Helper()
+	exts := []string{".mp3", ".jpg", ".mp4", ".flac"}
+	for i := 0; i < n; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("album%03d", i/100))
+		if i%100 == 0 {
+			if err := os.MkdirAll(sub, 0755); err != nil {
+				b.Fatalf("Failed to create %s: %v", sub, err)
+			}
+		}
+		path := filepath.Join(sub, fmt.Sprintf("file%05d%s", i, exts[i%len(exts)]))
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			b.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+}
+
+// BenchmarkScanFolder measures a first scan, which inserts every file, and a
+// rescan of the unchanged tree, which only reads.
+func BenchmarkScanFolder(b *testing.B) {
+	for _, n := range []int{100, 1000, 5000} {
+		b.Run(fmt.Sprintf("initial/%d", n), func(b *testing.B) {
+			database, folder, cleanup := setupTestEnv(b)
+			defer cleanup()
+			createBenchmarkTree(b, folder, n)
+			folderID := addTestFolder(b, database, folder)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if r := database.Write("DELETE FROM files"); r.Err != nil {
+					b.Fatalf("Failed to clear files: %v", r.Err)
+				}
+				b.StartTimer()
+
+				if _, err := scanner.ScanFolder(database, folder, folderID); err != nil {
+					b.Fatalf("ScanFolder failed: %v", err)
+				}
+			}
+			b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "files/s")
+		})
+
+		b.Run(fmt.Sprintf("rescan/%d", n), func(b *testing.B) {
+			database, folder, cleanup := setupTestEnv(b)
+			defer cleanup()
+			createBenchmarkTree(b, folder, n)
+			folderID := addTestFolder(b, database, folder)
+			if _, err := scanner.ScanFolder(database, folder, folderID); err != nil {
+				b.Fatalf("ScanFolder failed: %v", err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := scanner.ScanFolder(database, folder, folderID); err != nil {
+					b.Fatalf("ScanFolder failed: %v", err)
+				}
+			}
+			b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "files/s")
+		})
+	}
+}
+
+// isFileIndexed reports whether path is indexed and not marked deleted.
+func isFileIndexed(database *db.DB, path string) bool {
+	var n int
+	database.QueryRow("SELECT COUNT(*) FROM files WHERE path = ? AND deleted_at IS NULL", normalizePath(path)).Scan(&n)
+	return n > 0
+}
+
+// addTestFolder inserts folder into the folders table and returns its ID.
+func addTestFolder(t testing.TB, database *db.DB, folder string) int64 {
+	t.Helper()
+	result := database.Write("INSERT INTO folders (path) VALUES (?)", normalizePath(folder))
+	if result.Err != nil {
+		t.Fatalf("Failed to insert folder: %v", result.Err)
+	}
+	return result.LastInsertID
+}
+
+func TestScanProgressPrinter(t *testing.T) {
+	var buf bytes.Buffer
+	deep := "/music/" + strings.Repeat("nested/", 20) + "album"
+	sp := scanner.ScanProgress{FilesScanned: 1500, FilesAdded: 1200, FilesUpdated: 3, Dir: deep}
+
+	// Piped output gets a line per interval
+	p := &scanProgressPrinter{out: &buf, interval: time.Hour, start: time.Now().Add(-time.Second)}
+	p.update(sp)
+	p.update(sp)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one line within the interval, got %q", buf.String())
+	}
+	if !strings.Contains(lines[0], "1500 files scanned (1200 added, 3 updated)") || !strings.Contains(lines[0], "files/s") {
+		t.Errorf("Expected counts and rate, got %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[0], "nested/album") || strings.Contains(lines[0], deep) {
+		t.Errorf("Expected the end of a long directory, got %q", lines[0])
+	}
+	p.finish()
+	if strings.Contains(buf.String(), "\r") {
+		t.Error("Expected no carriage returns when not on a terminal")
+	}
+
+	// A terminal gets one line redrawn in place, cleared when done
+	buf.Reset()
+	p = &scanProgressPrinter{out: &buf, tty: true, start: time.Now()}
+	p.update(sp)
+	p.update(scanner.ScanProgress{FilesScanned: 1, Dir: "/m"})
+	p.finish()
+	out := buf.String()
+	if strings.Contains(out, "\n") || strings.Count(out, "\r") != 4 {
+		t.Errorf("Expected in-place redraws, got %q", out)
+	}
+	if !strings.HasSuffix(out, "\r") {
+		t.Errorf("Expected the line cleared at the end, got %q", out)
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	var reached int
+	handler := corsMiddleware(parseOrigins("https://app.example.com/, http://localhost:5173"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	}))
+	request := func(method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/roots", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// A preflight from an allowed origin is answered without reaching the API
+	w := request(http.MethodOptions, "https://app.example.com")
+	if w.Code != http.StatusNoContent || reached != 0 {
+		t.Errorf("Expected preflight answered with 204, got %d (handler reached %d times)", w.Code, reached)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Expected the origin allowed, got %q", got)
+	}
+	if w.Header().Get("Access-Control-Allow-Methods") != corsAllowMethods || w.Header().Get("Access-Control-Allow-Headers") != corsAllowHeaders {
+		t.Errorf("Expected allowed methods and headers, got %v", w.Header())
+	}
+
+	w = request(http.MethodGet, "http://localhost:5173")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "http://localhost:5173" {
+		t.Errorf("Expected a GET from an allowed origin to carry its origin, got %d %v", w.Code, w.Header())
+	}
+
+	// Other origins are not reflected
+	for _, method := range []string{http.MethodOptions, http.MethodGet} {
+		w = request(method, "https://evil.example.com")
+		for _, h := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Methods"} {
+			if got := w.Header().Get(h); got != "" {
+				t.Errorf("%s from a disallowed origin: expected no %s, got %q", method, h, got)
+			}
+		}
+	}
+	if w := request(http.MethodGet, ""); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Expected no CORS headers on a same-origin request")
+	}
+
+	wildcard := corsMiddleware([]string{"*"}, http.NotFoundHandler())
+	req := httptest.NewRequest(http.MethodGet, "/api/roots", nil)
+	req.Header.Set("Origin", "https://anywhere.example.com")
+	rec := httptest.NewRecorder()
+	wildcard.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Expected * with a wildcard, got %q", got)
+	}
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	video := bytes.Repeat([]byte{0, 0, 0, 0x18, 'f', 't', 'y', 'p'}, 512)
+	handler := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/files":
+			writeJSON(w, http.StatusOK, map[string]string{"name": strings.Repeat("holiday.jpg ", 200)})
+		case "/video":
+			w.Header().Set("Content-Type", "video/mp4")
+			http.ServeContent(w, r, "clip.mp4", time.Time{}, bytes.NewReader(video))
+		}
+	}))
+	request := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("/api/files", "br, gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected JSON to be gzipped, got headers %v", w.Header())
+	}
+	if !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") {
+		t.Errorf("Expected Vary: Accept-Encoding, got %q", w.Header().Get("Vary"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Body is not gzip: %v", err)
+	}
+	var got map[string]string
+	if err := json.NewDecoder(zr).Decode(&got); err != nil || !strings.HasPrefix(got["name"], "holiday.jpg") {
+		t.Errorf("Expected the JSON back after decompressing, got %v (%v)", got, err)
+	}
+
+	// Raw video bytes are sent as they are
+	w = request("/video", "gzip")
+	if w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), video) {
+		t.Errorf("Expected video sent uncompressed, got %q and %d bytes", w.Header().Get("Content-Encoding"), w.Body.Len())
+	}
+
+	// Clients that don't ask, or refuse gzip, get plain JSON
+	for _, accept := range []string{"", "gzip;q=0", "identity"} {
+		w = request("/api/files", accept)
+		if w.Header().Get("Content-Encoding") != "" || !json.Valid(w.Body.Bytes()) {
+			t.Errorf("Accept-Encoding %q: expected plain JSON, got %q", accept, w.Header().Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestSelfSignedCert_ServesTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, err := ensureSelfSignedCert(dir)
+	if err != nil {
+		t.Fatalf("ensureSelfSignedCert failed: %v", err)
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatalf("Failed to read certificate: %v", err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm()&0077 != 0 {
+		t.Errorf("Expected a private key file, got %v (%v)", info, err)
+	}
+
+	// Later runs reuse the same certificate
+	if _, _, err := ensureSelfSignedCert(dir); err != nil {
+		t.Fatalf("ensureSelfSignedCert failed on reuse: %v", err)
+	}
+	if again, _ := os.ReadFile(certFile); !bytes.Equal(again, certPEM) {
+		t.Error("Expected the certificate to be reused")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(homeEndpoint)}
+	go server.ServeTLS(ln, certFile, keyFile)
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(certPEM) {
+		t.Fatal("Failed to parse certificate")
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Errorf("Expected 200 over TLS, got %d (TLS %v)", resp.StatusCode, resp.TLS != nil)
+	}
+}
+
+func TestCastDeviceHandlers(t *testing.T) {
+	castMgr := cast.NewManager("")
+	var discoveries int
+	var lastTimeout time.Duration
+	castMgr.SetDiscoverySource(func(ctx context.Context) ([]cast.Device, error) {
+		discoveries++
+		if deadline, ok := ctx.Deadline(); ok {
+			lastTimeout = time.Until(deadline)
+		}
+		return []cast.Device{
+			{UUID: "tv-1", Name: "Living Room TV", Host: "127.0.0.1", Port: 8009, DeviceType: "Chromecast"},
+			{UUID: "speaker-1", Name: "Kitchen Speaker", Host: "127.0.0.1", Port: 8009, DeviceType: "Google Nest Mini", IsAudio: true},
+		}, nil
+	})
+	devicesHandler := makeCastDevicesHandler(castMgr)
+	connectHandler := makeCastConnectHandler(castMgr)
+
+	list := func(query string) (int, []cast.Device) {
+		w := httptest.NewRecorder()
+		devicesHandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/cast/devices"+query, nil))
+		var resp struct{ Devices []cast.Device }
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp.Devices
+	}
+
+	// Connecting before any discovery searches first; unknown names are 404
+	w := httptest.NewRecorder()
+	connectHandler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/cast/connect", strings.NewReader(`{"name": "Bedroom"}`)))
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "Kitchen Speaker") {
+		t.Errorf("Expected 404 listing the devices, got %d %s", w.Code, w.Body)
+	}
+	if discoveries != 1 {
+		t.Errorf("Expected connect to discover devices first, got %d discoveries", discoveries)
+	}
+
+	code, devices := list("?refresh=1")
+	if code != http.StatusOK || len(devices) != 2 || devices[0].Name != "Kitchen Speaker" || devices[1].UUID != "tv-1" {
+		t.Errorf("Expected both devices sorted by name, got %d %+v", code, devices)
+	}
+	if lastTimeout > defaultCastDiscoveryTimeout || lastTimeout < defaultCastDiscoveryTimeout-time.Second {
+		t.Errorf("Expected the default timeout, got %v", lastTimeout)
+	}
+	if _, devices := list("?type=audio"); len(devices) != 1 || devices[0].UUID != "speaker-1" {
+		t.Errorf("Expected only the speaker, got %+v", devices)
+	}
+
+	// The timeout is capped, and must be valid
+	list("?refresh=1&timeout=5m")
+	if lastTimeout > maxCastDiscoveryTimeout {
+		t.Errorf("Expected the timeout capped at %v, got %v", maxCastDiscoveryTimeout, lastTimeout)
+	}
+	list("?refresh=1&timeout=2")
+	if lastTimeout > 2*time.Second || lastTimeout < time.Second {
+		t.Errorf("Expected a 2 second timeout, got %v", lastTimeout)
+	}
+	for _, bad := range []string{"soon", "-1s", "0"} {
+		if code, _ := list("?timeout=" + bad); code != http.StatusBadRequest {
+			t.Errorf("timeout=%s: expected 400, got %d", bad, code)
+		}
+	}
+
+	for body, want := range map[string]int{
+		`{}`:                 http.StatusBadRequest,
+		`{"uuid": "gone-1"}`: http.StatusNotFound,
+		`not json`:           http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		connectHandler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/cast/connect", strings.NewReader(body)))
+		if w.Code != want {
+			t.Errorf("%s: expected %d, got %d %s", body, want, w.Code, w.Body)
+		}
+	}
+}
+
+func TestMetadataCoverage(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	photos := addTestFolder(t, database, filepath.Join(testFolder, "photos"))
+	addTestFolder(t, database, filepath.Join(testFolder, "empty"))
+
+	insert := func(name, mediaType, thumb, hash string, enrichedAt interface{}) int64 {
+		t.Helper()
+		r := database.Write(
+			"INSERT INTO files (folder_id, path, filename, mediatype, size, thumbnail_small_path, xxhash, enriched_at) VALUES (?, ?, ?, ?, 0, NULLIF(?, ''), NULLIF(?, ''), ?)",
+			photos, filepath.Join(testFolder, "photos", name), name, mediaType, thumb, hash, enrichedAt,
+		)
+		if r.Err != nil {
+			t.Fatalf("Failed to insert %s: %v", name, r.Err)
+		}
+		return r.LastInsertID
+	}
+	done := insert("done.jpg", "IMG", "thumbnails/aa/done.jpg", "abc", 1)
+	insert("new.jpg", "image", "", "", nil)
+	insert("broken.jpg", "IMG", "", "", 1)
+	insert("clip.mp4", "VID", "", "def", nil)
+	song := insert("song.mp3", "AUD", "", "", nil)
+	insert("tagless.mp3", "AUD", "", "", nil)
+	database.Write("INSERT INTO image_metadata (file_id) VALUES (?)", done)
+	database.Write("INSERT INTO audio_metadata (file_id) VALUES (?)", song)
+
+	folders, total, err := metadataCoverage(database)
+	if err != nil {
+		t.Fatalf("metadataCoverage failed: %v", err)
+	}
+	if len(folders) != 2 {
+		t.Fatalf("Expected both folders, got %+v", folders)
+	}
+	empty, got := folders[0], folders[1]
+	if empty.Files != 0 || empty.ThumbnailsPending != 0 || empty.WithoutHash != 0 {
+		t.Errorf("Expected zero counts for the empty folder, got %+v", empty)
+	}
+	want := FolderCoverage{
+		FolderID: photos, Path: got.Path,
+		Files: 6, Images: 3, ImagesWithoutMetadata: 2, Audio: 2, AudioWithoutMetadata: 1, Videos: 1,
+		ThumbnailsPending: 2, ThumbnailsFailed: 1, WithoutHash: 4,
+	}
+	if got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	want.FolderID, want.Path = 0, ""
+	if total != want {
+		t.Errorf("Expected totals %+v, got %+v", want, total)
+	}
+
+	w := httptest.NewRecorder()
+	makeCoverageHandler(database).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/coverage", nil))
+	var resp struct {
+		Folders []FolderCoverage `json:"folders"`
+		Total   FolderCoverage   `json:"total"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 with JSON, got %d (%v)", w.Code, err)
+	}
+	if len(resp.Folders) != 2 || resp.Total.ThumbnailsFailed != 1 {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+}
+
+func TestDownloadZipHandler(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	folderID := addTestFolder(t, database, testFolder)
+	outside := t.TempDir()
+	insert := func(path, content string) int64 {
+		t.Helper()
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+		r := database.Write("INSERT INTO files (folder_id, path, filename, size) VALUES (?, ?, ?, ?)",
+			folderID, normalizePath(path), filepath.Base(path), len(content))
+		if r.Err != nil {
+			t.Fatalf("Failed to insert %s: %v", path, r.Err)
+		}
+		return r.LastInsertID
+	}
+	first := insert(filepath.Join(testFolder, "2023", "photo.jpg"), "first photo")
+	second := insert(filepath.Join(testFolder, "2024", "photo.jpg"), "second photo")
+	notes := insert(filepath.Join(testFolder, "notes.txt"), strings.Repeat("notes ", 100))
+	stray := insert(filepath.Join(outside, "secret.txt"), "secret")
+
+	handler := makeDownloadZipHandler(database)
+	post := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/download/zip", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("application/json", fmt.Sprintf(`{"ids": [%d, %d, %d, %d], "name": "Trip/2024"}`, first, second, notes, first))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Expected a zip, got %d %s", w.Code, w.Body)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename=Trip_2024.zip` {
+		t.Errorf("Unexpected Content-Disposition %q", cd)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("Invalid zip: %v", err)
+	}
+	want := []struct {
+		name, content string
+		method        uint16
+	}{
+		{"photo.jpg", "first photo", zip.Store},
+		{"photo (2).jpg", "second photo", zip.Store},
+		{"notes.txt", strings.Repeat("notes ", 100), zip.Deflate},
+	}
+	if len(zr.File) != len(want) {
+		t.Fatalf("Expected %d entries, got %d", len(want), len(zr.File))
+	}
+	for i, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", f.Name, err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		if f.Name != want[i].name || string(content) != want[i].content || f.Method != want[i].method {
+			t.Errorf("Entry %d: expected %s (method %d), got %s (method %d) with %q", i, want[i].name, want[i].method, f.Name, f.Method, content)
+		}
+	}
+
+	// A plain form post works too
+	w = post("application/x-www-form-urlencoded", fmt.Sprintf("ids=%d,%d", first, notes))
+	if zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len())); err != nil || len(zr.File) != 2 {
+		t.Errorf("Expected 2 entries from a form post, got %d (%v)", w.Code, err)
+	}
+
+	for body, code := range map[string]int{
+		`{"ids": []}`:                       http.StatusBadRequest,
+		`{"ids": [424242]}`:                 http.StatusNotFound,
+		fmt.Sprintf(`{"ids": [%d]}`, stray): http.StatusForbidden,
+		`nope`:                              http.StatusBadRequest,
+	} {
+		if w := post("application/json", body); w.Code != code {
+			t.Errorf("%s: expected %d, got %d %s", body, code, w.Code, w.Body)
+		}
+	}
+
+	// A client that has gone away gets nothing more
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/api/download/zip", strings.NewReader(fmt.Sprintf(`{"ids": [%d]}`, first))).WithContext(ctx)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected no archive for a disconnected client, got %d bytes", w.Body.Len())
+	}
+}
+
+// fakeCastPlayer records the playback commands the cast handlers send.
+type fakeCastPlayer struct {
+	connected bool
+	calls     []string
+}
+
+func (f *fakeCastPlayer) call(format string, args ...interface{}) error {
+	if !f.connected {
+		return cast.ErrNotConnected
+	}
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+	return nil
+}
+
+func (f *fakeCastPlayer) PlayMedia(filePath, contentType, title string) (string, error) {
+	return "http://q2/api/stream?path=" + filePath, f.call("play %s %s %s", filePath, contentType, title)
+}
+func (f *fakeCastPlayer) Pause() error                  { return f.call("pause") }
+func (f *fakeCastPlayer) Resume() error                 { return f.call("resume") }
+func (f *fakeCastPlayer) Stop() error                   { return f.call("stop") }
+func (f *fakeCastPlayer) Seek(position float64) error   { return f.call("seek %g", position) }
+func (f *fakeCastPlayer) SetVolume(level float64) error { return f.call("volume %g", level) }
+func (f *fakeCastPlayer) SetMuted(muted bool) error     { return f.call("muted %t", muted) }
+func (f *fakeCastPlayer) GetStatus() cast.Status {
+	return cast.Status{Connected: f.connected, DeviceName: "Living Room TV", PlayerState: "PLAYING", Volume: 0.5}
+}
+
+func TestCastControlHandlers(t *testing.T) {
+	player := &fakeCastPlayer{connected: true}
+	handlers := map[string]http.HandlerFunc{
+		"play":   makeCastPlayHandler(player),
+		"pause":  makeCastPauseHandler(player),
+		"resume": makeCastResumeHandler(player),
+		"stop":   makeCastStopHandler(player),
+		"seek":   makeCastSeekHandler(player),
+		"volume": makeCastVolumeHandler(player),
+		"status": makeCastStatusHandler(player),
+	}
+	send := func(method, endpoint, body string) *httptest.ResponseRecorder {
+		name, _, _ := strings.Cut(endpoint, "?")
+		w := httptest.NewRecorder()
+		handlers[name].ServeHTTP(w, httptest.NewRequest(method, "/api/cast/"+endpoint, strings.NewReader(body)))
+		return w
+	}
+
+	commands := []struct {
+		endpoint, body, call string
+	}{
+		{"play", `{"path": "/music/song.mp3", "title": "Song"}`, "play /music/song.mp3 audio/mpeg Song"},
+		{"pause", "", "pause"},
+		{"resume", "", "resume"},
+		{"stop", "", "stop"},
+		{"seek?pos=90.5", "", "seek 90.5"},
+		{"seek", `{"position": 12}`, "seek 12"},
+		{"volume?level=0.25", "", "volume 0.25"},
+		{"volume", `{"level": 1, "muted": false}`, "volume 1"},
+		{"volume", `{"muted": true}`, "muted true"},
+	}
+	for _, c := range commands {
+		player.calls = nil
+		w := send(http.MethodPost, c.endpoint, c.body)
+		if w.Code != http.StatusOK || len(player.calls) == 0 || player.calls[0] != c.call {
+			t.Errorf("%s: expected %q, got %d %v %s", c.endpoint, c.call, w.Code, player.calls, w.Body)
+		}
+	}
+
+	w := send(http.MethodGet, "status", "")
+	var status cast.Status
+	json.NewDecoder(w.Body).Decode(&status)
+	if w.Code != http.StatusOK || !status.Connected || status.DeviceName != "Living Room TV" || status.Volume != 0.5 {
+		t.Errorf("Expected the player's status, got %d %+v", w.Code, status)
+	}
+
+	// Out of range or malformed values never reach the device
+	player.calls = nil
+	for _, endpoint := range []string{"volume?level=1.5", "volume?level=-0.1", "volume?level=loud", "seek?pos=-3", "seek?pos=NaN"} {
+		if w := send(http.MethodPost, endpoint, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", endpoint, w.Code)
+		}
+	}
+	if w := send(http.MethodPost, "volume", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without level or muted, got %d", w.Code)
+	}
+	if len(player.calls) != 0 {
+		t.Errorf("Expected no commands for invalid requests, got %v", player.calls)
+	}
+	if w := send(http.MethodGet, "pause", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET pause, got %d", w.Code)
+	}
+
+	// Every command is a conflict without a connected device
+	player.connected = false
+	for _, c := range commands {
+		if w := send(http.MethodPost, c.endpoint, c.body); w.Code != http.StatusConflict {
+			t.Errorf("%s: expected 409 when not connected, got %d", c.endpoint, w.Code)
+		}
+	}
+
+	// The real manager reports the same error
+	if err := cast.NewManager("").Pause(); !errors.Is(err, cast.ErrNotConnected) {
+		t.Errorf("Expected cast.ErrNotConnected, got %v", err)
+	}
+}
+
+func TestExportAlbum(t *testing.T) {
+	database, testFolder, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	folderID := addTestFolder(t, database, testFolder)
+	albumID := database.Write("INSERT INTO albums (name) VALUES ('Holiday')").LastInsertID
+	addItem := func(path, content string, position int) {
+		t.Helper()
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(content), 0644)
+		file := database.Write("INSERT INTO files (folder_id, path, filename, size) VALUES (?, ?, ?, ?)",
+			folderID, normalizePath(path), filepath.Base(path), len(content))
+		if file.Err != nil {
+			t.Fatalf("Failed to insert %s: %v", path, file.Err)
+		}
+		fileID := file.LastInsertID
+		if r := database.Write("INSERT INTO album_items (album_id, file_id, position) VALUES (?, ?, ?)", albumID, fileID, position); r.Err != nil {
+			t.Fatalf("Failed to add album item: %v", r.Err)
+		}
+	}
+	addItem(filepath.Join(testFolder, "beach.jpg"), "beach", 2)
+	addItem(filepath.Join(testFolder, "2024", "sunset.jpg"), "sunset", 0)
+	addItem(filepath.Join(testFolder, "gone.jpg"), "gone", 1)
+	os.Remove(filepath.Join(testFolder, "gone.jpg"))
+
+	dest := filepath.Join(t.TempDir(), "export")
+	result, err := exportAlbum(database, albumID, dest, false)
+	if err != nil {
+		t.Fatalf("exportAlbum failed: %v", err)
+	}
+	if got := strings.Join(result.Files, ", "); got != "001 - sunset.jpg, 003 - beach.jpg" {
+		t.Errorf("Expected files numbered in album order, got %s", got)
+	}
+	if len(result.Missing) != 1 || !strings.HasSuffix(result.Missing[0], "gone.jpg") {
+		t.Errorf("Expected gone.jpg reported missing, got %v", result.Missing)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dest, "003 - beach.jpg")); string(content) != "beach" {
+		t.Errorf("Expected the copied content, got %q", content)
+	}
+
+	// Exporting again keeps the first export and links where it can
+	result, err = exportAlbum(database, albumID, dest, true)
+	if err != nil {
+		t.Fatalf("exportAlbum with link failed: %v", err)
+	}
+	if got := strings.Join(result.Files, ", "); got != "001 - sunset (2).jpg, 003 - beach (2).jpg" || result.Linked != 2 {
+		t.Errorf("Expected numbered duplicates, both linked, got %s (%d linked)", got, result.Linked)
+	}
+	original, _ := os.Stat(filepath.Join(testFolder, "beach.jpg"))
+	if linked, err := os.Stat(filepath.Join(dest, "003 - beach (2).jpg")); err != nil || !os.SameFile(original, linked) {
+		t.Errorf("Expected a hard link to the original (%v)", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dest, "001 - sunset.jpg")); string(content) != "sunset" {
+		t.Errorf("Expected the earlier export kept, got %q", content)
+	}
+
+	if _, err := exportAlbum(database, albumID, filepath.Join(testFolder, "export"), false); !errors.Is(err, errInvalidExportDest) {
+		t.Errorf("Expected a destination inside a monitored folder to be refused, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(testFolder, "export")); !os.IsNotExist(err) {
+		t.Error("Expected the refused destination not to be created")
+	}
+	if _, err := exportAlbum(database, 4242, dest, false); !errors.Is(err, errAlbumNotFound) {
+		t.Errorf("Expected errAlbumNotFound, got %v", err)
+	}
+
+	handler := makeAlbumExportHandler(database, "secret")
+	for _, tt := range []struct {
+		body string
+		code int
+	}{
+		{fmt.Sprintf(`{"album_id": %d, "dest": %q}`, albumID, t.TempDir()), http.StatusOK},
+		{fmt.Sprintf(`{"album_id": %d, "dest": %q}`, albumID, testFolder), http.StatusBadRequest},
+		{fmt.Sprintf(`{"album_id": 4242, "dest": %q}`, t.TempDir()), http.StatusNotFound},
+		{fmt.Sprintf(`{"album_id": %d}`, albumID), http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/album/export", strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d %s", tt.body, tt.code, w.Code, w.Body)
+		}
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/album/export", strings.NewReader(`{}`)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the token, got %d", w.Code)
+	}
+}
+
+func TestRequestActivity_ThrottlesThumbnails(t *testing.T) {
+	defer func() {
+		serverActivity.inFlight.Store(0)
+		serverActivity.last.Store(0)
+		thumbnailIdleAfter.Store(0)
+		thumbnailWorkers.Store(0)
+	}()
+	thumbnailIdleAfter.Store(int64(time.Minute))
+	thumbnailWorkers.Store(4)
+
+	// Before any request the server is idle
+	if throttledThumbnailWorkers() != 4 {
+		t.Errorf("Expected 4 workers before any request, got %d", throttledThumbnailWorkers())
+	}
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := serverActivity.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/video" {
+			close(started)
+			<-release
+		}
+	}))
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/video", nil))
+		close(done)
+	}()
+	<-started
+	if serverActivity.idle(time.Now()) != 0 || throttledThumbnailWorkers() != 1 {
+		t.Errorf("Expected one worker while a request runs, got %d", throttledThumbnailWorkers())
+	}
+
+	w := httptest.NewRecorder()
+	makeThumbnailStatusHandler(nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/thumbnails/status", nil))
+	var status ThumbnailStatus
+	json.NewDecoder(w.Body).Decode(&status)
+	if !status.Throttled || status.Workers != 1 || status.MaxWorkers != 4 || status.ActiveRequests != 1 || status.LastRequest == "" {
+		t.Errorf("Unexpected status while busy: %+v", status)
+	}
+	close(release)
+	<-done
+
+	// Status polls are not activity
+	serverActivity.last.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/thumbnails/status", nil))
+	if throttledThumbnailWorkers() != 4 {
+		t.Errorf("Expected full speed once idle, got %d", throttledThumbnailWorkers())
+	}
+	if idle := serverActivity.idle(time.Now()); idle < 2*time.Minute {
+		t.Errorf("Expected a status poll not to count as activity, idle for %v", idle)
+	}
+
+	// A finished request keeps it throttled for the idle period
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/browse", nil))
+	if !thumbnailThrottled(time.Now()) || thumbnailThrottled(time.Now().Add(time.Minute+time.Second)) {
+		t.Error("Expected throttling to last one idle period after a request")
+	}
+	thumbnailIdleAfter.Store(0)
+	if throttledThumbnailWorkers() != 4 {
+		t.Error("Expected no throttling with -thumbnail-idle-after 0")
+	}
+}
+
+func TestAccessLogMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	handler := accessLogMiddleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("Q2"))
+	}))
+
+	type entry struct {
+		Msg      string
+		Method   string
+		Path     string
+		Status   int
+		Bytes    int64
+		Duration int64
+	}
+	serve := func(path string) entry {
+		t.Helper()
+		logs.Reset()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path+"?q=1", nil))
+		var e entry
+		if err := json.Unmarshal(logs.Bytes(), &e); err != nil {
+			t.Fatalf("Failed to parse log %q: %v", logs.String(), err)
+		}
+		return e
+	}
+
+	if e := serve("/api/roots"); e.Msg != "request" || e.Method != "GET" || e.Path != "/api/roots" || e.Status != 200 || e.Bytes != 2 || e.Duration <= 0 {
+		t.Errorf("Unexpected access log entry %+v", e)
+	}
+	if e := serve("/missing"); e.Status != http.StatusNotFound {
+		t.Errorf("Expected a 404 logged, got %+v", e)
+	}
+
+	// The access log is debug output
+	logs.Reset()
+	quiet := accessLogMiddleware(slog.New(slog.NewTextHandler(&logs, nil)), http.NotFoundHandler())
+	quiet.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if logs.Len() != 0 {
+		t.Errorf("Expected no access log at info level, got %q", logs.String())
+	}
+
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("Expected an invalid log level to be rejected")
+	}
+	if level, err := parseLogLevel("debug"); err != nil || level != slog.LevelDebug {
+		t.Errorf("Expected debug, got %v (%v)", level, err)
+	}
+}
@@ -0,0 +1,158 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // Register decoders for embedded cover formats
+	"image/jpeg"
+	_ "image/png"
+	"os"
+
+	"github.com/dhowden/tag"
+)
+
+// ErrNoAlbumArt is returned when an audio file has no embedded picture.
+var ErrNoAlbumArt = errors.New("no embedded album art")
+
+// AlbumArtQuality is the JPEG quality used for album art thumbnails.
+const AlbumArtQuality = 85
+
+// ExtractAlbumArt returns the embedded cover picture of an audio file
+// (ID3 APIC, MP4 covr, FLAC picture block) and its MIME type.
+func ExtractAlbumArt(audioPath string) ([]byte, string, error) {
+	file, err := os.Open(audioPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	m, err := tag.ReadFrom(file)
+	if err != nil {
+		return nil, "", ErrNoAlbumArt
+	}
+
+	pic := m.Picture()
+	if pic == nil || len(pic.Data) == 0 {
+		return nil, "", ErrNoAlbumArt
+	}
+
+	mimeType := pic.MIMEType
+	if mimeType == "" {
+		switch pic.Ext {
+		case "png":
+			mimeType = "image/png"
+		default:
+			mimeType = "image/jpeg"
+		}
+	}
+
+	return pic.Data, mimeType, nil
+}
+
+// GenerateAlbumArtThumbnail writes the embedded cover of an audio file as a
+// JPEG thumbnail at the same location an image thumbnail of that path would
+// use, so it is served by the regular thumbnail endpoint.
+// Returns the thumbnail path as recorded by store.
+// Skips generation if thumbnail exists and is newer than the source file.
+func GenerateAlbumArtThumbnail(audioPath string, store ThumbnailStore, size int) (string, error) {
+	srcInfo, err := os.Stat(audioPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot stat source file: %w", err)
+	}
+
+	if recorded, ok := store.Find(audioPath, size); ok {
+		if thumbInfo, err := os.Stat(store.FullPath(recorded)); err == nil && thumbInfo.ModTime().After(srcInfo.ModTime()) {
+			return recorded, nil
+		}
+	}
+
+	data, _, err := ExtractAlbumArt(audioPath)
+	if err != nil {
+		return "", err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("cannot decode album art: %w", err)
+	}
+
+	// Only now pick the location, so tracks without art leave no folders behind
+	thumbRelPath, err := store.Path(audioPath, size)
+	if err != nil {
+		return "", err
+	}
+	thumbRelPath = thumbnailFormatPath(thumbRelPath, ThumbnailFormatJPEG) // Whatever the store's format
+	thumbFullPath := store.FullPath(thumbRelPath)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, fitWithin(img, size), &jpeg.Options{Quality: AlbumArtQuality}); err != nil {
+		return "", fmt.Errorf("failed to encode album art: %w", err)
+	}
+	if err := os.WriteFile(thumbFullPath, buf.Bytes(), 0644); err != nil {
+		return "", fmt.Errorf("failed to write album art: %w", err)
+	}
+
+	return thumbRelPath, nil
+}
+
+// GenerateBothAlbumArtThumbnails creates small and large album art thumbnails.
+// Returns the recorded paths of both thumbnails, or ErrNoAlbumArt.
+func GenerateBothAlbumArtThumbnails(audioPath string, store ThumbnailStore) (smallPath, largePath string, err error) {
+	smallPath, err = GenerateAlbumArtThumbnail(audioPath, store, SmallThumbnailSize)
+	if err != nil {
+		return "", "", err
+	}
+
+	largePath, err = GenerateAlbumArtThumbnail(audioPath, store, LargeThumbnailSize)
+	if err != nil {
+		return "", "", err
+	}
+
+	return smallPath, largePath, nil
+}
+
+// fitWithin scales img down to fit a size x size box, keeping the aspect
+// ratio. Images that already fit are returned unchanged. Each output pixel
+// is the average of the source pixels it covers.
+func fitWithin(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
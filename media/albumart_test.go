@@ -0,0 +1,139 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// id3Frame encodes an ID3v2.3 frame.
+func id3Frame(id string, body []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(id)
+	binary.Write(&buf, binary.BigEndian, uint32(len(body)))
+	buf.Write([]byte{0, 0}) // Flags
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// writeMP3Fixture writes an MP3 with an ID3v2.3 tag holding a title and,
+// when art is non-nil, an APIC front cover frame, followed by one silent
+// MPEG-1 Layer III frame.
+func writeMP3Fixture(t *testing.T, path string, art []byte, mimeType string) {
+	t.Helper()
+
+	var frames bytes.Buffer
+	frames.Write(id3Frame("TIT2", append([]byte{0}, "Fixture"...)))
+	if art != nil {
+		var apic bytes.Buffer
+		apic.WriteByte(0) // ISO-8859-1 text encoding
+		apic.WriteString(mimeType)
+		apic.WriteByte(0)
+		apic.WriteByte(3) // Front cover
+		apic.WriteByte(0) // Empty description
+		apic.Write(art)
+		frames.Write(id3Frame("APIC", apic.Bytes()))
+	}
+
+	// Tag size is syncsafe: 7 bits per byte
+	size := frames.Len()
+	var file bytes.Buffer
+	file.WriteString("ID3")
+	file.Write([]byte{3, 0, 0})
+	file.Write([]byte{byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)})
+	file.Write(frames.Bytes())
+
+	// 128kbps 44.1kHz frame header, 417 bytes per frame
+	mpeg := make([]byte, 417)
+	copy(mpeg, []byte{0xff, 0xfb, 0x90, 0x00})
+	file.Write(mpeg)
+
+	if err := os.WriteFile(path, file.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write fixture: %v", err)
+	}
+}
+
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: 200, G: 30, B: 60, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractAlbumArt(t *testing.T) {
+	dir := t.TempDir()
+	art := testPNG(t, 8, 8)
+
+	withArt := filepath.Join(dir, "cover.mp3")
+	writeMP3Fixture(t, withArt, art, "image/png")
+
+	data, mimeType, err := ExtractAlbumArt(withArt)
+	if err != nil {
+		t.Fatalf("ExtractAlbumArt failed: %v", err)
+	}
+	if mimeType != "image/png" {
+		t.Errorf("Expected image/png, got %q", mimeType)
+	}
+	if !bytes.Equal(data, art) {
+		t.Errorf("Extracted %d bytes, expected the %d embedded bytes", len(data), len(art))
+	}
+
+	noArt := filepath.Join(dir, "plain.mp3")
+	writeMP3Fixture(t, noArt, nil, "")
+	if _, _, err := ExtractAlbumArt(noArt); !errors.Is(err, ErrNoAlbumArt) {
+		t.Errorf("Expected ErrNoAlbumArt, got %v", err)
+	}
+}
+
+func TestGenerateBothAlbumArtThumbnails(t *testing.T) {
+	dir := t.TempDir()
+	q2Dir := filepath.Join(dir, ".q2")
+
+	audioPath := filepath.Join(dir, "track.mp3")
+	writeMP3Fixture(t, audioPath, testPNG(t, 1000, 600), "image/png")
+
+	smallPath, largePath, err := GenerateBothAlbumArtThumbnails(audioPath, CentralStore{Dir: q2Dir})
+	if err != nil {
+		t.Fatalf("GenerateBothAlbumArtThumbnails failed: %v", err)
+	}
+	if smallPath != GetThumbnailPath(audioPath, SmallThumbnailSize, ThumbnailFormatJPEG) {
+		t.Errorf("Unexpected small thumbnail path %q", smallPath)
+	}
+
+	f, err := os.Open(filepath.Join(q2Dir, smallPath))
+	if err != nil {
+		t.Fatalf("Small thumbnail not written: %v", err)
+	}
+	defer f.Close()
+	cfg, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		t.Fatalf("Small thumbnail is not a JPEG: %v", err)
+	}
+	if cfg.Width != SmallThumbnailSize || cfg.Height != 300 {
+		t.Errorf("Expected %dx300 thumbnail, got %dx%d", SmallThumbnailSize, cfg.Width, cfg.Height)
+	}
+
+	// Art smaller than the large size is kept at its own size
+	data, err := os.ReadFile(filepath.Join(q2Dir, largePath))
+	if err != nil {
+		t.Fatalf("Large thumbnail not written: %v", err)
+	}
+	if cfg, err := jpeg.DecodeConfig(bytes.NewReader(data)); err != nil || cfg.Width != 1000 {
+		t.Errorf("Expected 1000px wide large thumbnail, got %+v, %v", cfg, err)
+	}
+}
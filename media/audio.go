@@ -1,11 +1,16 @@
 package media
 
 import (
+	"context"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/dhowden/tag"
 	"jukel.org/q2/db"
+	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/scanner"
 )
 
 // AudioMetadata contains extracted ID3/audio metadata.
@@ -17,25 +22,30 @@ type AudioMetadata struct {
 	TrackNumber     *int
 	Year            *int
 	DurationSeconds *int
-	Bitrate         *int
+	Bitrate         *int // kbps
 }
 
 // ExtractAudioMetadata extracts ID3/audio metadata from an audio file.
-func ExtractAudioMetadata(audioPath string) (*AudioMetadata, error) {
+// Duration and bitrate come from ffprobe, since the tag library doesn't
+// provide them; they are left nil when ffmpegMgr is nil or probing fails.
+func ExtractAudioMetadata(ctx context.Context, audioPath string, ffmpegMgr *ffmpeg.Manager) (*AudioMetadata, error) {
 	file, err := os.Open(audioPath)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
+	meta := &AudioMetadata{}
+	if ffmpegMgr != nil {
+		probeAudio(ctx, audioPath, ffmpegMgr, meta)
+	}
+
 	m, err := tag.ReadFrom(file)
 	if err != nil {
-		// No metadata or unsupported format - return empty metadata
-		return &AudioMetadata{}, nil
+		// No metadata or unsupported format - return what ffprobe found
+		return meta, nil
 	}
 
-	meta := &AudioMetadata{}
-
 	// Artist
 	if artist := strings.TrimSpace(m.Artist()); artist != "" {
 		meta.Artist = &artist
@@ -69,6 +79,23 @@ func ExtractAudioMetadata(audioPath string) (*AudioMetadata, error) {
 	return meta, nil
 }
 
+// probeAudio fills the duration and bitrate of meta from ffprobe's format info.
+func probeAudio(ctx context.Context, audioPath string, ffmpegMgr *ffmpeg.Manager, meta *AudioMetadata) {
+	probe, err := ffmpegMgr.Probe(ctx, scanner.LongPath(audioPath))
+	if err != nil {
+		return
+	}
+
+	if dur, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil && dur > 0 {
+		d := int(math.Round(dur))
+		meta.DurationSeconds = &d
+	}
+	if bps, err := strconv.ParseInt(probe.Format.BitRate, 10, 64); err == nil && bps > 0 {
+		kbps := int(math.Round(float64(bps) / 1000))
+		meta.Bitrate = &kbps
+	}
+}
+
 // SaveAudioMetadata saves audio metadata to the database, updating any existing record.
 func SaveAudioMetadata(database *db.DB, fileID int64, meta *AudioMetadata) error {
 	result := database.Write(`
@@ -84,7 +111,7 @@ func SaveAudioMetadata(database *db.DB, fileID int64, meta *AudioMetadata) error
 			track_number    = excluded.track_number,
 			year            = excluded.year,
 			duration_seconds = COALESCE(excluded.duration_seconds, duration_seconds),
-			bitrate         = excluded.bitrate
+			bitrate         = COALESCE(excluded.bitrate, bitrate)
 	`,
 		fileID, meta.Artist, meta.Album, meta.Title, meta.Genre,
 		meta.TrackNumber, meta.Year, meta.DurationSeconds, meta.Bitrate,
@@ -0,0 +1,56 @@
+package media
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"jukel.org/q2/ffmpeg"
+)
+
+func TestExtractAudioMetadata_Duration(t *testing.T) {
+	for _, bin := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not installed", bin)
+		}
+	}
+	dir := t.TempDir()
+
+	// A 3 second silent clip at 128 kbps
+	clip := filepath.Join(dir, "silence.mp3")
+	out, err := exec.Command("ffmpeg", "-v", "error",
+		"-f", "lavfi", "-i", "anullsrc=r=44100:cl=stereo", "-t", "3",
+		"-c:a", "libmp3lame", "-b:a", "128k", clip,
+	).CombinedOutput()
+	if err != nil {
+		t.Skipf("ffmpeg cannot encode mp3 here: %v: %s", err, out)
+	}
+
+	meta, err := ExtractAudioMetadata(context.Background(), clip, ffmpeg.NewManager(filepath.Join(dir, "bin")))
+	if err != nil {
+		t.Fatalf("ExtractAudioMetadata failed: %v", err)
+	}
+	if meta.DurationSeconds == nil || *meta.DurationSeconds != 3 {
+		t.Errorf("Expected duration 3s, got %v", meta.DurationSeconds)
+	}
+	if meta.Bitrate == nil || *meta.Bitrate < 120 || *meta.Bitrate > 140 {
+		t.Errorf("Expected bitrate near 128 kbps, got %v", meta.Bitrate)
+	}
+}
+
+func TestExtractAudioMetadata_WithoutFFmpeg(t *testing.T) {
+	clip := filepath.Join(t.TempDir(), "tagged.mp3")
+	writeMP3Fixture(t, clip, nil, "")
+
+	meta, err := ExtractAudioMetadata(context.Background(), clip, nil)
+	if err != nil {
+		t.Fatalf("ExtractAudioMetadata failed: %v", err)
+	}
+	if meta.Title == nil || *meta.Title != "Fixture" {
+		t.Errorf("Expected title from tags, got %v", meta.Title)
+	}
+	if meta.DurationSeconds != nil || meta.Bitrate != nil {
+		t.Errorf("Expected nil duration and bitrate without ffmpeg, got %v, %v", meta.DurationSeconds, meta.Bitrate)
+	}
+}
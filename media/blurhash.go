@@ -0,0 +1,150 @@
+package media
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg" // JPEG thumbnails; WebP and AVIF ones get no hash
+	"math"
+	"os"
+)
+
+// BlurHash components: 4 horizontally by 3 vertically suit the landscape
+// thumbnails most galleries show, in a 28-character hash.
+const (
+	blurHashXComponents = 4
+	blurHashYComponents = 3
+)
+
+// blurHashSamples is the most pixels sampled along each side of an image.
+// The hash keeps only a few low frequencies, so a coarse grid gives the same
+// result as every pixel of a thumbnail at a fraction of the cost.
+const blurHashSamples = 64
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// ComputeBlurHash decodes a thumbnail and returns its BlurHash
+// (https://blurha.sh): a short string clients decode into a blurred
+// placeholder to show while the thumbnail loads. Its first six characters
+// after the two-character header encode the image's average color.
+func ComputeBlurHash(thumbPath string) (string, error) {
+	f, err := os.Open(thumbPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode thumbnail: %w", err)
+	}
+	return encodeBlurHash(img), nil
+}
+
+// encodeBlurHash computes the BlurHash of img.
+func encodeBlurHash(img image.Image) string {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+	xs, ys := sampleCoords(w), sampleCoords(h)
+
+	// Linear RGB of the sampled grid, read once for every component
+	pixels := make([][3]float64, 0, len(xs)*len(ys))
+	for _, y := range ys {
+		for _, x := range xs {
+			r, g, b, _ := img.At(bounds.Min.X+int(x), bounds.Min.Y+int(y)).RGBA()
+			pixels = append(pixels, [3]float64{sRGBToLinear(r >> 8), sRGBToLinear(g >> 8), sRGBToLinear(b >> 8)})
+		}
+	}
+
+	factors := make([][3]float64, 0, blurHashXComponents*blurHashYComponents)
+	for j := 0; j < blurHashYComponents; j++ {
+		for i := 0; i < blurHashXComponents; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var sum [3]float64
+			for yi, y := range ys {
+				cy := math.Cos(math.Pi * float64(j) * y / float64(h))
+				for xi, x := range xs {
+					basis := cy * math.Cos(math.Pi*float64(i)*x/float64(w))
+					p := pixels[yi*len(xs)+xi]
+					sum[0] += basis * p[0]
+					sum[1] += basis * p[1]
+					sum[2] += basis * p[2]
+				}
+			}
+			scale := norm / float64(len(pixels))
+			factors = append(factors, [3]float64{sum[0] * scale, sum[1] * scale, sum[2] * scale})
+		}
+	}
+
+	dc, ac := factors[0], factors[1:]
+	hash := encodeBase83((blurHashXComponents-1)+(blurHashYComponents-1)*9, 1)
+
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = max(actualMax, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+		}
+		quantisedMax := int(max(0, min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		hash += encodeBase83(quantisedMax, 1)
+	} else {
+		hash += encodeBase83(0, 1)
+	}
+
+	hash += encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	quant := func(v float64) int {
+		return int(max(0, min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+	}
+	for _, f := range ac {
+		hash += encodeBase83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2)
+	}
+	return hash
+}
+
+// sampleCoords returns the centres of up to blurHashSamples equal cells
+// across [0, n). Sampling each pixel at its centre, as BlurHash does, is the
+// same as every cell being one pixel wide.
+func sampleCoords(n int) []float64 {
+	count := min(n, blurHashSamples)
+	coords := make([]float64, count)
+	for i := range coords {
+		coords[i] = (float64(i) + 0.5) * float64(n) / float64(count)
+	}
+	return coords
+}
+
+func sRGBToLinear(v uint32) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	c := max(0, min(1, v))
+	if c <= 0.0031308 {
+		return int(c*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(c, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// encodeBase83 encodes value as length base-83 digits.
+func encodeBase83(value, length int) string {
+	out := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		out[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(out)
+}
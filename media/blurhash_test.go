@@ -0,0 +1,79 @@
+package media
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestImage writes a w x h JPEG colored by fill.
+func writeTestImage(t *testing.T, path string, w, h int, fill func(x, y int) color.Color) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, fill(x, y))
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	defer f.Close()
+	if err := jpeg.Encode(f, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatalf("Failed to encode image: %v", err)
+	}
+}
+
+func TestComputeBlurHash(t *testing.T) {
+	dir := t.TempDir()
+
+	// A flat color has no detail: the hash is its average color and zeroed AC components
+	flat := filepath.Join(dir, "flat.jpg")
+	writeTestImage(t, flat, 120, 80, func(x, y int) color.Color { return color.RGBA{R: 255, G: 255, B: 255, A: 255} })
+	hash, err := ComputeBlurHash(flat)
+	if err != nil {
+		t.Fatalf("ComputeBlurHash failed: %v", err)
+	}
+	if want := "L0" + encodeBase83(0xffffff, 4) + strings.Repeat("fQ", 11); hash != want {
+		t.Errorf("Expected %s for white, got %s", want, hash)
+	}
+
+	// Gradients in different directions give different hashes of the same length
+	horizontal := filepath.Join(dir, "horizontal.jpg")
+	writeTestImage(t, horizontal, 400, 300, func(x, y int) color.Color { return color.Gray{Y: uint8(x * 255 / 399)} })
+	vertical := filepath.Join(dir, "vertical.jpg")
+	writeTestImage(t, vertical, 400, 300, func(x, y int) color.Color { return color.Gray{Y: uint8(y * 255 / 299)} })
+	h1, err1 := ComputeBlurHash(horizontal)
+	h2, err2 := ComputeBlurHash(vertical)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("ComputeBlurHash failed: %v, %v", err1, err2)
+	}
+	if len(h1) != 28 || len(h2) != 28 || h1 == h2 {
+		t.Errorf("Expected distinct 28-character hashes, got %s and %s", h1, h2)
+	}
+	if h1[1] == '0' {
+		t.Errorf("Expected a gradient to have AC components, got %s", h1)
+	}
+
+	notImage := filepath.Join(dir, "thumb.jpg")
+	os.WriteFile(notImage, []byte("thumb"), 0644)
+	if _, err := ComputeBlurHash(notImage); err == nil {
+		t.Error("Expected an error for a file that is not an image")
+	}
+}
+
+func TestEncodeBase83(t *testing.T) {
+	for _, tt := range []struct {
+		value, length int
+		want          string
+	}{{0, 1, "0"}, {21, 1, "L"}, {82, 1, "~"}, {83, 2, "10"}, {3429, 2, "fQ"}} {
+		if got := encodeBase83(tt.value, tt.length); got != tt.want {
+			t.Errorf("encodeBase83(%d, %d) = %q, want %q", tt.value, tt.length, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/scanner"
+)
+
+// ErrHEIFUnsupported is returned by ConvertToJPEG when the ffmpeg in use
+// cannot decode HEIC or HEIF images.
+var ErrHEIFUnsupported = errors.New("ffmpeg cannot decode HEIF images")
+
+// IsHEIF reports whether path names a HEIC or HEIF image, which many
+// browsers cannot display.
+func IsHEIF(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".heic" || ext == ".heif"
+}
+
+// GetConvertedPath returns where the JPEG conversion of an image whose
+// contents hash to xxhash (as HashFile computes it) is cached, relative to
+// the q2 directory. Copies of a photo share the conversion.
+func GetConvertedPath(xxhash string) string {
+	return filepath.Join(ThumbnailDir, getHashSubfolder(xxhash), xxhash+"_converted.jpg")
+}
+
+// ConvertToJPEG writes a full-size JPEG copy of a HEIC or HEIF image for
+// browsers that cannot display the original, turned upright according to
+// orientation, its EXIF Orientation value, as GenerateUprightImage does.
+// xxhash is the image's content hash; an empty one is computed. Returns the
+// copy's path relative to q2Dir, or ErrHEIFUnsupported if ffmpeg cannot
+// decode the image. Skips conversion if the copy exists.
+func ConvertToJPEG(ctx context.Context, imagePath, xxhash, q2Dir string, orientation int, ffmpegMgr *ffmpeg.Manager) (string, error) {
+	if ffmpegMgr == nil {
+		return "", fmt.Errorf("ffmpeg manager not available")
+	}
+	if !IsHEIF(imagePath) {
+		return "", fmt.Errorf("not a HEIC or HEIF image: %s", imagePath)
+	}
+
+	if xxhash == "" {
+		hash, err := HashFile(imagePath)
+		if err != nil {
+			return "", fmt.Errorf("cannot hash source file: %w", err)
+		}
+		xxhash = hash
+	}
+	relPath := GetConvertedPath(xxhash)
+	fullPath := filepath.Join(q2Dir, relPath)
+	if _, err := os.Stat(fullPath); err == nil {
+		return relPath, nil
+	}
+
+	if !ffmpegMgr.SupportsHEIF(ctx) {
+		return "", ErrHEIFUnsupported
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create thumbnail directory: %w", err)
+	}
+
+	// Written beside, then renamed, so a failed conversion never leaves a
+	// partial copy that would be served as the cached one
+	tmpPath := strings.TrimSuffix(fullPath, ".jpg") + ".tmp.jpg"
+	if err := ffmpegMgr.RotateImage(ctx, scanner.LongPath(imagePath), scanner.LongPath(tmpPath), orientation, UprightQuality); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to convert image: %w", err)
+	}
+	if err := os.Rename(tmpPath, fullPath); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to store converted image: %w", err)
+	}
+	return relPath, nil
+}
@@ -0,0 +1,87 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"jukel.org/q2/ffmpeg"
+)
+
+// writeHEIC encodes a width x height HEVC picture into an ISOBMFF file
+// branded heic, or skips the test if ffmpeg cannot encode HEVC.
+func writeHEIC(t *testing.T, path string, width, height int) {
+	t.Helper()
+	for _, bin := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not installed", bin)
+		}
+	}
+	encoders, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil || !strings.Contains(string(encoders), " libx265 ") {
+		t.Skip("ffmpeg cannot encode HEVC")
+	}
+	out, err := exec.Command("ffmpeg", "-f", "lavfi", "-i", fmt.Sprintf("color=red:s=%dx%d", width, height),
+		"-frames:v", "1", "-c:v", "libx265", "-brand", "heic", "-f", "mp4", "-y", path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to write HEIC fixture: %v: %s", err, out)
+	}
+}
+
+func TestConvertToJPEG_HEIC(t *testing.T) {
+	dir := t.TempDir()
+	photo := filepath.Join(dir, "IMG_0001.HEIC")
+	writeHEIC(t, photo, 64, 48)
+	mgr := ffmpeg.NewManager(filepath.Join(dir, "bin"))
+	if !mgr.SupportsHEIF(context.Background()) {
+		t.Skip("ffmpeg cannot decode HEVC")
+	}
+
+	rel, err := ConvertToJPEG(context.Background(), photo, "", dir, 1, mgr)
+	if err != nil {
+		t.Fatalf("ConvertToJPEG failed: %v", err)
+	}
+	hash, _ := HashFile(photo)
+	if rel != GetConvertedPath(hash) {
+		t.Errorf("Expected the copy keyed by content hash at %s, got %s", GetConvertedPath(hash), rel)
+	}
+
+	f, err := os.Open(filepath.Join(dir, rel))
+	if err != nil {
+		t.Fatalf("Copy not written: %v", err)
+	}
+	cfg, err := jpeg.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Cannot decode copy as JPEG: %v", err)
+	}
+	if cfg.Width != 64 || cfg.Height != 48 {
+		t.Errorf("Expected 64x48, got %dx%d", cfg.Width, cfg.Height)
+	}
+}
+
+func TestConvertToJPEG_Errors(t *testing.T) {
+	dir := t.TempDir()
+	mgr := enrichTestManager(t, dir)
+
+	photo := filepath.Join(dir, "photo.jpg")
+	writeOrientedJPEG(t, photo, 8, 8, 1)
+	if _, err := ConvertToJPEG(context.Background(), photo, "", dir, 1, mgr); err == nil {
+		t.Error("Expected an error converting a JPEG")
+	}
+
+	if mgr.SupportsHEIF(context.Background()) {
+		t.Skip("ffmpeg decodes HEVC")
+	}
+	heic := filepath.Join(dir, "IMG_0001.heic")
+	os.WriteFile(heic, []byte("not really"), 0644)
+	if _, err := ConvertToJPEG(context.Background(), heic, "", dir, 1, mgr); !errors.Is(err, ErrHEIFUnsupported) {
+		t.Errorf("Expected ErrHEIFUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/scanner"
+)
+
+// enrichBatch is how many files EnrichThumbnails takes from the files table at a time.
+const enrichBatch = 100
+
+// enrichThrottlePoll is how often a worker paused by a lower workers() count
+// checks whether it may continue.
+var enrichThrottlePoll = 500 * time.Millisecond
+
+// EnrichResult summarises an EnrichThumbnails run.
+type EnrichResult struct {
+	Enriched int // Files given thumbnails
+	Failed   int // Files whose thumbnails could not be generated
+	Skipped  int // Files whose library type wants no thumbnails
+}
+
+// EnrichThumbnails generates both thumbnail sizes for indexed images and
+// videos that have none, and reads the EXIF metadata of those images, as
+// their folder's library type allows. Scanning only indexes files, so
+// without this the first view of each one waits on ffmpeg.
+//
+// Each file is marked in files.enriched_at once tried, so an interrupted run
+// resumes where it stopped and files that fail are not retried until they
+// change. Each batch of files is worked on by workers() goroutines, asked
+// again before every batch so the count can be tuned while a run goes on;
+// a nil workers, or one returning zero, uses ffmpegMgr.MaxConcurrent.
+// workers is also asked before each file, and goroutines beyond a lowered
+// count pause until it rises or the batch ends, so a run can be throttled
+// at once, e.g. while the server is busy; one always keeps going.
+// ffmpeg's process limit bounds the work they start either way.
+func EnrichThumbnails(ctx context.Context, database *db.DB, store ThumbnailStore, ffmpegMgr *ffmpeg.Manager, workers func() int) (EnrichResult, error) {
+	var result EnrichResult
+	if ffmpegMgr == nil {
+		return result, fmt.Errorf("ffmpeg manager not available")
+	}
+	// Without ffmpeg every file would fail and be marked as tried
+	if _, err := ffmpegMgr.GetFFmpegPath(ctx); err != nil {
+		return result, err
+	}
+
+	workerCount := func() int {
+		n := 0
+		if workers != nil {
+			n = workers()
+		}
+		if n <= 0 {
+			n = ffmpegMgr.MaxConcurrent
+		}
+		if n <= 0 {
+			n = runtime.NumCPU()
+		}
+		return n
+	}
+
+	for {
+		todo, err := pendingEnrichment(database)
+		if err != nil || len(todo) == 0 {
+			return result, err
+		}
+
+		var mu sync.Mutex
+		var firstErr error
+		jobs := make(chan enrichFile)
+		sent := make(chan struct{}) // Closed once every job is handed out
+		var wg sync.WaitGroup
+		n := min(workerCount(), len(todo))
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(slot int) {
+				defer wg.Done()
+				for waitForWorkerSlot(ctx, sent, slot, workerCount) {
+					f, ok := <-jobs
+					if !ok {
+						return
+					}
+					outcome, err := enrichOne(ctx, database, store, ffmpegMgr, f)
+					mu.Lock()
+					switch {
+					case err != nil:
+						if firstErr == nil {
+							firstErr = err
+						}
+					case outcome == enrichGenerated:
+						result.Enriched++
+					case outcome == enrichFailed:
+						result.Failed++
+					default:
+						result.Skipped++
+					}
+					mu.Unlock()
+				}
+			}(i)
+		}
+		for _, f := range todo {
+			if ctx.Err() != nil {
+				break
+			}
+			jobs <- f
+		}
+		close(jobs)
+		close(sent)
+		wg.Wait()
+
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if firstErr != nil {
+			return result, firstErr
+		}
+	}
+}
+
+// waitForWorkerSlot blocks while slot, counting from zero, is beyond the
+// current worker count. It returns false once ctx is done or the batch's
+// jobs have all been handed out, ending the worker.
+func waitForWorkerSlot(ctx context.Context, sent <-chan struct{}, slot int, workerCount func() int) bool {
+	for slot > 0 && slot >= workerCount() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-sent:
+			return false
+		case <-time.After(enrichThrottlePoll):
+		}
+	}
+	return true
+}
+
+// enrichFile is an indexed file waiting for EnrichThumbnails.
+type enrichFile struct {
+	id        int64
+	path      string
+	mediaType string
+	features  scanner.LibraryFeatures
+}
+
+// pendingEnrichment returns the next batch of images and videos without
+// thumbnails that EnrichThumbnails has not tried yet.
+func pendingEnrichment(database *db.DB) ([]enrichFile, error) {
+	rows, err := database.Query(`
+		SELECT f.id, f.path, f.mediatype, fo.library_type
+		FROM files f
+		JOIN folders fo ON fo.id = f.folder_id
+		WHERE f.enriched_at IS NULL AND f.deleted_at IS NULL
+		  AND f.mediatype IN (?, ?)
+		  AND (COALESCE(f.thumbnail_small_path, '') = '' OR COALESCE(f.thumbnail_large_path, '') = '')
+		ORDER BY f.id
+		LIMIT ?
+	`, scanner.MediaTypeImage, scanner.MediaTypeVideo, enrichBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var todo []enrichFile
+	for rows.Next() {
+		var f enrichFile
+		var libraryType string
+		if err := rows.Scan(&f.id, &f.path, &f.mediaType, &libraryType); err != nil {
+			return nil, err
+		}
+		f.features = scanner.LibraryType(libraryType).Features()
+		todo = append(todo, f)
+	}
+	return todo, rows.Err()
+}
+
+// enrichOutcome is what enrichOne did with a file.
+type enrichOutcome int
+
+const (
+	enrichGenerated enrichOutcome = iota
+	enrichFailed
+	enrichSkipped
+)
+
+// enrichOne generates the thumbnails of one file and marks it as tried.
+// Returns an error only if the file could not be marked or ctx was
+// cancelled, leaving it for the next run.
+func enrichOne(ctx context.Context, database *db.DB, store ThumbnailStore, ffmpegMgr *ffmpeg.Manager, f enrichFile) (enrichOutcome, error) {
+	outcome := enrichGenerated
+	var smallPath, largePath, method string
+	var err error
+	switch {
+	case f.mediaType == scanner.MediaTypeImage && f.features.ImageThumbnails:
+		if f.features.EXIF {
+			if meta, err := ExtractEXIF(f.path); err == nil {
+				SaveImageMetadata(database, f.id, meta)
+			}
+			if xmp, err := ExtractXMP(f.path); err == nil {
+				SaveImageTags(database, f.id, xmp)
+			}
+		}
+		result := GenerateImageThumbnails(ctx, f.path, store, ffmpegMgr)
+		smallPath, largePath, method, err = result.SmallPath, result.LargePath, result.Method, result.Error
+	case f.mediaType == scanner.MediaTypeVideo && f.features.VideoThumbnails:
+		smallPath, largePath, err = GenerateBothVideoThumbnails(ctx, f.path, store, ffmpegMgr)
+	default:
+		outcome = enrichSkipped
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return outcome, ctxErr
+	}
+
+	now := time.Now().Unix()
+	if err != nil || outcome == enrichSkipped {
+		if err != nil {
+			outcome = enrichFailed
+		}
+		return outcome, database.Write("UPDATE files SET enriched_at = ? WHERE id = ?", now, f.id).Err
+	}
+
+	// A placeholder is a nicety; without one the file still has its thumbnails
+	var blurHash *string
+	if hash, err := ComputeBlurHash(store.FullPath(smallPath)); err == nil {
+		blurHash = &hash
+	}
+	return outcome, database.Write(
+		"UPDATE files SET thumbnail_small_path = ?, thumbnail_large_path = ?, thumbnail_method = COALESCE(NULLIF(?, ''), thumbnail_method), blurhash = ?, enriched_at = ? WHERE id = ?",
+		smallPath, largePath, method, blurHash, now, f.id,
+	).Err
+}
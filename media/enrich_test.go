@@ -0,0 +1,214 @@
+package media
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/ffmpeg"
+	_ "jukel.org/q2/migrations"
+	"jukel.org/q2/scanner"
+)
+
+// fakeFFmpeg holds the directory of the script standing in for ffmpeg. The
+// ffmpeg package caches the first path it resolves for the whole process, so
+// the script is written once and outlives the test that wrote it.
+var fakeFFmpeg struct {
+	once sync.Once
+	dir  string
+	err  error
+}
+
+// enrichTestManager returns an ffmpeg manager for enrichment tests. Without
+// ffmpeg installed, a script standing in for ffmpeg and ffprobe writes
+// placeholder thumbnails and fails for inputs named "broken".
+func enrichTestManager(t *testing.T, dir string) *ffmpeg.Manager {
+	t.Helper()
+	if _, err := exec.LookPath("ffmpeg"); err == nil {
+		return ffmpeg.NewManager(filepath.Join(dir, "bin"))
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg script needs a POSIX shell")
+	}
+
+	fakeFFmpeg.once.Do(func() {
+		script := `#!/bin/sh
+for a; do out=$a; done
+case "$*" in
+*broken*) exit 1 ;;
+*format=duration*) echo 2.0; exit 0 ;;
+*-encoders*|*-decoders*) exit 0 ;;
+esac
+echo thumb > "$out"
+`
+		if fakeFFmpeg.dir, fakeFFmpeg.err = os.MkdirTemp("", "q2-fake-ffmpeg-*"); fakeFFmpeg.err != nil {
+			return
+		}
+		for _, bin := range []string{"ffmpeg", "ffprobe"} {
+			if err := os.WriteFile(filepath.Join(fakeFFmpeg.dir, bin), []byte(script), 0755); err != nil {
+				fakeFFmpeg.err = err
+				return
+			}
+		}
+	})
+	if fakeFFmpeg.err != nil {
+		t.Fatalf("Failed to write fake ffmpeg: %v", fakeFFmpeg.err)
+	}
+	return ffmpeg.NewManager(fakeFFmpeg.dir)
+}
+
+func TestEnrichThumbnails(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+	mgr := enrichTestManager(t, dir)
+	store := CentralStore{Dir: filepath.Join(dir, ".q2")}
+
+	photos := filepath.Join(dir, "photos")
+	music := filepath.Join(dir, "music")
+	os.MkdirAll(photos, 0755)
+	os.MkdirAll(music, 0755)
+	writeOrientedJPEG(t, filepath.Join(photos, "photo.jpg"), 40, 20, 1)
+	clip := filepath.Join(photos, "clip.mp4")
+	if out, err := exec.Command("ffmpeg", "-f", "lavfi", "-i", "color=c=red:s=32x32:d=1", clip).CombinedOutput(); err != nil {
+		if _, lookErr := exec.LookPath("ffmpeg"); lookErr == nil {
+			t.Fatalf("Failed to make test video: %v: %s", err, out)
+		}
+		os.WriteFile(clip, []byte("video"), 0644)
+	}
+	os.WriteFile(filepath.Join(photos, "broken.mp4"), []byte("not a video"), 0644)
+	os.WriteFile(filepath.Join(music, "concert.mp4"), []byte("video"), 0644)
+
+	ids := make(map[string]int64)
+	for folder, libraryType := range map[string]string{photos: "photos", music: "music"} {
+		f := database.Write("INSERT INTO folders (path, library_type) VALUES (?, ?)", folder, libraryType)
+		if f.Err != nil {
+			t.Fatalf("Failed to insert folder: %v", f.Err)
+		}
+		entries, _ := os.ReadDir(folder)
+		for _, e := range entries {
+			path := filepath.Join(folder, e.Name())
+			r := database.Write("INSERT INTO files (folder_id, path, filename, mediatype, size) VALUES (?, ?, ?, ?, 0)",
+				f.LastInsertID, path, e.Name(), *scanner.GetMediaType(filepath.Ext(path)))
+			if r.Err != nil {
+				t.Fatalf("Failed to insert file: %v", r.Err)
+			}
+			ids[e.Name()] = r.LastInsertID
+		}
+	}
+
+	thumbnails := func(name string) (small, large sql.NullString, enriched sql.NullInt64) {
+		t.Helper()
+		row := database.QueryRow("SELECT thumbnail_small_path, thumbnail_large_path, enriched_at FROM files WHERE id = ?", ids[name])
+		if err := row.Scan(&small, &large, &enriched); err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		return small, large, enriched
+	}
+
+	// An interrupted run leaves files to the next one
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := EnrichThumbnails(ctx, database, store, mgr, nil); err == nil {
+		t.Error("Expected an error from a cancelled run")
+	}
+	for name := range ids {
+		if _, _, enriched := thumbnails(name); enriched.Valid {
+			t.Errorf("%s: expected no mark after a cancelled run", name)
+		}
+	}
+
+	result, err := EnrichThumbnails(context.Background(), database, store, mgr, func() int { return 2 })
+	if err != nil {
+		t.Fatalf("EnrichThumbnails failed: %v", err)
+	}
+	if result != (EnrichResult{Enriched: 2, Failed: 1, Skipped: 1}) {
+		t.Errorf("Expected 2 enriched, 1 failed, 1 skipped; got %+v", result)
+	}
+	for _, name := range []string{"photo.jpg", "clip.mp4"} {
+		small, large, _ := thumbnails(name)
+		if !small.Valid || !large.Valid {
+			t.Errorf("%s: expected both thumbnail paths, got %+v and %+v", name, small, large)
+			continue
+		}
+		for _, p := range []string{small.String, large.String} {
+			if _, err := os.Stat(store.FullPath(p)); err != nil {
+				t.Errorf("%s: thumbnail not written: %v", name, err)
+			}
+		}
+	}
+	for _, name := range []string{"broken.mp4", "concert.mp4"} {
+		if small, _, enriched := thumbnails(name); small.Valid || !enriched.Valid {
+			t.Errorf("%s: expected no thumbnail and a mark, got %+v, %+v", name, small, enriched)
+		}
+	}
+
+	// Files already tried are not tried again
+	result, err = EnrichThumbnails(context.Background(), database, store, mgr, func() int { return 2 })
+	if err != nil {
+		t.Fatalf("EnrichThumbnails failed: %v", err)
+	}
+	if result != (EnrichResult{}) {
+		t.Errorf("Expected nothing left to do, got %+v", result)
+	}
+}
+
+func TestEnrichThumbnails_Throttled(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+	mgr := enrichTestManager(t, dir)
+	store := CentralStore{Dir: filepath.Join(dir, ".q2")}
+	defer func(poll time.Duration) { enrichThrottlePoll = poll }(enrichThrottlePoll)
+	enrichThrottlePoll = 5 * time.Millisecond
+
+	photos := filepath.Join(dir, "photos")
+	os.MkdirAll(photos, 0755)
+	folder := database.Write("INSERT INTO folders (path, library_type) VALUES (?, 'photos')", photos)
+	for i := 0; i < 6; i++ {
+		path := filepath.Join(photos, fmt.Sprintf("photo%d.jpg", i))
+		writeOrientedJPEG(t, path, 40, 20, 1)
+		database.Write("INSERT INTO files (folder_id, path, filename, mediatype, size) VALUES (?, ?, ?, ?, 0)",
+			folder.LastInsertID, path, filepath.Base(path), scanner.MediaTypeImage)
+	}
+
+	// Dropping to one worker mid-batch pauses the others without stalling the run
+	var calls atomic.Int64
+	throttled := func() int {
+		if calls.Add(1) == 1 {
+			return 4
+		}
+		return 1
+	}
+	result, err := EnrichThumbnails(context.Background(), database, store, mgr, throttled)
+	if err != nil {
+		t.Fatalf("EnrichThumbnails failed: %v", err)
+	}
+	if result.Enriched != 6 {
+		t.Errorf("Expected all 6 files enriched by the remaining worker, got %+v", result)
+	}
+	if calls.Load() < 4 {
+		t.Errorf("Expected the paused workers to ask for the count again, got %d calls", calls.Load())
+	}
+}
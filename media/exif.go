@@ -217,6 +217,10 @@ func SaveImageMetadata(database *db.DB, fileID int64, meta *ImageMetadata) error
 			exposure_time = excluded.exposure_time,
 			f_number      = excluded.f_number,
 			focal_length  = excluded.focal_length,
+			-- Resolve the place again if the coordinates changed
+			location_name = CASE
+				WHEN gps_latitude IS excluded.gps_latitude AND gps_longitude IS excluded.gps_longitude
+				THEN location_name END,
 			gps_latitude  = excluded.gps_latitude,
 			gps_longitude = excluded.gps_longitude
 	`,
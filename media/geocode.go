@@ -0,0 +1,209 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"jukel.org/q2/db"
+)
+
+// ErrNoLocation is returned by a Geocoder when no place is known for the coordinates.
+var ErrNoLocation = errors.New("no location for coordinates")
+
+// Geocoder resolves coordinates to a human-readable place name.
+type Geocoder interface {
+	ReverseGeocode(ctx context.Context, lat, lon float64) (string, error)
+}
+
+// ReverseGeocode validates the coordinates and resolves them with geocoder.
+// Returns ErrNoLocation for out-of-range coordinates or a nil geocoder.
+func ReverseGeocode(ctx context.Context, geocoder Geocoder, lat, lon float64) (string, error) {
+	if geocoder == nil {
+		return "", ErrNoLocation
+	}
+	if math.IsNaN(lat) || math.IsNaN(lon) || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return "", ErrNoLocation
+	}
+	// Null Island is what cameras write when they have no fix
+	if lat == 0 && lon == 0 {
+		return "", ErrNoLocation
+	}
+
+	name, err := geocoder.ReverseGeocode(ctx, lat, lon)
+	if err != nil {
+		return "", err
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", ErrNoLocation
+	}
+	return name, nil
+}
+
+// NominatimGeocoder looks up places with the OpenStreetMap Nominatim API.
+// Requests are spaced at least a second apart, as the public instance requires.
+type NominatimGeocoder struct {
+	BaseURL string // Defaults to https://nominatim.openstreetmap.org
+	Client  *http.Client
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// ReverseGeocode returns a "city, country" style name for the coordinates.
+func (g *NominatimGeocoder) ReverseGeocode(ctx context.Context, lat, lon float64) (string, error) {
+	if err := g.wait(ctx); err != nil {
+		return "", err
+	}
+
+	base := g.BaseURL
+	if base == "" {
+		base = "https://nominatim.openstreetmap.org"
+	}
+	params := url.Values{
+		"format": {"jsonv2"},
+		"lat":    {strconv.FormatFloat(lat, 'f', 6, 64)},
+		"lon":    {strconv.FormatFloat(lon, 'f', 6, 64)},
+		"zoom":   {"10"}, // City level
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+"/reverse?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "q2-media-manager/1.0 (https://github.com/brirtch/q2)")
+
+	client := g.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("nominatim returned %s", resp.Status)
+	}
+
+	var result struct {
+		Error   string `json:"error"`
+		Address struct {
+			City    string `json:"city"`
+			Town    string `json:"town"`
+			Village string `json:"village"`
+			County  string `json:"county"`
+			State   string `json:"state"`
+			Country string `json:"country"`
+		} `json:"address"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to parse nominatim response: %w", err)
+	}
+	if result.Error != "" {
+		return "", ErrNoLocation
+	}
+
+	a := result.Address
+	var parts []string
+	for _, p := range []string{a.City, a.Town, a.Village, a.County, a.State} {
+		if p != "" {
+			parts = append(parts, p)
+			break
+		}
+	}
+	if a.Country != "" {
+		parts = append(parts, a.Country)
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+// wait blocks until a second has passed since the previous request.
+func (g *NominatimGeocoder) wait(ctx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if d := time.Until(g.last.Add(time.Second)); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	g.last = time.Now()
+	return nil
+}
+
+// EnrichLocations resolves a location_name for every image that has GPS
+// coordinates but no name yet. It is a separate pass from scanning so slow
+// or unavailable lookups never hold up indexing. Coordinates with no known
+// place are stored as an empty name so they aren't looked up again; other
+// lookup errors leave the row for the next pass.
+// Returns the number of images updated.
+func EnrichLocations(ctx context.Context, database *db.DB, geocoder Geocoder) (int, error) {
+	if geocoder == nil {
+		return 0, nil
+	}
+
+	type pending struct {
+		fileID   int64
+		lat, lon float64
+	}
+	rows, err := database.Query(`
+		SELECT file_id, gps_latitude, gps_longitude
+		FROM image_metadata
+		WHERE gps_latitude IS NOT NULL AND gps_longitude IS NOT NULL
+		  AND location_name IS NULL
+	`)
+	if err != nil {
+		return 0, err
+	}
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.fileID, &p.lat, &p.lon); err == nil {
+			todo = append(todo, p)
+		}
+	}
+	rows.Close()
+
+	// Photos from one outing share a place; look each ~100m cell up once
+	type cell struct{ lat, lon int64 }
+	names := make(map[cell]string)
+
+	updated := 0
+	for _, p := range todo {
+		if err := ctx.Err(); err != nil {
+			return updated, err
+		}
+
+		key := cell{int64(math.Round(p.lat * 1000)), int64(math.Round(p.lon * 1000))}
+		name, ok := names[key]
+		if !ok {
+			name, err = ReverseGeocode(ctx, geocoder, p.lat, p.lon)
+			if err != nil && !errors.Is(err, ErrNoLocation) {
+				continue
+			}
+			names[key] = name
+		}
+
+		result := database.Write("UPDATE image_metadata SET location_name = ? WHERE file_id = ?", name, p.fileID)
+		if result.Err != nil {
+			return updated, result.Err
+		}
+		updated++
+	}
+
+	return updated, nil
+}
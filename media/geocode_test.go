@@ -0,0 +1,143 @@
+package media
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"jukel.org/q2/db"
+	_ "jukel.org/q2/migrations"
+)
+
+// stubGeocoder resolves coordinates from a fixed table and counts lookups.
+type stubGeocoder struct {
+	places map[[2]float64]string
+	fail   map[[2]float64]bool
+	calls  int
+}
+
+func (g *stubGeocoder) ReverseGeocode(ctx context.Context, lat, lon float64) (string, error) {
+	g.calls++
+	key := [2]float64{lat, lon}
+	if g.fail[key] {
+		return "", errors.New("service unavailable")
+	}
+	if name, ok := g.places[key]; ok {
+		return name, nil
+	}
+	return "", ErrNoLocation
+}
+
+// insertGeotaggedImage adds a file with GPS coordinates and returns its ID.
+func insertGeotaggedImage(t *testing.T, database *db.DB, folderID int64, name string, lat, lon float64) int64 {
+	t.Helper()
+	result := database.Write(
+		"INSERT INTO files (folder_id, path, filename, size) VALUES (?, ?, ?, 0)",
+		folderID, "/photos/"+name, name,
+	)
+	if result.Err != nil {
+		t.Fatalf("Failed to insert file: %v", result.Err)
+	}
+	if err := SaveImageMetadata(database, result.LastInsertID, &ImageMetadata{GPSLatitude: &lat, GPSLongitude: &lon}); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+	return result.LastInsertID
+}
+
+func locationName(t *testing.T, database *db.DB, fileID int64) sql.NullString {
+	t.Helper()
+	var name sql.NullString
+	if err := database.QueryRow("SELECT location_name FROM image_metadata WHERE file_id = ?", fileID).Scan(&name); err != nil {
+		t.Fatalf("Failed to read location_name: %v", err)
+	}
+	return name
+}
+
+func TestEnrichLocations(t *testing.T) {
+	database, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+
+	folder := database.Write("INSERT INTO folders (path) VALUES ('/photos')")
+	if folder.Err != nil {
+		t.Fatalf("Failed to insert folder: %v", folder.Err)
+	}
+
+	geocoder := &stubGeocoder{
+		places: map[[2]float64]string{{-33.8568, 151.2153}: "Sydney, Australia"},
+		fail:   map[[2]float64]bool{{48.8584, 2.2945}: true},
+	}
+
+	opera1 := insertGeotaggedImage(t, database, folder.LastInsertID, "opera1.jpg", -33.8568, 151.2153)
+	opera2 := insertGeotaggedImage(t, database, folder.LastInsertID, "opera2.jpg", -33.85681, 151.21531) // Same ~100m cell
+	ocean := insertGeotaggedImage(t, database, folder.LastInsertID, "ocean.jpg", -40, -140)
+	paris := insertGeotaggedImage(t, database, folder.LastInsertID, "paris.jpg", 48.8584, 2.2945)
+
+	n, err := EnrichLocations(context.Background(), database, geocoder)
+	if err != nil {
+		t.Fatalf("EnrichLocations failed: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 images updated, got %d", n)
+	}
+	if geocoder.calls != 3 {
+		t.Errorf("Expected 3 lookups (one per place), got %d", geocoder.calls)
+	}
+
+	for _, id := range []int64{opera1, opera2} {
+		if name := locationName(t, database, id); name.String != "Sydney, Australia" {
+			t.Errorf("File %d: expected Sydney, got %+v", id, name)
+		}
+	}
+	if name := locationName(t, database, ocean); !name.Valid || name.String != "" {
+		t.Errorf("Expected empty name for unknown place, got %+v", name)
+	}
+	if name := locationName(t, database, paris); name.Valid {
+		t.Errorf("Expected failed lookup to stay NULL, got %+v", name)
+	}
+
+	// Only the failed lookup is retried
+	geocoder.calls = 0
+	geocoder.fail = nil
+	geocoder.places[[2]float64{48.8584, 2.2945}] = "Paris, France"
+	if _, err := EnrichLocations(context.Background(), database, geocoder); err != nil {
+		t.Fatalf("EnrichLocations failed: %v", err)
+	}
+	if geocoder.calls != 1 {
+		t.Errorf("Expected 1 retried lookup, got %d", geocoder.calls)
+	}
+	if name := locationName(t, database, paris); name.String != "Paris, France" {
+		t.Errorf("Expected Paris after retry, got %+v", name)
+	}
+
+	// Moving the photo clears the resolved name
+	lat, lon := 51.5007, -0.1246
+	if err := SaveImageMetadata(database, opera1, &ImageMetadata{GPSLatitude: &lat, GPSLongitude: &lon}); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+	if name := locationName(t, database, opera1); name.Valid {
+		t.Errorf("Expected name cleared after GPS change, got %+v", name)
+	}
+}
+
+func TestReverseGeocode_RejectsInvalidCoordinates(t *testing.T) {
+	geocoder := &stubGeocoder{}
+	for _, c := range [][2]float64{{0, 0}, {91, 0}, {0, 181}} {
+		if _, err := ReverseGeocode(context.Background(), geocoder, c[0], c[1]); !errors.Is(err, ErrNoLocation) {
+			t.Errorf("%v: expected ErrNoLocation, got %v", c, err)
+		}
+	}
+	if geocoder.calls != 0 {
+		t.Errorf("Expected no lookups for invalid coordinates, got %d", geocoder.calls)
+	}
+	if _, err := ReverseGeocode(context.Background(), nil, 1, 1); !errors.Is(err, ErrNoLocation) {
+		t.Errorf("Expected ErrNoLocation with no geocoder, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"jukel.org/q2/db"
+)
+
+// ErrInvalidBounds is returned for rectangles with coordinates out of range
+// or a south edge north of the north edge.
+var ErrInvalidBounds = errors.New("invalid bounds")
+
+// GeotaggedFile is an indexed image with GPS coordinates.
+type GeotaggedFile struct {
+	FileID int64
+	Path   string
+	Lat    float64
+	Lon    float64
+}
+
+// validBounds checks the rectangle is made of valid coordinates, with its
+// south edge not north of its north edge. The west edge may be east of the east
+// edge for rectangles crossing the antimeridian.
+func validBounds(minLat, minLon, maxLat, maxLon float64) error {
+	for _, lat := range []float64{minLat, maxLat} {
+		if !(lat >= -90 && lat <= 90) {
+			return fmt.Errorf("%w: latitude %v out of range", ErrInvalidBounds, lat)
+		}
+	}
+	for _, lon := range []float64{minLon, maxLon} {
+		if !(lon >= -180 && lon <= 180) {
+			return fmt.Errorf("%w: longitude %v out of range", ErrInvalidBounds, lon)
+		}
+	}
+	if minLat > maxLat {
+		return fmt.Errorf("%w: minimum latitude %v is north of maximum %v", ErrInvalidBounds, minLat, maxLat)
+	}
+	return nil
+}
+
+// FilesInBounds returns the geotagged images inside the rectangle from
+// (minLat, minLon) to (maxLat, maxLon), edges included, ordered by path.
+// A rectangle whose minLon is greater than its maxLon crosses the
+// antimeridian, and is searched as the two rectangles either side of it.
+func FilesInBounds(database *db.DB, minLat, minLon, maxLat, maxLon float64) ([]GeotaggedFile, error) {
+	if err := validBounds(minLat, minLon, maxLat, maxLon); err != nil {
+		return nil, err
+	}
+
+	type lonRange struct{ min, max float64 }
+	ranges := []lonRange{{minLon, maxLon}}
+	if minLon > maxLon {
+		ranges = []lonRange{{minLon, 180}, {-180, maxLon}}
+	}
+
+	// Each range is its own SELECT so both can use the (lat, lon) index
+	var selects []string
+	var args []any
+	for _, r := range ranges {
+		selects = append(selects, `
+		SELECT f.id, f.path, m.gps_latitude, m.gps_longitude
+		FROM image_metadata m
+		JOIN files f ON f.id = m.file_id
+		WHERE m.gps_latitude BETWEEN ? AND ?
+		  AND m.gps_longitude BETWEEN ? AND ?
+		  AND f.deleted_at IS NULL`)
+		args = append(args, minLat, maxLat, r.min, r.max)
+	}
+	query := strings.Join(selects, "\n\t\tUNION ALL\n") + "\n\t\tORDER BY 2"
+
+	rows, err := database.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []GeotaggedFile
+	for rows.Next() {
+		var f GeotaggedFile
+		if err := rows.Scan(&f.FileID, &f.Path, &f.Lat, &f.Lon); err != nil {
+			return nil, err
+		}
+		found = append(found, f)
+	}
+	return found, rows.Err()
+}
+
+// FindInBounds returns the IDs of the geotagged images inside a rectangle,
+// as FilesInBounds finds them.
+func FindInBounds(database *db.DB, minLat, minLon, maxLat, maxLon float64) ([]int64, error) {
+	found, err := FilesInBounds(database, minLat, minLon, maxLat, maxLon)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, len(found))
+	for i, f := range found {
+		ids[i] = f.FileID
+	}
+	return ids, nil
+}
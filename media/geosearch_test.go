@@ -0,0 +1,74 @@
+package media
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"jukel.org/q2/db"
+)
+
+func TestFindInBounds(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+
+	database.Write("INSERT INTO folders (path) VALUES ('/photos')")
+	fixtures := []struct {
+		name     string
+		lat, lon float64
+	}{
+		{"london.jpg", 51.5074, -0.1278},
+		{"paris.jpg", 48.8566, 2.3522},
+		{"fiji.jpg", -17.7134, 178.065},
+		{"samoa.jpg", -13.759, -172.1046},
+		{"sydney.jpg", -33.8688, 151.2093},
+	}
+	for i, f := range fixtures {
+		database.Write("INSERT INTO files (folder_id, path, filename, size) VALUES (1, ?, ?, 1)", "/photos/"+f.name, f.name)
+		lat, lon := f.lat, f.lon
+		if err := SaveImageMetadata(database, int64(i+1), &ImageMetadata{GPSLatitude: &lat, GPSLongitude: &lon}); err != nil {
+			t.Fatalf("SaveImageMetadata failed: %v", err)
+		}
+	}
+	// Images without a position are never found
+	database.Write("INSERT INTO files (folder_id, path, filename, size) VALUES (1, '/photos/scan.jpg', 'scan.jpg', 1)")
+	SaveImageMetadata(database, 6, &ImageMetadata{})
+
+	tests := []struct {
+		name                           string
+		minLat, minLon, maxLat, maxLon float64
+		want                           []int64
+	}{
+		{"western Europe", 45, -5, 55, 5, []int64{1, 2}},
+		{"London only", 51, -1, 52, 0, []int64{1}},
+		{"across the antimeridian", -25, 170, -10, -170, []int64{3, 4}},
+		{"west of the antimeridian only", -25, 170, -10, 179, []int64{3}},
+		{"everywhere", -90, -180, 90, 180, []int64{3, 1, 2, 4, 5}},
+		{"empty ocean", -60, -40, -50, -30, nil},
+	}
+	for _, tt := range tests {
+		got, err := FindInBounds(database, tt.minLat, tt.minLon, tt.maxLat, tt.maxLon)
+		if err != nil {
+			t.Errorf("%s: FindInBounds failed: %v", tt.name, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+
+	if _, err := FindInBounds(database, 10, 0, -10, 5); !errors.Is(err, ErrInvalidBounds) {
+		t.Errorf("Expected ErrInvalidBounds for an upside-down rectangle, got %v", err)
+	}
+	if _, err := FindInBounds(database, 0, 0, 10, 200); !errors.Is(err, ErrInvalidBounds) {
+		t.Errorf("Expected ErrInvalidBounds for longitude 200, got %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrNoRawPreview is returned by ExtractRawPreview for files without a usable
+// embedded JPEG preview.
+var ErrNoRawPreview = errors.New("no embedded preview")
+
+// rawExtensions are the camera RAW formats whose embedded JPEG preview is
+// used for thumbnails. All but RAF are TIFF-based.
+var rawExtensions = map[string]bool{
+	".raw": true, ".cr2": true, ".nef": true, ".nrw": true, ".arw": true,
+	".dng": true, ".orf": true, ".rw2": true, ".pef": true, ".srw": true,
+	".raf": true,
+}
+
+// IsRawFormat reports whether ext is a camera RAW format.
+func IsRawFormat(ext string) bool {
+	return rawExtensions[strings.ToLower(ext)]
+}
+
+// TIFF tags that locate embedded JPEGs.
+const (
+	tagCompression           = 0x0103
+	tagStripOffsets          = 0x0111
+	tagStripByteCounts       = 0x0117
+	tagSubIFDs               = 0x014a
+	tagJPEGInterchange       = 0x0201
+	tagJPEGInterchangeLength = 0x0202
+)
+
+// Limits that keep a corrupt file from sending the IFD walk astray.
+const (
+	maxRawIFDs       = 64
+	maxRawIFDEntries = 1000
+	maxRawSubIFDs    = 16
+)
+
+// rawJPEG is an embedded JPEG found in a RAW file.
+type rawJPEG struct {
+	offset, length int64
+	pixels         int // Width times height, from its SOF marker
+}
+
+// ExtractRawPreview returns the largest JPEG preview embedded in a camera RAW
+// file. Cameras store one next to the sensor data, often at full size, and
+// it is far quicker to scale than decoding the RAW, which ffmpeg mostly
+// cannot do. Lossless JPEG sensor data, as in CR2 and DNG, is skipped.
+func ExtractRawPreview(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	header := make([]byte, 92)
+	n, _ := f.ReadAt(header, 0)
+	header = header[:n]
+
+	var candidates []rawJPEG
+	if bytes.HasPrefix(header, []byte("FUJIFILMCCD-RAW")) && len(header) >= 92 {
+		// RAF has its own header pointing at the preview
+		candidates = []rawJPEG{{
+			offset: int64(binary.BigEndian.Uint32(header[84:88])),
+			length: int64(binary.BigEndian.Uint32(header[88:92])),
+		}}
+	} else {
+		order, first, ok := parseTIFFHeader(header)
+		if !ok {
+			return nil, ErrNoRawPreview
+		}
+		candidates = findTIFFJPEGs(f, order, first)
+	}
+
+	var best *rawJPEG
+	for i := range candidates {
+		c := &candidates[i]
+		if c.offset <= 0 || c.length <= 0 || c.offset+c.length > size {
+			continue
+		}
+		pixels, ok := jpegPixels(io.NewSectionReader(f, c.offset, c.length))
+		if !ok {
+			continue
+		}
+		c.pixels = pixels
+		if best == nil || c.pixels > best.pixels {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil, ErrNoRawPreview
+	}
+
+	data := make([]byte, best.length)
+	if _, err := f.ReadAt(data, best.offset); err != nil {
+		return nil, fmt.Errorf("failed to read preview: %w", err)
+	}
+	return data, nil
+}
+
+// parseTIFFHeader returns the byte order and first IFD offset of a TIFF-based
+// RAW file. Olympus (ORF) and Panasonic (RW2) use their own magic numbers.
+func parseTIFFHeader(header []byte) (binary.ByteOrder, uint32, bool) {
+	if len(header) < 8 {
+		return nil, 0, false
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, false
+	}
+	switch order.Uint16(header[2:4]) {
+	case 42, 0x4f52, 0x5352, 0x55:
+		return order, order.Uint32(header[4:8]), true
+	}
+	return nil, 0, false
+}
+
+// findTIFFJPEGs walks the IFD chain and any SubIFDs from first, collecting
+// the JPEGs they point to, either as a JPEGInterchangeFormat block or as a
+// single JPEG-compressed strip.
+func findTIFFJPEGs(r io.ReaderAt, order binary.ByteOrder, first uint32) []rawJPEG {
+	var found []rawJPEG
+	queue := []uint32{first}
+	seen := make(map[uint32]bool)
+	for len(queue) > 0 && len(seen) < maxRawIFDs {
+		offset := queue[0]
+		queue = queue[1:]
+		if offset == 0 || seen[offset] {
+			continue
+		}
+		seen[offset] = true
+
+		var countBuf [2]byte
+		if _, err := r.ReadAt(countBuf[:], int64(offset)); err != nil {
+			continue
+		}
+		count := int(order.Uint16(countBuf[:]))
+		if count == 0 || count > maxRawIFDEntries {
+			continue
+		}
+		entries := make([]byte, count*12+4)
+		if _, err := r.ReadAt(entries, int64(offset)+2); err != nil {
+			continue
+		}
+
+		var compression, stripOffset, stripLength, jpegOffset, jpegLength uint32
+		strips := 0
+		for i := 0; i < count; i++ {
+			e := entries[i*12 : i*12+12]
+			tag, typ, n := order.Uint16(e[0:2]), order.Uint16(e[2:4]), order.Uint32(e[4:8])
+			switch tag {
+			case tagCompression:
+				compression = tiffValue(order, typ, e[8:12])
+			case tagStripOffsets:
+				strips, stripOffset = int(n), tiffValue(order, typ, e[8:12])
+			case tagStripByteCounts:
+				stripLength = tiffValue(order, typ, e[8:12])
+			case tagJPEGInterchange:
+				jpegOffset = tiffValue(order, typ, e[8:12])
+			case tagJPEGInterchangeLength:
+				jpegLength = tiffValue(order, typ, e[8:12])
+			case tagSubIFDs:
+				queue = append(queue, subIFDOffsets(r, order, n, e[8:12])...)
+			}
+		}
+
+		if jpegOffset > 0 && jpegLength > 0 {
+			found = append(found, rawJPEG{offset: int64(jpegOffset), length: int64(jpegLength)})
+		}
+		if (compression == 6 || compression == 7) && strips == 1 && stripLength > 0 {
+			found = append(found, rawJPEG{offset: int64(stripOffset), length: int64(stripLength)})
+		}
+		queue = append(queue, order.Uint32(entries[count*12:]))
+	}
+	return found
+}
+
+// tiffValue returns the first value of a SHORT or LONG entry stored inline.
+func tiffValue(order binary.ByteOrder, typ uint16, value []byte) uint32 {
+	if typ == 3 { // SHORT
+		return uint32(order.Uint16(value))
+	}
+	return order.Uint32(value)
+}
+
+// subIFDOffsets returns the offsets listed by a SubIFDs entry: inline for a
+// single IFD, otherwise in an array the entry points to.
+func subIFDOffsets(r io.ReaderAt, order binary.ByteOrder, count uint32, value []byte) []uint32 {
+	if count == 1 {
+		return []uint32{order.Uint32(value)}
+	}
+	if count == 0 || count > maxRawSubIFDs {
+		return nil
+	}
+	buf := make([]byte, count*4)
+	if _, err := r.ReadAt(buf, int64(order.Uint32(value))); err != nil {
+		return nil
+	}
+	offsets := make([]uint32, count)
+	for i := range offsets {
+		offsets[i] = order.Uint32(buf[i*4:])
+	}
+	return offsets
+}
+
+// jpegPixels reads the markers of a JPEG up to its frame header and returns
+// its width times height. Only baseline and progressive JPEGs, which any
+// decoder handles, are accepted.
+func jpegPixels(r io.Reader) (int, bool) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return 0, false
+	}
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xff {
+			return 0, false
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return 0, false
+		}
+		switch marker[1] {
+		case 0xc0, 0xc1, 0xc2: // Baseline, extended and progressive frames
+			var frame [5]byte
+			if _, err := io.ReadFull(r, frame[:]); err != nil {
+				return 0, false
+			}
+			height := int(binary.BigEndian.Uint16(frame[1:3]))
+			width := int(binary.BigEndian.Uint16(frame[3:5]))
+			return width * height, width > 0 && height > 0
+		case 0xc3, 0xc5, 0xc6, 0xc7, 0xc9, 0xca, 0xcb, 0xcd, 0xce, 0xcf, 0xda:
+			// Lossless or arithmetic-coded frames, or scan data before any frame
+			return 0, false
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+			return 0, false
+		}
+	}
+}
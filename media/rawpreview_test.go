@@ -0,0 +1,146 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testJPEG returns a w x h JPEG.
+func testJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// writeTestNEF writes a little-endian TIFF laid out like a NEF: IFD0 holds a
+// small JPEGInterchangeFormat thumbnail and two SubIFDs, one a JPEG preview
+// strip and one lossless JPEG "sensor data" with larger dimensions.
+func writeTestNEF(t *testing.T, path string, preview []byte) {
+	t.Helper()
+	thumb := testJPEG(t, 64, 48)
+	lossless := []byte{0xff, 0xd8, 0xff, 0xc3, 0x00, 0x0b, 0x0c, 0x0f, 0xa0, 0x17, 0x70, 0x01, 0x01, 0x11, 0x00}
+
+	const ifdSize = 2 + 3*12 + 4
+	const (
+		ifd0     = 8
+		subArray = ifd0 + ifdSize
+		subA     = subArray + 8
+		subB     = subA + ifdSize
+		data     = subB + ifdSize
+	)
+	thumbAt := uint32(data)
+	previewAt := thumbAt + uint32(len(thumb))
+	losslessAt := previewAt + uint32(len(preview))
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	ifd := func(entries ...[3]uint32) {
+		binary.Write(&buf, le, uint16(len(entries)))
+		for _, e := range entries {
+			typ := uint16(4) // LONG
+			if e[0] == tagCompression {
+				typ = 3 // SHORT
+			}
+			binary.Write(&buf, le, uint16(e[0]))
+			binary.Write(&buf, le, typ)
+			binary.Write(&buf, le, e[1])
+			binary.Write(&buf, le, e[2])
+		}
+		binary.Write(&buf, le, uint32(0))
+	}
+
+	buf.WriteString("II")
+	binary.Write(&buf, le, uint16(42))
+	binary.Write(&buf, le, uint32(ifd0))
+	ifd([3]uint32{tagSubIFDs, 2, subArray}, [3]uint32{tagJPEGInterchange, 1, thumbAt}, [3]uint32{tagJPEGInterchangeLength, 1, uint32(len(thumb))})
+	binary.Write(&buf, le, []uint32{subA, subB})
+	ifd([3]uint32{tagCompression, 1, 6}, [3]uint32{tagStripOffsets, 1, previewAt}, [3]uint32{tagStripByteCounts, 1, uint32(len(preview))})
+	ifd([3]uint32{tagCompression, 1, 7}, [3]uint32{tagStripOffsets, 1, losslessAt}, [3]uint32{tagStripByteCounts, 1, uint32(len(lossless))})
+	buf.Write(thumb)
+	buf.Write(preview)
+	buf.Write(lossless)
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write NEF: %v", err)
+	}
+}
+
+func TestExtractRawPreview(t *testing.T) {
+	dir := t.TempDir()
+
+	// The largest decodable JPEG wins over the IFD0 thumbnail and the sensor data
+	preview := testJPEG(t, 200, 100)
+	nef := filepath.Join(dir, "photo.nef")
+	writeTestNEF(t, nef, preview)
+	got, err := ExtractRawPreview(nef)
+	if err != nil {
+		t.Fatalf("ExtractRawPreview failed: %v", err)
+	}
+	if !bytes.Equal(got, preview) {
+		t.Errorf("Expected the 200x100 preview, got %d bytes", len(got))
+	}
+
+	// Fujifilm RAF points at its preview from the header
+	var raf bytes.Buffer
+	raf.WriteString("FUJIFILMCCD-RAW 0201FF383501")
+	raf.Write(make([]byte, 84-raf.Len()))
+	binary.Write(&raf, binary.BigEndian, []uint32{100, uint32(len(preview))})
+	raf.Write(make([]byte, 100-raf.Len()))
+	raf.Write(preview)
+	rafPath := filepath.Join(dir, "photo.raf")
+	os.WriteFile(rafPath, raf.Bytes(), 0644)
+	if got, err := ExtractRawPreview(rafPath); err != nil || !bytes.Equal(got, preview) {
+		t.Errorf("Expected the RAF preview, got %d bytes (%v)", len(got), err)
+	}
+
+	// Files without a preview
+	plain := filepath.Join(dir, "plain.jpg")
+	os.WriteFile(plain, preview, 0644)
+	garbage := filepath.Join(dir, "garbage.cr2")
+	os.WriteFile(garbage, []byte("II*\x00\xff\xff\xff\x7f"), 0644)
+	for _, path := range []string{plain, garbage} {
+		if _, err := ExtractRawPreview(path); !errors.Is(err, ErrNoRawPreview) {
+			t.Errorf("%s: expected ErrNoRawPreview, got %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestGenerateImageThumbnails_RawPreview(t *testing.T) {
+	dir := t.TempDir()
+	mgr := enrichTestManager(t, dir)
+	store := CentralStore{Dir: filepath.Join(dir, ".q2")}
+
+	nef := filepath.Join(dir, "photo.nef")
+	writeTestNEF(t, nef, testJPEG(t, 200, 100))
+	result := GenerateImageThumbnails(context.Background(), nef, store, mgr)
+	if result.Error != nil {
+		t.Fatalf("GenerateImageThumbnails failed: %v", result.Error)
+	}
+	if result.Method != ThumbnailMethodPreview {
+		t.Errorf("Expected the RAW to be thumbnailed from its preview, got %q", result.Method)
+	}
+	if _, err := os.Stat(store.FullPath(result.SmallPath) + ".preview.jpg"); !os.IsNotExist(err) {
+		t.Error("Expected the extracted preview to be removed")
+	}
+
+	// Up-to-date thumbnails are not made again
+	if again := GenerateImageThumbnails(context.Background(), nef, store, mgr); again.Error != nil || again.Method != "" {
+		t.Errorf("Expected up-to-date thumbnails to be kept, got %q (%v)", again.Method, again.Error)
+	}
+
+	photo := filepath.Join(dir, "photo.jpg")
+	writeOrientedJPEG(t, photo, 40, 20, 1)
+	if result := GenerateImageThumbnails(context.Background(), photo, store, mgr); result.Error != nil || result.Method != ThumbnailMethodDecode {
+		t.Errorf("Expected a JPEG to be decoded, got %q (%v)", result.Method, result.Error)
+	}
+}
@@ -0,0 +1,60 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/scanner"
+)
+
+// ErrNoMetadata is returned by RefreshMetadata for files it reads nothing
+// from: videos, unknown types, or types the folder's library type skips.
+var ErrNoMetadata = errors.New("no metadata to read")
+
+// RefreshMetadata reads the metadata of the indexed file fileID again and
+// stores it in place of what was stored, as scanning reads it the first
+// time: EXIF and XMP for images, tags for audio, as the library type of the
+// file's folder allows. Fields the file no longer has are cleared; values
+// worked out from others, such as the place named by the GPS position, are
+// kept only while those stay the same. Reports db.ErrNotFound for unknown IDs.
+func RefreshMetadata(ctx context.Context, database *db.DB, fileID int64, ffmpegMgr *ffmpeg.Manager) error {
+	var path string
+	var libraryType string
+	err := database.QueryRow(`
+		SELECT f.path, COALESCE(d.library_type, '') FROM files f
+		JOIN folders d ON d.id = f.folder_id
+		WHERE f.id = ?`, fileID).Scan(&path, &libraryType)
+	if err != nil {
+		return db.Classify(err)
+	}
+
+	features := scanner.LibraryType(libraryType).Features()
+	mediaType := scanner.GetMediaType(filepath.Ext(path))
+	switch {
+	case mediaType == nil:
+		return ErrNoMetadata
+	case *mediaType == scanner.MediaTypeImage && features.EXIF:
+		meta, err := ExtractEXIF(path)
+		if err != nil {
+			return err
+		}
+		if err := SaveImageMetadata(database, fileID, meta); err != nil {
+			return err
+		}
+		xmp, err := ExtractXMP(path)
+		if err != nil {
+			return err
+		}
+		return SaveImageTags(database, fileID, xmp)
+	case *mediaType == scanner.MediaTypeAudio && features.AudioMetadata:
+		meta, err := ExtractAudioMetadata(ctx, path, ffmpegMgr)
+		if err != nil {
+			return err
+		}
+		return SaveAudioMetadata(database, fileID, meta)
+	}
+	return ErrNoMetadata
+}
@@ -0,0 +1,101 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"jukel.org/q2/db"
+)
+
+// writeModelJPEG writes a small JPEG whose EXIF names the camera model.
+func writeModelJPEG(t *testing.T, path, model string) {
+	t.Helper()
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+
+	// Big-endian TIFF with a single IFD entry: Model (0x0110), ASCII, stored after the IFD
+	value := append([]byte(model), 0)
+	var tiff bytes.Buffer
+	tiff.WriteString("MM")
+	binary.Write(&tiff, binary.BigEndian, uint16(42))
+	binary.Write(&tiff, binary.BigEndian, uint32(8))
+	binary.Write(&tiff, binary.BigEndian, uint16(1))
+	binary.Write(&tiff, binary.BigEndian, []uint16{0x0110, 2})
+	binary.Write(&tiff, binary.BigEndian, uint32(len(value)))
+	binary.Write(&tiff, binary.BigEndian, uint32(8+2+12+4))
+	binary.Write(&tiff, binary.BigEndian, uint32(0))
+	tiff.Write(value)
+
+	app1 := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:2]) // SOI
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(&out, binary.BigEndian, uint16(len(app1)+2))
+	out.Write(app1)
+	out.Write(encoded.Bytes()[2:])
+
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write JPEG: %v", err)
+	}
+}
+
+func TestRefreshMetadata_UpdatesCameraModel(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+
+	photo := filepath.Join(dir, "photo.jpg")
+	writeModelJPEG(t, photo, "EOS 5D")
+	folder := database.Write("INSERT INTO folders (path) VALUES (?)", dir)
+	file := database.Write("INSERT INTO files (folder_id, path, filename, size) VALUES (?, ?, 'photo.jpg', 1)", folder.LastInsertID, photo)
+	if file.Err != nil {
+		t.Fatalf("Failed to insert file: %v", file.Err)
+	}
+	fileID := file.LastInsertID
+
+	model := func() string {
+		var m string
+		database.QueryRow("SELECT COALESCE(camera_model, '') FROM image_metadata WHERE file_id = ?", fileID).Scan(&m)
+		return m
+	}
+	if err := RefreshMetadata(context.Background(), database, fileID, nil); err != nil {
+		t.Fatalf("RefreshMetadata failed: %v", err)
+	}
+	if got := model(); got != "EOS 5D" {
+		t.Fatalf("Expected camera model EOS 5D, got %q", got)
+	}
+
+	// The EXIF is edited after indexing
+	writeModelJPEG(t, photo, "EOS R5")
+	if err := RefreshMetadata(context.Background(), database, fileID, nil); err != nil {
+		t.Fatalf("RefreshMetadata failed: %v", err)
+	}
+	if got := model(); got != "EOS R5" {
+		t.Errorf("Expected the refreshed camera model EOS R5, got %q", got)
+	}
+	var rows int
+	database.QueryRow("SELECT COUNT(*) FROM image_metadata WHERE file_id = ?", fileID).Scan(&rows)
+	if rows != 1 {
+		t.Errorf("Expected the row replaced, got %d rows", rows)
+	}
+
+	if err := RefreshMetadata(context.Background(), database, fileID+1, nil); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown file, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package media
+
+import (
+	"database/sql"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"jukel.org/q2/db"
+)
+
+// GCThumbnails deletes thumbnails in the central cache under q2Dir that no
+// indexed file refers to any more, such as those of deleted files. A file
+// refers to the thumbnails GetThumbnailPath names for it at each of
+// ThumbnailSizes in every format, to its upright copy and JPEG conversion,
+// and to the ones recorded in its row, in either mode. Thumbnails written
+// after the collection starts are kept, as their file may have been indexed
+// since the files table was read. Returns how many thumbnails were deleted
+// and their size.
+func GCThumbnails(database *db.DB, q2Dir string) (removed int, bytes int64, err error) {
+	start := time.Now()
+
+	referenced := make(map[string]bool)
+	rows, err := database.Query("SELECT path, thumbnail_small_path, thumbnail_large_path, xxhash FROM files")
+	if err != nil {
+		return 0, 0, err
+	}
+	for rows.Next() {
+		var path string
+		var small, large, xxhash sql.NullString
+		if err := rows.Scan(&path, &small, &large, &xxhash); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		names := []string{small.String, large.String, GetUprightPath(path)}
+		if xxhash.String != "" {
+			names = append(names, GetConvertedPath(xxhash.String))
+		}
+		for _, format := range []string{ThumbnailFormatJPEG, ThumbnailFormatWebP, ThumbnailFormatAVIF} {
+			for _, size := range ThumbnailSizes {
+				names = append(names, GetThumbnailPath(path, size, format))
+			}
+		}
+		for _, rel := range names {
+			if rel != "" {
+				referenced[filepath.Clean(rel)] = true
+				referenced[filepath.Clean(ThumbnailModePath(rel, ThumbnailModeCrop))] = true
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	err = filepath.WalkDir(filepath.Join(q2Dir, ThumbnailDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // No cache yet
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(q2Dir, path)
+		if err != nil || referenced[rel] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(start) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return nil
+		}
+		removed++
+		bytes += info.Size()
+		return nil
+	})
+	return removed, bytes, err
+}
@@ -0,0 +1,75 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"jukel.org/q2/db"
+	_ "jukel.org/q2/migrations"
+)
+
+func TestGCThumbnails(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+
+	folder := database.Write("INSERT INTO folders (path) VALUES ('/photos')")
+	if folder.Err != nil {
+		t.Fatalf("Failed to insert folder: %v", folder.Err)
+	}
+	if r := database.Write("INSERT INTO files (folder_id, path, filename, size) VALUES (?, '/photos/kept.jpg', 'kept.jpg', 0)", folder.LastInsertID); r.Err != nil {
+		t.Fatalf("Failed to insert file: %v", r.Err)
+	}
+
+	q2Dir := filepath.Join(dir, ".q2")
+	old := time.Now().Add(-time.Hour)
+	writeThumb := func(rel string, size int) string {
+		full := filepath.Join(q2Dir, rel)
+		os.MkdirAll(filepath.Dir(full), 0755)
+		if err := os.WriteFile(full, make([]byte, size), 0644); err != nil {
+			t.Fatalf("Failed to write thumbnail: %v", err)
+		}
+		os.Chtimes(full, old, old)
+		return full
+	}
+	kept := writeThumb(GetThumbnailPath("/photos/kept.jpg", SmallThumbnailSize, ThumbnailFormatJPEG), 10)
+	keptLarge := writeThumb(GetThumbnailPath("/photos/kept.jpg", LargeThumbnailSize, ThumbnailFormatJPEG), 20)
+	keptCrop := writeThumb(ThumbnailModePath(GetThumbnailPath("/photos/kept.jpg", SmallThumbnailSize, ThumbnailFormatJPEG), ThumbnailModeCrop), 5)
+	orphan := writeThumb(GetThumbnailPath("/photos/deleted.jpg", SmallThumbnailSize, ThumbnailFormatJPEG), 300)
+
+	// Written after the collection starts, so possibly for a newly indexed file
+	fresh := filepath.Join(q2Dir, GetThumbnailPath("/photos/new.jpg", SmallThumbnailSize, ThumbnailFormatJPEG))
+	os.MkdirAll(filepath.Dir(fresh), 0755)
+	future := time.Now().Add(time.Hour)
+	os.WriteFile(fresh, []byte("jpeg"), 0644)
+	os.Chtimes(fresh, future, future)
+
+	removed, bytes, err := GCThumbnails(database, q2Dir)
+	if err != nil {
+		t.Fatalf("GCThumbnails failed: %v", err)
+	}
+	if removed != 1 || bytes != 300 {
+		t.Errorf("Expected 1 thumbnail and 300 bytes reclaimed, got %d and %d", removed, bytes)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("Expected the orphan thumbnail to be deleted")
+	}
+	for _, path := range []string{kept, keptLarge, keptCrop, fresh} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected %s to survive: %v", path, err)
+		}
+	}
+
+	// No cache at all is not an error
+	if _, _, err := GCThumbnails(database, filepath.Join(dir, "empty")); err != nil {
+		t.Errorf("Expected no error without a thumbnail cache, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package media
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"os"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/cespare/xxhash/v2"
 	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/scanner"
 )
 
 const (
@@ -18,13 +20,120 @@ const (
 	ThumbnailDir          = "thumbnails"
 )
 
+// ThumbnailSizes are the sizes thumbnails are made at on request, such as by
+// GET /api/image?w=, smallest first. Snapping requests to them keeps the
+// cache to a few files per image, and includes the small and large sizes so
+// those are reused.
+var ThumbnailSizes = []int{128, 256, SmallThumbnailSize, 1024, LargeThumbnailSize, 2560}
+
+// NearestThumbnailSize returns the smallest of ThumbnailSizes at least w,
+// or the largest if w exceeds them all.
+func NearestThumbnailSize(w int) int {
+	for _, size := range ThumbnailSizes {
+		if size >= w {
+			return size
+		}
+	}
+	return ThumbnailSizes[len(ThumbnailSizes)-1]
+}
+
+// Thumbnail methods, as stored in files.thumbnail_method.
+const (
+	ThumbnailMethodDecode  = "decode"  // FFmpeg decoded the original
+	ThumbnailMethodPreview = "preview" // Scaled from the JPEG preview embedded in a RAW file
+)
+
+// Thumbnail aspect modes.
+const (
+	ThumbnailModeFit  = "fit"  // Scaled to fit within the size, keeping the whole picture (default)
+	ThumbnailModeCrop = "crop" // Center-cropped to a square of the size
+)
+
+// ParseThumbnailMode returns the thumbnail mode named by s, defaulting to
+// ThumbnailModeFit when s is empty.
+func ParseThumbnailMode(s string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(s)); mode {
+	case "", ThumbnailModeFit:
+		return ThumbnailModeFit, nil
+	case ThumbnailModeCrop:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid thumbnail mode %q (must be %s or %s)", s, ThumbnailModeFit, ThumbnailModeCrop)
+}
+
+// Thumbnail formats, as stored in the thumbnail_format setting.
+const (
+	ThumbnailFormatJPEG = ffmpeg.ThumbnailJPEG // Default; read by every browser and client
+	ThumbnailFormatWebP = ffmpeg.ThumbnailWebP // About a third smaller
+	ThumbnailFormatAVIF = ffmpeg.ThumbnailAVIF // Smaller still, but slow to encode
+)
+
+// ParseThumbnailFormat returns the thumbnail format named by s, defaulting
+// to ThumbnailFormatJPEG when s is empty.
+func ParseThumbnailFormat(s string) (string, error) {
+	switch format := strings.ToLower(strings.TrimSpace(s)); format {
+	case "", "jpg", ThumbnailFormatJPEG:
+		return ThumbnailFormatJPEG, nil
+	case ThumbnailFormatWebP, ThumbnailFormatAVIF:
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid thumbnail format %q (must be %s, %s or %s)",
+		s, ThumbnailFormatJPEG, ThumbnailFormatWebP, ThumbnailFormatAVIF)
+}
+
+// thumbnailFormatPath returns path with the extension of format in place of its own.
+func thumbnailFormatPath(path, format string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ffmpeg.ThumbnailExtension(format)
+}
+
+// thumbnailOutputPath returns the recorded path to write the thumbnail of
+// sourcePath at size in mode to. It is in the store's format when ffmpeg
+// can encode it and in JPEG otherwise, where the store finds it too.
+func thumbnailOutputPath(ctx context.Context, sourcePath string, store ThumbnailStore, size int, mode string, ffmpegMgr *ffmpeg.Manager) (string, error) {
+	thumbRelPath, err := store.Path(sourcePath, size)
+	if err != nil {
+		return "", err
+	}
+	if format := thumbnailPathFormat(thumbRelPath); !ffmpegMgr.SupportsThumbnailFormat(ctx, format) {
+		thumbRelPath = thumbnailFormatPath(thumbRelPath, ThumbnailFormatJPEG)
+	}
+	return ThumbnailModePath(thumbRelPath, mode), nil
+}
+
+// thumbnailPathFormat returns the format of the thumbnail at path, by its extension.
+func thumbnailPathFormat(path string) string {
+	for _, format := range []string{ThumbnailFormatWebP, ThumbnailFormatAVIF} {
+		if strings.EqualFold(filepath.Ext(path), ffmpeg.ThumbnailExtension(format)) {
+			return format
+		}
+	}
+	return ThumbnailFormatJPEG
+}
+
+// ThumbnailModePath returns the path of the thumbnail in mode, given the path
+// of its fit thumbnail. Cropped thumbnails are kept beside fit ones with a
+// "_crop" suffix, so both modes coexist in every store.
+func ThumbnailModePath(path, mode string) string {
+	if mode != ThumbnailModeCrop {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "_" + mode + ext
+}
+
 // ThumbnailResult contains the result of thumbnail generation.
 type ThumbnailResult struct {
 	SmallPath string // Relative path to small thumbnail
 	LargePath string // Relative path to large thumbnail
+	Method    string // ThumbnailMethodDecode or ThumbnailMethodPreview; empty if both were up to date
 	Error     error
 }
 
+// thumbnailHash returns the hash naming the central cache's files for imagePath.
+func thumbnailHash(imagePath string) string {
+	return fmt.Sprintf("%016x", xxhash.Sum64String(strings.ToLower(imagePath)))
+}
+
 // getHashSubfolder returns the first 2 characters of the hash for subfolder sharding
 func getHashSubfolder(hash string) string {
 	if len(hash) >= 2 {
@@ -33,75 +142,120 @@ func getHashSubfolder(hash string) string {
 	return "00"
 }
 
-// GenerateThumbnail creates a thumbnail for the given image file using FFmpeg.
-// Returns the relative path to the thumbnail within the q2Dir.
+// GenerateThumbnail creates a thumbnail for the given image file using FFmpeg,
+// rotated upright according to its EXIF orientation, in mode (ThumbnailModeFit
+// or ThumbnailModeCrop). Camera RAW files are thumbnailed from their embedded
+// JPEG preview when they have one.
+// Returns the thumbnail path as recorded by store.
 // Skips generation if thumbnail exists and is newer than the source file.
-func GenerateThumbnail(ctx context.Context, imagePath, q2Dir string, size int, ffmpegMgr *ffmpeg.Manager) (string, error) {
+func GenerateThumbnail(ctx context.Context, imagePath string, store ThumbnailStore, size int, mode string, ffmpegMgr *ffmpeg.Manager) (string, error) {
+	path, _, err := generateThumbnail(ctx, imagePath, store, size, mode, ffmpegMgr)
+	return path, err
+}
+
+// generateThumbnail is GenerateThumbnail, also returning the method used,
+// or "" if the thumbnail was already up to date.
+func generateThumbnail(ctx context.Context, imagePath string, store ThumbnailStore, size int, mode string, ffmpegMgr *ffmpeg.Manager) (string, string, error) {
 	if ffmpegMgr == nil {
-		return "", fmt.Errorf("ffmpeg manager not available")
+		return "", "", fmt.Errorf("ffmpeg manager not available")
 	}
 
 	// Get source file info for mtime comparison
 	srcInfo, err := os.Stat(imagePath)
 	if err != nil {
-		return "", fmt.Errorf("cannot stat source file: %w", err)
+		return "", "", fmt.Errorf("cannot stat source file: %w", err)
 	}
 
-	// Generate hash of original path for filename
-	hash := fmt.Sprintf("%016x", xxhash.Sum64String(strings.ToLower(imagePath)))
-	subfolder := getHashSubfolder(hash)
-
-	// Thumbnail filename includes size for uniqueness
-	thumbFilename := fmt.Sprintf("%s_%d.jpg", hash, size)
-	thumbRelPath := filepath.Join(ThumbnailDir, subfolder, thumbFilename)
-	thumbFullPath := filepath.Join(q2Dir, thumbRelPath)
+	// The store picks the location and creates its directory
+	thumbRelPath, err := thumbnailOutputPath(ctx, imagePath, store, size, mode, ffmpegMgr)
+	if err != nil {
+		return "", "", err
+	}
+	thumbFullPath := store.FullPath(thumbRelPath)
 
 	// Check if thumbnail already exists and is newer than source
 	if thumbInfo, err := os.Stat(thumbFullPath); err == nil {
 		if thumbInfo.ModTime().After(srcInfo.ModTime()) {
 			// Thumbnail is up to date
-			return thumbRelPath, nil
+			return thumbRelPath, "", nil
 		}
 	}
 
-	// Create thumbnail directory if it doesn't exist
-	thumbDir := filepath.Join(q2Dir, ThumbnailDir, subfolder)
-	if err := os.MkdirAll(thumbDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create thumbnail directory: %w", err)
+	// Phone cameras store portrait photos sideways with an EXIF Orientation tag
+	orientation := 1
+	if meta, err := ExtractEXIF(imagePath); err == nil && meta.Orientation != nil {
+		orientation = *meta.Orientation
 	}
 
-	// Generate thumbnail using FFmpeg
-	if err := ffmpegMgr.GenerateThumbnail(ctx, imagePath, thumbFullPath, size, ThumbnailQuality); err != nil {
-		return "", fmt.Errorf("failed to generate thumbnail: %w", err)
+	// A RAW file's preview is stored unrotated, so the RAW's orientation still applies
+	input, method := imagePath, ThumbnailMethodDecode
+	if IsRawFormat(filepath.Ext(imagePath)) {
+		if preview, err := ExtractRawPreview(imagePath); err == nil {
+			previewPath := thumbFullPath + ".preview.jpg"
+			if err := os.WriteFile(previewPath, preview, 0644); err == nil {
+				defer os.Remove(previewPath)
+				input, method = previewPath, ThumbnailMethodPreview
+			}
+		}
 	}
 
-	return thumbRelPath, nil
+	// Generate thumbnail using FFmpeg, which needs the long-path form for deep folders on Windows
+	if err := ffmpegMgr.GenerateThumbnail(ctx, scanner.LongPath(input), scanner.LongPath(thumbFullPath), size, ThumbnailQuality, orientation, mode == ThumbnailModeCrop); err != nil {
+		return "", "", fmt.Errorf("failed to generate thumbnail: %w", err)
+	}
+
+	return thumbRelPath, method, nil
 }
 
 // GenerateSmallThumbnail creates a small (500px) thumbnail.
-func GenerateSmallThumbnail(ctx context.Context, imagePath, q2Dir string, ffmpegMgr *ffmpeg.Manager) (string, error) {
-	return GenerateThumbnail(ctx, imagePath, q2Dir, SmallThumbnailSize, ffmpegMgr)
+func GenerateSmallThumbnail(ctx context.Context, imagePath string, store ThumbnailStore, ffmpegMgr *ffmpeg.Manager) (string, error) {
+	return GenerateThumbnail(ctx, imagePath, store, SmallThumbnailSize, ThumbnailModeFit, ffmpegMgr)
 }
 
 // GenerateLargeThumbnail creates a large (1800px) thumbnail.
-func GenerateLargeThumbnail(ctx context.Context, imagePath, q2Dir string, ffmpegMgr *ffmpeg.Manager) (string, error) {
-	return GenerateThumbnail(ctx, imagePath, q2Dir, LargeThumbnailSize, ffmpegMgr)
+func GenerateLargeThumbnail(ctx context.Context, imagePath string, store ThumbnailStore, ffmpegMgr *ffmpeg.Manager) (string, error) {
+	return GenerateThumbnail(ctx, imagePath, store, LargeThumbnailSize, ThumbnailModeFit, ffmpegMgr)
 }
 
 // GenerateBothThumbnails creates both small and large thumbnails for an image.
-// Returns relative paths to both thumbnails.
-func GenerateBothThumbnails(ctx context.Context, imagePath, q2Dir string, ffmpegMgr *ffmpeg.Manager) (smallPath, largePath string, err error) {
-	smallPath, err = GenerateSmallThumbnail(ctx, imagePath, q2Dir, ffmpegMgr)
+// Returns the recorded paths of both thumbnails.
+func GenerateBothThumbnails(ctx context.Context, imagePath string, store ThumbnailStore, ffmpegMgr *ffmpeg.Manager) (smallPath, largePath string, err error) {
+	result := GenerateImageThumbnails(ctx, imagePath, store, ffmpegMgr)
+	return result.SmallPath, result.LargePath, result.Error
+}
+
+// GenerateImageThumbnails creates both small and large thumbnails for an
+// image, reporting how they were made.
+func GenerateImageThumbnails(ctx context.Context, imagePath string, store ThumbnailStore, ffmpegMgr *ffmpeg.Manager) ThumbnailResult {
+	smallPath, smallMethod, err := generateThumbnail(ctx, imagePath, store, SmallThumbnailSize, ThumbnailModeFit, ffmpegMgr)
 	if err != nil {
-		return "", "", fmt.Errorf("small thumbnail: %w", err)
+		return ThumbnailResult{Error: fmt.Errorf("small thumbnail: %w", err)}
 	}
 
-	largePath, err = GenerateLargeThumbnail(ctx, imagePath, q2Dir, ffmpegMgr)
+	largePath, largeMethod, err := generateThumbnail(ctx, imagePath, store, LargeThumbnailSize, ThumbnailModeFit, ffmpegMgr)
 	if err != nil {
-		return "", "", fmt.Errorf("large thumbnail: %w", err)
+		return ThumbnailResult{Error: fmt.Errorf("large thumbnail: %w", err)}
 	}
 
-	return smallPath, largePath, nil
+	return ThumbnailResult{SmallPath: smallPath, LargePath: largePath, Method: cmp.Or(largeMethod, smallMethod)}
+}
+
+// GenerateThumbnailSizes creates fit thumbnails of an image at each of sizes,
+// as GenerateThumbnail does, skipping those already up to date.
+// Returns the recorded path of each size.
+func GenerateThumbnailSizes(ctx context.Context, imagePath string, store ThumbnailStore, sizes []int, ffmpegMgr *ffmpeg.Manager) (map[int]string, error) {
+	paths := make(map[int]string, len(sizes))
+	for _, size := range sizes {
+		if size <= 0 {
+			return nil, fmt.Errorf("invalid thumbnail size %d", size)
+		}
+		path, err := GenerateThumbnail(ctx, imagePath, store, size, ThumbnailModeFit, ffmpegMgr)
+		if err != nil {
+			return nil, fmt.Errorf("%dpx thumbnail: %w", size, err)
+		}
+		paths[size] = path
+	}
+	return paths, nil
 }
 
 // IsSupportedImageFormat checks if the file extension is a supported image format.
@@ -124,34 +278,39 @@ func IsSupportedImageFormat(ext string) bool {
 		".nef":  true,
 		".arw":  true,
 	}
-	return supported[ext]
+	return supported[ext] || IsRawFormat(ext)
 }
 
-// DeleteThumbnail removes a thumbnail file if it exists.
+// DeleteThumbnail removes a thumbnail file and its cropped counterpart if they
+// exist. thumbPath is a recorded thumbnail path: relative to q2Dir, or
+// absolute for sidecar thumbnails.
 func DeleteThumbnail(thumbPath, q2Dir string) error {
 	if thumbPath == "" {
 		return nil
 	}
-	fullPath := filepath.Join(q2Dir, thumbPath)
-	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
-		return err
+	fullPath := CentralStore{Dir: q2Dir}.FullPath(thumbPath)
+	for _, path := range []string{fullPath, ThumbnailModePath(fullPath, ThumbnailModeCrop)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 	return nil
 }
 
-// GetThumbnailPath returns the expected thumbnail path for an image without generating it.
+// GetThumbnailPath returns the expected thumbnail path for an image in format without generating it.
 // Useful for checking if a thumbnail exists or for serving.
-func GetThumbnailPath(imagePath string, size int) string {
-	hash := fmt.Sprintf("%016x", xxhash.Sum64String(strings.ToLower(imagePath)))
+func GetThumbnailPath(imagePath string, size int, format string) string {
+	hash := thumbnailHash(imagePath)
 	subfolder := getHashSubfolder(hash)
-	thumbFilename := fmt.Sprintf("%s_%d.jpg", hash, size)
+	thumbFilename := fmt.Sprintf("%s_%d%s", hash, size, ffmpeg.ThumbnailExtension(format))
 	return filepath.Join(ThumbnailDir, subfolder, thumbFilename)
 }
 
-// GenerateVideoThumbnail creates a thumbnail for a video file by extracting a frame at 10% duration.
-// Returns the relative path to the thumbnail within the q2Dir.
+// GenerateVideoThumbnail creates a thumbnail for a video file by extracting a frame at 10% duration,
+// in mode (ThumbnailModeFit or ThumbnailModeCrop).
+// Returns the thumbnail path as recorded by store.
 // Skips generation if thumbnail exists and is newer than the source file.
-func GenerateVideoThumbnail(ctx context.Context, videoPath, q2Dir string, size int, ffmpegMgr *ffmpeg.Manager) (string, error) {
+func GenerateVideoThumbnail(ctx context.Context, videoPath string, store ThumbnailStore, size int, mode string, ffmpegMgr *ffmpeg.Manager) (string, error) {
 	if ffmpegMgr == nil {
 		return "", fmt.Errorf("ffmpeg manager not available")
 	}
@@ -162,14 +321,12 @@ func GenerateVideoThumbnail(ctx context.Context, videoPath, q2Dir string, size i
 		return "", fmt.Errorf("cannot stat source file: %w", err)
 	}
 
-	// Generate hash of original path for filename
-	hash := fmt.Sprintf("%016x", xxhash.Sum64String(strings.ToLower(videoPath)))
-	subfolder := getHashSubfolder(hash)
-
-	// Thumbnail filename includes size for uniqueness
-	thumbFilename := fmt.Sprintf("%s_%d.jpg", hash, size)
-	thumbRelPath := filepath.Join(ThumbnailDir, subfolder, thumbFilename)
-	thumbFullPath := filepath.Join(q2Dir, thumbRelPath)
+	// The store picks the location and creates its directory
+	thumbRelPath, err := thumbnailOutputPath(ctx, videoPath, store, size, mode, ffmpegMgr)
+	if err != nil {
+		return "", err
+	}
+	thumbFullPath := store.FullPath(thumbRelPath)
 
 	// Check if thumbnail already exists and is newer than source
 	if thumbInfo, err := os.Stat(thumbFullPath); err == nil {
@@ -179,14 +336,8 @@ func GenerateVideoThumbnail(ctx context.Context, videoPath, q2Dir string, size i
 		}
 	}
 
-	// Create thumbnail directory if it doesn't exist
-	thumbDir := filepath.Join(q2Dir, ThumbnailDir, subfolder)
-	if err := os.MkdirAll(thumbDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create thumbnail directory: %w", err)
-	}
-
 	// Get video duration to calculate 10% timestamp
-	duration, err := ffmpegMgr.GetVideoDuration(ctx, videoPath)
+	duration, err := ffmpegMgr.GetVideoDuration(ctx, scanner.LongPath(videoPath))
 	if err != nil {
 		// If we can't get duration, try 5 seconds as fallback
 		duration = 50 // Will result in 5 seconds at 10%
@@ -202,7 +353,7 @@ func GenerateVideoThumbnail(ctx context.Context, videoPath, q2Dir string, size i
 	}
 
 	// Extract frame using FFmpeg
-	if err := ffmpegMgr.ExtractVideoFrame(ctx, videoPath, thumbFullPath, timestamp, size, ThumbnailQuality); err != nil {
+	if err := ffmpegMgr.ExtractVideoFrame(ctx, scanner.LongPath(videoPath), scanner.LongPath(thumbFullPath), timestamp, size, ThumbnailQuality, mode == ThumbnailModeCrop); err != nil {
 		return "", fmt.Errorf("failed to extract video frame: %w", err)
 	}
 
@@ -210,24 +361,24 @@ func GenerateVideoThumbnail(ctx context.Context, videoPath, q2Dir string, size i
 }
 
 // GenerateVideoThumbnailSmall creates a small (500px) thumbnail for a video.
-func GenerateVideoThumbnailSmall(ctx context.Context, videoPath, q2Dir string, ffmpegMgr *ffmpeg.Manager) (string, error) {
-	return GenerateVideoThumbnail(ctx, videoPath, q2Dir, SmallThumbnailSize, ffmpegMgr)
+func GenerateVideoThumbnailSmall(ctx context.Context, videoPath string, store ThumbnailStore, ffmpegMgr *ffmpeg.Manager) (string, error) {
+	return GenerateVideoThumbnail(ctx, videoPath, store, SmallThumbnailSize, ThumbnailModeFit, ffmpegMgr)
 }
 
 // GenerateVideoThumbnailLarge creates a large (1800px) thumbnail for a video.
-func GenerateVideoThumbnailLarge(ctx context.Context, videoPath, q2Dir string, ffmpegMgr *ffmpeg.Manager) (string, error) {
-	return GenerateVideoThumbnail(ctx, videoPath, q2Dir, LargeThumbnailSize, ffmpegMgr)
+func GenerateVideoThumbnailLarge(ctx context.Context, videoPath string, store ThumbnailStore, ffmpegMgr *ffmpeg.Manager) (string, error) {
+	return GenerateVideoThumbnail(ctx, videoPath, store, LargeThumbnailSize, ThumbnailModeFit, ffmpegMgr)
 }
 
 // GenerateBothVideoThumbnails creates both small and large thumbnails for a video.
-// Returns relative paths to both thumbnails.
-func GenerateBothVideoThumbnails(ctx context.Context, videoPath, q2Dir string, ffmpegMgr *ffmpeg.Manager) (smallPath, largePath string, err error) {
-	smallPath, err = GenerateVideoThumbnailSmall(ctx, videoPath, q2Dir, ffmpegMgr)
+// Returns the recorded paths of both thumbnails.
+func GenerateBothVideoThumbnails(ctx context.Context, videoPath string, store ThumbnailStore, ffmpegMgr *ffmpeg.Manager) (smallPath, largePath string, err error) {
+	smallPath, err = GenerateVideoThumbnailSmall(ctx, videoPath, store, ffmpegMgr)
 	if err != nil {
 		return "", "", fmt.Errorf("small video thumbnail: %w", err)
 	}
 
-	largePath, err = GenerateVideoThumbnailLarge(ctx, videoPath, q2Dir, ffmpegMgr)
+	largePath, err = GenerateVideoThumbnailLarge(ctx, videoPath, store, ffmpegMgr)
 	if err != nil {
 		return "", "", fmt.Errorf("large video thumbnail: %w", err)
 	}
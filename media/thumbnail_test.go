@@ -0,0 +1,290 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"jukel.org/q2/ffmpeg"
+)
+
+// writeOrientedJPEG writes a w x h JPEG carrying an EXIF Orientation tag.
+func writeOrientedJPEG(t *testing.T, path string, w, h, orientation int) {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, nil); err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+
+	// Big-endian TIFF with a single IFD entry: Orientation (0x0112), SHORT
+	var tiff bytes.Buffer
+	tiff.WriteString("MM")
+	binary.Write(&tiff, binary.BigEndian, uint16(42))
+	binary.Write(&tiff, binary.BigEndian, uint32(8))
+	binary.Write(&tiff, binary.BigEndian, uint16(1))
+	binary.Write(&tiff, binary.BigEndian, []uint16{0x0112, 3})
+	binary.Write(&tiff, binary.BigEndian, uint32(1))
+	binary.Write(&tiff, binary.BigEndian, []uint16{uint16(orientation), 0})
+	binary.Write(&tiff, binary.BigEndian, uint32(0))
+
+	app1 := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:2]) // SOI
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(&out, binary.BigEndian, uint16(len(app1)+2))
+	out.Write(app1)
+	out.Write(encoded.Bytes()[2:])
+
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write JPEG: %v", err)
+	}
+}
+
+func TestExtractEXIF_Orientation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "portrait.jpg")
+	writeOrientedJPEG(t, path, 40, 20, 6)
+
+	meta, err := ExtractEXIF(path)
+	if err != nil {
+		t.Fatalf("ExtractEXIF failed: %v", err)
+	}
+	if meta.Orientation == nil || *meta.Orientation != 6 {
+		t.Errorf("Expected orientation 6, got %v", meta.Orientation)
+	}
+}
+
+func TestGenerateThumbnail_HonorsOrientation(t *testing.T) {
+	for _, bin := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not installed", bin)
+		}
+	}
+	dir := t.TempDir()
+	mgr := ffmpeg.NewManager(filepath.Join(dir, "bin"))
+
+	// A landscape-encoded 40x20 source; 90/270 degree orientations swap the dimensions
+	tests := []struct {
+		orientation int
+		wantW       int
+		wantH       int
+	}{
+		{1, 40, 20}, {2, 40, 20}, {3, 40, 20}, {4, 40, 20},
+		{5, 20, 40}, {6, 20, 40}, {7, 20, 40}, {8, 20, 40},
+	}
+	for _, tt := range tests {
+		src := filepath.Join(dir, "src", string(rune('0'+tt.orientation))+".jpg")
+		os.MkdirAll(filepath.Dir(src), 0755)
+		writeOrientedJPEG(t, src, 40, 20, tt.orientation)
+
+		rel, err := GenerateThumbnail(context.Background(), src, CentralStore{Dir: dir}, SmallThumbnailSize, ThumbnailModeFit, mgr)
+		if err != nil {
+			t.Fatalf("Orientation %d: GenerateThumbnail failed: %v", tt.orientation, err)
+		}
+		f, err := os.Open(filepath.Join(dir, rel))
+		if err != nil {
+			t.Fatalf("Orientation %d: thumbnail not written: %v", tt.orientation, err)
+		}
+		cfg, err := jpeg.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Orientation %d: cannot decode thumbnail: %v", tt.orientation, err)
+		}
+		if cfg.Width != tt.wantW || cfg.Height != tt.wantH {
+			t.Errorf("Orientation %d: expected %dx%d, got %dx%d", tt.orientation, tt.wantW, tt.wantH, cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func TestGenerateUprightImage_SwapsDimensions(t *testing.T) {
+	for _, bin := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not installed", bin)
+		}
+	}
+	dir := t.TempDir()
+	mgr := ffmpeg.NewManager(filepath.Join(dir, "bin"))
+
+	// Stored landscape, shown portrait: rotated 90 degrees clockwise
+	src := filepath.Join(dir, "portrait.jpg")
+	writeOrientedJPEG(t, src, 40, 20, 6)
+	rel, err := GenerateUprightImage(context.Background(), src, dir, 6, mgr)
+	if err != nil {
+		t.Fatalf("GenerateUprightImage failed: %v", err)
+	}
+	if rel != GetUprightPath(src) {
+		t.Errorf("Expected the copy at %s, got %s", GetUprightPath(src), rel)
+	}
+
+	upright := filepath.Join(dir, rel)
+	f, err := os.Open(upright)
+	if err != nil {
+		t.Fatalf("Copy not written: %v", err)
+	}
+	cfg, err := jpeg.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Cannot decode copy: %v", err)
+	}
+	if cfg.Width != 20 || cfg.Height != 40 {
+		t.Errorf("Expected 20x40, got %dx%d", cfg.Width, cfg.Height)
+	}
+	if meta, err := ExtractEXIF(upright); err != nil || meta.Orientation != nil {
+		t.Errorf("Expected no EXIF Orientation left, got %v (%v)", meta.Orientation, err)
+	}
+}
+
+func TestGenerateThumbnail_CropMode(t *testing.T) {
+	dir := t.TempDir()
+	mgr := enrichTestManager(t, dir)
+	store := CentralStore{Dir: filepath.Join(dir, ".q2")}
+
+	photo := filepath.Join(dir, "photo.jpg")
+	writeOrientedJPEG(t, photo, 40, 20, 1)
+	fit, err := GenerateThumbnail(context.Background(), photo, store, SmallThumbnailSize, ThumbnailModeFit, mgr)
+	if err != nil {
+		t.Fatalf("GenerateThumbnail (fit) failed: %v", err)
+	}
+	crop, err := GenerateThumbnail(context.Background(), photo, store, SmallThumbnailSize, ThumbnailModeCrop, mgr)
+	if err != nil {
+		t.Fatalf("GenerateThumbnail (crop) failed: %v", err)
+	}
+
+	// Both modes coexist, the cropped one beside the fit one
+	if fit != GetThumbnailPath(photo, SmallThumbnailSize, ThumbnailFormatJPEG) {
+		t.Errorf("Expected the fit thumbnail at its usual path, got %s", fit)
+	}
+	if want := strings.TrimSuffix(fit, ".jpg") + "_crop.jpg"; crop != want {
+		t.Errorf("Expected the cropped thumbnail at %s, got %s", want, crop)
+	}
+	for _, rel := range []string{fit, crop} {
+		if _, err := os.Stat(store.FullPath(rel)); err != nil {
+			t.Errorf("Expected %s on disk: %v", rel, err)
+		}
+	}
+
+	// Deleting the recorded thumbnail takes its cropped counterpart along
+	if err := DeleteThumbnail(fit, store.Dir); err != nil {
+		t.Fatalf("DeleteThumbnail failed: %v", err)
+	}
+	for _, rel := range []string{fit, crop} {
+		if _, err := os.Stat(store.FullPath(rel)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be deleted", rel)
+		}
+	}
+}
+
+func TestGenerateThumbnailSizes(t *testing.T) {
+	dir := t.TempDir()
+	mgr := enrichTestManager(t, dir)
+	store := CentralStore{Dir: filepath.Join(dir, ".q2")}
+
+	photo := filepath.Join(dir, "photo.jpg")
+	writeOrientedJPEG(t, photo, 40, 20, 1)
+	sizes := []int{128, 256, 1024}
+	paths, err := GenerateThumbnailSizes(context.Background(), photo, store, sizes, mgr)
+	if err != nil {
+		t.Fatalf("GenerateThumbnailSizes failed: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, size := range sizes {
+		rel, ok := paths[size]
+		if !ok {
+			t.Fatalf("No path for size %d", size)
+		}
+		if want := GetThumbnailPath(photo, size, ThumbnailFormatJPEG); rel != want {
+			t.Errorf("Size %d: expected %s, got %s", size, want, rel)
+		}
+		if seen[rel] {
+			t.Errorf("Size %d shares its file %s with another size", size, rel)
+		}
+		seen[rel] = true
+		if _, err := os.Stat(store.FullPath(rel)); err != nil {
+			t.Errorf("Size %d: expected %s on disk: %v", size, rel, err)
+		}
+	}
+
+	if _, err := GenerateThumbnailSizes(context.Background(), photo, store, []int{0}, mgr); err == nil {
+		t.Error("Expected an error for a zero size")
+	}
+}
+
+func TestNearestThumbnailSize(t *testing.T) {
+	for w, want := range map[int]int{1: 128, 128: 128, 200: 256, 500: SmallThumbnailSize, 1500: LargeThumbnailSize, 10000: 2560} {
+		if got := NearestThumbnailSize(w); got != want {
+			t.Errorf("NearestThumbnailSize(%d) = %d, want %d", w, got, want)
+		}
+	}
+}
+
+func TestParseThumbnailMode(t *testing.T) {
+	for in, want := range map[string]string{"": ThumbnailModeFit, "fit": ThumbnailModeFit, " Crop ": ThumbnailModeCrop} {
+		if got, err := ParseThumbnailMode(in); err != nil || got != want {
+			t.Errorf("ParseThumbnailMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseThumbnailMode("stretch"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+func TestGenerateThumbnail_WebP(t *testing.T) {
+	for _, bin := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not installed", bin)
+		}
+	}
+	dir := t.TempDir()
+	mgr := ffmpeg.NewManager(filepath.Join(dir, "bin"))
+	if !mgr.SupportsThumbnailFormat(context.Background(), ThumbnailFormatWebP) {
+		t.Skip("ffmpeg built without libwebp")
+	}
+	store := CentralStore{Dir: filepath.Join(dir, ".q2"), Format: ThumbnailFormatWebP}
+
+	photo := filepath.Join(dir, "photo.jpg")
+	writeOrientedJPEG(t, photo, 40, 20, 1)
+	rel, err := GenerateThumbnail(context.Background(), photo, store, SmallThumbnailSize, ThumbnailModeFit, mgr)
+	if err != nil {
+		t.Fatalf("GenerateThumbnail failed: %v", err)
+	}
+	if want := GetThumbnailPath(photo, SmallThumbnailSize, ThumbnailFormatWebP); rel != want {
+		t.Errorf("Expected the thumbnail at %s, got %s", want, rel)
+	}
+
+	data, err := os.ReadFile(store.FullPath(rel))
+	if err != nil {
+		t.Fatalf("Thumbnail not written: %v", err)
+	}
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		t.Errorf("Expected a WebP file, got header %q", data[:min(len(data), 12)])
+	}
+	if found, ok := store.Find(photo, SmallThumbnailSize); !ok || found != rel {
+		t.Errorf("Find = %s, %v; want %s", found, ok, rel)
+	}
+}
+
+func TestParseThumbnailFormat(t *testing.T) {
+	for in, want := range map[string]string{"": ThumbnailFormatJPEG, "jpg": ThumbnailFormatJPEG, " WebP ": ThumbnailFormatWebP, "avif": ThumbnailFormatAVIF} {
+		if got, err := ParseThumbnailFormat(in); err != nil || got != want {
+			t.Errorf("ParseThumbnailFormat(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseThumbnailFormat("png"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
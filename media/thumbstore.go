@@ -0,0 +1,139 @@
+package media
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/scanner"
+)
+
+// Thumbnail placements, as stored in the thumbnail_store setting.
+const (
+	PlacementCentral = "central" // Under .q2/thumbnails (default)
+	PlacementSidecar = "sidecar" // In a .q2thumbs folder next to each original
+)
+
+// ThumbnailStore decides where thumbnails are written and where they are found.
+// The paths it records in the files table are relative to the q2 directory for
+// the central cache and absolute for thumbnails kept elsewhere.
+type ThumbnailStore interface {
+	// Path returns the recorded path to write the thumbnail of sourcePath
+	// at size to, creating its directory.
+	Path(sourcePath string, size int) (string, error)
+	// FullPath resolves a recorded thumbnail path to a file path.
+	FullPath(recorded string) string
+	// Find returns the recorded path of an existing thumbnail of sourcePath at size.
+	Find(sourcePath string, size int) (string, bool)
+}
+
+// NewThumbnailStore returns the store for placement, writing thumbnails in
+// format. Sidecar thumbnails fall back to the central cache under q2Dir for
+// folders that cannot be written.
+func NewThumbnailStore(placement, format, q2Dir string) (ThumbnailStore, error) {
+	format, err := ParseThumbnailFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	central := CentralStore{Dir: q2Dir, Format: format}
+	switch strings.ToLower(strings.TrimSpace(placement)) {
+	case "", PlacementCentral:
+		return central, nil
+	case PlacementSidecar:
+		return SidecarStore{Fallback: central}, nil
+	}
+	return nil, fmt.Errorf("invalid thumbnail placement %q (must be %s or %s)", placement, PlacementCentral, PlacementSidecar)
+}
+
+// CentralStore keeps every thumbnail under Dir/thumbnails, named by a hash
+// of the source path.
+type CentralStore struct {
+	Dir    string // The q2 directory
+	Format string // ThumbnailFormatJPEG (the default if empty), ThumbnailFormatWebP or ThumbnailFormatAVIF
+}
+
+func (s CentralStore) Path(sourcePath string, size int) (string, error) {
+	rel := GetThumbnailPath(sourcePath, size, s.Format)
+	if err := os.MkdirAll(filepath.Dir(s.FullPath(rel)), 0755); err != nil {
+		return "", fmt.Errorf("failed to create thumbnail directory: %w", err)
+	}
+	return rel, nil
+}
+
+func (s CentralStore) FullPath(recorded string) string {
+	if filepath.IsAbs(recorded) {
+		return recorded
+	}
+	return filepath.Join(s.Dir, recorded)
+}
+
+func (s CentralStore) Find(sourcePath string, size int) (string, bool) {
+	for _, format := range thumbnailFormats(s.Format) {
+		rel := GetThumbnailPath(sourcePath, size, format)
+		if _, err := os.Stat(s.FullPath(rel)); err == nil {
+			return rel, true
+		}
+	}
+	return GetThumbnailPath(sourcePath, size, s.Format), false
+}
+
+// thumbnailFormats returns the formats a thumbnail in format may have been
+// written in: format itself and JPEG, which album art, ffmpeg builds without
+// the format's encoder and thumbnails made before the format changed use.
+func thumbnailFormats(format string) []string {
+	if format == "" || format == ThumbnailFormatJPEG {
+		return []string{ThumbnailFormatJPEG}
+	}
+	return []string{format, ThumbnailFormatJPEG}
+}
+
+// SidecarStore keeps thumbnails in a .q2thumbs folder beside the originals,
+// so they travel with the media and survive losing the central cache.
+// Read-only source folders use Fallback instead.
+type SidecarStore struct {
+	Fallback CentralStore
+}
+
+// SidecarThumbnailPath returns where SidecarStore keeps the thumbnail of sourcePath in format.
+func SidecarThumbnailPath(sourcePath string, size int, format string) string {
+	return filepath.Join(filepath.Dir(sourcePath), scanner.ThumbnailSidecarDir,
+		fmt.Sprintf("%s_%d%s", filepath.Base(sourcePath), size, ffmpeg.ThumbnailExtension(format)))
+}
+
+func (s SidecarStore) Path(sourcePath string, size int) (string, error) {
+	path := SidecarThumbnailPath(sourcePath, size, s.Fallback.Format)
+	if writableDir(filepath.Dir(path)) {
+		return path, nil
+	}
+	return s.Fallback.Path(sourcePath, size)
+}
+
+func (s SidecarStore) FullPath(recorded string) string {
+	return s.Fallback.FullPath(recorded)
+}
+
+func (s SidecarStore) Find(sourcePath string, size int) (string, bool) {
+	for _, format := range thumbnailFormats(s.Fallback.Format) {
+		path := SidecarThumbnailPath(sourcePath, size, format)
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return s.Fallback.Find(sourcePath, size)
+}
+
+// writableDir creates dir if needed and reports whether files can be created in it.
+func writableDir(dir string) bool {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false
+	}
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return true
+}
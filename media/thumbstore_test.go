@@ -0,0 +1,116 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewThumbnailStore(t *testing.T) {
+	for placement, wantSidecar := range map[string]bool{"": false, "central": false, "Sidecar": true} {
+		store, err := NewThumbnailStore(placement, "", "/q2")
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", placement, err)
+			continue
+		}
+		if _, isSidecar := store.(SidecarStore); isSidecar != wantSidecar {
+			t.Errorf("%q: got %T", placement, store)
+		}
+	}
+	if _, err := NewThumbnailStore("nearby", "", "/q2"); err == nil {
+		t.Error("Expected an error for an unknown placement")
+	}
+}
+
+func TestSidecarStore_WritesNextToOriginal(t *testing.T) {
+	dir := t.TempDir()
+	q2Dir := filepath.Join(dir, ".q2")
+	store := SidecarStore{Fallback: CentralStore{Dir: q2Dir}}
+
+	audioPath := filepath.Join(dir, "album", "track.mp3")
+	os.MkdirAll(filepath.Dir(audioPath), 0755)
+	writeMP3Fixture(t, audioPath, testPNG(t, 800, 800), "image/png")
+
+	smallPath, _, err := GenerateBothAlbumArtThumbnails(audioPath, store)
+	if err != nil {
+		t.Fatalf("GenerateBothAlbumArtThumbnails failed: %v", err)
+	}
+	want := filepath.Join(dir, "album", ".q2thumbs", "track.mp3_500.jpg")
+	if smallPath != want {
+		t.Errorf("Expected sidecar thumbnail %s, got %s", want, smallPath)
+	}
+	if _, err := os.Stat(store.FullPath(smallPath)); err != nil {
+		t.Errorf("Sidecar thumbnail not written: %v", err)
+	}
+	if found, ok := store.Find(audioPath, SmallThumbnailSize); !ok || found != smallPath {
+		t.Errorf("Find = %q, %v; want %q", found, ok, smallPath)
+	}
+	if _, err := os.Stat(filepath.Join(q2Dir, ThumbnailDir)); !os.IsNotExist(err) {
+		t.Error("Expected nothing written to the central cache")
+	}
+
+	// Tracks without art leave no sidecar folder behind
+	plain := filepath.Join(dir, "singles", "plain.mp3")
+	os.MkdirAll(filepath.Dir(plain), 0755)
+	writeMP3Fixture(t, plain, nil, "")
+	GenerateBothAlbumArtThumbnails(plain, store)
+	if _, err := os.Stat(filepath.Join(dir, "singles", ".q2thumbs")); !os.IsNotExist(err) {
+		t.Error("Expected no sidecar folder for a track without art")
+	}
+}
+
+func TestSidecarStore_ReadOnlyFolderFallsBack(t *testing.T) {
+	dir := t.TempDir()
+	q2Dir := filepath.Join(dir, ".q2")
+	store := SidecarStore{Fallback: CentralStore{Dir: q2Dir}}
+
+	readOnly := filepath.Join(dir, "readonly")
+	os.MkdirAll(readOnly, 0755)
+	audioPath := filepath.Join(readOnly, "track.mp3")
+	writeMP3Fixture(t, audioPath, testPNG(t, 100, 100), "image/png")
+	if err := os.Chmod(readOnly, 0555); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	defer os.Chmod(readOnly, 0755)
+	if writableDir(filepath.Join(readOnly, ".q2thumbs")) {
+		t.Skip("folder is still writable (running as root?)")
+	}
+
+	smallPath, _, err := GenerateBothAlbumArtThumbnails(audioPath, store)
+	if err != nil {
+		t.Fatalf("GenerateBothAlbumArtThumbnails failed: %v", err)
+	}
+	if smallPath != GetThumbnailPath(audioPath, SmallThumbnailSize, ThumbnailFormatJPEG) {
+		t.Errorf("Expected fallback to the central cache, got %s", smallPath)
+	}
+	if found, ok := store.Find(audioPath, SmallThumbnailSize); !ok || found != smallPath {
+		t.Errorf("Find = %q, %v; want central %q", found, ok, smallPath)
+	}
+}
+
+func TestCentralStore_FindFallsBackToJPEG(t *testing.T) {
+	dir := t.TempDir()
+	store := CentralStore{Dir: dir, Format: ThumbnailFormatAVIF}
+	source := "/photos/beach.jpg"
+
+	// Made before the format changed, or by ffmpeg without an AVIF encoder
+	jpegPath := GetThumbnailPath(source, SmallThumbnailSize, ThumbnailFormatJPEG)
+	os.MkdirAll(filepath.Dir(store.FullPath(jpegPath)), 0755)
+	if err := os.WriteFile(store.FullPath(jpegPath), []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := store.Find(source, SmallThumbnailSize); !ok || found != jpegPath {
+		t.Errorf("Find = %s, %v; want the JPEG %s", found, ok, jpegPath)
+	}
+
+	avifPath := GetThumbnailPath(source, SmallThumbnailSize, ThumbnailFormatAVIF)
+	if filepath.Ext(avifPath) != ".avif" {
+		t.Errorf("Expected an .avif path, got %s", avifPath)
+	}
+	if err := os.WriteFile(store.FullPath(avifPath), []byte("avif"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := store.Find(source, SmallThumbnailSize); !ok || found != avifPath {
+		t.Errorf("Find = %s, %v; want the AVIF %s", found, ok, avifPath)
+	}
+}
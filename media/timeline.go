@@ -0,0 +1,68 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"jukel.org/q2/db"
+)
+
+// Timeline granularities.
+const (
+	TimelineYear  = "year"
+	TimelineMonth = "month"
+	TimelineDay   = "day"
+)
+
+// ErrInvalidGranularity is returned by Timeline for unknown granularities.
+var ErrInvalidGranularity = errors.New("invalid granularity")
+
+// timelinePrefixes is how much of a stored timestamp names each
+// granularity's period: "2024", "2024-06" or "2024-06-30".
+var timelinePrefixes = map[string]int{TimelineYear: 4, TimelineMonth: 7, TimelineDay: 10}
+
+// TimelinePeriod is a year, month or day and how many photos were taken in it.
+type TimelinePeriod struct {
+	Period string `json:"period"` // "2024", "2024-06" or "2024-06-30"
+	Count  int64  `json:"count"`
+}
+
+// timelineQuery groups photos by the start of their EXIF date, or of their
+// file date for photos without one. Both are stored as text beginning
+// YYYY-MM-DD in the time the photo or file recorded, so cutting the text
+// keeps that day instead of SQLite's date functions converting it to UTC.
+// Files indexed by the metadata refresh are typed image rather than IMG.
+const timelineQuery = `
+	SELECT substr(COALESCE(m.date_taken, f.created_at), 1, ?) AS period, COUNT(*)
+	FROM files f
+	LEFT JOIN image_metadata m ON m.file_id = f.id
+	WHERE f.mediatype IN ('IMG', 'image') AND COALESCE(m.date_taken, f.created_at) IS NOT NULL AND f.deleted_at IS NULL
+	GROUP BY period
+	ORDER BY period DESC`
+
+// Timeline counts the indexed photos per year, month or day they were
+// taken, newest first. Photos without an EXIF date count under the date of
+// their file.
+func Timeline(database *db.DB, granularity string) ([]TimelinePeriod, error) {
+	n, ok := timelinePrefixes[strings.ToLower(strings.TrimSpace(granularity))]
+	if !ok {
+		return nil, fmt.Errorf("%w %q (must be %s, %s or %s)", ErrInvalidGranularity, granularity, TimelineYear, TimelineMonth, TimelineDay)
+	}
+
+	rows, err := database.Query(timelineQuery, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := []TimelinePeriod{}
+	for rows.Next() {
+		var p TimelinePeriod
+		if err := rows.Scan(&p.Period, &p.Count); err != nil {
+			return nil, err
+		}
+		periods = append(periods, p)
+	}
+	return periods, rows.Err()
+}
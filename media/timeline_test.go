@@ -0,0 +1,70 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"jukel.org/q2/db"
+	_ "jukel.org/q2/migrations"
+)
+
+func TestTimeline(t *testing.T) {
+	database, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+	folder := database.Write("INSERT INTO folders (path) VALUES ('/photos')")
+	if folder.Err != nil {
+		t.Fatalf("Failed to insert folder: %v", folder.Err)
+	}
+
+	pacific := time.FixedZone("PDT", -7*3600)
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 12, 0, 0, 0, time.UTC) }
+	add := func(name, mediaType string, created time.Time, taken *time.Time) {
+		t.Helper()
+		r := database.Write("INSERT INTO files (folder_id, path, filename, mediatype, size, created_at) VALUES (?, ?, ?, ?, 0, ?)",
+			folder.LastInsertID, "/photos/"+name, name, mediaType, created)
+		if r.Err != nil {
+			t.Fatalf("Failed to insert %s: %v", name, r.Err)
+		}
+		if r := database.Write("INSERT INTO image_metadata (file_id, date_taken) VALUES (?, ?)", r.LastInsertID, taken); r.Err != nil {
+			t.Fatalf("Failed to insert metadata of %s: %v", name, r.Err)
+		}
+	}
+	may10, may20 := day(2024, time.May, 10), day(2024, time.May, 20)
+	add("a.jpg", "IMG", day(2024, time.July, 1), &may10) // The EXIF date wins over the file date
+	add("b.jpg", "image", day(2024, time.July, 1), &may20)
+	add("c.jpg", "IMG", day(2024, time.June, 3), nil)
+	// Late evening in its own zone, already the next day in UTC
+	add("d.jpg", "IMG", time.Date(2024, time.June, 30, 23, 30, 0, 0, pacific), nil)
+	add("song.mp3", "AUD", day(2024, time.June, 3), nil)
+	if r := database.Write("INSERT INTO files (folder_id, path, filename, mediatype, size, created_at) VALUES (?, '/photos/e.jpg', 'e.jpg', 'IMG', 0, ?)",
+		folder.LastInsertID, day(2023, time.December, 25)); r.Err != nil {
+		t.Fatalf("Failed to insert e.jpg: %v", r.Err)
+	}
+
+	for granularity, want := range map[string]string{
+		TimelineMonth: "[{2024-06 2} {2024-05 2} {2023-12 1}]",
+		TimelineYear:  "[{2024 4} {2023 1}]",
+		TimelineDay:   "[{2024-06-30 1} {2024-06-03 1} {2024-05-20 1} {2024-05-10 1} {2023-12-25 1}]",
+	} {
+		periods, err := Timeline(database, granularity)
+		if err != nil {
+			t.Fatalf("Timeline(%s) failed: %v", granularity, err)
+		}
+		if got := fmt.Sprint(periods); got != want {
+			t.Errorf("Timeline(%s) = %s, want %s", granularity, got, want)
+		}
+	}
+
+	if _, err := Timeline(database, "week"); !errors.Is(err, ErrInvalidGranularity) {
+		t.Errorf("Expected ErrInvalidGranularity, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/scanner"
+)
+
+// UprightQuality is the FFmpeg qscale:v of upright copies: near the
+// original's quality, as they stand in for it.
+const UprightQuality = 2
+
+// GetUprightPath returns where the upright copy of an image is cached,
+// relative to the q2 directory: beside its thumbnails in the central cache.
+func GetUprightPath(imagePath string) string {
+	hash := thumbnailHash(imagePath)
+	return filepath.Join(ThumbnailDir, getHashSubfolder(hash), hash+"_upright.jpg")
+}
+
+// GenerateUprightImage writes a full-size JPEG copy of an image turned
+// upright according to orientation, its EXIF Orientation value, without the
+// EXIF data, so browsers that do and do not honor the tag show it the same.
+// Returns the copy's path relative to q2Dir.
+// Skips generation if the copy exists and is newer than the source file.
+func GenerateUprightImage(ctx context.Context, imagePath, q2Dir string, orientation int, ffmpegMgr *ffmpeg.Manager) (string, error) {
+	if ffmpegMgr == nil {
+		return "", fmt.Errorf("ffmpeg manager not available")
+	}
+
+	srcInfo, err := os.Stat(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("cannot stat source file: %w", err)
+	}
+
+	relPath := GetUprightPath(imagePath)
+	fullPath := filepath.Join(q2Dir, relPath)
+	if info, err := os.Stat(fullPath); err == nil && info.ModTime().After(srcInfo.ModTime()) {
+		return relPath, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create thumbnail directory: %w", err)
+	}
+
+	if err := ffmpegMgr.RotateImage(ctx, scanner.LongPath(imagePath), scanner.LongPath(fullPath), orientation, UprightQuality); err != nil {
+		return "", fmt.Errorf("failed to rotate image: %w", err)
+	}
+	return relPath, nil
+}
@@ -0,0 +1,186 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"jukel.org/q2/db"
+)
+
+// XMP namespaces of the properties read.
+const (
+	xmpDCNamespace  = "http://purl.org/dc/elements/1.1/"
+	xmpRDFNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+)
+
+// xmpJPEGHeader starts the APP1 segment of a JPEG that holds its XMP packet.
+const xmpJPEGHeader = "http://ns.adobe.com/xap/1.0/\x00"
+
+// XMPMetadata is what photo managers such as Lightroom record about an
+// image in its XMP metadata, which EXIF does not carry.
+type XMPMetadata struct {
+	Keywords []string // dc:subject, in order, without duplicates
+	Caption  *string  // dc:description, in the default language
+}
+
+// ExtractXMP reads the XMP metadata of an image: the packet embedded in a
+// JPEG, or for other formats, such as camera RAW files, a sidecar beside it
+// named photo.xmp or photo.cr2.xmp. Images without XMP give empty metadata.
+func ExtractXMP(imagePath string) (*XMPMetadata, error) {
+	var packet []byte
+	if ext := strings.ToLower(filepath.Ext(imagePath)); ext == ".jpg" || ext == ".jpeg" {
+		var err error
+		if packet, err = readJPEGXMP(imagePath); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, sidecar := range []string{strings.TrimSuffix(imagePath, filepath.Ext(imagePath)) + ".xmp", imagePath + ".xmp"} {
+			if data, err := os.ReadFile(sidecar); err == nil {
+				packet = data
+				break
+			}
+		}
+	}
+	if packet == nil {
+		return &XMPMetadata{}, nil
+	}
+	return parseXMP(packet)
+}
+
+// ExtractXMPKeywords returns the keywords an image is tagged with in its XMP metadata.
+func ExtractXMPKeywords(imagePath string) ([]string, error) {
+	meta, err := ExtractXMP(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	return meta.Keywords, nil
+}
+
+// readJPEGXMP returns the XMP packet of the JPEG at path, or nil if it has
+// none. Only the segments before the image data are read.
+func readJPEGXMP(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, fmt.Errorf("not a JPEG file")
+	}
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xff {
+			return nil, nil // Truncated or malformed; no XMP found before it
+		}
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return nil, nil // Start of scan or end of image: no more metadata
+		}
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return nil, nil
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, nil
+		}
+		if marker[1] == 0xe1 && bytes.HasPrefix(segment, []byte(xmpJPEGHeader)) {
+			return segment[len(xmpJPEGHeader):], nil
+		}
+	}
+}
+
+// parseXMP reads the keywords and caption from an XMP packet. Both are RDF
+// containers of rdf:li items: a bag of keywords, and alternative captions
+// per language, of which x-default is preferred.
+func parseXMP(packet []byte) (*XMPMetadata, error) {
+	meta := &XMPMetadata{}
+	seen := make(map[string]bool)
+	dec := xml.NewDecoder(bytes.NewReader(packet))
+
+	var property string // dc:subject or dc:description while inside one
+	var inItem bool
+	var lang string
+	var text strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return meta, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid XMP: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case t.Name.Space == xmpDCNamespace && (t.Name.Local == "subject" || t.Name.Local == "description"):
+				property = t.Name.Local
+			case property != "" && t.Name.Space == xmpRDFNamespace && t.Name.Local == "li":
+				inItem, lang = true, ""
+				text.Reset()
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "lang" {
+						lang = attr.Value
+					}
+				}
+			}
+		case xml.CharData:
+			if inItem {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			switch {
+			case inItem && t.Name.Space == xmpRDFNamespace && t.Name.Local == "li":
+				inItem = false
+				value := strings.TrimSpace(text.String())
+				switch {
+				case value == "":
+				case property == "subject" && !seen[strings.ToLower(value)]:
+					seen[strings.ToLower(value)] = true
+					meta.Keywords = append(meta.Keywords, value)
+				case property == "description" && (meta.Caption == nil || lang == "x-default"):
+					meta.Caption = &value
+				}
+			case t.Name.Space == xmpDCNamespace && t.Name.Local == property:
+				property = ""
+			}
+		}
+	}
+}
+
+// SaveImageTags records an image's XMP keywords as its tags, replacing those
+// it had, and its caption in image_metadata.
+func SaveImageTags(database *db.DB, fileID int64, meta *XMPMetadata) error {
+	return database.Transaction(func(tx *db.DB) error {
+		if err := tx.Write(`
+			INSERT INTO image_metadata (file_id, caption) VALUES (?, ?)
+			ON CONFLICT(file_id) DO UPDATE SET caption = excluded.caption`,
+			fileID, meta.Caption).Err; err != nil {
+			return err
+		}
+		if err := tx.Write("DELETE FROM image_tags WHERE file_id = ?", fileID).Err; err != nil {
+			return err
+		}
+		for _, keyword := range meta.Keywords {
+			if err := tx.Write("INSERT OR IGNORE INTO tags (name) VALUES (?)", keyword).Err; err != nil {
+				return err
+			}
+			if err := tx.Write(
+				"INSERT OR IGNORE INTO image_tags (file_id, tag_id) SELECT ?, id FROM tags WHERE name = ?",
+				fileID, keyword).Err; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,132 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"jukel.org/q2/db"
+)
+
+// testXMP is a Lightroom-style XMP packet with three keywords, one repeated
+// in another case, and a caption in two languages.
+const testXMP = `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">
+   <dc:subject>
+    <rdf:Bag>
+     <rdf:li>sunset</rdf:li>
+     <rdf:li>beach</rdf:li>
+     <rdf:li>Sunset</rdf:li>
+     <rdf:li>family &amp; friends</rdf:li>
+    </rdf:Bag>
+   </dc:subject>
+   <dc:description>
+    <rdf:Alt>
+     <rdf:li xml:lang="fr-FR">Coucher de soleil</rdf:li>
+     <rdf:li xml:lang="x-default">Sunset over the bay</rdf:li>
+    </rdf:Alt>
+   </dc:description>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+// writeXMPJPEG writes a small JPEG carrying packet in an XMP APP1 segment.
+func writeXMPJPEG(t *testing.T, path, packet string) {
+	t.Helper()
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+	app1 := append([]byte(xmpJPEGHeader), packet...)
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:2]) // SOI
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(&out, binary.BigEndian, uint16(len(app1)+2))
+	out.Write(app1)
+	out.Write(encoded.Bytes()[2:])
+
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write JPEG: %v", err)
+	}
+}
+
+func TestExtractXMP(t *testing.T) {
+	dir := t.TempDir()
+	photo := filepath.Join(dir, "beach.jpg")
+	writeXMPJPEG(t, photo, testXMP)
+
+	meta, err := ExtractXMP(photo)
+	if err != nil {
+		t.Fatalf("ExtractXMP failed: %v", err)
+	}
+	if want := []string{"sunset", "beach", "family & friends"}; !slices.Equal(meta.Keywords, want) {
+		t.Errorf("Expected keywords %q, got %q", want, meta.Keywords)
+	}
+	if meta.Caption == nil || *meta.Caption != "Sunset over the bay" {
+		t.Errorf("Expected the x-default caption, got %v", meta.Caption)
+	}
+
+	// A RAW file's keywords are in its sidecar
+	raw := filepath.Join(dir, "IMG_0001.CR2")
+	os.WriteFile(raw, []byte("raw"), 0644)
+	os.WriteFile(filepath.Join(dir, "IMG_0001.xmp"), []byte(testXMP), 0644)
+	if keywords, err := ExtractXMPKeywords(raw); err != nil || len(keywords) != 3 {
+		t.Errorf("Expected the sidecar's 3 keywords, got %q (%v)", keywords, err)
+	}
+
+	// Images without XMP have no keywords
+	plain := filepath.Join(dir, "plain.jpg")
+	writeOrientedJPEG(t, plain, 8, 8, 1)
+	if meta, err := ExtractXMP(plain); err != nil || len(meta.Keywords) != 0 || meta.Caption != nil {
+		t.Errorf("Expected empty metadata, got %+v (%v)", meta, err)
+	}
+}
+
+func TestSaveImageTags(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+	database.Write("INSERT INTO folders (path) VALUES ('/photos')")
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		database.Write("INSERT INTO files (folder_id, path, filename, size) VALUES (1, ?, ?, 1)", "/photos/"+name, name)
+	}
+
+	caption := "At the beach"
+	if err := SaveImageTags(database, 1, &XMPMetadata{Keywords: []string{"sunset", "beach"}, Caption: &caption}); err != nil {
+		t.Fatalf("SaveImageTags failed: %v", err)
+	}
+	if err := SaveImageTags(database, 2, &XMPMetadata{Keywords: []string{"SUNSET"}}); err != nil {
+		t.Fatalf("SaveImageTags failed: %v", err)
+	}
+	// Saving again replaces the file's tags
+	if err := SaveImageTags(database, 1, &XMPMetadata{Keywords: []string{"sunset"}, Caption: &caption}); err != nil {
+		t.Fatalf("SaveImageTags failed: %v", err)
+	}
+
+	var tags, links int
+	database.QueryRow("SELECT COUNT(*) FROM tags").Scan(&tags)
+	database.QueryRow("SELECT COUNT(*) FROM image_tags").Scan(&links)
+	if tags != 2 || links != 2 {
+		t.Errorf("Expected 2 tags shared by 2 links, got %d and %d", tags, links)
+	}
+	var stored string
+	database.QueryRow("SELECT caption FROM image_metadata WHERE file_id = 1").Scan(&stored)
+	if stored != caption {
+		t.Errorf("Expected caption %q, got %q", caption, stored)
+	}
+}
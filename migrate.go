@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"jukel.org/q2/db"
+)
+
+// errNoDatabase is returned by migrateDown when baseDir holds no database.
+var errNoDatabase = errors.New("no database to migrate")
+
+// openUnmigrated opens the database in baseDir without migrating it, for
+// inspecting migrations. A missing database is not created: an empty one in
+// a temporary directory stands in for it. closeDB closes and removes it.
+func openUnmigrated(baseDir string) (database *db.DB, closeDB func(), err error) {
+	dbPath := filepath.Join(baseDir, dbFile)
+	dir := ""
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		if dir, err = os.MkdirTemp("", "q2-plan-*"); err != nil {
+			return nil, nil, err
+		}
+		dbPath = filepath.Join(dir, dbFile)
+	}
+
+	database, err = db.Open(dbPath)
+	if err != nil {
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
+		return nil, nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	return database, func() {
+		database.Close()
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
+	}, nil
+}
+
+// planMigrations returns the IDs of the migrations initDB would apply to the
+// database in baseDir, in order, without applying them. A missing database
+// is not created; every migration would run on it.
+func planMigrations(baseDir string) ([]string, error) {
+	database, closeDB, err := openUnmigrated(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	defer closeDB()
+	return database.PlanMigrations()
+}
+
+// migrateUp applies the pending migrations to the database in baseDir, as
+// initDB does, and lists them on w. With dryRun it only lists them.
+func migrateUp(baseDir string, dryRun bool, w io.Writer) error {
+	plan, err := planMigrations(baseDir)
+	if err != nil {
+		return fmt.Errorf("failed to plan migrations: %w", err)
+	}
+	if len(plan) == 0 {
+		fmt.Fprintln(w, "Database is up to date")
+		return nil
+	}
+	if dryRun {
+		fmt.Fprintf(w, "%d migrations would run:\n", len(plan))
+		for _, id := range plan {
+			fmt.Fprintln(w, " ", id)
+		}
+		return nil
+	}
+
+	database, err := initDB(baseDir)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	for _, id := range plan {
+		fmt.Fprintln(w, "Applied", id)
+	}
+	return nil
+}
+
+// migrateDown rolls back the last n migrations applied to the database in
+// baseDir, newest first, and lists them on w. The next command to open the
+// database applies them again, so this is for going back to an older q2.
+func migrateDown(baseDir string, n int, w io.Writer) error {
+	if n < 1 {
+		return fmt.Errorf("cannot roll back %d migrations", n)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, dbFile)); os.IsNotExist(err) {
+		return errNoDatabase
+	}
+	database, closeDB, err := openUnmigrated(baseDir)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	before, err := database.GetAppliedMigrations()
+	if err != nil {
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	migrateErr := database.MigrateDown(min(n, len(before)))
+	after, err := database.GetAppliedMigrations()
+	if err != nil {
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	// Report what was rolled back even if a later rollback failed
+	for _, id := range slices.Backward(before) {
+		if !slices.Contains(after, id) {
+			fmt.Fprintln(w, "Rolled back", id)
+		}
+	}
+	if len(before) == 0 {
+		fmt.Fprintln(w, "No migrations applied")
+	}
+	return migrateErr
+}
+
+// migrateStatus lists every migration of the database in baseDir on w, in
+// order, as applied or pending.
+func migrateStatus(baseDir string, w io.Writer) error {
+	database, closeDB, err := openUnmigrated(baseDir)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	applied, err := database.GetAppliedMigrations()
+	if err != nil {
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	pending, err := database.PlanMigrations()
+	if err != nil {
+		return fmt.Errorf("failed to get pending migrations: %w", err)
+	}
+
+	for _, id := range applied {
+		fmt.Fprintf(w, "applied  %s\n", id)
+	}
+	for _, id := range pending {
+		fmt.Fprintf(w, "pending  %s\n", id)
+	}
+	fmt.Fprintf(w, "%d applied, %d pending\n", len(applied), len(pending))
+	return nil
+}
@@ -0,0 +1,15 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "013_add_folder_library_type",
+		Up: func(d *db.DB) error {
+			return d.Write(`ALTER TABLE folders ADD COLUMN library_type TEXT NOT NULL DEFAULT 'mixed'`).Err
+		},
+		Down: func(d *db.DB) error {
+			return d.Write(`ALTER TABLE folders DROP COLUMN library_type`).Err
+		},
+	})
+}
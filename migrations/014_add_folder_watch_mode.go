@@ -0,0 +1,34 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "014_add_folder_watch_mode",
+		Up: func(d *db.DB) error {
+			stmts := []string{
+				`ALTER TABLE folders ADD COLUMN watch_mode TEXT NOT NULL DEFAULT 'auto'`,
+				// Seconds between rescans of a poll-mode folder; 0 uses the server default
+				`ALTER TABLE folders ADD COLUMN poll_interval INTEGER NOT NULL DEFAULT 0`,
+			}
+			for _, s := range stmts {
+				if r := d.Write(s); r.Err != nil {
+					return r.Err
+				}
+			}
+			return nil
+		},
+		Down: func(d *db.DB) error {
+			stmts := []string{
+				`ALTER TABLE folders DROP COLUMN poll_interval`,
+				`ALTER TABLE folders DROP COLUMN watch_mode`,
+			}
+			for _, s := range stmts {
+				if r := d.Write(s); r.Err != nil {
+					return r.Err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,15 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "015_add_image_location_name",
+		Up: func(d *db.DB) error {
+			return d.Write(`ALTER TABLE image_metadata ADD COLUMN location_name TEXT`).Err
+		},
+		Down: func(d *db.DB) error {
+			return d.Write(`ALTER TABLE image_metadata DROP COLUMN location_name`).Err
+		},
+	})
+}
@@ -0,0 +1,35 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "016_add_files_seen_at",
+		Up: func(d *db.DB) error {
+			stmts := []string{
+				// Scan pass (Unix nanoseconds at its start) that last found the file;
+				// rows a completed scan did not reach are removed
+				`ALTER TABLE files ADD COLUMN seen_at INTEGER`,
+				`CREATE INDEX IF NOT EXISTS idx_files_folder_seen ON files(folder_id, seen_at)`,
+			}
+			for _, s := range stmts {
+				if r := d.Write(s); r.Err != nil {
+					return r.Err
+				}
+			}
+			return nil
+		},
+		Down: func(d *db.DB) error {
+			stmts := []string{
+				`DROP INDEX IF EXISTS idx_files_folder_seen`,
+				`ALTER TABLE files DROP COLUMN seen_at`,
+			}
+			for _, s := range stmts {
+				if r := d.Write(s); r.Err != nil {
+					return r.Err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,26 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "017_create_scan_progress",
+		Up: func(d *db.DB) error {
+			// Checkpoints of folder scans that have not finished, so an
+			// interrupted scan resumes where it stopped
+			result := d.Write(`
+				CREATE TABLE scan_progress (
+					path TEXT PRIMARY KEY,
+					folder_id INTEGER NOT NULL,
+					pass INTEGER NOT NULL,
+					checkpoint TEXT NOT NULL,
+					updated_at DATETIME NOT NULL
+				)
+			`)
+			return result.Err
+		},
+		Down: func(d *db.DB) error {
+			return d.Write("DROP TABLE scan_progress").Err
+		},
+	})
+}
@@ -0,0 +1,16 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "018_add_folder_debounce",
+		Up: func(d *db.DB) error {
+			// Milliseconds a watched folder's events settle before processing; 0 uses the server default
+			return d.Write(`ALTER TABLE folders ADD COLUMN debounce_ms INTEGER NOT NULL DEFAULT 0`).Err
+		},
+		Down: func(d *db.DB) error {
+			return d.Write(`ALTER TABLE folders DROP COLUMN debounce_ms`).Err
+		},
+	})
+}
@@ -0,0 +1,16 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "020_add_folder_case_insensitive",
+		Up: func(d *db.DB) error {
+			// Whether the folder's volume ignores case; NULL until detected
+			return d.Write(`ALTER TABLE folders ADD COLUMN case_insensitive INTEGER`).Err
+		},
+		Down: func(d *db.DB) error {
+			return d.Write(`ALTER TABLE folders DROP COLUMN case_insensitive`).Err
+		},
+	})
+}
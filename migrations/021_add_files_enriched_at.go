@@ -0,0 +1,17 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "021_add_files_enriched_at",
+		Up: func(d *db.DB) error {
+			// When thumbnail enrichment last tried the file (Unix seconds);
+			// NULL until it has, and again once the file changes
+			return d.Write(`ALTER TABLE files ADD COLUMN enriched_at INTEGER`).Err
+		},
+		Down: func(d *db.DB) error {
+			return d.Write(`ALTER TABLE files DROP COLUMN enriched_at`).Err
+		},
+	})
+}
@@ -0,0 +1,25 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "022_create_api_keys",
+		Up: func(d *db.DB) error {
+			// Keys are stored as SHA-256 hashes; prefix identifies a key without revealing it
+			return d.Write(`
+				CREATE TABLE api_keys (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name TEXT NOT NULL DEFAULT '',
+					prefix TEXT NOT NULL,
+					key_hash TEXT NOT NULL UNIQUE,
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					last_used_at DATETIME
+				)
+			`).Err
+		},
+		Down: func(d *db.DB) error {
+			return d.Write("DROP TABLE api_keys").Err
+		},
+	})
+}
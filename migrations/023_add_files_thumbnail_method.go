@@ -0,0 +1,17 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "023_add_files_thumbnail_method",
+		Up: func(d *db.DB) error {
+			// How the image thumbnails were made: "decode" or, for RAW files,
+			// "preview" (from the embedded JPEG); NULL if not recorded
+			return d.Write(`ALTER TABLE files ADD COLUMN thumbnail_method TEXT`).Err
+		},
+		Down: func(d *db.DB) error {
+			return d.Write(`ALTER TABLE files DROP COLUMN thumbnail_method`).Err
+		},
+	})
+}
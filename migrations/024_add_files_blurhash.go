@@ -0,0 +1,17 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "024_add_files_blurhash",
+		Up: func(d *db.DB) error {
+			// BlurHash of the small thumbnail, for placeholders while it
+			// loads; NULL until the thumbnail worker computes it
+			return d.Write(`ALTER TABLE files ADD COLUMN blurhash TEXT`).Err
+		},
+		Down: func(d *db.DB) error {
+			return d.Write(`ALTER TABLE files DROP COLUMN blurhash`).Err
+		},
+	})
+}
@@ -0,0 +1,16 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "025_add_folders_last_scanned_at",
+		Up: func(d *db.DB) error {
+			// When a scan of the whole folder last completed; NULL until one does
+			return d.Write(`ALTER TABLE folders ADD COLUMN last_scanned_at DATETIME`).Err
+		},
+		Down: func(d *db.DB) error {
+			return d.Write(`ALTER TABLE folders DROP COLUMN last_scanned_at`).Err
+		},
+	})
+}
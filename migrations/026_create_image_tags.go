@@ -0,0 +1,47 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "026_create_image_tags",
+		Up: func(d *db.DB) error {
+			stmts := []string{
+				// Keywords from images' XMP metadata, matched without regard to case
+				`CREATE TABLE tags (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name TEXT NOT NULL UNIQUE COLLATE NOCASE
+				)`,
+				`CREATE TABLE image_tags (
+					file_id INTEGER NOT NULL,
+					tag_id INTEGER NOT NULL,
+					PRIMARY KEY (file_id, tag_id),
+					FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+					FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+				)`,
+				`CREATE INDEX idx_image_tags_tag_id ON image_tags(tag_id)`,
+				// The XMP description; NULL for images without one
+				`ALTER TABLE image_metadata ADD COLUMN caption TEXT`,
+			}
+			for _, s := range stmts {
+				if r := d.Write(s); r.Err != nil {
+					return r.Err
+				}
+			}
+			return nil
+		},
+		Down: func(d *db.DB) error {
+			stmts := []string{
+				`ALTER TABLE image_metadata DROP COLUMN caption`,
+				`DROP TABLE image_tags`,
+				`DROP TABLE tags`,
+			}
+			for _, s := range stmts {
+				if r := d.Write(s); r.Err != nil {
+					return r.Err
+				}
+			}
+			return nil
+		},
+	})
+}
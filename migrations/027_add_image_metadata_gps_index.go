@@ -0,0 +1,17 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "027_add_image_metadata_gps_index",
+		Up: func(d *db.DB) error {
+			// Bounding-box searches for the map view range over latitude
+			// first, then longitude
+			return d.Write(`CREATE INDEX idx_image_metadata_gps ON image_metadata(gps_latitude, gps_longitude)`).Err
+		},
+		Down: func(d *db.DB) error {
+			return d.Write(`DROP INDEX idx_image_metadata_gps`).Err
+		},
+	})
+}
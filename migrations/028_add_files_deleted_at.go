@@ -0,0 +1,36 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+func init() {
+	db.Register(db.Migration{
+		ID: "028_add_files_deleted_at",
+		Up: func(d *db.DB) error {
+			stmts := []string{
+				// Unix seconds a file was found missing from disk; NULL while it
+				// is there. Missing files keep their rows (and albums, metadata)
+				// in case they come back, e.g. after a NAS remounts
+				`ALTER TABLE files ADD COLUMN deleted_at INTEGER`,
+				`CREATE INDEX idx_files_deleted_at ON files(deleted_at)`,
+			}
+			for _, s := range stmts {
+				if r := d.Write(s); r.Err != nil {
+					return r.Err
+				}
+			}
+			return nil
+		},
+		Down: func(d *db.DB) error {
+			stmts := []string{
+				`DROP INDEX idx_files_deleted_at`,
+				`ALTER TABLE files DROP COLUMN deleted_at`,
+			}
+			for _, s := range stmts {
+				if r := d.Write(s); r.Err != nil {
+					return r.Err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,26 @@
+package migrations
+
+import "jukel.org/q2/db"
+
+// Schema is the set of tables and columns the code relies on once every
+// migration has run, checked at startup by db.ValidateSchema. Update it
+// alongside any migration that adds, renames or drops a table or column.
+var Schema = []db.Table{
+	{Name: "folders", Columns: []string{"id", "path", "created_at", "library_type", "watch_mode", "poll_interval", "debounce_ms", "case_insensitive", "last_scanned_at"}},
+	{Name: "files", Columns: []string{"id", "folder_id", "path", "filename", "extension", "mediatype", "size", "created_at", "modified_at", "indexed_at",
+		"thumbnail_small_path", "thumbnail_large_path", "xxhash", "seen_at", "enriched_at", "thumbnail_method", "blurhash", "deleted_at"}},
+	{Name: "scan_queue", Columns: []string{"id", "path", "requested_at", "started_at", "completed_at"}},
+	{Name: "scan_progress", Columns: []string{"path", "folder_id", "pass", "checkpoint", "updated_at"}},
+	{Name: "image_metadata", Columns: []string{"id", "file_id", "camera_make", "camera_model", "date_taken", "width", "height", "orientation",
+		"iso", "exposure_time", "f_number", "focal_length", "gps_latitude", "gps_longitude", "location_name", "caption"}},
+	{Name: "tags", Columns: []string{"id", "name"}},
+	{Name: "image_tags", Columns: []string{"file_id", "tag_id"}},
+	{Name: "audio_metadata", Columns: []string{"id", "file_id", "artist", "album", "title", "genre", "track_number", "year", "duration_seconds", "bitrate"}},
+	{Name: "albums", Columns: []string{"id", "name", "cover_path", "created_at", "updated_at"}},
+	{Name: "album_items", Columns: []string{"id", "album_id", "file_id", "position", "added_at"}},
+	{Name: "settings", Columns: []string{"key", "value"}},
+	{Name: "lyrics", Columns: []string{"id", "file_id", "synced_lyrics", "plain_lyrics", "fetched_at"}},
+	{Name: "play_history", Columns: []string{"id", "file_id", "played_at"}},
+	{Name: "favourites", Columns: []string{"id", "type", "key", "created_at"}},
+	{Name: "api_keys", Columns: []string{"id", "name", "prefix", "key_hash", "created_at", "last_used_at"}},
+}
@@ -0,0 +1,75 @@
+package monitor
+
+import (
+	"errors"
+	"strings"
+)
+
+// Op describes the kind of change reported for a path.
+type Op uint32
+
+// File system operations
+const (
+	Create Op = 1 << iota
+	Write
+	Remove
+	Rename
+	Chmod
+)
+
+// Has reports whether op includes o.
+func (op Op) Has(o Op) bool {
+	return op&o != 0
+}
+
+func (op Op) String() string {
+	var parts []string
+	if op.Has(Create) {
+		parts = append(parts, "CREATE")
+	}
+	if op.Has(Write) {
+		parts = append(parts, "WRITE")
+	}
+	if op.Has(Remove) {
+		parts = append(parts, "REMOVE")
+	}
+	if op.Has(Rename) {
+		parts = append(parts, "RENAME")
+	}
+	if op.Has(Chmod) {
+		parts = append(parts, "CHMOD")
+	}
+	if len(parts) == 0 {
+		return "NONE"
+	}
+	return strings.Join(parts, "|")
+}
+
+// Event is a single change to a file or directory.
+type Event struct {
+	Name string // Full path of the affected file or directory
+	Op   Op
+}
+
+// errEventOverflow is sent on an fsWatcher's Errors channel when events were
+// dropped, e.g. the inotify queue overflowed. The watched folders are
+// rescanned to pick up the changes that were missed.
+var errEventOverflow = errors.New("file system event queue overflowed; some changes may have been missed")
+
+// errWatchUnsupported is returned by newFSWatcher on platforms without
+// file system event support. Every folder is polled instead.
+var errWatchUnsupported = errors.New("file system events are not supported on this platform")
+
+// newFSWatcherFunc creates the fsWatcher used by NewWatcher. Tests replace it
+// to simulate platforms without file system events.
+var newFSWatcherFunc = newFSWatcher
+
+// fsWatcher is the platform-specific source of file system events.
+// Watches are per directory; subdirectories must be added individually.
+type fsWatcher interface {
+	Add(path string) error
+	Remove(path string) error
+	Events() <-chan Event
+	Errors() <-chan error
+	Close() error
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package monitor
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// pollFilesystems are filesystems where inotify misses changes made by other
+// hosts or by the FUSE daemon, keyed by statfs f_type magic.
+var pollFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517B:     "smb",
+	0xFF534D42: "cifs",
+	0xFE534D42: "smb2",
+	0x65735546: "fuse",
+	0x01021997: "9p",
+	0x5346414F: "afs",
+	0x73757245: "coda",
+	0x564C:     "ncp",
+	0x00C36400: "ceph",
+	0x47504653: "gpfs",
+	0x0BD00BD0: "lustre",
+}
+
+// localFilesystems names common local filesystems for status output.
+var localFilesystems = map[uint32]string{
+	0xEF53:     "ext4",
+	0x9123683E: "btrfs",
+	0x58465342: "xfs",
+	0x2FC12FC1: "zfs",
+	0xF2F52010: "f2fs",
+	0x01021994: "tmpfs",
+	0x794C7630: "overlayfs",
+	0x4D44:     "vfat",
+	0x2011BAB0: "exfat",
+	0x5346544E: "ntfs",
+}
+
+// detectFSType returns the filesystem name for path and whether changes on
+// it must be detected by polling.
+func detectFSType(path string) (name string, poll bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", false
+	}
+
+	magic := uint32(st.Type)
+	if name, ok := pollFilesystems[magic]; ok {
+		return name, true
+	}
+	if name, ok := localFilesystems[magic]; ok {
+		return name, false
+	}
+	return fmt.Sprintf("0x%x", magic), false
+}
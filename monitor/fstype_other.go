@@ -0,0 +1,8 @@
+//go:build !linux
+
+package monitor
+
+// detectFSType is not implemented on this platform.
+func detectFSType(path string) (name string, poll bool) {
+	return "", false
+}
@@ -0,0 +1,190 @@
+//go:build linux
+
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask selects the inotify events translated into Ops.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MOVED_TO |
+	syscall.IN_MODIFY |
+	syscall.IN_DELETE | syscall.IN_DELETE_SELF |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVE_SELF |
+	syscall.IN_ATTRIB
+
+// inotifyWatcher is the Linux fsWatcher backed by inotify.
+type inotifyWatcher struct {
+	fd   int
+	file *os.File // Non-blocking wrapper so reads can be interrupted by Close
+
+	mu      sync.Mutex
+	watches map[string]int // path -> watch descriptor
+	paths   map[int]string // watch descriptor -> path
+
+	events    chan Event
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newFSWatcher() (fsWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init: %w", err)
+	}
+
+	w := &inotifyWatcher{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: make(map[string]int),
+		paths:   make(map[int]string),
+		events:  make(chan Event, 256),
+		errors:  make(chan error, 16),
+		done:    make(chan struct{}),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Add(path string) error {
+	path = filepath.Clean(path)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return os.ErrClosed
+	default:
+	}
+
+	wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+	}
+	w.watches[path] = wd
+	w.paths[wd] = path
+	return nil
+}
+
+func (w *inotifyWatcher) Remove(path string) error {
+	path = filepath.Clean(path)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	wd, ok := w.watches[path]
+	if !ok {
+		return fmt.Errorf("not watched: %s", path)
+	}
+	delete(w.watches, path)
+	delete(w.paths, wd)
+
+	if _, err := syscall.InotifyRmWatch(w.fd, uint32(wd)); err != nil {
+		return &os.PathError{Op: "inotify_rm_watch", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (w *inotifyWatcher) Events() <-chan Event { return w.events }
+func (w *inotifyWatcher) Errors() <-chan error { return w.errors }
+
+func (w *inotifyWatcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		w.mu.Lock()
+		close(w.done)
+		w.mu.Unlock()
+		err = w.file.Close()
+	})
+	return err
+}
+
+// readEvents decodes raw inotify records until the watcher is closed.
+func (w *inotifyWatcher) readEvents() {
+	defer close(w.events)
+	defer close(w.errors)
+
+	var buf [(syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1) * 64]byte
+	for {
+		n, err := w.file.Read(buf[:])
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.sendError(err)
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			mask := raw.Mask
+			nameLen := int(raw.Len)
+
+			if mask&syscall.IN_Q_OVERFLOW != 0 {
+				w.sendError(errEventOverflow)
+			}
+
+			w.mu.Lock()
+			dir := w.paths[int(raw.Wd)]
+			if mask&syscall.IN_IGNORED != 0 && dir != "" {
+				// The kernel dropped the watch (directory removed or Remove called)
+				delete(w.paths, int(raw.Wd))
+				if w.watches[dir] == int(raw.Wd) {
+					delete(w.watches, dir)
+				}
+			}
+			w.mu.Unlock()
+
+			name := dir
+			if nameLen > 0 {
+				start := offset + syscall.SizeofInotifyEvent
+				name = filepath.Join(dir, strings.TrimRight(string(buf[start:start+nameLen]), "\x00"))
+			}
+			offset += syscall.SizeofInotifyEvent + nameLen
+
+			if op := inotifyOp(mask); op != 0 && dir != "" {
+				select {
+				case w.events <- Event{Name: name, Op: op}:
+				case <-w.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) sendError(err error) {
+	select {
+	case w.errors <- err:
+	case <-w.done:
+	}
+}
+
+// inotifyOp translates an inotify mask into an Op.
+func inotifyOp(mask uint32) Op {
+	var op Op
+	if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		op |= Create
+	}
+	if mask&syscall.IN_MODIFY != 0 {
+		op |= Write
+	}
+	if mask&(syscall.IN_DELETE|syscall.IN_DELETE_SELF) != 0 {
+		op |= Remove
+	}
+	if mask&(syscall.IN_MOVED_FROM|syscall.IN_MOVE_SELF) != 0 {
+		op |= Rename
+	}
+	if mask&syscall.IN_ATTRIB != 0 {
+		op |= Chmod
+	}
+	return op
+}
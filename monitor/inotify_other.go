@@ -0,0 +1,7 @@
+//go:build !linux
+
+package monitor
+
+func newFSWatcher() (fsWatcher, error) {
+	return nil, errWatchUnsupported
+}
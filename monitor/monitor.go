@@ -0,0 +1,774 @@
+// Package monitor keeps the file index in sync with the monitored folders.
+//
+// Folders on local filesystems are watched for changes (inotify on Linux).
+// Folders on network or FUSE filesystems, where events from other hosts are
+// never delivered, are rescanned periodically instead. Folders also fall back
+// to polling when a watch cannot be added, and on platforms without file
+// system events. The folders.watch_mode column overrides the automatic choice
+// per folder, and folders.poll_interval sets a per-folder poll interval.
+// All rescans go through the scan_queue table and are run by a single
+// worker, up to Config.ScanConcurrency at a time.
+//
+// Folders added or removed in the same process (the HTTP API) take effect
+// through AddFolder and RemoveFolder. Folders changed by other processes,
+// such as the addfolder and removefolder commands, are picked up by
+// periodically reconciling against the folders table.
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/folders"
+	"jukel.org/q2/scanner"
+)
+
+// Mode describes how changes in a monitored folder are detected.
+type Mode string
+
+// Watch modes. ModeAuto is only a folder setting; a monitored folder is
+// always either watched or polled.
+const (
+	ModeAuto  Mode = "auto"  // Watch unless the filesystem needs polling
+	ModeWatch Mode = "watch" // File system events
+	ModePoll  Mode = "poll"  // Periodic rescans
+)
+
+// DefaultPollInterval is how often poll-mode folders are rescanned when
+// Config.PollInterval is not set.
+const DefaultPollInterval = 5 * time.Minute
+
+// MinPollInterval is the shortest per-folder poll interval accepted from users.
+const MinPollInterval = 10 * time.Second
+
+// DefaultReconcileInterval is how often the folders table is re-read when
+// Config.ReconcileInterval is not set.
+const DefaultReconcileInterval = 30 * time.Second
+
+// DefaultStartupScanAge is how recently a folder must have been fully
+// scanned for Start to skip its initial scan, as serve's default.
+const DefaultStartupScanAge = 10 * time.Minute
+
+// ParseMode validates a folder watch mode. An empty string maps to ModeAuto.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(strings.TrimSpace(s))); m {
+	case "":
+		return ModeAuto, nil
+	case ModeAuto, ModeWatch, ModePoll:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown watch mode %q (expected auto, watch or poll)", s)
+	}
+}
+
+// Scan concurrency defaults and limits.
+const (
+	DefaultScanConcurrency = 1
+	MaxScanConcurrency     = 8
+)
+
+// Config holds monitor settings.
+type Config struct {
+	PollInterval      time.Duration // How often poll-mode folders are rescanned
+	ReconcileInterval time.Duration // How often the folders table is checked for changes
+	ScanConcurrency   int           // How many folders are scanned at once; 0 uses the default
+	StartupScanAge    time.Duration // Folders fully scanned more recently are not rescanned by Start; 0 rescans every folder
+	Watcher           WatcherConfig
+}
+
+// folderState is the monitor's view of one monitored folder.
+type folderState struct {
+	id           int64
+	path         string
+	configured   Mode // folders.watch_mode
+	mode         Mode // ModeWatch or ModePoll
+	fsType       string
+	reason       string
+	pollInterval time.Duration
+	debounce     time.Duration // folders.debounce_ms; 0 uses the watcher default
+	nextPoll     time.Time
+	lastScan     time.Time
+}
+
+// Monitor watches or polls every monitored folder and runs the resulting scans.
+type Monitor struct {
+	db                *db.DB
+	pollInterval      time.Duration
+	reconcileInterval time.Duration
+	startupScanAge    time.Duration
+	watcherConfig     WatcherConfig
+	status            *StatusTracker
+
+	mu       sync.Mutex
+	watcher  *Watcher // nil when file system events are unavailable
+	watchErr error    // Why watcher is nil
+	folders  map[string]*folderState
+	running  bool
+
+	lastReconcile time.Time
+
+	scanConcurrency int
+	scans           map[string]context.CancelFunc // Running scans by normalized path
+	scanSlot        chan struct{}                 // Signals a scan finished or the concurrency changed
+
+	wake        chan struct{} // Signals the scan worker
+	pollChanged chan struct{} // Signals pollLoop that poll folders changed
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// New creates a Monitor. Call Start to begin monitoring.
+func New(database *db.DB, cfg Config) *Monitor {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	if cfg.ReconcileInterval <= 0 {
+		cfg.ReconcileInterval = DefaultReconcileInterval
+	}
+	if cfg.ScanConcurrency <= 0 {
+		cfg.ScanConcurrency = DefaultScanConcurrency
+	}
+	cfg.Watcher = cfg.Watcher.withDefaults()
+	return &Monitor{
+		db:                database,
+		pollInterval:      cfg.PollInterval,
+		reconcileInterval: cfg.ReconcileInterval,
+		startupScanAge:    cfg.StartupScanAge,
+		watcherConfig:     cfg.Watcher,
+		status:            NewStatusTracker(cfg.Watcher.MaxActivities),
+		folders:           make(map[string]*folderState),
+		scanConcurrency:   min(cfg.ScanConcurrency, MaxScanConcurrency),
+		scans:             make(map[string]context.CancelFunc),
+		scanSlot:          make(chan struct{}, 1),
+		wake:              make(chan struct{}, 1),
+		pollChanged:       make(chan struct{}, 1),
+	}
+}
+
+// Start begins monitoring every folder in the folders table and queues an
+// initial scan of each to pick up changes made while the server was down,
+// except those fully scanned within Config.StartupScanAge.
+func (m *Monitor) Start() error {
+	m.mu.Lock()
+	if m.running {
+		m.mu.Unlock()
+		return nil
+	}
+	m.running = true
+	m.done = make(chan struct{})
+
+	w, err := NewWatcher(m.db, m.status, func(path string) { m.QueueScan(path) }, m.watcherConfig)
+	if err != nil {
+		m.watchErr = err
+		m.status.Record(ActivityError, "", fmt.Sprintf("file watching unavailable, polling all folders: %v", err))
+	}
+	m.watcher = w
+	m.mu.Unlock()
+
+	type folderRow struct {
+		id   int64
+		path string
+	}
+	var stored []folderRow
+	rows, err := m.db.Query("SELECT id, path FROM folders")
+	if err != nil {
+		m.Stop()
+		return fmt.Errorf("failed to load folders: %w", err)
+	}
+	for rows.Next() {
+		var f folderRow
+		if err := rows.Scan(&f.id, &f.path); err == nil {
+			stored = append(stored, f)
+		}
+	}
+	rows.Close()
+
+	for _, f := range stored {
+		m.AddFolder(f.id, f.path)
+		if m.startupScanAge > 0 {
+			stale, err := folders.NeedsScan(m.db, f.id, m.startupScanAge)
+			if err == nil && !stale {
+				m.status.Record(ActivityScan, f.path, "scanned recently; skipping startup scan")
+				continue
+			}
+		}
+		m.QueueScan(f.path)
+	}
+
+	m.wg.Add(3)
+	go m.scanWorker()
+	go m.pollLoop()
+	go m.reconcileLoop()
+
+	return nil
+}
+
+// Stop stops watching, interrupts the current scan and waits for the scan
+// worker to exit.
+func (m *Monitor) Stop() {
+	m.mu.Lock()
+	if !m.running {
+		m.mu.Unlock()
+		return
+	}
+	m.running = false
+	close(m.done)
+	w := m.watcher
+	m.watcher = nil
+	m.mu.Unlock()
+
+	if w != nil {
+		w.Close()
+	}
+	m.wg.Wait()
+}
+
+// AddFolder starts monitoring a folder, choosing between watching and polling
+// according to its watch_mode setting and filesystem.
+// Calling it again for a monitored folder re-applies its settings.
+func (m *Monitor) AddFolder(folderID int64, path string) {
+	state := &folderState{
+		id:           folderID,
+		path:         path,
+		configured:   ModeAuto,
+		mode:         ModeWatch,
+		pollInterval: m.pollInterval,
+	}
+
+	var watchMode string
+	var pollSeconds, debounceMS int64
+	row := m.db.QueryRow("SELECT watch_mode, poll_interval, debounce_ms FROM folders WHERE id = ?", folderID)
+	if err := row.Scan(&watchMode, &pollSeconds, &debounceMS); err == nil {
+		if mode, err := ParseMode(watchMode); err == nil {
+			state.configured = mode
+		}
+		if pollSeconds > 0 {
+			state.pollInterval = time.Duration(pollSeconds) * time.Second
+		}
+		if debounceMS > 0 {
+			state.debounce = time.Duration(debounceMS) * time.Millisecond
+		}
+	}
+
+	fsType, poll := detectFSType(path)
+	state.fsType = fsType
+
+	m.mu.Lock()
+	w := m.watcher
+	watchErr := m.watchErr
+	old := m.folders[scanner.NormalizePath(path)]
+	m.mu.Unlock()
+
+	if old != nil && old.mode == ModeWatch && w != nil {
+		w.RemoveRoot(path)
+	}
+
+	switch {
+	case state.configured == ModePoll:
+		state.mode = ModePoll
+		state.reason = "poll mode set for folder"
+	case w == nil:
+		state.mode = ModePoll
+		if watchErr != nil {
+			state.reason = watchErr.Error()
+		}
+	case poll && state.configured == ModeAuto:
+		state.mode = ModePoll
+		state.reason = fmt.Sprintf("%s filesystem does not report changes reliably", fsType)
+	default:
+		w.SetRootDebounce(path, state.debounce)
+		if err := w.AddRoot(folderID, path); err != nil {
+			state.mode = ModePoll
+			state.reason = fmt.Sprintf("could not watch folder: %v", err)
+		}
+	}
+
+	msg := string(state.mode)
+	if state.mode == ModePoll {
+		msg += " every " + state.pollInterval.String()
+		state.nextPoll = time.Now().Add(state.pollInterval)
+	} else if state.debounce > 0 {
+		msg += ", debounce " + state.debounce.String()
+	}
+	if state.reason != "" {
+		msg += ": " + state.reason
+	}
+	m.status.Record(ActivityWatch, path, msg)
+
+	m.mu.Lock()
+	m.folders[scanner.NormalizePath(path)] = state
+	m.mu.Unlock()
+
+	m.signalPollChanged()
+}
+
+// RemoveFolder stops monitoring a folder and cancels its queued scans.
+// A scan of the folder that is already running is left to finish.
+func (m *Monitor) RemoveFolder(path string) {
+	key := scanner.NormalizePath(path)
+
+	if _, err := scanner.CancelScans(m.db, path); err != nil {
+		m.status.Record(ActivityError, path, fmt.Sprintf("cancel scans: %v", err))
+	}
+
+	m.mu.Lock()
+	delete(m.folders, key)
+	w := m.watcher
+	m.mu.Unlock()
+
+	if w != nil {
+		w.RemoveRoot(path)
+	}
+	m.status.Record(ActivityWatch, path, "no longer monitored")
+	m.signalPollChanged()
+}
+
+func (m *Monitor) signalPollChanged() {
+	select {
+	case m.pollChanged <- struct{}{}:
+	default:
+	}
+}
+
+// QueueScan queues a rescan of a monitored folder.
+func (m *Monitor) QueueScan(path string) {
+	if err := scanner.QueueScan(m.db, path); err != nil {
+		m.status.Record(ActivityError, path, fmt.Sprintf("queue scan: %v", err))
+		return
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// CancelState reports what CancelScan did.
+type CancelState string
+
+const (
+	CancelNotFound  CancelState = "not_found" // The path was neither queued nor being scanned
+	CancelDequeued  CancelState = "dequeued"  // The scan was queued and has been removed
+	CancelCancelled CancelState = "cancelled" // The scan was running and has been stopped
+)
+
+// CancelScan cancels the scan of path: a queued scan is removed from the
+// queue, and a running scan is stopped and then removed. A stopped scan keeps
+// its checkpoint, so a later scan of the folder resumes from it.
+func (m *Monitor) CancelScan(path string) (CancelState, error) {
+	key := scanner.NormalizePath(path)
+
+	// Held while dequeuing so runScan cannot start the scan in between
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cancel, ok := m.scans[key]; ok {
+		cancel()
+		return CancelCancelled, nil
+	}
+	removed, err := scanner.DequeueScan(m.db, path)
+	if err != nil {
+		return CancelNotFound, err
+	}
+	if !removed {
+		return CancelNotFound, nil
+	}
+	m.status.Record(ActivityScan, path, "queued scan cancelled")
+	return CancelDequeued, nil
+}
+
+// Status returns a snapshot of the monitored folders and recent activity.
+func (m *Monitor) Status() Status {
+	m.mu.Lock()
+	st := Status{
+		Running:           m.running,
+		PollInterval:      m.pollInterval.String(),
+		ReconcileInterval: m.reconcileInterval.String(),
+		DebounceTime:      m.watcherConfig.DebounceTime.String(),
+		Folders:           make([]FolderStatus, 0, len(m.folders)),
+	}
+	if !m.lastReconcile.IsZero() {
+		t := m.lastReconcile
+		st.LastReconcile = &t
+	}
+	for _, f := range m.folders {
+		fs := FolderStatus{
+			ID:         f.id,
+			Path:       f.path,
+			Mode:       f.mode,
+			Configured: f.configured,
+			FSType:     f.fsType,
+			Reason:     f.reason,
+		}
+		if f.mode == ModePoll {
+			fs.PollInterval = f.pollInterval.String()
+		} else {
+			fs.Debounce = m.watcherConfig.DebounceTime.String()
+			if f.debounce > 0 {
+				fs.Debounce = max(f.debounce, MinDebounceTime).String()
+			}
+		}
+		if !f.lastScan.IsZero() {
+			t := f.lastScan
+			fs.LastScan = &t
+		}
+		st.Folders = append(st.Folders, fs)
+	}
+	w := m.watcher
+	m.mu.Unlock()
+
+	if w != nil {
+		st.WatchedDirs, st.AttemptedDirs = w.WatchCounts()
+	}
+
+	sort.Slice(st.Folders, func(i, j int) bool { return st.Folders[i].Path < st.Folders[j].Path })
+	st.CurrentScan = m.status.CurrentScan()
+	st.RecentActivity = m.status.Recent()
+	return st
+}
+
+// pollLoop queues a rescan of each poll-mode folder whenever its poll
+// interval has elapsed.
+func (m *Monitor) pollLoop() {
+	defer m.wg.Done()
+
+	timer := time.NewTimer(m.pollInterval)
+	defer timer.Stop()
+
+	for {
+		var due []string
+		next := time.Now().Add(m.pollInterval)
+
+		m.mu.Lock()
+		now := time.Now()
+		for _, f := range m.folders {
+			if f.mode != ModePoll {
+				continue
+			}
+			if !now.Before(f.nextPoll) {
+				due = append(due, f.path)
+				f.nextPoll = now.Add(f.pollInterval)
+			}
+			if f.nextPoll.Before(next) {
+				next = f.nextPoll
+			}
+		}
+		m.mu.Unlock()
+
+		for _, p := range due {
+			m.QueueScan(p)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+
+		select {
+		case <-m.done:
+			return
+		case <-m.pollChanged:
+		case <-timer.C:
+		}
+	}
+}
+
+// reconcileLoop periodically applies changes to the folders table made by
+// other processes.
+func (m *Monitor) reconcileLoop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.Reconcile()
+		}
+	}
+}
+
+// Reconcile brings the monitored folders in line with the folders table:
+// new folders are monitored and scanned, removed folders are dropped, and
+// folders whose watch settings changed have them re-applied.
+func (m *Monitor) Reconcile() {
+	if err := scanner.LoadFolderCase(m.db); err != nil {
+		m.status.Record(ActivityError, "", fmt.Sprintf("detect folder case: %v", err))
+	}
+
+	type folderRow struct {
+		id           int64
+		path         string
+		configured   Mode
+		pollInterval time.Duration
+		debounce     time.Duration
+	}
+	rows, err := m.db.Query("SELECT id, path, watch_mode, poll_interval, debounce_ms FROM folders")
+	if err != nil {
+		m.status.Record(ActivityError, "", fmt.Sprintf("reconcile folders: %v", err))
+		return
+	}
+	stored := make(map[string]folderRow)
+	for rows.Next() {
+		var f folderRow
+		var watchMode string
+		var pollSeconds, debounceMS int64
+		if err := rows.Scan(&f.id, &f.path, &watchMode, &pollSeconds, &debounceMS); err != nil {
+			continue
+		}
+		f.configured, err = ParseMode(watchMode)
+		if err != nil {
+			f.configured = ModeAuto
+		}
+		f.pollInterval = m.pollInterval
+		if pollSeconds > 0 {
+			f.pollInterval = time.Duration(pollSeconds) * time.Second
+		}
+		if debounceMS > 0 {
+			f.debounce = time.Duration(debounceMS) * time.Millisecond
+		}
+		stored[scanner.NormalizePath(f.path)] = f
+	}
+	rows.Close()
+
+	var added, changed []folderRow
+	var removed []string
+
+	m.mu.Lock()
+	m.lastReconcile = time.Now()
+	for key, f := range stored {
+		cur, ok := m.folders[key]
+		switch {
+		case !ok:
+			added = append(added, f)
+		case cur.id != f.id || cur.configured != f.configured || cur.pollInterval != f.pollInterval || cur.debounce != f.debounce:
+			changed = append(changed, f)
+		}
+	}
+	for key, cur := range m.folders {
+		if _, ok := stored[key]; !ok {
+			removed = append(removed, cur.path)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, path := range removed {
+		m.RemoveFolder(path)
+	}
+	for _, f := range changed {
+		m.AddFolder(f.id, f.path)
+	}
+	for _, f := range added {
+		m.AddFolder(f.id, f.path)
+		m.QueueScan(f.path)
+	}
+}
+
+// SetDebounce changes how long file system events must settle before they
+// are processed, for folders without their own debounce. It applies to
+// events from now on, and again when the monitor is restarted.
+func (m *Monitor) SetDebounce(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watcherConfig.DebounceTime = max(d, MinDebounceTime)
+	if m.watcher != nil {
+		m.watcher.SetDebounce(d)
+	}
+}
+
+// Debounce returns the debounce time of folders without their own.
+func (m *Monitor) Debounce() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.watcherConfig.DebounceTime
+}
+
+// SetScanConcurrency changes how many folders are scanned at once, from 1 to
+// MaxScanConcurrency. Lowering it lets running scans finish; no new scan
+// starts until fewer than n are running.
+func (m *Monitor) SetScanConcurrency(n int) {
+	m.mu.Lock()
+	m.scanConcurrency = min(max(n, 1), MaxScanConcurrency)
+	m.mu.Unlock()
+	m.signalScanSlot()
+}
+
+// ScanConcurrency returns how many folders are scanned at once.
+func (m *Monitor) ScanConcurrency() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.scanConcurrency
+}
+
+// signalScanSlot wakes the scan worker to start queued scans in a freed slot.
+func (m *Monitor) signalScanSlot() {
+	select {
+	case m.scanSlot <- struct{}{}:
+	default:
+	}
+}
+
+// scanWorker runs queued scans, up to the scan concurrency at a time.
+// Stopping the monitor interrupts the running scans; they stay queued and
+// resume from their checkpoints.
+func (m *Monitor) scanWorker() {
+	defer m.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var scans sync.WaitGroup
+	defer scans.Wait()
+	for {
+		m.drainScanQueue(ctx, &scans)
+		select {
+		case <-m.done:
+			return
+		case <-m.wake:
+		case <-m.scanSlot:
+		}
+	}
+}
+
+// drainScanQueue starts pending scans in the order requested while slots
+// are free, and returns without waiting for them; scans adds each one. A
+// folder already being scanned is left queued until that scan ends. The
+// worker calls it again when a scan is queued, a scan ends or the scan
+// concurrency changes, so a freed slot picks up new work straight away.
+func (m *Monitor) drainScanQueue(ctx context.Context, scans *sync.WaitGroup) {
+	paths, err := scanner.GetPendingScans(m.db)
+	if err != nil {
+		m.status.Record(ActivityError, "", fmt.Sprintf("read scan queue: %v", err))
+		return
+	}
+
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return
+		}
+		scanCtx, ok := m.acquireScanSlot(ctx, path)
+		if !ok {
+			continue
+		}
+		scans.Add(1)
+		go func() {
+			defer scans.Done()
+			m.runScan(ctx, scanCtx, path)
+		}()
+	}
+}
+
+// acquireScanSlot claims a slot for path, which runScan releases, if fewer
+// scans than the scan concurrency are running and path is not one of them.
+// The returned context is cancelled by CancelScan.
+func (m *Monitor) acquireScanSlot(ctx context.Context, path string) (context.Context, bool) {
+	key := scanner.NormalizePath(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, running := m.scans[key]; running || len(m.scans) >= m.scanConcurrency {
+		return nil, false
+	}
+	scanCtx, cancel := context.WithCancel(ctx)
+	m.scans[key] = cancel
+	return scanCtx, true
+}
+
+// otherScan returns the path of a running scan other than key, or "".
+func (m *Monitor) otherScan(key string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for path := range m.scans {
+		if path != key {
+			return path
+		}
+	}
+	return ""
+}
+
+// runScan scans one queued folder in the slot claimed by acquireScanSlot
+// and removes it from the queue. ctx is the scan worker's context.
+func (m *Monitor) runScan(ctx, scanCtx context.Context, path string) {
+	key := scanner.NormalizePath(path)
+	defer func() {
+		m.mu.Lock()
+		m.scans[key]()
+		delete(m.scans, key)
+		m.mu.Unlock()
+		m.signalScanSlot()
+	}()
+
+	// The claimed queue row alone is removed when the scan ends, so the path
+	// queued again meanwhile is scanned again
+	claim, err := scanner.MarkScanStarted(m.db, path)
+	if err != nil {
+		m.status.Record(ActivityError, path, fmt.Sprintf("start scan: %v", err))
+		return
+	}
+	if claim == 0 {
+		// Cancelled while waiting in the queue
+		return
+	}
+
+	_, folderID, err := scanner.FindParentFolder(m.db, path)
+	if err != nil {
+		// The folder was removed after the scan was queued
+		scanner.RemoveCompletedScan(m.db, claim)
+		return
+	}
+	m.status.SetCurrentScan(path)
+
+	result, err := scanner.ScanFolderContext(scanCtx, m.db, path, folderID, nil)
+
+	m.status.SetCurrentScan(m.otherScan(key))
+	switch {
+	case err != nil && scanCtx.Err() != nil && ctx.Err() == nil:
+		// Cancelled through CancelScan
+		m.status.Record(ActivityScan, path, "scan cancelled")
+		scanner.RemoveCompletedScan(m.db, claim)
+		return
+	case err != nil && ctx.Err() != nil:
+		// Back to pending, to resume from its checkpoint on the next start.
+		// Stop waits for this before the database can be closed.
+		if err := scanner.MarkScanPending(m.db, path); err != nil {
+			m.status.Record(ActivityError, path, fmt.Sprintf("requeue interrupted scan: %v", err))
+			return
+		}
+		m.status.Record(ActivityScan, path, "scan interrupted; it resumes from its checkpoint on restart")
+		return
+	case err != nil:
+		m.status.Record(ActivityError, path, fmt.Sprintf("scan failed: %v", err))
+	default:
+		msg := fmt.Sprintf("%d added, %d updated, %d removed, %d errors",
+			result.FilesAdded, result.FilesUpdated, result.FilesRemoved, len(result.Errors))
+		if result.Resumed {
+			msg += " (resumed)"
+		}
+		m.status.Record(ActivityScan, path, msg)
+	}
+
+	m.mu.Lock()
+	if f, ok := m.folders[scanner.NormalizePath(path)]; ok {
+		f.lastScan = time.Now()
+	}
+	m.mu.Unlock()
+
+	scanner.MarkScanCompleted(m.db, claim)
+	scanner.RemoveCompletedScan(m.db, claim)
+}
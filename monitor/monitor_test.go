@@ -0,0 +1,596 @@
+package monitor
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/folders"
+	_ "jukel.org/q2/migrations"
+	"jukel.org/q2/scanner"
+)
+
+// setupMonitorTest creates a migrated database with one monitored folder.
+// Returns the database, the folder path and ID, and a cleanup function.
+func setupMonitorTest(t *testing.T) (*db.DB, string, int64, func()) {
+	tmpDir, err := os.MkdirTemp("", "q2-monitor-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+
+	database, err := db.Open(filepath.Join(tmpDir, "test.db"))
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := database.Migrate(); err != nil {
+		database.Close()
+		os.RemoveAll(tmpDir)
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+
+	folder := filepath.Join(tmpDir, "library")
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		database.Close()
+		os.RemoveAll(tmpDir)
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+
+	result := database.Write("INSERT INTO folders (path) VALUES (?)", scanner.NormalizePath(folder))
+	if result.Err != nil {
+		database.Close()
+		os.RemoveAll(tmpDir)
+		t.Fatalf("Failed to insert folder: %v", result.Err)
+	}
+
+	cleanup := func() {
+		database.Close()
+		os.RemoveAll(tmpDir)
+	}
+	return database, folder, result.LastInsertID, cleanup
+}
+
+// waitFor polls cond until it returns true or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("condition not met before timeout")
+}
+
+func isIndexed(database *db.DB, path string) bool {
+	var id int64
+	return database.QueryRow("SELECT id FROM files WHERE path = ? AND deleted_at IS NULL", scanner.NormalizePath(path)).Scan(&id) == nil
+}
+
+func folderStatus(t *testing.T, m *Monitor, path string) FolderStatus {
+	t.Helper()
+	for _, f := range m.Status().Folders {
+		if f.Path == scanner.NormalizePath(path) {
+			return f
+		}
+	}
+	t.Fatalf("Folder %s missing from status", path)
+	return FolderStatus{}
+}
+
+func TestMonitor_InitialScanIndexesExistingFiles(t *testing.T) {
+	database, folder, _, cleanup := setupMonitorTest(t)
+	defer cleanup()
+
+	existing := filepath.Join(folder, "existing.jpg")
+	if err := os.WriteFile(existing, []byte("jpeg"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	m := New(database, Config{})
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Stop()
+
+	waitFor(t, 5*time.Second, func() bool { return isIndexed(database, existing) })
+}
+
+func TestMonitor_StartSkipsRecentlyScannedFolders(t *testing.T) {
+	database, fresh, freshID, cleanup := setupMonitorTest(t)
+	defer cleanup()
+
+	stale := filepath.Join(filepath.Dir(fresh), "stale")
+	if err := os.MkdirAll(stale, 0755); err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	if result := database.Write("INSERT INTO folders (path) VALUES (?)", scanner.NormalizePath(stale)); result.Err != nil {
+		t.Fatalf("Failed to insert folder: %v", result.Err)
+	}
+	if err := folders.MarkScanned(database, freshID); err != nil {
+		t.Fatalf("MarkScanned failed: %v", err)
+	}
+	freshFile, staleFile := filepath.Join(fresh, "fresh.jpg"), filepath.Join(stale, "stale.jpg")
+	for _, path := range []string{freshFile, staleFile} {
+		if err := os.WriteFile(path, []byte("jpeg"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	m := New(database, Config{StartupScanAge: time.Hour})
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Stop()
+
+	// Only the never-scanned folder is scanned
+	waitFor(t, 5*time.Second, func() bool {
+		pending, _ := scanner.GetPendingScans(database)
+		return isIndexed(database, staleFile) && len(pending) == 0
+	})
+	if isIndexed(database, freshFile) {
+		t.Error("Expected the recently scanned folder not to be rescanned")
+	}
+	skipped := false
+	for _, a := range m.Status().RecentActivity {
+		skipped = skipped || (a.Path == scanner.NormalizePath(fresh) && strings.Contains(a.Message, "skipping startup scan"))
+	}
+	if !skipped {
+		t.Error("Expected the skipped startup scan recorded")
+	}
+}
+
+func TestMonitor_StopInterruptsScan(t *testing.T) {
+	database, folder, _, cleanup := setupMonitorTest(t)
+	defer cleanup()
+
+	const n = 5000
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(folder, fmt.Sprintf("album%02d", i/100))
+		os.MkdirAll(dir, 0755)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("track%04d.mp3", i)), []byte("mp3"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	indexed := func() int {
+		var count int
+		database.QueryRow("SELECT COUNT(*) FROM files").Scan(&count)
+		return count
+	}
+
+	m := New(database, Config{})
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return indexed() >= 100 })
+	m.Stop()
+
+	if got := indexed(); got >= n {
+		t.Fatalf("Expected Stop to interrupt the scan, but all %d files were indexed", got)
+	}
+	var started, completed sql.NullString
+	err := database.QueryRow("SELECT started_at, completed_at FROM scan_queue WHERE path = ?", scanner.NormalizePath(folder)).Scan(&started, &completed)
+	if err != nil {
+		t.Fatalf("Expected the interrupted scan to stay queued: %v", err)
+	}
+	if started.Valid || completed.Valid {
+		t.Errorf("Expected the scan back to pending, got started %v, completed %v", started, completed)
+	}
+
+	// The next start finishes it
+	m = New(database, Config{})
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Stop()
+	waitFor(t, 10*time.Second, func() bool { return indexed() == n })
+}
+
+func TestMonitor_WatchModeIndexesChanges(t *testing.T) {
+	database, folder, _, cleanup := setupMonitorTest(t)
+	defer cleanup()
+
+	m := New(database, Config{PollInterval: time.Hour})
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Stop()
+
+	if fs := folderStatus(t, m, folder); fs.Mode != ModeWatch {
+		t.Skipf("Folder is not watched here (%s)", fs.Reason)
+	}
+
+	added := filepath.Join(folder, "sub", "new.mp3")
+	if err := os.MkdirAll(filepath.Dir(added), 0755); err != nil {
+		t.Fatalf("Failed to create subdir: %v", err)
+	}
+	if err := os.WriteFile(added, []byte("mp3"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return isIndexed(database, added) })
+
+	if err := os.Remove(added); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return !isIndexed(database, added) })
+}
+
+func TestMonitor_PollModeWhenWatchingUnavailable(t *testing.T) {
+	database, folder, _, cleanup := setupMonitorTest(t)
+	defer cleanup()
+
+	orig := newFSWatcherFunc
+	newFSWatcherFunc = func() (fsWatcher, error) { return nil, errWatchUnsupported }
+	defer func() { newFSWatcherFunc = orig }()
+
+	m := New(database, Config{PollInterval: 50 * time.Millisecond})
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Stop()
+
+	fs := folderStatus(t, m, folder)
+	if fs.Mode != ModePoll {
+		t.Fatalf("Expected poll mode, got %s", fs.Mode)
+	}
+	if !strings.Contains(fs.Reason, "not supported") {
+		t.Errorf("Expected reason to explain the fallback, got %q", fs.Reason)
+	}
+
+	// Let the initial scan finish so the new file is only found by polling
+	waitFor(t, 5*time.Second, func() bool { return folderStatus(t, m, folder).LastScan != nil })
+
+	added := filepath.Join(folder, "polled.png")
+	if err := os.WriteFile(added, []byte("png"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return isIndexed(database, added) })
+}
+
+func TestMonitor_PollModeSetting(t *testing.T) {
+	database, folder, folderID, cleanup := setupMonitorTest(t)
+	defer cleanup()
+
+	result := database.Write("UPDATE folders SET watch_mode = 'poll', poll_interval = 1 WHERE id = ?", folderID)
+	if result.Err != nil {
+		t.Fatalf("Failed to set watch mode: %v", result.Err)
+	}
+
+	// The server-wide interval is far longer than the folder's own
+	m := New(database, Config{PollInterval: time.Hour})
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Stop()
+
+	fs := folderStatus(t, m, folder)
+	if fs.Mode != ModePoll || fs.Configured != ModePoll {
+		t.Fatalf("Expected configured poll mode, got mode=%s configured=%s", fs.Mode, fs.Configured)
+	}
+	if fs.PollInterval != "1s" {
+		t.Errorf("Expected poll interval 1s, got %q", fs.PollInterval)
+	}
+
+	waitFor(t, 5*time.Second, func() bool { return folderStatus(t, m, folder).LastScan != nil })
+
+	added := filepath.Join(folder, "archive.mkv")
+	if err := os.WriteFile(added, []byte("mkv"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return isIndexed(database, added) })
+}
+
+func TestParseMode(t *testing.T) {
+	tests := map[string]Mode{"": ModeAuto, "auto": ModeAuto, " Poll ": ModePoll, "WATCH": ModeWatch}
+	for in, want := range tests {
+		got, err := ParseMode(in)
+		if err != nil || got != want {
+			t.Errorf("ParseMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseMode("inotify"); err == nil {
+		t.Error("Expected error for unknown mode")
+	}
+}
+
+func TestMonitor_RemoveFolder(t *testing.T) {
+	database, folder, _, cleanup := setupMonitorTest(t)
+	defer cleanup()
+
+	m := New(database, Config{})
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Stop()
+
+	m.RemoveFolder(folder)
+	if n := len(m.Status().Folders); n != 0 {
+		t.Errorf("Expected no folders after RemoveFolder, got %d", n)
+	}
+}
+
+func TestMonitor_RemoveFolderCancelsQueuedScans(t *testing.T) {
+	database, folder, folderID, cleanup := setupMonitorTest(t)
+	defer cleanup()
+
+	m := New(database, Config{})
+	m.AddFolder(folderID, folder)
+	for _, p := range []string{folder, filepath.Join(folder, "sub")} {
+		if err := scanner.QueueScan(database, p); err != nil {
+			t.Fatalf("QueueScan failed: %v", err)
+		}
+	}
+
+	m.RemoveFolder(folder)
+
+	pending, err := scanner.GetPendingScans(database)
+	if err != nil {
+		t.Fatalf("GetPendingScans failed: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Expected queued scans cancelled, got %v", pending)
+	}
+}
+
+func TestMonitor_CancelScan(t *testing.T) {
+	database, folder, _, cleanup := setupMonitorTest(t)
+	defer cleanup()
+
+	const n = 5000
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(folder, fmt.Sprintf("album%02d", i/100))
+		os.MkdirAll(dir, 0755)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("track%04d.mp3", i)), []byte("mp3"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	indexed := func() int {
+		var count int
+		database.QueryRow("SELECT COUNT(*) FROM files").Scan(&count)
+		return count
+	}
+
+	// A queued scan is removed
+	m := New(database, Config{})
+	sub := filepath.Join(folder, "album00")
+	if err := scanner.QueueScan(database, sub); err != nil {
+		t.Fatalf("QueueScan failed: %v", err)
+	}
+	if state, err := m.CancelScan(sub); err != nil || state != CancelDequeued {
+		t.Errorf("Expected %s, got %s, %v", CancelDequeued, state, err)
+	}
+	if state, _ := m.CancelScan(sub); state != CancelNotFound {
+		t.Errorf("Expected %s for a second cancel, got %s", CancelNotFound, state)
+	}
+
+	// A running scan is stopped and leaves the queue, without stopping the monitor
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Stop()
+	waitFor(t, 5*time.Second, func() bool { return indexed() >= 100 })
+	if state, err := m.CancelScan(folder); err != nil || state != CancelCancelled {
+		t.Fatalf("Expected %s, got %s, %v", CancelCancelled, state, err)
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		pending, _ := scanner.GetPendingScans(database)
+		return len(pending) == 0 && m.Status().CurrentScan == ""
+	})
+	if got := indexed(); got >= n {
+		t.Errorf("Expected the scan cancelled, but all %d files were indexed", got)
+	}
+	if !m.Status().Running {
+		t.Error("Expected the monitor to keep running")
+	}
+}
+
+func TestMonitor_RequeueDuringScanRunsAgain(t *testing.T) {
+	database, folder, _, cleanup := setupMonitorTest(t)
+	defer cleanup()
+
+	const n = 5000
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(folder, fmt.Sprintf("album%02d", i/100))
+		os.MkdirAll(dir, 0755)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("track%04d.mp3", i)), []byte("mp3"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	indexed := func() int {
+		var count int
+		database.QueryRow("SELECT COUNT(*) FROM files").Scan(&count)
+		return count
+	}
+
+	m := New(database, Config{})
+	scansFinished := func() int {
+		count := 0
+		for _, a := range m.Status().RecentActivity {
+			if a.Kind == ActivityScan && a.Path == scanner.NormalizePath(folder) && strings.Contains(a.Message, " added, ") {
+				count++
+			}
+		}
+		return count
+	}
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Stop()
+	waitFor(t, 5*time.Second, func() bool { return indexed() >= 100 })
+
+	// Queued again while it is being scanned: the finishing scan leaves the
+	// new request queued, and the folder is scanned a second time
+	m.QueueScan(folder)
+	waitFor(t, 30*time.Second, func() bool { return scansFinished() == 2 })
+	waitFor(t, 5*time.Second, func() bool {
+		pending, _ := scanner.GetPendingScans(database)
+		return len(pending) == 0
+	})
+}
+
+func TestMonitor_ScanConcurrency(t *testing.T) {
+	database, folder, _, cleanup := setupMonitorTest(t)
+	defer cleanup()
+
+	// Two folders big enough that their scans overlap
+	second := filepath.Join(filepath.Dir(folder), "second")
+	if r := database.Write("INSERT INTO folders (path) VALUES (?)", scanner.NormalizePath(second)); r.Err != nil {
+		t.Fatalf("Failed to insert folder: %v", r.Err)
+	}
+	const n = 2000
+	for _, root := range []string{folder, second} {
+		for i := 0; i < n; i++ {
+			dir := filepath.Join(root, fmt.Sprintf("album%02d", i/100))
+			os.MkdirAll(dir, 0755)
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("track%04d.mp3", i)), []byte("mp3"), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+		}
+	}
+
+	m := New(database, Config{ScanConcurrency: 2})
+	running := func() int {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.scans)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Stop()
+	waitFor(t, 5*time.Second, func() bool { return running() == 2 })
+	waitFor(t, 30*time.Second, func() bool {
+		pending, _ := scanner.GetPendingScans(database)
+		return len(pending) == 0 && running() == 0
+	})
+	var count int
+	database.QueryRow("SELECT COUNT(*) FROM files").Scan(&count)
+	if count != 2*n {
+		t.Errorf("Expected both folders indexed (%d files), got %d", 2*n, count)
+	}
+
+	for set, want := range map[int]int{0: 1, 3: 3, 100: MaxScanConcurrency} {
+		m.SetScanConcurrency(set)
+		if got := m.ScanConcurrency(); got != want {
+			t.Errorf("SetScanConcurrency(%d): got %d, want %d", set, got, want)
+		}
+	}
+}
+
+func TestMonitor_QueuedScanUsesFreeSlot(t *testing.T) {
+	database, folder, _, cleanup := setupMonitorTest(t)
+	defer cleanup()
+
+	const n = 5000
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(folder, fmt.Sprintf("album%02d", i/100))
+		os.MkdirAll(dir, 0755)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("track%04d.mp3", i)), []byte("mp3"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	indexed := func() int {
+		var count int
+		database.QueryRow("SELECT COUNT(*) FROM files").Scan(&count)
+		return count
+	}
+
+	m := New(database, Config{ScanConcurrency: 2})
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Stop()
+	waitFor(t, 5*time.Second, func() bool { return indexed() >= 100 })
+
+	// A folder added while the long scan runs is scanned in the free slot
+	// without waiting for it
+	second := filepath.Join(filepath.Dir(folder), "second")
+	os.MkdirAll(second, 0755)
+	photo := filepath.Join(second, "photo.jpg")
+	if err := os.WriteFile(photo, []byte("jpeg"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	r := database.Write("INSERT INTO folders (path) VALUES (?)", scanner.NormalizePath(second))
+	if r.Err != nil {
+		t.Fatalf("Failed to insert folder: %v", r.Err)
+	}
+	m.AddFolder(r.LastInsertID, second)
+	m.QueueScan(second)
+
+	waitFor(t, 5*time.Second, func() bool { return isIndexed(database, photo) })
+	m.mu.Lock()
+	_, running := m.scans[scanner.NormalizePath(folder)]
+	m.mu.Unlock()
+	if !running {
+		t.Errorf("Expected the second folder scanned before the first scan finished (%d of %d files indexed)", indexed(), n)
+	}
+}
+
+func TestMonitor_ReconcilePicksUpExternalChanges(t *testing.T) {
+	database, folder, _, cleanup := setupMonitorTest(t)
+	defer cleanup()
+
+	m := New(database, Config{ReconcileInterval: 50 * time.Millisecond})
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Stop()
+
+	// Another process (addfolder) adds a folder with a file in it
+	external := filepath.Join(filepath.Dir(folder), "external")
+	if err := os.MkdirAll(external, 0755); err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	existing := filepath.Join(external, "song.mp3")
+	if err := os.WriteFile(existing, []byte("mp3"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if r := database.Write("INSERT INTO folders (path, watch_mode) VALUES (?, 'poll')", scanner.NormalizePath(external)); r.Err != nil {
+		t.Fatalf("Failed to insert folder: %v", r.Err)
+	}
+
+	waitFor(t, 5*time.Second, func() bool { return isIndexed(database, existing) })
+	if fs := folderStatus(t, m, external); fs.Mode != ModePoll {
+		t.Errorf("Expected the stored poll mode to apply, got %s", fs.Mode)
+	}
+
+	// A changed setting is re-applied
+	if r := database.Write("UPDATE folders SET poll_interval = 60 WHERE path = ?", scanner.NormalizePath(external)); r.Err != nil {
+		t.Fatalf("Failed to update folder: %v", r.Err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return folderStatus(t, m, external).PollInterval == "1m0s" })
+
+	// ...and removefolder drops it again
+	if r := database.Write("DELETE FROM folders WHERE path = ?", scanner.NormalizePath(external)); r.Err != nil {
+		t.Fatalf("Failed to delete folder: %v", r.Err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return len(m.Status().Folders) == 1 })
+}
+
+func TestStatusTracker_CapsRecentActivities(t *testing.T) {
+	for _, size := range []int{DefaultMaxActivities, 25} {
+		s := NewStatusTracker(size)
+		for i := 0; i < size+10; i++ {
+			s.Record(ActivityEvent, "", string(rune('a'+i%26)))
+		}
+
+		recent := s.Recent()
+		if len(recent) != size {
+			t.Fatalf("Expected %d activities, got %d", size, len(recent))
+		}
+		last := size + 9
+		if recent[0].Message != string(rune('a'+last%26)) {
+			t.Errorf("Expected newest activity first, got %q", recent[0].Message)
+		}
+	}
+
+	if s := NewStatusTracker(0); s.maxActivities != MinMaxActivities {
+		t.Errorf("Expected a zero size raised to %d, got %d", MinMaxActivities, s.maxActivities)
+	}
+}
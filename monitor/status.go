@@ -0,0 +1,115 @@
+package monitor
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Activity kinds
+const (
+	ActivityScan   = "scan"
+	ActivityEvent  = "event"
+	ActivityRemove = "remove"
+	ActivityWatch  = "watch"
+	ActivityError  = "error"
+)
+
+// Activity is a single entry in the monitor's recent activity log.
+type Activity struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Path    string    `json:"path,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// FolderStatus describes how a monitored folder is kept in sync.
+type FolderStatus struct {
+	ID           int64      `json:"id"`
+	Path         string     `json:"path"`
+	Mode         Mode       `json:"mode"`       // Effective mode: watch or poll
+	Configured   Mode       `json:"configured"` // folders.watch_mode setting
+	FSType       string     `json:"fs_type,omitempty"`
+	Reason       string     `json:"reason,omitempty"` // Why the folder is polled
+	PollInterval string     `json:"poll_interval,omitempty"`
+	Debounce     string     `json:"debounce,omitempty"` // How long a watched folder's events settle
+	LastScan     *time.Time `json:"last_scan,omitempty"`
+}
+
+// Status is a snapshot of the monitor state.
+type Status struct {
+	Running           bool           `json:"running"`
+	PollInterval      string         `json:"poll_interval"`
+	ReconcileInterval string         `json:"reconcile_interval"` // How often the folders table is re-read
+	DebounceTime      string         `json:"debounce_time"`      // How long file events settle before processing
+	LastReconcile     *time.Time     `json:"last_reconcile,omitempty"`
+	WatchedDirs       int            `json:"watched_dirs"`   // Directories with an active watch
+	AttemptedDirs     int            `json:"attempted_dirs"` // Directories a watch was tried for; more than watched_dirs means some changes are missed
+	CurrentScan       string         `json:"current_scan,omitempty"`
+	Folders           []FolderStatus `json:"folders"`
+	RecentActivity    []Activity     `json:"recent_activity"`
+}
+
+// StatusTracker records recent monitor activity for display.
+type StatusTracker struct {
+	mu               sync.Mutex
+	maxActivities    int
+	recentActivities []Activity
+	currentScan      string
+}
+
+// NewStatusTracker creates an empty StatusTracker that keeps the last
+// maxActivities activities; values below MinMaxActivities are raised to it.
+func NewStatusTracker(maxActivities int) *StatusTracker {
+	return &StatusTracker{maxActivities: max(maxActivities, MinMaxActivities)}
+}
+
+// Record adds an activity, dropping the oldest once the log is full. It is
+// also logged to slog.Default(): errors as warnings, the rest at debug level.
+func (s *StatusTracker) Record(kind, path, message string) {
+	level := slog.LevelDebug
+	if kind == ActivityError {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, "monitor "+kind, "path", path, "message", message)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.recentActivities = append(s.recentActivities, Activity{
+		Time:    time.Now(),
+		Kind:    kind,
+		Path:    path,
+		Message: message,
+	})
+	if len(s.recentActivities) > s.maxActivities {
+		s.recentActivities = s.recentActivities[len(s.recentActivities)-s.maxActivities:]
+	}
+}
+
+// Recent returns the recorded activities, newest first.
+func (s *StatusTracker) Recent() []Activity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Activity, len(s.recentActivities))
+	for i, a := range s.recentActivities {
+		out[len(out)-1-i] = a
+	}
+	return out
+}
+
+// SetCurrentScan records the path being scanned, or "" when idle.
+func (s *StatusTracker) SetCurrentScan(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.currentScan = path
+}
+
+// CurrentScan returns the path being scanned, or "" when idle.
+func (s *StatusTracker) CurrentScan() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.currentScan
+}
@@ -0,0 +1,573 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/scanner"
+)
+
+// Watcher defaults and the smallest accepted values.
+const (
+	DefaultDebounceTime  = 100 * time.Millisecond
+	MinDebounceTime      = 10 * time.Millisecond
+	DefaultMaxActivities = 100
+	MinMaxActivities     = 10
+	DefaultBurstEvents   = 1000
+	MinBurstEvents       = 10
+)
+
+// WatcherConfig tunes event handling. Zero values use the defaults.
+type WatcherConfig struct {
+	// DebounceTime is how long events must settle before they are processed.
+	// Editors and copies emit bursts of events per file; network filesystems
+	// deliver them more slowly and need a longer window.
+	DebounceTime time.Duration
+	// MaxActivities is how many recent activities the status keeps.
+	MaxActivities int
+	// BurstEvents is how many events a folder may deliver within one debounce
+	// window before they stop being processed one by one and the folder is
+	// rescanned once instead. Bulk imports and large copies otherwise index
+	// file by file, which a single rescan outpaces.
+	BurstEvents int
+}
+
+// Validate reports values below the supported minimums.
+func (c WatcherConfig) Validate() error {
+	if c.DebounceTime != 0 && c.DebounceTime < MinDebounceTime {
+		return fmt.Errorf("debounce time must be at least %s", MinDebounceTime)
+	}
+	if c.MaxActivities != 0 && c.MaxActivities < MinMaxActivities {
+		return fmt.Errorf("activity buffer must hold at least %d entries", MinMaxActivities)
+	}
+	if c.BurstEvents != 0 && c.BurstEvents < MinBurstEvents {
+		return fmt.Errorf("burst threshold must be at least %d events", MinBurstEvents)
+	}
+	return nil
+}
+
+// withDefaults fills in zero values and raises values below the minimums.
+func (c WatcherConfig) withDefaults() WatcherConfig {
+	if c.DebounceTime == 0 {
+		c.DebounceTime = DefaultDebounceTime
+	}
+	if c.MaxActivities == 0 {
+		c.MaxActivities = DefaultMaxActivities
+	}
+	if c.BurstEvents == 0 {
+		c.BurstEvents = DefaultBurstEvents
+	}
+	c.DebounceTime = max(c.DebounceTime, MinDebounceTime)
+	c.MaxActivities = max(c.MaxActivities, MinMaxActivities)
+	c.BurstEvents = max(c.BurstEvents, MinBurstEvents)
+	return c
+}
+
+// Watcher turns file system events under the watched folders into index
+// updates.
+type Watcher struct {
+	db          *db.DB
+	fsWatcher   fsWatcher
+	status      *StatusTracker
+	queueScan   func(path string) // Requests a rescan of a monitored folder
+	debounce    time.Duration     // Used for roots without their own
+	burstEvents int
+
+	mu        sync.Mutex
+	roots     map[string]int64         // Watched monitored folders (normalized path -> folder ID)
+	debounces map[string]time.Duration // Per-root debounce times
+	dirs      map[string]string        // Every directory with an active watch (normalized path -> path as watched)
+	failed    map[string]error         // Directories whose watch could not be added
+	batches   map[string]*eventBatch   // Debounced events waiting to be processed, by root
+	closed    bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// eventBatch collects one root's events until they settle. Each root settles
+// on its own, so a busy folder does not hold back a quiet one.
+type eventBatch struct {
+	events map[string]Op   // By path; nil once the batch is a burst
+	count  int             // Events received, the folder's rate over the window
+	burst  bool            // Too many events: rescan the folder instead
+	dirs   map[string]bool // Directories with events, to watch new ones after a burst
+	timer  *time.Timer
+}
+
+// NewWatcher creates a Watcher. Changed files and new directories are indexed
+// directly; queueScan is called with the path of a monitored folder when a new
+// directory in it cannot be watched, or after a burst of events. Only
+// cfg.DebounceTime and cfg.BurstEvents are used here; the activity buffer
+// belongs to status.
+// Returns errWatchUnsupported on platforms without file system events.
+func NewWatcher(database *db.DB, status *StatusTracker, queueScan func(path string), cfg WatcherConfig) (*Watcher, error) {
+	fsw, err := newFSWatcherFunc()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg = cfg.withDefaults()
+	w := &Watcher{
+		db:          database,
+		fsWatcher:   fsw,
+		status:      status,
+		queueScan:   queueScan,
+		debounce:    cfg.DebounceTime,
+		burstEvents: cfg.BurstEvents,
+		roots:       make(map[string]int64),
+		debounces:   make(map[string]time.Duration),
+		dirs:        make(map[string]string),
+		failed:      make(map[string]error),
+		batches:     make(map[string]*eventBatch),
+		done:        make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w, nil
+}
+
+// Close stops the watcher and discards any pending events.
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	for _, b := range w.batches {
+		b.timer.Stop()
+	}
+	w.mu.Unlock()
+
+	close(w.done)
+	err := w.fsWatcher.Close()
+	w.wg.Wait()
+	return err
+}
+
+// AddRoot starts watching a monitored folder and all its subdirectories.
+// An error means the folder itself could not be watched.
+func (w *Watcher) AddRoot(folderID int64, path string) error {
+	if err := w.addWatchRecursive(path); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.roots[scanner.NormalizePath(path)] = folderID
+	w.mu.Unlock()
+	return nil
+}
+
+// SetDebounce changes the configured DebounceTime for events arriving from
+// now on, e.g. to ride out a large import. Values below MinDebounceTime are
+// raised to it; folders with their own debounce keep it.
+func (w *Watcher) SetDebounce(d time.Duration) {
+	w.mu.Lock()
+	w.debounce = max(d, MinDebounceTime)
+	w.mu.Unlock()
+}
+
+// SetRootDebounce sets how long events in a monitored folder must settle
+// before they are processed, overriding the configured DebounceTime. Zero
+// restores it; other values are raised to MinDebounceTime.
+func (w *Watcher) SetRootDebounce(path string, d time.Duration) {
+	root := scanner.NormalizePath(path)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if d == 0 {
+		delete(w.debounces, root)
+		return
+	}
+	w.debounces[root] = max(d, MinDebounceTime)
+}
+
+// RemoveRoot stops watching a monitored folder and discards its pending events.
+func (w *Watcher) RemoveRoot(path string) {
+	root := scanner.NormalizePath(path)
+
+	w.mu.Lock()
+	delete(w.roots, root)
+	delete(w.debounces, root)
+	if b, ok := w.batches[root]; ok {
+		b.timer.Stop()
+		delete(w.batches, root)
+	}
+	w.mu.Unlock()
+
+	w.removeWatches(root, true)
+}
+
+// addWatchRecursive adds a watch for dir and every directory below it.
+// Subdirectories that cannot be watched are skipped and reported as a single
+// error activity, so a library that is only partly watched does not go unnoticed.
+func (w *Watcher) addWatchRecursive(dir string) error {
+	if err := w.addWatch(dir); err != nil {
+		return err
+	}
+
+	attempted, failed := 1, 0
+	var firstErr error
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == dir {
+			return nil
+		}
+		if scanner.IsThumbnailSidecarDir(d.Name()) {
+			return filepath.SkipDir
+		}
+		attempted++
+		if err := w.addWatch(path); err != nil {
+			failed++
+			if firstErr == nil || (isWatchLimit(err) && !isWatchLimit(firstErr)) {
+				firstErr = err
+			}
+		}
+		return nil
+	})
+
+	if failed > 0 {
+		w.status.Record(ActivityError, dir, fmt.Sprintf("%d of %d directories not watched: %v", failed, attempted, firstErr))
+	}
+	return nil
+}
+
+// addWatch watches a single directory. Running out of inotify watches or
+// instances is reported with the sysctl to raise.
+func (w *Watcher) addWatch(dir string) error {
+	key := scanner.NormalizePath(dir)
+	if err := w.fsWatcher.Add(dir); err != nil {
+		if isWatchLimit(err) {
+			err = fmt.Errorf("%w; raise the limit with sysctl fs.inotify.max_user_watches (and fs.inotify.max_user_instances) and restart", err)
+		}
+		w.mu.Lock()
+		w.failed[key] = err
+		w.mu.Unlock()
+		return err
+	}
+	w.mu.Lock()
+	w.dirs[key] = dir
+	delete(w.failed, key)
+	w.mu.Unlock()
+	return nil
+}
+
+// isWatchLimit reports whether err means the system is out of watches
+// (ENOSPC from inotify_add_watch) or of descriptors (EMFILE).
+func isWatchLimit(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE)
+}
+
+// WatchCounts returns how many directories are watched and how many watches
+// were attempted, including those that failed.
+func (w *Watcher) WatchCounts() (watched, attempted int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.dirs), len(w.dirs) + len(w.failed)
+}
+
+// removeWatches drops the watches on path and any directories below it.
+// With keepRooted set, directories still inside another watched root are kept.
+func (w *Watcher) removeWatches(path string, keepRooted bool) {
+	w.mu.Lock()
+	for dir := range w.failed {
+		if scanner.IsSubfolderOf(dir, path) {
+			if _, ok := w.rootForLocked(dir); !ok || !keepRooted {
+				delete(w.failed, dir)
+			}
+		}
+	}
+	var stale []string
+	for key, dir := range w.dirs {
+		if !scanner.IsSubfolderOf(key, path) {
+			continue
+		}
+		if _, ok := w.rootForLocked(key); ok && keepRooted {
+			continue
+		}
+		// Remove by the path the watch was added with; the key may be
+		// case folded
+		stale = append(stale, dir)
+		delete(w.dirs, key)
+	}
+	w.mu.Unlock()
+
+	for _, dir := range stale {
+		w.fsWatcher.Remove(dir)
+	}
+}
+
+// run forwards events into the debounce buffer until the watcher is closed.
+func (w *Watcher) run() {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case ev, ok := <-w.fsWatcher.Events():
+			if !ok {
+				return
+			}
+			w.queueEvent(ev)
+		case err, ok := <-w.fsWatcher.Errors():
+			if !ok {
+				return
+			}
+			w.status.Record(ActivityError, "", err.Error())
+			if errors.Is(err, errEventOverflow) {
+				w.rescanRoots()
+			}
+		}
+	}
+}
+
+// rescanRoots queues a rescan of every watched folder, after events were
+// dropped and there is no telling which of them changed.
+func (w *Watcher) rescanRoots() {
+	w.mu.Lock()
+	roots := make([]string, 0, len(w.roots))
+	for root := range w.roots {
+		roots = append(roots, root)
+	}
+	w.mu.Unlock()
+
+	for _, root := range roots {
+		w.status.Record(ActivityEvent, root, "events dropped; rescanning folder")
+		w.queueScan(root)
+	}
+}
+
+// queueEvent buffers an event in its root's batch, keyed by path, and
+// restarts that root's debounce timer. Once a batch holds more than
+// burstEvents events it stops keeping them; the folder is rescanned instead.
+func (w *Watcher) queueEvent(ev Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Thumbnails written beside the originals are neither media nor activity
+	if w.closed || scanner.IsThumbnailSidecar(ev.Name) {
+		return
+	}
+	root, ok := w.rootForLocked(ev.Name)
+	if !ok {
+		return
+	}
+
+	debounce := w.debounce
+	if d, ok := w.debounces[root]; ok {
+		debounce = d
+	}
+	b := w.batches[root]
+	if b == nil {
+		b = &eventBatch{events: make(map[string]Op), dirs: make(map[string]bool)}
+		b.timer = time.AfterFunc(debounce, func() { w.flush(root, b) })
+		w.batches[root] = b
+	} else {
+		b.timer.Reset(debounce)
+	}
+	b.count++
+	b.dirs[filepath.Dir(ev.Name)] = true
+
+	if b.burst {
+		return
+	}
+	if prev, ok := b.events[ev.Name]; ok {
+		dir := false
+		if ev.Op.Has(Create) {
+			info, err := os.Stat(ev.Name)
+			dir = err == nil && info.IsDir()
+		}
+		b.events[ev.Name] = mergeOps(prev, ev.Op, dir)
+	} else {
+		b.events[ev.Name] = ev.Op
+	}
+	if b.count > w.burstEvents {
+		b.burst = true
+		b.events = nil
+	}
+}
+
+// mergeOps combines a pending op for a path with a newer one. dir reports
+// whether the path is now a directory.
+func mergeOps(prev, next Op, dir bool) Op {
+	// Atomic save: editors write a temp file and rename it over the original,
+	// or move the original away and write a new one. Either way the path
+	// disappears and reappears within the window. Treat it as an in-place
+	// update so the existing row, and everything keyed to its ID, is kept.
+	// A directory replaced this way (mv, rsync) is a new tree to watch and
+	// index, so it stays a Create.
+	if !dir && (prev.Has(Remove) || prev.Has(Rename)) && next.Has(Create) {
+		return Write
+	}
+	// A trailing chmod must not hide the change before it
+	if next == Chmod {
+		return prev | Chmod
+	}
+	return next
+}
+
+// flush processes a root's batch once its events have settled.
+func (w *Watcher) flush(root string, b *eventBatch) {
+	w.mu.Lock()
+	if w.closed || w.batches[root] != b {
+		// Closed, root removed, or already flushed by an earlier firing
+		w.mu.Unlock()
+		return
+	}
+	delete(w.batches, root)
+	w.wg.Add(1) // Let Close wait for in-flight processing
+	w.mu.Unlock()
+	defer w.wg.Done()
+
+	if b.burst {
+		w.flushBurst(root, b)
+		return
+	}
+	for name, op := range b.events {
+		w.processEvent(Event{Name: name, Op: op})
+	}
+}
+
+// flushBurst brings the watches up to date after a burst of events in root
+// and queues a single rescan of the folder in place of per-file processing.
+func (w *Watcher) flushBurst(root string, b *eventBatch) {
+	// Drop watches on directories removed during the burst
+	w.mu.Lock()
+	var gone []string
+	for key, dir := range w.dirs {
+		if scanner.IsSubfolderOf(key, root) {
+			if _, err := os.Stat(dir); err != nil {
+				gone = append(gone, dir)
+			}
+		}
+	}
+	w.mu.Unlock()
+	for _, dir := range gone {
+		w.removeWatches(dir, false)
+	}
+
+	// Watch directories created during the burst; the rescan indexes their
+	// contents. Walking a directory covers those below it.
+	dirs := make([]string, 0, len(b.dirs))
+	for dir := range b.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	walked := ""
+	for _, dir := range dirs {
+		if walked != "" && scanner.IsSubfolderOf(dir, walked) {
+			continue
+		}
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			w.addWatchRecursive(dir)
+			walked = dir
+		}
+	}
+
+	w.status.Record(ActivityEvent, root, fmt.Sprintf("burst of %d events; rescanning folder", b.count))
+	w.queueScan(root)
+}
+
+// processEvent applies a single debounced event to the index.
+//
+//   - Remove/Rename: drop the path (and anything under it) from the index.
+//   - Create of a directory: watch it and everything below it, then index
+//     the files already inside, dropping entries of a directory it replaced.
+//     If it cannot be watched, rescan the containing folder instead.
+//   - Create/Write of a file: index just that file. A directory Write is
+//     ignored (its entries changed, which is reported separately for each entry).
+//   - Chmod on its own: ignored. Permission and metadata changes don't
+//     change anything that is indexed.
+func (w *Watcher) processEvent(ev Event) {
+	// Thumbnails written beside the originals are not media
+	if scanner.IsThumbnailSidecar(ev.Name) {
+		return
+	}
+
+	w.mu.Lock()
+	root, ok := w.rootForLocked(ev.Name)
+	folderID := w.roots[root]
+	w.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	switch {
+	case ev.Op.Has(Remove) || ev.Op.Has(Rename):
+		w.removeWatches(ev.Name, false)
+		removed, err := scanner.RemovePath(w.db, ev.Name)
+		if err != nil {
+			w.status.Record(ActivityError, ev.Name, fmt.Sprintf("remove from index: %v", err))
+			return
+		}
+		if removed > 0 {
+			w.status.Record(ActivityRemove, ev.Name, fmt.Sprintf("%d file(s) removed from index", removed))
+		}
+
+	case ev.Op.Has(Create) || ev.Op.Has(Write):
+		info, err := os.Stat(ev.Name)
+		if err != nil {
+			return // Gone again before we got to it
+		}
+		if info.IsDir() {
+			if !ev.Op.Has(Create) {
+				return
+			}
+			// Watches left from a directory moved away from this path follow
+			// it; drop them. Then watch the whole new tree before listing it:
+			// anything created meanwhile (mkdir -p, a copy in progress) is
+			// either found by the walk or reported by the new watches
+			w.removeWatches(ev.Name, false)
+			if err := w.addWatchRecursive(ev.Name); err != nil {
+				w.status.Record(ActivityError, ev.Name, fmt.Sprintf("watch directory: %v", err))
+				w.queueScan(root)
+				return
+			}
+			// A directory moved or copied in arrives with its contents
+			result, err := scanner.ScanTree(w.db, ev.Name, folderID)
+			if err != nil {
+				w.status.Record(ActivityError, ev.Name, fmt.Sprintf("index directory: %v", err))
+				return
+			}
+			for _, err := range result.Errors {
+				w.status.Record(ActivityError, ev.Name, err.Error())
+			}
+			w.status.Record(ActivityEvent, ev.Name, ev.Op.String())
+			return
+		}
+
+		// Index just the changed file; rescanning the folder for every
+		// event re-walks large libraries on each save
+		if _, err := scanner.ScanSingleFile(w.db, ev.Name, folderID); err != nil {
+			w.status.Record(ActivityError, ev.Name, fmt.Sprintf("index file: %v", err))
+			return
+		}
+		w.status.Record(ActivityEvent, ev.Name, ev.Op.String())
+
+	default:
+		// Chmod only
+	}
+}
+
+// rootForLocked returns the innermost watched root containing path.
+// Caller must hold w.mu.
+func (w *Watcher) rootForLocked(path string) (string, bool) {
+	best := ""
+	for root := range w.roots {
+		if scanner.IsSubfolderOf(path, root) && len(root) > len(best) {
+			best = root
+		}
+	}
+	return best, best != ""
+}
@@ -0,0 +1,689 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"jukel.org/q2/scanner"
+)
+
+// fakeFSWatcher is an fsWatcher that records watched directories.
+type fakeFSWatcher struct {
+	mu        sync.Mutex
+	added     []string
+	removed   []string
+	addErr    map[string]error
+	events    chan Event
+	errors    chan error
+	closeOnce sync.Once
+}
+
+func newFakeFSWatcher() *fakeFSWatcher {
+	return &fakeFSWatcher{
+		addErr: make(map[string]error),
+		events: make(chan Event),
+		errors: make(chan error),
+	}
+}
+
+func (f *fakeFSWatcher) Add(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.addErr[path]; err != nil {
+		return err
+	}
+	f.added = append(f.added, path)
+	return nil
+}
+
+func (f *fakeFSWatcher) Remove(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removed = append(f.removed, path)
+	return nil
+}
+
+func (f *fakeFSWatcher) Events() <-chan Event { return f.events }
+func (f *fakeFSWatcher) Errors() <-chan error { return f.errors }
+
+func (f *fakeFSWatcher) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.events)
+		close(f.errors)
+	})
+	return nil
+}
+
+func (f *fakeFSWatcher) watched(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range f.added {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// scanRecorder collects the folders passed to a Watcher's queueScan.
+type scanRecorder struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (r *scanRecorder) queue(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paths = append(r.paths, path)
+}
+
+func (r *scanRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.paths)
+}
+
+// setupWatcherTest returns a Watcher over a fake fsWatcher, watching the
+// test folder, along with the folder path and recorder for queued scans.
+func setupWatcherTest(t *testing.T) (*Watcher, *fakeFSWatcher, string, *scanRecorder) {
+	t.Helper()
+	return setupWatcherTestConfig(t, WatcherConfig{})
+}
+
+// setupWatcherTestConfig is setupWatcherTest with a custom WatcherConfig.
+func setupWatcherTestConfig(t *testing.T, cfg WatcherConfig) (*Watcher, *fakeFSWatcher, string, *scanRecorder) {
+	t.Helper()
+
+	database, folder, folderID, cleanup := setupMonitorTest(t)
+	t.Cleanup(cleanup)
+
+	fake := newFakeFSWatcher()
+	orig := newFSWatcherFunc
+	newFSWatcherFunc = func() (fsWatcher, error) { return fake, nil }
+	t.Cleanup(func() { newFSWatcherFunc = orig })
+
+	rec := &scanRecorder{}
+	w, err := NewWatcher(database, NewStatusTracker(DefaultMaxActivities), rec.queue, cfg)
+	if err != nil {
+		t.Fatalf("NewWatcher failed: %v", err)
+	}
+	t.Cleanup(func() { w.Close() })
+
+	if err := w.AddRoot(folderID, folder); err != nil {
+		t.Fatalf("AddRoot failed: %v", err)
+	}
+	return w, fake, folder, rec
+}
+
+func writeTestFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func TestProcessEvent_FileOps(t *testing.T) {
+	tests := []struct {
+		name        string
+		op          Op
+		wantIndexed bool
+	}{
+		{"create", Create, true},
+		{"write", Write, true},
+		{"write with chmod", Write | Chmod, true},
+		{"chmod only", Chmod, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, _, folder, rec := setupWatcherTest(t)
+			file := filepath.Join(folder, "photo.jpg")
+			writeTestFile(t, file)
+
+			w.processEvent(Event{Name: file, Op: tt.op})
+
+			if got := isIndexed(w.db, file); got != tt.wantIndexed {
+				t.Errorf("Expected indexed=%v, got %v", tt.wantIndexed, got)
+			}
+			if rec.count() != 0 {
+				t.Errorf("Expected file events not to queue a folder scan, got %d", rec.count())
+			}
+		})
+	}
+}
+
+func TestProcessEvent_ModifiedFileIndexedAlone(t *testing.T) {
+	w, _, folder, rec := setupWatcherTest(t)
+	for i := 0; i < 1000; i++ {
+		writeTestFile(t, filepath.Join(folder, fmt.Sprintf("photo%04d.jpg", i)))
+	}
+	folderID := w.roots[scanner.NormalizePath(folder)]
+	if _, err := scanner.ScanFolder(w.db, folder, folderID); err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+
+	// Make every row stale, then change one file on disk
+	if result := w.db.Write("UPDATE files SET modified_at = '2000-01-01 00:00:00'"); result.Err != nil {
+		t.Fatalf("Failed to age rows: %v", result.Err)
+	}
+	changed := filepath.Join(folder, "photo0500.jpg")
+	if err := os.WriteFile(changed, []byte("edited data"), 0644); err != nil {
+		t.Fatalf("Failed to modify file: %v", err)
+	}
+
+	w.processEvent(Event{Name: changed, Op: Write})
+
+	// A rescan would have refreshed every stale row
+	var refreshed int
+	w.db.QueryRow("SELECT COUNT(*) FROM files WHERE modified_at != '2000-01-01 00:00:00'").Scan(&refreshed)
+	if refreshed != 1 {
+		t.Errorf("Expected only the modified file to be re-indexed, got %d", refreshed)
+	}
+	var size int64
+	w.db.QueryRow("SELECT size FROM files WHERE path = ?", scanner.NormalizePath(changed)).Scan(&size)
+	if size != int64(len("edited data")) {
+		t.Errorf("Expected updated size, got %d", size)
+	}
+	if rec.count() != 0 {
+		t.Errorf("Expected no folder scan, got %d", rec.count())
+	}
+}
+
+func TestProcessEvent_ChmodRecordsNoActivity(t *testing.T) {
+	w, _, folder, _ := setupWatcherTest(t)
+	file := filepath.Join(folder, "song.mp3")
+	writeTestFile(t, file)
+
+	w.processEvent(Event{Name: file, Op: Chmod})
+
+	for _, a := range w.status.Recent() {
+		if a.Path == file {
+			t.Errorf("Expected no activity for a chmod, got %+v", a)
+		}
+	}
+}
+
+func TestProcessEvent_DirectoryOps(t *testing.T) {
+	w, fake, folder, rec := setupWatcherTest(t)
+	dir := filepath.Join(folder, "2024")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+
+	// A directory Write only means its entries changed
+	w.processEvent(Event{Name: dir, Op: Write})
+	if rec.count() != 0 {
+		t.Errorf("Expected no scan for a directory write, got %d", rec.count())
+	}
+	if fake.watched(dir) {
+		t.Error("Expected directory write not to add a watch")
+	}
+
+	w.processEvent(Event{Name: dir, Op: Create})
+	if rec.count() != 0 {
+		t.Errorf("Expected a new directory to be indexed without a folder scan, got %d", rec.count())
+	}
+	if !fake.watched(dir) {
+		t.Error("Expected new directory to be watched")
+	}
+}
+
+func TestProcessEvent_NewDirectoryTree(t *testing.T) {
+	w, fake, folder, rec := setupWatcherTest(t)
+
+	// mkdir -p and a copy land before the events for the nested entries
+	// are read, so only the top directory's Create is delivered
+	top := filepath.Join(folder, "import")
+	dirs := []string{top, filepath.Join(top, "2024"), filepath.Join(top, "2024", "summer")}
+	if err := os.MkdirAll(dirs[len(dirs)-1], 0755); err != nil {
+		t.Fatalf("Failed to create tree: %v", err)
+	}
+	var files []string
+	for _, dir := range dirs {
+		file := filepath.Join(dir, "photo.jpg")
+		writeTestFile(t, file)
+		files = append(files, file)
+	}
+
+	w.queueEvent(Event{Name: top, Op: Create})
+	waitFor(t, 2*time.Second, func() bool { return isIndexed(w.db, files[len(files)-1]) })
+
+	for _, dir := range dirs {
+		if !fake.watched(dir) {
+			t.Errorf("Expected %s to be watched", dir)
+		}
+	}
+	for _, file := range files {
+		if !isIndexed(w.db, file) {
+			t.Errorf("Expected %s to be indexed", file)
+		}
+	}
+	if rec.count() != 0 {
+		t.Errorf("Expected no folder scan, got %d", rec.count())
+	}
+}
+
+func TestProcessEvent_UnwatchableDirectoryQueuesScan(t *testing.T) {
+	w, fake, folder, rec := setupWatcherTest(t)
+	dir := filepath.Join(folder, "locked")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	fake.addErr[dir] = errors.New("no space left on device")
+
+	w.processEvent(Event{Name: dir, Op: Create})
+
+	if rec.count() != 1 {
+		t.Errorf("Expected a folder scan when the directory cannot be watched, got %d", rec.count())
+	}
+}
+
+func TestAddRoot_WatchLimitSurfaced(t *testing.T) {
+	w, fake, _, _ := setupWatcherTest(t)
+	library := filepath.Join(t.TempDir(), "library")
+	dirs := []string{library, filepath.Join(library, "a"), filepath.Join(library, "b"), filepath.Join(library, "c")}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+	// max_user_watches runs out partway through the tree
+	for _, dir := range dirs[2:] {
+		fake.addErr[dir] = &os.PathError{Op: "inotify_add_watch", Path: dir, Err: syscall.ENOSPC}
+	}
+	watchedBefore, _ := w.WatchCounts()
+
+	if err := w.AddRoot(2, library); err != nil {
+		t.Fatalf("AddRoot failed: %v", err)
+	}
+
+	var found *Activity
+	for _, a := range w.status.Recent() {
+		if a.Kind == ActivityError && a.Path == library {
+			found = &a
+			break
+		}
+	}
+	if found == nil {
+		t.Fatal("Expected the failed watches to be reported")
+	}
+	if !strings.Contains(found.Message, "2 of 4 directories") || !strings.Contains(found.Message, "fs.inotify.max_user_watches") {
+		t.Errorf("Expected a count and the sysctl to raise, got %q", found.Message)
+	}
+
+	watched, attempted := w.WatchCounts()
+	if watched != watchedBefore+2 || attempted != watchedBefore+4 {
+		t.Errorf("Expected %d of %d directories watched, got %d of %d", watchedBefore+2, watchedBefore+4, watched, attempted)
+	}
+
+	// Failing on the folder itself fails AddRoot with the same advice
+	fake.addErr[library] = &os.PathError{Op: "inotify_add_watch", Path: library, Err: syscall.ENOSPC}
+	w.RemoveRoot(library)
+	if err := w.AddRoot(2, library); err == nil || !strings.Contains(err.Error(), "fs.inotify.max_user_watches") {
+		t.Errorf("Expected AddRoot to explain the watch limit, got %v", err)
+	}
+
+	// Removing the folder forgets its failed directories
+	w.RemoveRoot(library)
+	if watched, attempted := w.WatchCounts(); watched != attempted {
+		t.Errorf("Expected no failed watches after RemoveRoot, got %d of %d", watched, attempted)
+	}
+}
+
+func TestProcessEvent_RemoveAndRename(t *testing.T) {
+	for _, op := range []Op{Remove, Rename} {
+		t.Run(op.String(), func(t *testing.T) {
+			w, _, folder, rec := setupWatcherTest(t)
+			file := filepath.Join(folder, "clip.mp4")
+			writeTestFile(t, file)
+
+			folderID := w.roots[scanner.NormalizePath(folder)]
+			if _, err := scanner.ScanFolder(w.db, folder, folderID); err != nil {
+				t.Fatalf("ScanFolder failed: %v", err)
+			}
+			if !isIndexed(w.db, file) {
+				t.Fatal("Expected file to be indexed before removal")
+			}
+			os.Remove(file)
+
+			w.processEvent(Event{Name: file, Op: op})
+
+			if isIndexed(w.db, file) {
+				t.Error("Expected file to be removed from the index")
+			}
+			if rec.count() != 0 {
+				t.Errorf("Expected no scans for %s, got %d", op, rec.count())
+			}
+		})
+	}
+}
+
+func TestProcessEvent_OutsideRootsIgnored(t *testing.T) {
+	w, _, folder, rec := setupWatcherTest(t)
+	outside := filepath.Join(filepath.Dir(folder), "elsewhere.jpg")
+	writeTestFile(t, outside)
+
+	w.processEvent(Event{Name: outside, Op: Create})
+	if rec.count() != 0 {
+		t.Errorf("Expected events outside watched folders to be ignored, got %d scans", rec.count())
+	}
+}
+
+func TestMergeOps(t *testing.T) {
+	tests := []struct {
+		prev, next Op
+		dir        bool
+		want       Op
+	}{
+		{Remove, Create, false, Write},
+		{Rename, Create, false, Write},
+		{Remove, Create, true, Create},
+		{Rename, Create, true, Create},
+		{Create, Write, false, Write},
+		{Write, Chmod, false, Write | Chmod},
+		{Create, Remove, false, Remove},
+		{Write, Rename, false, Rename},
+	}
+	for _, tt := range tests {
+		if got := mergeOps(tt.prev, tt.next, tt.dir); got != tt.want {
+			t.Errorf("mergeOps(%s, %s, %v) = %s, want %s", tt.prev, tt.next, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestAtomicSave_KeepsRow(t *testing.T) {
+	w, _, folder, _ := setupWatcherTest(t)
+	file := filepath.Join(folder, "notes.mp3")
+	writeTestFile(t, file)
+
+	folderID := w.roots[scanner.NormalizePath(folder)]
+	if _, err := scanner.ScanFolder(w.db, folder, folderID); err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	var originalID int64
+	if err := w.db.QueryRow("SELECT id FROM files WHERE path = ?", scanner.NormalizePath(file)).Scan(&originalID); err != nil {
+		t.Fatalf("File not indexed: %v", err)
+	}
+
+	// Editor moves the original away, then writes the new version in its place
+	backup := file + "~"
+	if err := os.Rename(file, backup); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	w.queueEvent(Event{Name: file, Op: Rename})
+	w.queueEvent(Event{Name: backup, Op: Create})
+	writeTestFile(t, file)
+	w.queueEvent(Event{Name: file, Op: Create})
+	os.Remove(backup)
+	w.queueEvent(Event{Name: backup, Op: Remove})
+
+	waitFor(t, 2*time.Second, func() bool {
+		for _, a := range w.status.Recent() {
+			if a.Path == file {
+				return true
+			}
+		}
+		return false
+	})
+
+	var id int64
+	if err := w.db.QueryRow("SELECT id FROM files WHERE path = ?", scanner.NormalizePath(file)).Scan(&id); err != nil {
+		t.Fatalf("Expected row to survive the atomic save: %v", err)
+	}
+	if id != originalID {
+		t.Errorf("Expected row ID %d to be preserved, got %d", originalID, id)
+	}
+
+	// The save is processed as a single in-place update
+	var ops []string
+	for _, a := range w.status.Recent() {
+		if a.Path == file {
+			ops = append(ops, a.Message)
+		}
+	}
+	if len(ops) != 1 || ops[0] != Write.String() {
+		t.Errorf("Expected one WRITE for the saved file, got %v", ops)
+	}
+}
+
+func TestReplacedDirectory_WatchedAndIndexed(t *testing.T) {
+	w, fake, folder, rec := setupWatcherTest(t)
+	dir := filepath.Join(folder, "2024")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	old := filepath.Join(dir, "old.jpg")
+	writeTestFile(t, old)
+	w.processEvent(Event{Name: dir, Op: Create})
+	if !isIndexed(w.db, old) {
+		t.Fatal("Expected the directory's file to be indexed")
+	}
+
+	// The directory is moved away and another put in its place (mv, rsync)
+	// within one debounce window
+	if err := os.Rename(dir, dir+".bak"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	w.queueEvent(Event{Name: dir, Op: Rename})
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	replacement := filepath.Join(dir, "new.jpg")
+	writeTestFile(t, replacement)
+	w.queueEvent(Event{Name: dir, Op: Create})
+
+	waitFor(t, 2*time.Second, func() bool { return isIndexed(w.db, replacement) })
+	if isIndexed(w.db, old) {
+		t.Error("Expected the replaced directory's file dropped from the index")
+	}
+	watches := 0
+	fake.mu.Lock()
+	for _, p := range fake.added {
+		if p == dir {
+			watches++
+		}
+	}
+	fake.mu.Unlock()
+	if watches != 2 {
+		t.Errorf("Expected the new directory watched again, got %d watches", watches)
+	}
+	if rec.count() != 0 {
+		t.Errorf("Expected no folder scan, got %d", rec.count())
+	}
+}
+
+func TestWatcher_DebounceCoalescesBurst(t *testing.T) {
+	const debounce = 500 * time.Millisecond
+	w, _, folder, _ := setupWatcherTestConfig(t, WatcherConfig{DebounceTime: debounce})
+	file := filepath.Join(folder, "slow.mp3")
+
+	processed := func() int {
+		n := 0
+		for _, a := range w.status.Recent() {
+			if a.Path == file {
+				n++
+			}
+		}
+		return n
+	}
+
+	// A slow copy over a network share: writes keep arriving inside the window
+	start := time.Now()
+	writeTestFile(t, file)
+	w.queueEvent(Event{Name: file, Op: Create})
+	for i := 0; i < 4; i++ {
+		time.Sleep(debounce / 5)
+		w.queueEvent(Event{Name: file, Op: Write})
+		if n := processed(); n != 0 {
+			t.Fatalf("Event processed %s into the burst, before the debounce window closed", time.Since(start))
+		}
+	}
+
+	waitFor(t, 5*time.Second, func() bool { return processed() > 0 })
+	if elapsed := time.Since(start); elapsed < debounce {
+		t.Errorf("Burst processed after %s, expected at least %s", elapsed, debounce)
+	}
+	time.Sleep(2 * debounce)
+	if n := processed(); n != 1 {
+		t.Errorf("Expected the burst to be processed once, got %d", n)
+	}
+}
+
+func TestWatcher_OverflowRescansRoots(t *testing.T) {
+	w, fake, folder, rec := setupWatcherTest(t)
+
+	// Events were dropped: every watched folder is rescanned
+	fake.errors <- errEventOverflow
+	waitFor(t, 2*time.Second, func() bool { return rec.count() == 1 })
+	rec.mu.Lock()
+	queued := rec.paths[0]
+	rec.mu.Unlock()
+	if queued != scanner.NormalizePath(folder) {
+		t.Errorf("Expected %s rescanned, got %s", folder, queued)
+	}
+
+	// Other errors are only reported
+	fake.errors <- errors.New("read failed")
+	waitFor(t, 2*time.Second, func() bool {
+		for _, a := range w.status.Recent() {
+			if a.Message == "read failed" {
+				return true
+			}
+		}
+		return false
+	})
+	if rec.count() != 1 {
+		t.Errorf("Expected no rescan for other errors, got %d", rec.count())
+	}
+}
+
+func TestWatcher_RemovesCaseFoldedWatch(t *testing.T) {
+	w, fake, folder, _ := setupWatcherTest(t)
+	scanner.SetCaseInsensitive(folder, true)
+	defer scanner.SetCaseInsensitive(folder, false)
+
+	sub := filepath.Join(folder, "MixedCase")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatalf("Failed to create subfolder: %v", err)
+	}
+	if err := w.addWatch(sub); err != nil {
+		t.Fatalf("addWatch failed: %v", err)
+	}
+
+	// The watch is removed by the path it was added with, not the folded key
+	w.removeWatches(sub, false)
+	fake.mu.Lock()
+	removed := fake.removed
+	fake.mu.Unlock()
+	if len(removed) != 1 || removed[0] != sub {
+		t.Errorf("Expected %s removed, got %v", sub, removed)
+	}
+}
+
+func TestWatcherConfig(t *testing.T) {
+	valid := []WatcherConfig{
+		{},
+		{DebounceTime: MinDebounceTime, MaxActivities: MinMaxActivities},
+		{DebounceTime: 2 * time.Second, MaxActivities: 1000},
+	}
+	for _, cfg := range valid {
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("%+v: unexpected error %v", cfg, err)
+		}
+	}
+	for _, cfg := range []WatcherConfig{{DebounceTime: time.Millisecond}, {MaxActivities: 5}, {DebounceTime: -time.Second}, {BurstEvents: 1}} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+
+	if got := (WatcherConfig{}).withDefaults(); got.DebounceTime != DefaultDebounceTime || got.MaxActivities != DefaultMaxActivities || got.BurstEvents != DefaultBurstEvents {
+		t.Errorf("Expected defaults for a zero config, got %+v", got)
+	}
+	if got := (WatcherConfig{DebounceTime: time.Millisecond, MaxActivities: 1}).withDefaults(); got.DebounceTime != MinDebounceTime || got.MaxActivities != MinMaxActivities {
+		t.Errorf("Expected values raised to the minimums, got %+v", got)
+	}
+}
+
+func TestWatcher_BurstQueuesFolderRescan(t *testing.T) {
+	w, fake, folder, rec := setupWatcherTestConfig(t, WatcherConfig{DebounceTime: 50 * time.Millisecond, BurstEvents: MinBurstEvents})
+
+	// A bulk import: more files than the burst threshold, one in a new directory
+	sub := filepath.Join(folder, "import")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	w.queueEvent(Event{Name: sub, Op: Create})
+	var files []string
+	for i := 0; i < 2*MinBurstEvents; i++ {
+		file := filepath.Join(folder, fmt.Sprintf("photo%02d.jpg", i))
+		if i == 0 {
+			file = filepath.Join(sub, "photo.jpg")
+		}
+		writeTestFile(t, file)
+		w.queueEvent(Event{Name: file, Op: Create})
+		files = append(files, file)
+	}
+
+	waitFor(t, 2*time.Second, func() bool { return rec.count() > 0 })
+	time.Sleep(100 * time.Millisecond)
+	if n := rec.count(); n != 1 {
+		t.Errorf("Expected one folder rescan for the burst, got %d", n)
+	}
+	if rec.paths[0] != scanner.NormalizePath(folder) {
+		t.Errorf("Expected a rescan of %s, got %s", folder, rec.paths[0])
+	}
+	for _, file := range files {
+		if isIndexed(w.db, file) {
+			t.Errorf("Expected %s left to the rescan, but it was indexed on its own", file)
+		}
+	}
+	if !fake.watched(sub) {
+		t.Error("Expected the directory created during the burst to be watched")
+	}
+}
+
+func TestWatcher_PerRootDebounce(t *testing.T) {
+	w, _, busy, _ := setupWatcherTestConfig(t, WatcherConfig{DebounceTime: MinDebounceTime})
+	quiet := t.TempDir()
+	if err := w.AddRoot(2, quiet); err != nil {
+		t.Fatalf("AddRoot failed: %v", err)
+	}
+	w.SetRootDebounce(busy, time.Second)
+
+	busyFile := filepath.Join(busy, "busy.jpg")
+	quietFile := filepath.Join(quiet, "quiet.jpg")
+	writeTestFile(t, busyFile)
+	writeTestFile(t, quietFile)
+	w.queueEvent(Event{Name: busyFile, Op: Create})
+	w.queueEvent(Event{Name: quietFile, Op: Create})
+
+	// The quiet folder settles on the default window, without waiting for the busy one
+	waitFor(t, 500*time.Millisecond, func() bool { return isIndexed(w.db, quietFile) })
+	if isIndexed(w.db, busyFile) {
+		t.Error("Expected the busy folder's longer debounce to hold its event back")
+	}
+	waitFor(t, 3*time.Second, func() bool { return isIndexed(w.db, busyFile) })
+}
+
+func TestWatcher_SetDebounce(t *testing.T) {
+	w, _, folder, _ := setupWatcherTestConfig(t, WatcherConfig{DebounceTime: MinDebounceTime})
+	w.SetDebounce(time.Second)
+
+	path := filepath.Join(folder, "photo.jpg")
+	writeTestFile(t, path)
+	w.queueEvent(Event{Name: path, Op: Create})
+
+	time.Sleep(300 * time.Millisecond)
+	if isIndexed(w.db, path) {
+		t.Error("Expected the longer debounce to hold the event back")
+	}
+	waitFor(t, 3*time.Second, func() bool { return isIndexed(w.db, path) })
+}
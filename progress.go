@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"jukel.org/q2/scanner"
+)
+
+// How often scan progress is shown: redrawn in place on a terminal, or
+// printed as a new line when output goes to a file or pipe.
+const (
+	progressRedrawInterval = 100 * time.Millisecond
+	progressLogInterval    = 10 * time.Second
+)
+
+// maxProgressDirLen is how much of the current directory fits on the line.
+const maxProgressDirLen = 50
+
+// scanProgressPrinter shows how a CLI scan is getting on, so a scan of a
+// large library doesn't look stuck.
+type scanProgressPrinter struct {
+	out      io.Writer
+	tty      bool
+	interval time.Duration
+	start    time.Time
+	last     time.Time
+	width    int // Length of the line drawn last, to blank out what is left of it
+}
+
+// newScanProgressPrinter returns a printer writing to f, redrawing a single
+// line if f is a terminal.
+func newScanProgressPrinter(f *os.File) *scanProgressPrinter {
+	tty := term.IsTerminal(int(f.Fd()))
+	interval := progressLogInterval
+	if tty {
+		interval = progressRedrawInterval
+	}
+	return &scanProgressPrinter{out: f, tty: tty, interval: interval, start: time.Now()}
+}
+
+// update is a scanner progress callback.
+func (p *scanProgressPrinter) update(sp scanner.ScanProgress) {
+	now := time.Now()
+	if now.Sub(p.last) < p.interval {
+		return
+	}
+	p.last = now
+
+	rate := float64(sp.FilesScanned) / max(now.Sub(p.start).Seconds(), 0.001)
+	line := fmt.Sprintf("%d files scanned (%d added, %d updated), %.0f files/s: %s",
+		sp.FilesScanned, sp.FilesAdded, sp.FilesUpdated, rate, shortenDir(sp.Dir))
+
+	if !p.tty {
+		fmt.Fprintln(p.out, line)
+		return
+	}
+	fmt.Fprintf(p.out, "\r%-*s", p.width, line)
+	p.width = len(line)
+}
+
+// finish clears the progress line so the summary starts on a clean line.
+func (p *scanProgressPrinter) finish() {
+	if p.tty && p.width > 0 {
+		fmt.Fprintf(p.out, "\r%s\r", strings.Repeat(" ", p.width))
+		p.width = 0
+	}
+}
+
+// shortenDir keeps the end of dir, the part that changes as a scan goes.
+func shortenDir(dir string) string {
+	if len(dir) <= maxProgressDirLen {
+		return dir
+	}
+	return "..." + dir[len(dir)-maxProgressDirLen+3:]
+}
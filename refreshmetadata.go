@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/files"
+	"jukel.org/q2/media"
+	"jukel.org/q2/scanner"
+)
+
+// metadataReread summarises a refresh-metadata run.
+type metadataReread struct {
+	Refreshed int // Files whose metadata was read again
+	Skipped   int // Files without metadata to read, such as videos
+	Failed    int // Files that could not be read, e.g. deleted since the last scan
+}
+
+// rereadMetadata reads the metadata of indexed files again, replacing what
+// was stored, so edits made since they were indexed (a photo's EXIF, a
+// track's tags) show up. path is an indexed file, a directory whose indexed
+// files are all read, or empty for every monitored folder. Files that cannot
+// be read are reported to w and counted, not fatal.
+func rereadMetadata(ctx context.Context, database *db.DB, ffmpegMgr *ffmpeg.Manager, path string, w io.Writer) (metadataReread, error) {
+	var result metadataReread
+
+	var targets []scanner.IndexedFile
+	if path == "" {
+		roots, err := getMonitoredFolders(database)
+		if err != nil {
+			return result, err
+		}
+		for _, root := range roots {
+			under, err := scanner.ListFilesUnder(database, root)
+			if err != nil {
+				return result, err
+			}
+			targets = append(targets, under...)
+		}
+	} else {
+		cleaned, ok := cleanPath(path)
+		if !ok {
+			return result, errors.New("path cannot be empty")
+		}
+		if f, err := files.NewRepository(database).GetByPath(normalizePath(cleaned)); err == nil {
+			if f.DeletedAt == 0 {
+				targets = []scanner.IndexedFile{{ID: f.ID, Path: f.Path}}
+			}
+		} else if !errors.Is(err, db.ErrNotFound) {
+			return result, err
+		} else if targets, err = scanner.ListFilesUnder(database, cleaned); err != nil {
+			return result, err
+		}
+		if len(targets) == 0 {
+			return result, fmt.Errorf("nothing indexed at %s", cleaned)
+		}
+	}
+
+	for _, f := range targets {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		switch err := media.RefreshMetadata(ctx, database, f.ID, ffmpegMgr); {
+		case errors.Is(err, media.ErrNoMetadata):
+			result.Skipped++
+		case err != nil:
+			result.Failed++
+			fmt.Fprintf(w, "%s: %v\n", f.Path, err)
+		default:
+			result.Refreshed++
+		}
+	}
+	return result, nil
+}
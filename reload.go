@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/monitor"
+)
+
+// settingChange is a runtime setting a reload changed.
+type settingChange struct {
+	Name string
+	From string
+	To   string
+}
+
+// reloadRuntimeSettings re-reads the stored runtime settings and applies
+// them to the running server, through the same path as POST
+// /api/settings/runtime, returning those that changed. Settings without a
+// stored value keep the value in effect.
+func reloadRuntimeSettings(database *db.DB, mon *monitor.Monitor, ffmpegMgr *ffmpeg.Manager) []settingChange {
+	before := currentRuntimeSettings(mon, ffmpegMgr)
+	applyRuntimeSettings(mon, loadRuntimeSettings(database))
+	after := currentRuntimeSettings(mon, ffmpegMgr)
+
+	var changes []settingChange
+	compare := func(name string, from, to any) {
+		if f, t := fmt.Sprint(from), fmt.Sprint(to); f != t {
+			changes = append(changes, settingChange{Name: name, From: f, To: t})
+		}
+	}
+	compare(settingWatchDebounce, *before.WatchDebounceMS, *after.WatchDebounceMS)
+	compare(settingScanConcurrency, *before.ScanConcurrency, *after.ScanConcurrency)
+	compare(settingThumbnailWorkers, *before.ThumbnailWorkers, *after.ThumbnailWorkers)
+	compare(settingLogLevel, *before.LogLevel, *after.LogLevel)
+	return changes
+}
+
+// reloadOnHangup reloads the runtime settings each time the process gets
+// SIGHUP, logging what changed, until the returned function is called.
+// Everything else serve runs with, such as its port and data directory,
+// only changes on restart. Windows never sends SIGHUP.
+func reloadOnHangup(database *db.DB, mon *monitor.Monitor, ffmpegMgr *ffmpeg.Manager) (stop func()) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-hangups:
+				changes := reloadRuntimeSettings(database, mon, ffmpegMgr)
+				for _, c := range changes {
+					slog.Info("runtime setting changed", "setting", c.Name, "from", c.From, "to", c.To)
+				}
+				slog.Info("runtime settings reloaded", "changed", len(changes),
+					"note", "flags such as -port and the data directory need a restart")
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(hangups)
+		close(done)
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"jukel.org/q2/ffmpeg"
+	"jukel.org/q2/files"
 	"jukel.org/q2/media"
 	"jukel.org/q2/db"
+	"jukel.org/q2/scanner"
 )
 
 // It processes the given path, then drains the queue iteratively (no recursion).
@@ -32,6 +37,7 @@ func refreshMetadata(database *db.DB, rootPath string, q2Dir string, ffmpegMgr *
 func runOneRefresh(database *db.DB, rootPath string, q2Dir string, ffmpegMgr *ffmpeg.Manager) {
 	// Create cancellable context
 	ctx, cancel := context.WithCancel(context.Background())
+	store := thumbnailStore(database, q2Dir)
 
 	// Set initial state
 	metadataRefreshMu.Lock()
@@ -51,35 +57,41 @@ func runOneRefresh(database *db.DB, rootPath string, q2Dir string, ffmpegMgr *ff
 
 	// Cache folder list once — avoids a full table scan per file during the walk.
 	type folderRecord struct {
-		id     int64
-		prefix string // normalised path + separator
-		exact  string // normalised path without separator
+		id       int64
+		prefix   string // normalised path + separator
+		exact    string // normalised path without separator
+		features scanner.LibraryFeatures
 	}
 	var cachedFolders []folderRecord
-	if rows, err := database.Query("SELECT id, path FROM folders ORDER BY LENGTH(path) DESC"); err == nil {
+	if rows, err := database.Query("SELECT id, path, library_type FROM folders ORDER BY LENGTH(path) DESC"); err == nil {
 		for rows.Next() {
 			var id int64
-			var p string
-			if rows.Scan(&id, &p) == nil {
+			var p, lt string
+			if rows.Scan(&id, &p, &lt) == nil {
 				norm := normalizePath(p)
 				prefix := norm
 				if !strings.HasSuffix(prefix, string(filepath.Separator)) {
 					prefix += string(filepath.Separator)
 				}
-				cachedFolders = append(cachedFolders, folderRecord{id: id, prefix: prefix, exact: norm})
+				cachedFolders = append(cachedFolders, folderRecord{
+					id:       id,
+					prefix:   prefix,
+					exact:    norm,
+					features: scanner.LibraryType(lt).Features(),
+				})
 			}
 		}
 		rows.Close()
 	}
 
-	folderIDForPath := func(filePath string) (int64, bool) {
+	folderForPath := func(filePath string) (folderRecord, bool) {
 		norm := normalizePath(filePath)
 		for _, f := range cachedFolders {
 			if norm == f.exact || strings.HasPrefix(norm, f.prefix) {
-				return f.id, true
+				return f, true
 			}
 		}
-		return 0, false
+		return folderRecord{}, false
 	}
 
 	// First pass: count files (can be cancelled)
@@ -91,6 +103,9 @@ func runOneRefresh(database *db.DB, rootPath string, q2Dir string, ffmpegMgr *ff
 			return errScanCancelled
 		default:
 		}
+		if err == nil && d.IsDir() && scanner.IsThumbnailSidecarDir(d.Name()) {
+			return filepath.SkipDir
+		}
 		if err != nil || d.IsDir() {
 			return nil
 		}
@@ -120,6 +135,10 @@ func runOneRefresh(database *db.DB, rootPath string, q2Dir string, ffmpegMgr *ff
 		default:
 		}
 
+		// Thumbnails kept beside the originals are not media
+		if err == nil && d.IsDir() && scanner.IsThumbnailSidecarDir(d.Name()) {
+			return filepath.SkipDir
+		}
 		if err != nil || d.IsDir() {
 			return nil
 		}
@@ -146,8 +165,8 @@ func runOneRefresh(database *db.DB, rootPath string, q2Dir string, ffmpegMgr *ff
 			return nil
 		}
 
-		// Get folder ID for this file (from cache — no DB query per file)
-		folderID, ok := folderIDForPath(path)
+		// Get folder for this file (from cache — no DB query per file)
+		folder, ok := folderForPath(path)
 		if !ok {
 			metadataRefreshMu.Lock()
 			metadataRefreshDone++
@@ -156,7 +175,7 @@ func runOneRefresh(database *db.DB, rootPath string, q2Dir string, ffmpegMgr *ff
 		}
 
 		// Upsert the file record
-		fileID, err := upsertFile(database, folderID, path, info)
+		fileID, err := upsertFile(database, folder.id, path, info)
 		if err != nil {
 			metadataRefreshMu.Lock()
 			metadataRefreshDone++
@@ -164,33 +183,41 @@ func runOneRefresh(database *db.DB, rootPath string, q2Dir string, ffmpegMgr *ff
 			return nil
 		}
 
-		// Extract and save metadata
+		// Extract and save metadata, honouring the folder's library type
+		features := folder.features
 		if isAudio {
-			if meta, err := media.ExtractAudioMetadata(path); err == nil {
-				// Get duration via ffprobe (tag library doesn't provide it)
-				if ffmpegMgr != nil {
-					if dur, err := ffmpegMgr.GetVideoDuration(ctx, path); err == nil {
-						d := int(dur)
-						meta.DurationSeconds = &d
-					}
+			if features.AudioMetadata {
+				if meta, err := media.ExtractAudioMetadata(ctx, path, ffmpegMgr); err == nil {
+					media.SaveAudioMetadata(database, fileID, meta)
+				}
+			}
+			// Embedded cover art doubles as the track's thumbnail
+			if features.ImageThumbnails {
+				smallPath, largePath, err := media.GenerateBothAlbumArtThumbnails(path, store)
+				if err == nil {
+					updateFileThumbnails(database, fileID, smallPath, largePath)
 				}
-				media.SaveAudioMetadata(database, fileID, meta)
 			}
 		} else if isImage {
-			if meta, err := media.ExtractEXIF(path); err == nil {
-				media.SaveImageMetadata(database, fileID, meta)
+			if features.EXIF {
+				if meta, err := media.ExtractEXIF(path); err == nil {
+					media.SaveImageMetadata(database, fileID, meta)
+				}
+				if xmp, err := media.ExtractXMP(path); err == nil {
+					media.SaveImageTags(database, fileID, xmp)
+				}
 			}
 			// Generate thumbnails for images
-			if ffmpegMgr != nil {
-				smallPath, largePath, err := media.GenerateBothThumbnails(ctx, path, q2Dir, ffmpegMgr)
-				if err == nil {
-					updateFileThumbnails(database, fileID, smallPath, largePath)
+			if ffmpegMgr != nil && features.ImageThumbnails {
+				result := media.GenerateImageThumbnails(ctx, path, store, ffmpegMgr)
+				if result.Error == nil {
+					updateImageThumbnails(database, fileID, result)
 				}
 			}
 		} else if isVideo {
 			// Generate thumbnails for videos
-			if ffmpegMgr != nil {
-				smallPath, largePath, err := media.GenerateBothVideoThumbnails(ctx, path, q2Dir, ffmpegMgr)
+			if ffmpegMgr != nil && features.VideoThumbnails {
+				smallPath, largePath, err := media.GenerateBothVideoThumbnails(ctx, path, store, ffmpegMgr)
 				if err == nil {
 					updateFileThumbnails(database, fileID, smallPath, largePath)
 				}
@@ -204,3 +231,250 @@ func runOneRefresh(database *db.DB, rootPath string, q2Dir string, ffmpegMgr *ff
 		return nil
 	})
 }
+
+// runLocationEnrichment resolves place names for geotagged images every
+// interval until ctx is cancelled. It runs apart from scanning so that
+// geocoding lookups never slow down indexing.
+func runLocationEnrichment(ctx context.Context, database *db.DB, geocoder media.Geocoder, interval time.Duration) {
+	for {
+		if n, err := media.EnrichLocations(ctx, database, geocoder); err != nil && ctx.Err() == nil {
+			fmt.Fprintln(os.Stderr, "Warning: location lookup failed:", err)
+		} else if n > 0 {
+			fmt.Printf("Resolved locations for %d images\n", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// runThumbnailEnrichment generates thumbnails for newly indexed images and
+// videos every interval until ctx is cancelled, so scans stay fast and items
+// are ready before they are first viewed. It slows to one worker while the
+// server is busy, and stops if ffmpeg is unavailable.
+func runThumbnailEnrichment(ctx context.Context, database *db.DB, q2Dir string, ffmpegMgr *ffmpeg.Manager, interval time.Duration) {
+	for {
+		result, err := media.EnrichThumbnails(ctx, database, thumbnailStore(database, q2Dir), ffmpegMgr, throttledThumbnailWorkers)
+		if errors.Is(err, ffmpeg.ErrFFmpegNotFound) {
+			fmt.Fprintln(os.Stderr, "Warning: thumbnails are not generated in the background:", err)
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			fmt.Fprintln(os.Stderr, "Warning: thumbnail generation failed:", err)
+		} else if result.Enriched > 0 || result.Failed > 0 {
+			fmt.Printf("Generated thumbnails for %d files (%d failed)\n", result.Enriched, result.Failed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// runWALCheckpoints truncates the database's WAL every interval until ctx is
+// done, so continuous monitoring writes don't grow it without bound.
+func runWALCheckpoints(ctx context.Context, database *db.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Busy means readers were still using the WAL; the next run catches up
+		if err := database.Checkpoint(db.CheckpointTruncate); err != nil && !errors.Is(err, db.ErrCheckpointBusy) {
+			fmt.Fprintln(os.Stderr, "Warning: WAL checkpoint failed:", err)
+		}
+	}
+}
+
+// trashPurgeInterval is how often runTrashPurge looks for files to purge.
+const trashPurgeInterval = time.Hour
+
+// runTrashPurge purges files that have been missing from disk for longer
+// than grace, with their albums and metadata, on start and then every
+// trashPurgeInterval until ctx is done. Files that come back within grace
+// are restored by the next scan.
+func runTrashPurge(ctx context.Context, database *db.DB, grace time.Duration) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := files.NewRepository(database).PurgeDeleted(time.Now().Add(-grace)); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: purging deleted files failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// thumbnailStore returns the thumbnail store chosen by the thumbnail_store
+// setting, writing thumbnails in the format the thumbnail_format setting
+// chooses. Unset or unknown values use the central cache in q2Dir and JPEG.
+func thumbnailStore(database *db.DB, q2Dir string) media.ThumbnailStore {
+	var placement string
+	database.QueryRow("SELECT value FROM settings WHERE key = 'thumbnail_store'").Scan(&placement)
+	store, err := media.NewThumbnailStore(placement, thumbnailFormat(database), q2Dir)
+	if err != nil {
+		return media.CentralStore{Dir: q2Dir}
+	}
+	return store
+}
+
+// thumbnailFormat returns the thumbnail format chosen by the
+// thumbnail_format setting. Unset or unknown values use JPEG.
+func thumbnailFormat(database *db.DB) string {
+	var setting string
+	database.QueryRow("SELECT value FROM settings WHERE key = 'thumbnail_format'").Scan(&setting)
+	format, err := media.ParseThumbnailFormat(setting)
+	if err != nil {
+		return media.ThumbnailFormatJPEG
+	}
+	return format
+}
+
+// generateThumbnails creates the small and large thumbnails for a media file:
+// embedded cover art for audio, a scaled copy for images and a frame for videos.
+func generateThumbnails(ctx context.Context, path string, store media.ThumbnailStore, ffmpegMgr *ffmpeg.Manager) (smallPath, largePath string, err error) {
+	switch {
+	case isAudioFile(path):
+		return media.GenerateBothAlbumArtThumbnails(path, store)
+	case isImageFile(path):
+		return media.GenerateBothThumbnails(ctx, path, store, ffmpegMgr)
+	case isVideoFile(path):
+		return media.GenerateBothVideoThumbnails(ctx, path, store, ffmpegMgr)
+	}
+	return "", "", fmt.Errorf("no thumbnails for %s", filepath.Ext(path))
+}
+
+// thumbnailMode returns the thumbnail mode chosen by the thumbnail_mode
+// setting, used when a request names none. Unset or unknown values fit.
+func thumbnailMode(database *db.DB) string {
+	var setting string
+	database.QueryRow("SELECT value FROM settings WHERE key = 'thumbnail_mode'").Scan(&setting)
+	mode, err := media.ParseThumbnailMode(setting)
+	if err != nil {
+		return media.ThumbnailModeFit
+	}
+	return mode
+}
+
+// generateModeThumbnail creates the thumbnail of an image or video at size in
+// mode, for modes the background workers do not make.
+func generateModeThumbnail(ctx context.Context, path string, store media.ThumbnailStore, size int, mode string, ffmpegMgr *ffmpeg.Manager) (string, error) {
+	switch {
+	case isImageFile(path):
+		return media.GenerateThumbnail(ctx, path, store, size, mode, ffmpegMgr)
+	case isVideoFile(path):
+		return media.GenerateVideoThumbnail(ctx, path, store, size, mode, ffmpegMgr)
+	}
+	return "", fmt.Errorf("no %s thumbnails for %s", mode, filepath.Ext(path))
+}
+
+// restoreThumbnails regenerates the thumbnails of a file whose recorded
+// thumbnails are gone from disk, e.g. after the thumbnail cache was cleared.
+// Returns false without generating anything if no thumbnail was ever
+// recorded for path, as the file's library type may not want one.
+func restoreThumbnails(ctx context.Context, database *db.DB, q2Dir string, ffmpegMgr *ffmpeg.Manager, path string) (bool, error) {
+	var fileID int64
+	var smallPath, largePath *string
+	row := database.QueryRow("SELECT id, thumbnail_small_path, thumbnail_large_path FROM files WHERE path = ?", normalizePath(path))
+	if err := row.Scan(&fileID, &smallPath, &largePath); err != nil {
+		return false, nil
+	}
+	if (smallPath == nil || *smallPath == "") && (largePath == nil || *largePath == "") {
+		return false, nil
+	}
+
+	small, large, err := generateThumbnails(ctx, path, thumbnailStore(database, q2Dir), ffmpegMgr)
+	if err != nil {
+		return true, err
+	}
+	updateFileThumbnails(database, fileID, small, large)
+	return true, nil
+}
+
+// thumbnailCheck summarises a verifyThumbnails run.
+type thumbnailCheck struct {
+	Checked     int // Files with recorded thumbnails
+	Missing     int // Files with a recorded thumbnail missing on disk
+	Regenerated int
+	Cleared     int // Missing thumbnails that could not be regenerated and were unrecorded
+}
+
+// verifyThumbnails checks every thumbnail recorded in the files table
+// exists on disk. Unless dryRun is set, missing thumbnails are
+// regenerated; those that cannot be (the source is gone or has no artwork)
+// are cleared so pages stop linking to them.
+func verifyThumbnails(ctx context.Context, database *db.DB, q2Dir string, ffmpegMgr *ffmpeg.Manager, dryRun bool) (thumbnailCheck, error) {
+	var check thumbnailCheck
+
+	type recorded struct {
+		id                   int64
+		path                 string
+		smallPath, largePath *string
+	}
+	rows, err := database.Query(`
+		SELECT id, path, thumbnail_small_path, thumbnail_large_path
+		FROM files
+		WHERE (COALESCE(thumbnail_small_path, '') != '' OR COALESCE(thumbnail_large_path, '') != '')
+		  AND deleted_at IS NULL
+		ORDER BY path
+	`)
+	if err != nil {
+		return check, err
+	}
+	var files []recorded
+	for rows.Next() {
+		var f recorded
+		if err := rows.Scan(&f.id, &f.path, &f.smallPath, &f.largePath); err == nil {
+			files = append(files, f)
+		}
+	}
+	rows.Close()
+
+	store := thumbnailStore(database, q2Dir)
+	exists := func(recorded *string) bool {
+		if recorded == nil || *recorded == "" {
+			return true
+		}
+		_, err := os.Stat(store.FullPath(*recorded))
+		return err == nil
+	}
+
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return check, err
+		}
+		check.Checked++
+		if exists(f.smallPath) && exists(f.largePath) {
+			continue
+		}
+		check.Missing++
+
+		if dryRun {
+			fmt.Printf("Missing thumbnail: %s\n", f.path)
+			continue
+		}
+
+		small, large, err := generateThumbnails(ctx, f.path, store, ffmpegMgr)
+		if err != nil {
+			fmt.Printf("Cannot regenerate thumbnail for %s: %v\n", f.path, err)
+			updateFileThumbnails(database, f.id, "", "")
+			check.Cleared++
+			continue
+		}
+		updateFileThumbnails(database, f.id, small, large)
+		check.Regenerated++
+	}
+
+	return check, nil
+}
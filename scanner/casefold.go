@@ -0,0 +1,188 @@
+package scanner
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"jukel.org/q2/db"
+)
+
+// Folders on case-insensitive volumes (ciopfs or NTFS mounts on Linux, most
+// macOS volumes) have the paths under them lowercased by NormalizePath, as
+// Windows paths always are, so Photo.JPG and photo.jpg are one file and one
+// row. Whether a folder's volume ignores case is detected once and stored in
+// folders.case_insensitive.
+var (
+	caseMu        sync.RWMutex
+	caseFoldRoots = make(map[string]bool) // Lowercased roots of case-insensitive folders
+)
+
+// DetectCaseInsensitive reports whether dir is on a volume that ignores case,
+// by creating a temporary file and looking it up under a different case.
+// Folders that cannot be written are judged by the platform instead.
+func DetectCaseInsensitive(dir string) bool {
+	f, err := os.CreateTemp(dir, ".Q2Case-*")
+	if err != nil {
+		return platformCaseInsensitive(dir)
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+
+	_, err = os.Stat(filepath.Join(filepath.Dir(name), strings.ToLower(filepath.Base(name))))
+	return err == nil
+}
+
+// SetCaseInsensitive records whether the folder at root is on a
+// case-insensitive volume, so NormalizePath folds the case of paths under it.
+func SetCaseInsensitive(root string, insensitive bool) {
+	key := strings.ToLower(filepath.Clean(root))
+
+	caseMu.Lock()
+	defer caseMu.Unlock()
+	if insensitive {
+		caseFoldRoots[key] = true
+	} else {
+		delete(caseFoldRoots, key)
+	}
+}
+
+// caseFolded reports whether path is under a folder on a case-insensitive volume.
+func caseFolded(path string) bool {
+	caseMu.RLock()
+	defer caseMu.RUnlock()
+	if len(caseFoldRoots) == 0 {
+		return false
+	}
+
+	lower := strings.ToLower(path)
+	for root := range caseFoldRoots {
+		if lower == root || strings.HasPrefix(lower, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadFolderCase registers the stored case sensitivity of every folder with
+// NormalizePath. Folders not checked yet are detected now; the stored paths
+// of those found case-insensitive are folded to match.
+func LoadFolderCase(database *db.DB) error {
+	type folderRow struct {
+		id       int64
+		path     string
+		detected bool
+	}
+	var folders []folderRow
+	rows, err := database.Query("SELECT id, path, case_insensitive FROM folders")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var f folderRow
+		var insensitive sql.NullBool
+		if err := rows.Scan(&f.id, &f.path, &insensitive); err != nil {
+			rows.Close()
+			return err
+		}
+		if insensitive.Valid {
+			SetCaseInsensitive(f.path, insensitive.Bool)
+			continue
+		}
+		folders = append(folders, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	fold := false
+	for _, f := range folders {
+		if _, err := os.Stat(f.path); err != nil {
+			continue // Offline; checked once it is back
+		}
+		insensitive := DetectCaseInsensitive(f.path)
+		SetCaseInsensitive(f.path, insensitive)
+		if r := database.Write("UPDATE folders SET case_insensitive = ? WHERE id = ?", insensitive, f.id); r.Err != nil {
+			return r.Err
+		}
+		fold = fold || insensitive
+	}
+	if fold {
+		return FoldStoredPaths(database)
+	}
+	return nil
+}
+
+// FoldStoredPaths rewrites the stored paths of folders, files and scans as
+// NormalizePath now normalizes them. A row whose folded path is already taken
+// is a phantom duplicate and is removed: a folder's files move to the
+// remaining folder, and a file's metadata, album entries, lyrics and history
+// go with it.
+func FoldStoredPaths(database *db.DB) error {
+	for _, table := range []string{"folders", "files", "scan_queue", "scan_progress"} {
+		if err := foldPathCase(database, table); err != nil {
+			return fmt.Errorf("fold %s paths: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// foldPathCase applies FoldStoredPaths to one table.
+func foldPathCase(database *db.DB, table string) error {
+	type change struct {
+		rowid int64
+		path  string
+	}
+	var changes []change
+	rows, err := database.Query("SELECT rowid, path FROM " + table)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var c change
+		var path string
+		if err := rows.Scan(&c.rowid, &path); err != nil {
+			rows.Close()
+			return err
+		}
+		if c.path = normalizePath(path); c.path != path {
+			changes = append(changes, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		r := database.Write("UPDATE OR IGNORE "+table+" SET path = ? WHERE rowid = ?", c.path, c.rowid)
+		if r.Err != nil {
+			return r.Err
+		}
+		if r.RowsAffected > 0 {
+			continue
+		}
+		var stmts []db.Statement
+		switch table {
+		case "folders":
+			stmts = append(stmts, db.Statement{
+				Query: "UPDATE files SET folder_id = (SELECT id FROM folders WHERE path = ?) WHERE folder_id = ?",
+				Args:  []interface{}{c.path, c.rowid},
+			})
+		case "files":
+			for _, dep := range []string{"image_metadata", "audio_metadata", "album_items", "lyrics", "play_history"} {
+				stmts = append(stmts, db.Statement{Query: "DELETE FROM " + dep + " WHERE file_id = ?", Args: []interface{}{c.rowid}})
+			}
+		}
+		stmts = append(stmts, db.Statement{Query: "DELETE FROM " + table + " WHERE rowid = ?", Args: []interface{}{c.rowid}})
+		if err := database.WriteTransaction(stmts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
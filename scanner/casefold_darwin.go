@@ -0,0 +1,28 @@
+//go:build darwin
+
+package scanner
+
+import (
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// pcCaseSensitive is _PC_CASE_SENSITIVE, which asks pathconf(2) whether a
+// volume tells names apart by case.
+const pcCaseSensitive = 11
+
+// platformCaseInsensitive asks the volume holding path whether it ignores
+// case, as APFS and HFS+ volumes do by default. Used when the folder cannot
+// be probed with a file. A path that does not exist is judged by its nearest
+// existing ancestor.
+func platformCaseInsensitive(path string) bool {
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if sensitive, err := unix.Pathconf(dir, pcCaseSensitive); err == nil {
+			return sensitive == 0
+		}
+		if filepath.Dir(dir) == dir {
+			return false
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !darwin
+
+package scanner
+
+import "runtime"
+
+// platformCaseInsensitive guesses from the platform whether path ignores
+// case, for folders that cannot be probed with a file.
+func platformCaseInsensitive(path string) bool {
+	return runtime.GOOS == "windows"
+}
@@ -0,0 +1,99 @@
+package scanner
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestScanFolder_CaseInsensitiveVolume(t *testing.T) {
+	database, folder, folderID := setupScanTest(t)
+	// As LoadFolderCase registers a folder found on a case-insensitive volume
+	SetCaseInsensitive(folder, true)
+	defer SetCaseInsensitive(folder, false)
+
+	original := filepath.Join(folder, "Photo.JPG")
+	writeScanFile(t, original)
+	if _, err := ScanFolder(database, folder, folderID); err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	var id int64
+	if err := database.QueryRow("SELECT id FROM files WHERE path = ?", NormalizePath(original)).Scan(&id); err != nil {
+		t.Fatalf("File not indexed: %v", err)
+	}
+
+	// The same file seen under another case is not a new one
+	renamed := filepath.Join(folder, "photo.jpg")
+	if err := os.Rename(original, renamed); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	result, err := ScanFolder(database, folder, folderID)
+	if err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	if result.FilesAdded != 0 {
+		t.Errorf("Expected no new files, got %d added", result.FilesAdded)
+	}
+	var count int
+	var renamedID int64
+	database.QueryRow("SELECT COUNT(*) FROM files").Scan(&count)
+	database.QueryRow("SELECT id FROM files WHERE path = ?", NormalizePath(renamed)).Scan(&renamedID)
+	if count != 1 || renamedID != id {
+		t.Errorf("Expected the one row (ID %d) to remain, got %d rows and ID %d", id, count, renamedID)
+	}
+}
+
+func TestNormalizePath_CaseInsensitiveFolder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows paths are always lowercased")
+	}
+	root := filepath.Join(t.TempDir(), "Music")
+	SetCaseInsensitive(root, true)
+	defer SetCaseInsensitive(root, false)
+
+	if got, want := NormalizePath(filepath.Join(root, "Album", "Track.MP3")), strings.ToLower(filepath.Join(root, "Album", "Track.MP3")); got != want {
+		t.Errorf("Expected path under a case-insensitive folder folded to %q, got %q", want, got)
+	}
+	outside := filepath.Join(filepath.Dir(root), "MusicOther", "Track.MP3")
+	if got := NormalizePath(outside); got != outside {
+		t.Errorf("Expected path outside the folder unchanged, got %q", got)
+	}
+
+	SetCaseInsensitive(root, false)
+	if got := NormalizePath(filepath.Join(root, "Track.MP3")); got != filepath.Join(root, "Track.MP3") {
+		t.Errorf("Expected case kept once the folder is case-sensitive, got %q", got)
+	}
+}
+
+func TestLoadFolderCase(t *testing.T) {
+	database, folder, folderID := setupScanTest(t)
+	defer SetCaseInsensitive(folder, false)
+
+	// The probe leaves nothing behind
+	want := DetectCaseInsensitive(folder)
+	if entries, _ := os.ReadDir(folder); len(entries) != 0 {
+		t.Errorf("Expected the probe file removed, found %d entries", len(entries))
+	}
+
+	// Folders stored before detection existed are probed on load
+	if err := LoadFolderCase(database); err != nil {
+		t.Fatalf("LoadFolderCase failed: %v", err)
+	}
+	var stored sql.NullBool
+	database.QueryRow("SELECT case_insensitive FROM folders WHERE id = ?", folderID).Scan(&stored)
+	if !stored.Valid || stored.Bool != want {
+		t.Errorf("Expected case_insensitive detected and stored, got %+v", stored)
+	}
+
+	// A stored value is used as it is, without probing again
+	database.Write("UPDATE folders SET case_insensitive = 1 WHERE id = ?", folderID)
+	if err := LoadFolderCase(database); err != nil {
+		t.Fatalf("LoadFolderCase failed: %v", err)
+	}
+	if !caseFolded(filepath.Join(folder, "Photo.JPG")) {
+		t.Error("Expected the stored case-insensitive folder registered")
+	}
+}
@@ -0,0 +1,69 @@
+package scanner
+
+import (
+	"path/filepath"
+	"strings"
+
+	"jukel.org/q2/db"
+)
+
+// IndexedFile is an indexed file, as listed by ListFilesUnder and ListFilesIn.
+type IndexedFile struct {
+	ID        int64
+	FolderID  int64 // The monitored folder, however deep the file is within it
+	Path      string
+	Filename  string
+	MediaType string // IMG, AUD or VID (image, audio or video if indexed by a metadata refresh), or empty
+	Size      int64
+}
+
+// PathPrefixRange returns the bounds of the paths under dir, normalized like
+// indexed paths: every such path p has lo <= p < hi. Comparing against them,
+// rather than matching a prefix, lets SQLite walk idx_files_path.
+func PathPrefixRange(dir string) (lo, hi string) {
+	lo = normalizePath(dir)
+	if !strings.HasSuffix(lo, string(filepath.Separator)) {
+		lo += string(filepath.Separator)
+	}
+	// The separator is ASCII, so the next byte up ends the range
+	return lo, lo[:len(lo)-1] + string(filepath.Separator+1)
+}
+
+// ListFilesUnder returns the indexed files under dir at any depth, ordered
+// by path. files.folder_id only names the monitored folder, so this is how
+// to list a subdirectory of one.
+func ListFilesUnder(database *db.DB, dir string) ([]IndexedFile, error) {
+	lo, hi := PathPrefixRange(dir)
+	return listFiles(database, "path >= ? AND path < ?", lo, hi)
+}
+
+// ListFilesIn returns the indexed files directly in dir, not in its
+// subdirectories, ordered by path.
+func ListFilesIn(database *db.DB, dir string) ([]IndexedFile, error) {
+	lo, hi := PathPrefixRange(dir)
+	// Lengths are in characters, as SQLite's substr counts them
+	return listFiles(database, "path >= ? AND path < ? AND instr(substr(path, ?), ?) = 0",
+		lo, hi, len([]rune(lo))+1, string(filepath.Separator))
+}
+
+func listFiles(database *db.DB, where string, args ...interface{}) ([]IndexedFile, error) {
+	rows, err := database.Query(`
+		SELECT id, folder_id, path, filename, COALESCE(mediatype, ''), size
+		FROM files
+		WHERE deleted_at IS NULL AND `+where+`
+		ORDER BY path`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []IndexedFile{}
+	for rows.Next() {
+		var f IndexedFile
+		if err := rows.Scan(&f.ID, &f.FolderID, &f.Path, &f.Filename, &f.MediaType, &f.Size); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
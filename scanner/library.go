@@ -0,0 +1,84 @@
+package scanner
+
+import (
+	"fmt"
+	"strings"
+
+	"jukel.org/q2/db"
+)
+
+// LibraryType classifies a monitored folder. It drives which metadata and
+// thumbnail work is performed for the files inside that folder.
+type LibraryType string
+
+// Library type constants
+const (
+	LibraryMixed  LibraryType = "mixed"
+	LibraryPhotos LibraryType = "photos"
+	LibraryMusic  LibraryType = "music"
+	LibraryVideos LibraryType = "videos"
+)
+
+// LibraryFeatures lists the processing steps enabled for a library type.
+type LibraryFeatures struct {
+	AudioMetadata   bool // Read ID3/audio tags and duration
+	EXIF            bool // Read EXIF metadata from images
+	ImageThumbnails bool // Generate thumbnails for images
+	VideoThumbnails bool // Extract thumbnail frames from videos
+}
+
+// libraryFeatures holds the defaults for each library type.
+var libraryFeatures = map[LibraryType]LibraryFeatures{
+	LibraryMixed: {
+		AudioMetadata:   true,
+		EXIF:            true,
+		ImageThumbnails: true,
+		VideoThumbnails: true,
+	},
+	LibraryPhotos: {
+		EXIF:            true,
+		ImageThumbnails: true,
+		VideoThumbnails: true, // Phone videos usually live alongside photos
+	},
+	LibraryMusic: {
+		AudioMetadata:   true,
+		ImageThumbnails: true, // Cover images (folder.jpg etc.)
+	},
+	LibraryVideos: {
+		ImageThumbnails: true,
+		VideoThumbnails: true,
+	},
+}
+
+// Features returns the processing defaults for the library type.
+// Unknown types get the permissive mixed defaults.
+func (t LibraryType) Features() LibraryFeatures {
+	if f, ok := libraryFeatures[t]; ok {
+		return f
+	}
+	return libraryFeatures[LibraryMixed]
+}
+
+// ParseLibraryType validates a library type name. An empty string maps to LibraryMixed.
+func ParseLibraryType(s string) (LibraryType, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return LibraryMixed, nil
+	}
+	t := LibraryType(s)
+	if _, ok := libraryFeatures[t]; !ok {
+		return "", fmt.Errorf("unknown library type %q (expected mixed, photos, music or videos)", s)
+	}
+	return t, nil
+}
+
+// GetFolderLibraryType returns the library type stored for a monitored folder.
+// Reports db.ErrNotFound for unknown IDs.
+func GetFolderLibraryType(database *db.DB, folderID int64) (LibraryType, error) {
+	var s string
+	row := database.QueryRow("SELECT library_type FROM folders WHERE id = ?", folderID)
+	if err := row.Scan(&s); err != nil {
+		return "", fmt.Errorf("folder %d: %w", folderID, db.Classify(err))
+	}
+	return ParseLibraryType(s)
+}
@@ -0,0 +1,37 @@
+package scanner
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"jukel.org/q2/db"
+	_ "jukel.org/q2/migrations"
+)
+
+func TestGetFolderLibraryType(t *testing.T) {
+	database, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+	folder := database.Write("INSERT INTO folders (path, library_type) VALUES ('/photos', 'photos')")
+	if folder.Err != nil {
+		t.Fatalf("Failed to insert folder: %v", folder.Err)
+	}
+
+	if got, err := GetFolderLibraryType(database, folder.LastInsertID); err != nil || got != LibraryPhotos {
+		t.Errorf("Expected photos, got %q (%v)", got, err)
+	}
+	if _, err := GetFolderLibraryType(database, folder.LastInsertID+1); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown folder, got %v", err)
+	}
+
+	// Other failures are not reported as a missing folder
+	database.Close()
+	if _, err := GetFolderLibraryType(database, folder.LastInsertID); err == nil || errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected a database error once closed, got %v", err)
+	}
+}
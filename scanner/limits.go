@@ -0,0 +1,146 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Default thresholds above which a folder needs to be confirmed before indexing.
+const (
+	DefaultMaxFiles = 200000
+	DefaultMaxBytes = 2 << 40 // 2 TiB
+)
+
+// errLimitReached stops the estimation walk early.
+var errLimitReached = errors.New("limit reached")
+
+// Limits bounds how large a folder may be before indexing it requires
+// confirmation. A zero field disables that check.
+type Limits struct {
+	MaxFiles int
+	MaxBytes int64
+}
+
+// DefaultLimits returns the default indexing limits.
+func DefaultLimits() Limits {
+	return Limits{MaxFiles: DefaultMaxFiles, MaxBytes: DefaultMaxBytes}
+}
+
+// Estimate is a quick count of the files under a folder.
+type Estimate struct {
+	Files    int
+	Bytes    int64
+	Exceeded bool // Counting stopped early because a limit was passed
+}
+
+// FolderTooLargeError is returned by CheckFolderSize when a folder exceeds the limits.
+type FolderTooLargeError struct {
+	Path     string
+	Estimate Estimate
+	Limits   Limits
+}
+
+func (e *FolderTooLargeError) Error() string {
+	if e.Limits.MaxFiles > 0 && e.Estimate.Files > e.Limits.MaxFiles {
+		return fmt.Sprintf("%s contains more than %d files", e.Path, e.Limits.MaxFiles)
+	}
+	return fmt.Sprintf("%s contains more than %s of files", e.Path, FormatSize(e.Limits.MaxBytes))
+}
+
+// EstimateFolder counts the files under root and their total size, the same
+// files ScanFolder would index, stopping as soon as either limit is passed.
+// Unreadable subdirectories are skipped.
+func EstimateFolder(root string, limits Limits) (Estimate, error) {
+	var est Estimate
+	root = LongPath(root)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if IsThumbnailSidecarDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		est.Files++
+		if info, err := d.Info(); err == nil {
+			est.Bytes += info.Size()
+		}
+
+		if (limits.MaxFiles > 0 && est.Files > limits.MaxFiles) ||
+			(limits.MaxBytes > 0 && est.Bytes > limits.MaxBytes) {
+			est.Exceeded = true
+			return errLimitReached
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errLimitReached) {
+		return est, err
+	}
+	return est, nil
+}
+
+// CheckFolderSize returns a *FolderTooLargeError if root exceeds the limits.
+func CheckFolderSize(root string, limits Limits) error {
+	est, err := EstimateFolder(root, limits)
+	if err != nil {
+		return err
+	}
+	if est.Exceeded {
+		return &FolderTooLargeError{Path: root, Estimate: est, Limits: limits}
+	}
+	return nil
+}
+
+// ParseSize parses a byte size such as "500", "750M", "2G" or "1.5TB".
+// Suffixes are binary (1K = 1024 bytes).
+func ParseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// FormatSize formats a byte count using binary units.
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}
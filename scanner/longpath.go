@@ -0,0 +1,63 @@
+package scanner
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Windows paths longer than MAX_PATH (260) fail in Win32 APIs and in child
+// processes such as ffmpeg unless they carry the \\?\ prefix. Directories
+// hit the limit earlier, as room is kept for an 8.3 file name.
+const maxShortPathLen = 248
+
+const (
+	longPathPrefix    = `\\?\`
+	longUNCPathPrefix = `\\?\UNC\`
+)
+
+// LongPath returns path in the \\?\ long-path form on Windows when it is too
+// long for MAX_PATH, so deep folders can be walked and passed to ffmpeg.
+// Short paths, paths already in that form, and paths on other platforms are
+// returned unchanged.
+func LongPath(path string) string {
+	if runtime.GOOS != "windows" || len(path) < maxShortPathLen || strings.HasPrefix(path, longPathPrefix) {
+		return path
+	}
+
+	// The prefix turns off Win32 path parsing, so the path must be absolute and clean
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\.\`) {
+		return abs
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return longUNCPathPrefix + abs[2:]
+	}
+	return longPathPrefix + abs
+}
+
+// splitLongPathPrefix splits off a \\?\ or \\?\UNC\ prefix, matched in any case.
+func splitLongPathPrefix(path string) (prefix, rest string) {
+	for _, p := range []string{longUNCPathPrefix, longPathPrefix} {
+		if len(path) >= len(p) && strings.EqualFold(path[:len(p)], p) {
+			return p, path[len(p):]
+		}
+	}
+	return "", path
+}
+
+// walkRoot returns the path to walk for root, and a function that maps each
+// walked path back onto root as it was given, so stored paths keep matching
+// the folder path whether or not the long-path form was needed to read it.
+func walkRoot(root string) (string, func(string) string) {
+	long := LongPath(root)
+	if long == root {
+		return root, func(path string) string { return path }
+	}
+	return long, func(path string) string {
+		return root + strings.TrimPrefix(path, long)
+	}
+}
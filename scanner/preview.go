@@ -0,0 +1,69 @@
+package scanner
+
+import (
+	"io/fs"
+	"path/filepath"
+)
+
+// indexBytesPerFile approximates the database space one indexed file takes,
+// including its row in files and the path/parent_path index entries.
+const indexBytesPerFile = 512
+
+// Preview is a breakdown of the files a folder contains by media type.
+type Preview struct {
+	Images  int
+	Videos  int
+	Audio   int
+	Other   int
+	Folders int
+}
+
+// Total returns the number of files that would be indexed.
+func (p Preview) Total() int {
+	return p.Images + p.Videos + p.Audio + p.Other
+}
+
+// EstimatedIndexBytes approximates how much the index grows when the folder is added.
+// Thumbnails and metadata extracted later are not included.
+func (p Preview) EstimatedIndexBytes() int64 {
+	return int64(p.Total()) * indexBytesPerFile
+}
+
+// PreviewFolder counts the files under root by media type without touching
+// the database. Only directory entries are read; files are not stat'ed.
+// Unreadable subdirectories are skipped.
+func PreviewFolder(root string) (Preview, error) {
+	var p Preview
+	root = LongPath(root)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if IsThumbnailSidecarDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			if path != root {
+				p.Folders++
+			}
+			return nil
+		}
+
+		mediaType := GetMediaType(filepath.Ext(path))
+		switch {
+		case mediaType == nil:
+			p.Other++
+		case *mediaType == MediaTypeImage:
+			p.Images++
+		case *mediaType == MediaTypeVideo:
+			p.Videos++
+		case *mediaType == MediaTypeAudio:
+			p.Audio++
+		}
+		return nil
+	})
+	return p, err
+}
@@ -0,0 +1,68 @@
+package scanner
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"jukel.org/q2/db"
+)
+
+// checkpointEvery is how many files are scanned between checkpoints.
+const checkpointEvery = 1000
+
+// maxCheckpointAge is how long an interrupted scan can be resumed. Files in
+// the directories a resume skips may have changed since; after this long a
+// fresh scan is cheaper than trusting them.
+const maxCheckpointAge = 24 * time.Hour
+
+// scanProgress is the checkpoint of an unfinished scan of a folder.
+type scanProgress struct {
+	pass       int64  // Seen pass the scan stamps files with
+	checkpoint string // Last file scanned, relative to the folder
+}
+
+// loadScanProgress returns the checkpoint of an interrupted scan of path in
+// folder folderID that can still be resumed.
+func loadScanProgress(database *db.DB, path string, folderID int64) (scanProgress, bool) {
+	var p scanProgress
+	var id int64
+	var updated time.Time
+	row := database.QueryRow("SELECT folder_id, pass, checkpoint, updated_at FROM scan_progress WHERE path = ?", normalizePath(path))
+	if err := row.Scan(&id, &p.pass, &p.checkpoint, &updated); err != nil {
+		return p, false
+	}
+	// A folder removed and added again has a new ID and none of its files indexed
+	if id != folderID || time.Since(updated) > maxCheckpointAge {
+		return p, false
+	}
+	return p, true
+}
+
+// saveScanProgress records that the scan of path has reached checkpoint.
+func saveScanProgress(database *db.DB, path string, folderID int64, p scanProgress) error {
+	return database.Write(`
+		INSERT OR REPLACE INTO scan_progress (path, folder_id, pass, checkpoint, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, normalizePath(path), folderID, p.pass, p.checkpoint, time.Now()).Err
+}
+
+// clearScanProgress forgets the checkpoint of a finished scan.
+func clearScanProgress(database *db.DB, path string) error {
+	return database.Write("DELETE FROM scan_progress WHERE path = ?", normalizePath(path)).Err
+}
+
+// walkedBy reports whether a walk that reached checkpoint has already visited
+// rel. Both are relative to the walked folder. filepath.Walk visits the
+// entries of each directory in name order and descends as it goes, so paths
+// are ordered component by component, a directory before its contents.
+func walkedBy(rel, checkpoint string) bool {
+	a := strings.Split(rel, string(filepath.Separator))
+	b := strings.Split(checkpoint, string(filepath.Separator))
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) <= len(b)
+}
@@ -0,0 +1,103 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// interruptAfter is a context that reports itself cancelled once Err has
+// been checked n times, to stop a scan partway through deterministically.
+type interruptAfter struct {
+	context.Context
+	n int
+}
+
+func (c *interruptAfter) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestScanFolder_ResumesInterruptedScan(t *testing.T) {
+	database, folder, folderID := setupScanTest(t)
+
+	// Album directories, including names that sort around the separator
+	var files []string
+	for _, album := range []string{"a", "a b", "a-b", filepath.Join("a", "disc1"), "b", "c"} {
+		for i := 0; i < 3; i++ {
+			file := filepath.Join(folder, album, fmt.Sprintf("track%d.mp3", i))
+			writeScanFile(t, file)
+			files = append(files, file)
+		}
+	}
+
+	// A file indexed earlier that has since been deleted
+	stale := filepath.Join(folder, "c", "deleted.mp3")
+	if r := database.Write("INSERT INTO files (folder_id, path, filename, size) VALUES (?, ?, 'deleted.mp3', 0)", folderID, NormalizePath(stale)); r.Err != nil {
+		t.Fatalf("Failed to insert file: %v", r.Err)
+	}
+
+	first, err := ScanFolderContext(&interruptAfter{Context: context.Background(), n: 12}, database, folder, folderID, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the scan to be interrupted, got %v", err)
+	}
+	if first.FilesAdded == 0 || first.FilesAdded >= len(files) {
+		t.Fatalf("Expected a partial scan, got %d of %d files", first.FilesAdded, len(files))
+	}
+	if !isIndexed(database, stale) {
+		t.Error("Expected no files removed by an interrupted scan")
+	}
+
+	second, err := ScanFolder(database, folder, folderID)
+	if err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	if !second.Resumed {
+		t.Error("Expected the scan to resume")
+	}
+	if first.FilesAdded+second.FilesAdded != len(files) {
+		t.Errorf("Expected each file scanned once: %d + %d added, %d files", first.FilesAdded, second.FilesAdded, len(files))
+	}
+	for _, file := range files {
+		if !isIndexed(database, file) {
+			t.Errorf("Expected %s to be indexed", file)
+		}
+	}
+	if isIndexed(database, stale) || second.FilesRemoved != 1 {
+		t.Errorf("Expected the deleted file removed once the scan completed, removed %d", second.FilesRemoved)
+	}
+
+	// A completed scan leaves nothing to resume
+	third, err := ScanFolder(database, folder, folderID)
+	if err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	if third.Resumed || third.FilesAdded != 0 || third.FilesRemoved != 0 {
+		t.Errorf("Expected a fresh scan with no changes, got %+v", third)
+	}
+}
+
+func TestWalkedBy(t *testing.T) {
+	sep := string(filepath.Separator)
+	tests := []struct {
+		rel, checkpoint string
+		want            bool
+	}{
+		{"a", "a", true},
+		{"a", "a" + sep + "disc1", true},
+		{"a" + sep + "disc1", "a", false},
+		{"a" + sep + "z.mp3", "a b", true},
+		{"a b", "a" + sep + "z.mp3", false},
+		{"a-b" + sep + "track.mp3", "b", true},
+		{"c", "b" + sep + "track.mp3", false},
+	}
+	for _, tt := range tests {
+		if got := walkedBy(tt.rel, tt.checkpoint); got != tt.want {
+			t.Errorf("walkedBy(%q, %q) = %v, want %v", tt.rel, tt.checkpoint, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package scanner
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -9,6 +11,8 @@ import (
 	"time"
 
 	"jukel.org/q2/db"
+	"jukel.org/q2/files"
+	"jukel.org/q2/folders"
 )
 
 // Media type constants
@@ -18,11 +22,33 @@ const (
 	MediaTypeAudio = "AUD"
 )
 
+// ThumbnailSidecarDir is the folder beside the originals that sidecar
+// thumbnails are kept in. It is skipped when scanning and watching.
+const ThumbnailSidecarDir = ".q2thumbs"
+
+// IsThumbnailSidecarDir reports whether name, a directory's base name, is a
+// sidecar thumbnail folder. Case is ignored, as case-insensitive volumes do.
+func IsThumbnailSidecarDir(name string) bool {
+	return strings.EqualFold(name, ThumbnailSidecarDir)
+}
+
+// IsThumbnailSidecar reports whether path is, or is inside, a sidecar thumbnail folder.
+func IsThumbnailSidecar(path string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if IsThumbnailSidecarDir(part) {
+			return true
+		}
+	}
+	return false
+}
+
 // Image file extensions
 var imageExtensions = map[string]bool{
 	".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
 	".bmp": true, ".webp": true, ".tiff": true, ".tif": true,
 	".heic": true, ".heif": true, ".raw": true, ".cr2": true, ".nef": true,
+	".nrw": true, ".arw": true, ".dng": true, ".orf": true, ".rw2": true,
+	".pef": true, ".srw": true, ".raf": true,
 }
 
 // Video file extensions
@@ -56,163 +82,393 @@ func GetMediaType(extension string) *string {
 	return nil
 }
 
+// metadataMediaTypes maps the media types metadata refresh writes to the
+// scanner's.
+var metadataMediaTypes = map[string]string{"image": MediaTypeImage, "video": MediaTypeVideo, "audio": MediaTypeAudio}
+
+// sameMediaType reports whether the stored media type is the one GetMediaType
+// gives now, however it was written.
+func sameMediaType(stored, current string) bool {
+	if mt, ok := metadataMediaTypes[stored]; ok {
+		stored = mt
+	}
+	return stored == current
+}
+
 // normalizePath applies platform-specific path normalization.
+// A \\?\ long-path prefix is kept as written so the path stays usable.
+// Paths under folders on case-insensitive volumes are lowercased like Windows
+// paths; see SetCaseInsensitive.
 func normalizePath(path string) string {
 	path = filepath.Clean(path)
 	if runtime.GOOS == "windows" {
+		prefix, rest := splitLongPathPrefix(path)
+		path = trimShareRoot(prefix + strings.ToLower(rest))
+	} else if caseFolded(path) {
 		path = strings.ToLower(path)
 	}
 	return path
 }
 
+// trimShareRoot drops the separator Clean leaves after a bare UNC share
+// (\\server\share\), so a share matches however it was typed.
+// Drive roots such as C:\ keep theirs, since C: alone means the current directory.
+func trimShareRoot(path string) string {
+	vol := filepath.VolumeName(path)
+	if !strings.HasPrefix(vol, `\\`) || path != vol+`\` {
+		return path
+	}
+	if prefix, _ := splitLongPathPrefix(vol); strings.HasPrefix(vol, `\\.\`) || prefix == longPathPrefix {
+		return path // Device path or \\?\C:\, not a share
+	}
+	return vol
+}
+
 // ScanResult holds the results of a scan operation.
 type ScanResult struct {
 	FilesAdded   int
 	FilesUpdated int
 	FilesRemoved int
 	Errors       []error
+	Resumed      bool // Continued an interrupted scan from its checkpoint
+}
+
+// ScanProgress is a snapshot of a running folder scan.
+type ScanProgress struct {
+	FilesScanned int // Files looked at so far, changed or not
+	FilesAdded   int
+	FilesUpdated int
+	Dir          string // Directory being scanned
 }
 
 // ScanFolder recursively scans a folder and indexes all files.
 // folderID is the ID of the parent folder in the folders table.
 func ScanFolder(database *db.DB, folderPath string, folderID int64) (*ScanResult, error) {
+	return ScanFolderContext(context.Background(), database, folderPath, folderID, nil)
+}
+
+// ScanFolderContext is ScanFolder, stopping when ctx is done.
+// Progress is checkpointed as the scan goes, so a scan that is cancelled or
+// crashes resumes after the last checkpoint next time the folder is scanned.
+// Files that no longer exist are only removed once a scan completes, as the
+// directories not reached yet have not been seen.
+// If onProgress is not nil it is called after each file; it should return quickly.
+func ScanFolderContext(ctx context.Context, database *db.DB, folderPath string, folderID int64, onProgress func(ScanProgress)) (*ScanResult, error) {
 	result := &ScanResult{}
+	scanned := 0
+
+	// Files found are marked seen in the database rather than collected in
+	// memory, so huge libraries scan in bounded memory
+	seen := newSeenMarker(database)
+
+	progress, resumed := loadScanProgress(database, folderPath, folderID)
+	if resumed {
+		seen.pass = progress.pass
+		result.Resumed = true
+	} else {
+		progress = scanProgress{pass: seen.pass}
+	}
+	skipTo := progress.checkpoint
 
-	// Track all file paths we encounter during scan
-	scannedPaths := make(map[string]bool)
+	checkpoint := func() error {
+		if err := seen.flush(); err != nil {
+			return err
+		}
+		return saveScanProgress(database, folderPath, folderID, progress)
+	}
 
-	err := filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
+	sinceCheckpoint := 0
+	root, rebase := walkRoot(folderPath)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		path = rebase(path)
 		if err != nil {
 			result.Errors = append(result.Errors, fmt.Errorf("error accessing %s: %w", path, err))
 			return nil // Continue walking
 		}
 
-		// Skip directories
-		if info.IsDir() {
+		// Skip what the interrupted scan already covered
+		rel, _ := filepath.Rel(folderPath, path)
+		if skipTo != "" && rel != "." && walkedBy(rel, skipTo) {
+			if info.IsDir() && !strings.HasPrefix(skipTo, rel+string(filepath.Separator)) {
+				return filepath.SkipDir // Entirely before the checkpoint
+			}
 			return nil
 		}
 
-		normalizedPath := normalizePath(path)
-		scannedPaths[normalizedPath] = true
+		// Skip directories, and thumbnails kept beside the originals
+		if info.IsDir() {
+			if IsThumbnailSidecarDir(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-		added, updated, scanErr := scanFile(database, path, info, folderID)
+		added, updated, scanErr := scanFile(database, path, info, folderID, seen)
+		progress.checkpoint = rel
 		if scanErr != nil {
 			result.Errors = append(result.Errors, fmt.Errorf("error scanning %s: %w", path, scanErr))
-			return nil // Continue walking
-		}
-
-		if added {
+		} else if added {
 			result.FilesAdded++
 		} else if updated {
 			result.FilesUpdated++
 		}
 
-		return nil
+		scanned++
+		if onProgress != nil {
+			onProgress(ScanProgress{
+				FilesScanned: scanned,
+				FilesAdded:   result.FilesAdded,
+				FilesUpdated: result.FilesUpdated,
+				Dir:          filepath.Dir(path),
+			})
+		}
+
+		if sinceCheckpoint++; sinceCheckpoint == checkpointEvery {
+			sinceCheckpoint = 0
+			if err := checkpoint(); err != nil {
+				result.Errors = append(result.Errors, fmt.Errorf("error saving scan progress: %w", err))
+			}
+		}
+		return nil // Continue walking
 	})
 
+	if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+		if progress.checkpoint != "" {
+			if err := checkpoint(); err != nil {
+				result.Errors = append(result.Errors, fmt.Errorf("error saving scan progress: %w", err))
+			}
+		}
+		return result, fmt.Errorf("scan interrupted: %w", ctxErr)
+	}
 	if err != nil {
 		return result, fmt.Errorf("error walking folder: %w", err)
 	}
 
+	if err := seen.flush(); err != nil {
+		return result, fmt.Errorf("error marking files seen: %w", err)
+	}
+
 	// Remove files that no longer exist
-	removed, removeErr := removeDeletedFiles(database, folderID, scannedPaths)
+	removed, removeErr := removeDeletedFiles(database, folderID, seen.pass)
 	if removeErr != nil {
 		result.Errors = append(result.Errors, fmt.Errorf("error removing deleted files: %w", removeErr))
 	}
 	result.FilesRemoved = removed
 
+	if err := clearScanProgress(database, folderPath); err != nil {
+		result.Errors = append(result.Errors, fmt.Errorf("error clearing scan progress: %w", err))
+	}
+	if err := folders.MarkScanned(database, folderID); err != nil {
+		result.Errors = append(result.Errors, fmt.Errorf("error recording scan time: %w", err))
+	}
+
 	return result, nil
 }
 
-// scanFile indexes a single file, returning whether it was added or updated.
-func scanFile(database *db.DB, path string, info os.FileInfo, folderID int64) (added bool, updated bool, err error) {
-	normalizedPath := normalizePath(path)
-	filename := info.Name()
-	extension := strings.ToLower(filepath.Ext(filename))
-	mediaType := GetMediaType(extension)
-	size := info.Size()
-	modTime := info.ModTime()
+// ScanSingleFile indexes one file of a monitored folder without walking the
+// rest of the folder. A file that no longer exists is removed from the index.
+func ScanSingleFile(database *db.DB, path string, folderID int64) (*ScanResult, error) {
+	result := &ScanResult{}
+	if IsThumbnailSidecar(path) {
+		return result, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return result, err
+		}
+		removed, err := RemovePath(database, path)
+		result.FilesRemoved = int(removed)
+		return result, err
+	}
+	if info.IsDir() {
+		return result, fmt.Errorf("%s is a directory", path)
+	}
 
-	// Get created time (platform-specific, use mod time as fallback)
-	createdTime := modTime
-
-	// Check if file already exists in database
-	var existingID int64
-	var existingModTime time.Time
-	row := database.QueryRow("SELECT id, modified_at FROM files WHERE path = ?", normalizedPath)
-	scanErr := row.Scan(&existingID, &existingModTime)
-
-	if scanErr == nil {
-		// File exists - check if it needs updating
-		if !modTime.Equal(existingModTime) {
-			result := database.Write(`
-				UPDATE files SET
-					filename = ?,
-					extension = ?,
-					mediatype = ?,
-					size = ?,
-					modified_at = ?,
-					indexed_at = CURRENT_TIMESTAMP
-				WHERE id = ?
-			`, filename, extension, mediaType, size, modTime, existingID)
-			if result.Err != nil {
-				return false, false, result.Err
+	seen := newSeenMarker(database)
+	added, updated, err := scanFile(database, path, info, folderID, seen)
+	if err == nil {
+		err = seen.flush()
+	}
+	if err != nil {
+		return result, err
+	}
+	if added {
+		result.FilesAdded++
+	} else if updated {
+		result.FilesUpdated++
+	}
+	return result, nil
+}
+
+// ScanTree indexes the files under dir, a directory inside the monitored
+// folder folderID, and removes index entries under dir that no longer exist.
+// Unlike ScanFolder, entries elsewhere in the folder are left alone.
+func ScanTree(database *db.DB, dir string, folderID int64) (*ScanResult, error) {
+	result := &ScanResult{}
+	seen := newSeenMarker(database)
+
+	root, rebase := walkRoot(dir)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		path = rebase(path)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Errorf("error accessing %s: %w", path, err))
+			return nil
+		}
+		if info.IsDir() {
+			if IsThumbnailSidecarDir(info.Name()) {
+				return filepath.SkipDir
 			}
-			return false, true, nil
+			return nil
 		}
-		// File unchanged
-		return false, false, nil
+
+		added, updated, scanErr := scanFile(database, path, info, folderID, seen)
+		if scanErr != nil {
+			result.Errors = append(result.Errors, fmt.Errorf("error scanning %s: %w", path, scanErr))
+			return nil
+		}
+		if added {
+			result.FilesAdded++
+		} else if updated {
+			result.FilesUpdated++
+		}
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("error walking folder: %w", err)
 	}
 
-	// File doesn't exist - insert it
-	result := database.Write(`
-		INSERT INTO files (folder_id, path, filename, extension, mediatype, size, created_at, modified_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, folderID, normalizedPath, filename, extension, mediaType, size, createdTime, modTime)
+	if err := seen.flush(); err != nil {
+		return result, fmt.Errorf("error marking files seen: %w", err)
+	}
 
-	if result.Err != nil {
-		return false, false, result.Err
+	prefix := normalizePath(dir) + string(filepath.Separator)
+	r := database.Write(`
+		UPDATE files SET deleted_at = ?
+		WHERE substr(path, 1, length(?)) = ? AND (seen_at IS NULL OR seen_at < ?) AND deleted_at IS NULL`,
+		time.Now().Unix(), prefix, prefix, seen.pass)
+	if r.Err != nil {
+		return result, r.Err
 	}
+	result.FilesRemoved = int(r.RowsAffected)
 
-	return true, false, nil
+	return result, nil
 }
 
-// removeDeletedFiles removes database entries for files that no longer exist on disk.
-func removeDeletedFiles(database *db.DB, folderID int64, existingPaths map[string]bool) (int, error) {
-	// Get all files for this folder from the database
-	rows, err := database.Query("SELECT id, path FROM files WHERE folder_id = ?", folderID)
-	if err != nil {
-		return 0, err
+// scanFile indexes a single file, returning whether it was added or updated.
+// The file is marked as found by the scan pass of seen.
+func scanFile(database *db.DB, path string, info os.FileInfo, folderID int64, seen *seenMarker) (added bool, updated bool, err error) {
+	repo := files.NewRepository(database)
+	extension := strings.ToLower(filepath.Ext(info.Name()))
+	var mediaType string
+	if t := GetMediaType(extension); t != nil {
+		mediaType = *t
 	}
-	defer rows.Close()
+	normalizedPath := normalizePath(path)
+	modTime := info.ModTime()
 
-	var idsToRemove []int64
-	for rows.Next() {
-		var id int64
-		var path string
-		if err := rows.Scan(&id, &path); err != nil {
-			return 0, err
+	existing, err := repo.GetByPath(normalizedPath)
+	if err == nil {
+		// A file that went missing and is back, e.g. after its NAS share
+		// remounted, keeps its row: albums and metadata are as they were.
+		// It counts as added, being listed again.
+		restored := existing.DeletedAt != 0
+		// A file whose stored type no longer matches its name, e.g. one indexed
+		// before its extension was recognized, is updated even if unchanged
+		if modTime.Equal(existing.ModifiedAt) && existing.Extension == extension && sameMediaType(existing.MediaType, mediaType) {
+			// File unchanged
+			if restored {
+				if err := repo.Restore(existing.ID); err != nil {
+					return false, false, err
+				}
+			}
+			return restored, false, seen.mark(existing.ID)
 		}
-
-		// If the path wasn't found during scan, mark for removal
-		if !existingPaths[path] {
-			idsToRemove = append(idsToRemove, id)
+		// Changed files get their type recomputed and their thumbnails made again
+		existing.Filename, existing.Extension, existing.MediaType = info.Name(), extension, mediaType
+		existing.Size, existing.ModifiedAt = info.Size(), modTime
+		existing.SeenAt, existing.EnrichedAt, existing.DeletedAt = seen.pass, 0, 0
+		if err := repo.Update(existing); err != nil {
+			return false, false, err
 		}
+		return restored, !restored, nil
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return false, false, err
 	}
 
-	if err := rows.Err(); err != nil {
-		return 0, err
+	// Creation time is platform-specific; the mod time stands in for it
+	if err := repo.Insert(&files.File{
+		FolderID:   folderID,
+		Path:       normalizedPath,
+		Filename:   info.Name(),
+		Extension:  extension,
+		MediaType:  mediaType,
+		Size:       info.Size(),
+		CreatedAt:  modTime,
+		ModifiedAt: modTime,
+		SeenAt:     seen.pass,
+	}); err != nil {
+		return false, false, err
 	}
+	return true, false, nil
+}
 
-	// Remove the files that no longer exist
-	for _, id := range idsToRemove {
-		result := database.Write("DELETE FROM files WHERE id = ?", id)
-		if result.Err != nil {
-			return 0, result.Err
-		}
+// removeDeletedFiles marks the files of the folder that the scan pass did not
+// find on disk as deleted, leaving their rows for files.Repository.PurgeDeleted.
+func removeDeletedFiles(database *db.DB, folderID int64, pass int64) (int, error) {
+	result := database.Write(`
+		UPDATE files SET deleted_at = ?
+		WHERE folder_id = ? AND (seen_at IS NULL OR seen_at < ?) AND deleted_at IS NULL`,
+		time.Now().Unix(), folderID, pass)
+	if result.Err != nil {
+		return 0, result.Err
+	}
+	return int(result.RowsAffected), nil
+}
+
+// seenBatchSize is how many unchanged files are marked seen per UPDATE.
+const seenBatchSize = 500
+
+// seenMarker records which files a scan pass found. Added and updated files
+// are stamped as they are written; unchanged files are stamped in batches so
+// a rescan does not cost one write per file.
+type seenMarker struct {
+	db   *db.DB
+	pass int64 // Unix nanoseconds at the start of the pass
+	ids  []int64
+}
+
+func newSeenMarker(database *db.DB) *seenMarker {
+	return &seenMarker{db: database, pass: time.Now().UnixNano()}
+}
+
+// mark records that the unchanged file id was found.
+func (m *seenMarker) mark(id int64) error {
+	m.ids = append(m.ids, id)
+	if len(m.ids) >= seenBatchSize {
+		return m.flush()
 	}
+	return nil
+}
 
-	return len(idsToRemove), nil
+// flush writes the pending marks.
+func (m *seenMarker) flush() error {
+	if len(m.ids) == 0 {
+		return nil
+	}
+	args := make([]any, 0, len(m.ids)+1)
+	args = append(args, m.pass)
+	for _, id := range m.ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(m.ids)), ",")
+	m.ids = m.ids[:0]
+	return m.db.Write("UPDATE files SET seen_at = ? WHERE id IN ("+placeholders+")", args...).Err
 }
 
 // GetFolderID retrieves the folder ID for a given path.
@@ -314,27 +570,96 @@ func GetPendingScans(database *db.DB) ([]string, error) {
 	return paths, rows.Err()
 }
 
-// MarkScanStarted marks a scan as started.
-func MarkScanStarted(database *db.DB, path string) error {
+// MarkScanStarted marks a queued scan as started and returns the ID of the
+// queue row it claimed, to complete or remove that row alone once the scan
+// ends: queueing the path again meanwhile replaces the row, and the new
+// request stays queued. Returns 0 if the scan is no longer queued, e.g.
+// because it was dequeued after GetPendingScans.
+func MarkScanStarted(database *db.DB, path string) (int64, error) {
+	normalizedPath := normalizePath(path)
+	var id int64
+	err := database.Transaction(func(tx *db.DB) error {
+		err := db.Classify(tx.QueryRow(`SELECT id FROM scan_queue WHERE path = ?`, normalizedPath).Scan(&id))
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Write(`UPDATE scan_queue SET started_at = CURRENT_TIMESTAMP WHERE id = ?`, id).Err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// MarkScanPending returns a started scan to the queue, as it was before
+// MarkScanStarted, so it runs again (and can be cancelled) after an interruption.
+func MarkScanPending(database *db.DB, path string) error {
 	normalizedPath := normalizePath(path)
 	result := database.Write(`
-		UPDATE scan_queue SET started_at = CURRENT_TIMESTAMP WHERE path = ?
+		UPDATE scan_queue SET started_at = NULL WHERE path = ? AND completed_at IS NULL
 	`, normalizedPath)
 	return result.Err
 }
 
-// MarkScanCompleted marks a scan as completed.
-func MarkScanCompleted(database *db.DB, path string) error {
-	normalizedPath := normalizePath(path)
+// MarkScanCompleted marks the scan claimed by MarkScanStarted as completed.
+func MarkScanCompleted(database *db.DB, id int64) error {
 	result := database.Write(`
-		UPDATE scan_queue SET completed_at = CURRENT_TIMESTAMP WHERE path = ?
-	`, normalizedPath)
+		UPDATE scan_queue SET completed_at = CURRENT_TIMESTAMP WHERE id = ?
+	`, id)
 	return result.Err
 }
 
-// RemoveCompletedScan removes a completed scan from the queue.
-func RemoveCompletedScan(database *db.DB, path string) error {
-	normalizedPath := normalizePath(path)
-	result := database.Write(`DELETE FROM scan_queue WHERE path = ?`, normalizedPath)
+// RemoveCompletedScan removes the scan claimed by MarkScanStarted from the
+// queue, leaving any request for the same path queued since it started.
+func RemoveCompletedScan(database *db.DB, id int64) error {
+	result := database.Write(`DELETE FROM scan_queue WHERE id = ?`, id)
 	return result.Err
 }
+
+// DequeueScan removes the queued scan of exactly path if it has not started.
+// Reports whether there was one.
+func DequeueScan(database *db.DB, path string) (bool, error) {
+	normalizedPath := normalizePath(path)
+	result := database.Write(`DELETE FROM scan_queue WHERE path = ? AND started_at IS NULL`, normalizedPath)
+	return result.RowsAffected > 0, result.Err
+}
+
+// CancelScans removes queued scans of path, or of any folder under it, that
+// have not started yet. Returns the number of scans cancelled.
+func CancelScans(database *db.DB, path string) (int64, error) {
+	normalizedPath := normalizePath(path)
+	prefix := normalizedPath + string(filepath.Separator)
+
+	result := database.Write(`
+		DELETE FROM scan_queue
+		WHERE started_at IS NULL AND (path = ? OR substr(path, 1, length(?)) = ?)
+	`, normalizedPath, prefix, prefix)
+
+	return result.RowsAffected, result.Err
+}
+
+// NormalizePath applies the platform-specific normalization used for paths
+// stored in the database.
+func NormalizePath(path string) string {
+	return normalizePath(path)
+}
+
+// RemovePath marks a file, or every file under a directory, that no longer
+// exists on disk as deleted. Their rows are kept, with their albums and
+// metadata, until files.Repository.PurgeDeleted purges them, so files that
+// come back (e.g. when a NAS share remounts) are restored as they were.
+// Returns the number of entries removed.
+func RemovePath(database *db.DB, path string) (int64, error) {
+	normalizedPath := normalizePath(path)
+	prefix := normalizedPath + string(filepath.Separator)
+
+	result := database.Write(`
+		UPDATE files SET deleted_at = ?
+		WHERE (path = ? OR substr(path, 1, length(?)) = ?) AND deleted_at IS NULL
+	`, time.Now().Unix(), normalizedPath, prefix, prefix)
+
+	return result.RowsAffected, result.Err
+}
@@ -0,0 +1,188 @@
+package scanner
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"jukel.org/q2/db"
+	_ "jukel.org/q2/migrations"
+)
+
+// setupScanTest creates a migrated database with one monitored folder.
+// Returns the database, the folder path and its ID.
+func setupScanTest(t *testing.T) (*db.DB, string, int64) {
+	t.Helper()
+	dir := t.TempDir()
+
+	database, err := db.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+
+	folder := filepath.Join(dir, "library")
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	result := database.Write("INSERT INTO folders (path) VALUES (?)", NormalizePath(folder))
+	if result.Err != nil {
+		t.Fatalf("Failed to insert folder: %v", result.Err)
+	}
+	return database, folder, result.LastInsertID
+}
+
+// writeScanFile writes a small file at path, creating its directory.
+func writeScanFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("media"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+}
+
+// isIndexed reports whether path is indexed and not marked deleted.
+func isIndexed(database *db.DB, path string) bool {
+	var n int
+	database.QueryRow("SELECT COUNT(*) FROM files WHERE path = ? AND deleted_at IS NULL", NormalizePath(path)).Scan(&n)
+	return n > 0
+}
+
+func TestScanFolder_RescanReconcilesDeletions(t *testing.T) {
+	database, folder, folderID := setupScanTest(t)
+
+	// More files than one batch of seen marks
+	const n = 1234
+	for i := 0; i < n; i++ {
+		writeScanFile(t, filepath.Join(folder, fmt.Sprintf("photo%04d.jpg", i)))
+	}
+	if _, err := ScanFolder(database, folder, folderID); err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+
+	for _, i := range []int{0, 600, n - 1} {
+		os.Remove(filepath.Join(folder, fmt.Sprintf("photo%04d.jpg", i)))
+	}
+	result, err := ScanFolder(database, folder, folderID)
+	if err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	if result.FilesRemoved != 3 || result.FilesAdded != 0 {
+		t.Errorf("Expected 3 removed and 0 added, got %+v", result)
+	}
+
+	var count int
+	database.QueryRow("SELECT COUNT(*) FROM files WHERE folder_id = ? AND deleted_at IS NULL", folderID).Scan(&count)
+	if count != n-3 {
+		t.Errorf("Expected %d unchanged files kept, got %d", n-3, count)
+	}
+}
+
+func TestScanTree_ReconcilesOnlyUnderDir(t *testing.T) {
+	database, folder, folderID := setupScanTest(t)
+
+	album := filepath.Join(folder, "album")
+	kept := filepath.Join(album, "kept.mp3")
+	gone := filepath.Join(album, "gone.mp3")
+	outside := filepath.Join(folder, "outside.mp3")
+	for _, path := range []string{kept, gone, outside} {
+		writeScanFile(t, path)
+	}
+	if _, err := ScanFolder(database, folder, folderID); err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+
+	// Both a file under the tree and one outside it are deleted; only the
+	// tree is scanned
+	os.Remove(gone)
+	os.Remove(outside)
+	added := filepath.Join(album, "disc2", "added.mp3")
+	writeScanFile(t, added)
+	result, err := ScanTree(database, album, folderID)
+	if err != nil {
+		t.Fatalf("ScanTree failed: %v", err)
+	}
+	if result.FilesAdded != 1 || result.FilesRemoved != 1 {
+		t.Errorf("Expected 1 added and 1 removed, got %+v", result)
+	}
+	if !isIndexed(database, kept) || !isIndexed(database, added) || isIndexed(database, gone) {
+		t.Error("Expected the tree's files reconciled with the disk")
+	}
+	if !isIndexed(database, outside) {
+		t.Error("Expected the file outside the tree left alone")
+	}
+}
+
+func TestScanFolder_RecomputesStaleMediaType(t *testing.T) {
+	database, folder, folderID := setupScanTest(t)
+
+	clipPath := filepath.Join(folder, "clip.mp4")
+	photoPath := filepath.Join(folder, "photo.jpg")
+	writeScanFile(t, clipPath)
+	writeScanFile(t, photoPath)
+	if _, err := ScanFolder(database, folder, folderID); err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+
+	// The clip was indexed as audio, as if its content had been, and the
+	// photo by a metadata refresh; neither file changes on disk
+	database.Write("UPDATE files SET mediatype = 'AUD', enriched_at = 1 WHERE filename = 'clip.mp4'")
+	database.Write("UPDATE files SET mediatype = 'image', enriched_at = 1 WHERE filename = 'photo.jpg'")
+
+	result, err := ScanFolder(database, folder, folderID)
+	if err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	if result.FilesUpdated != 1 {
+		t.Errorf("Expected only the clip updated, got %+v", result)
+	}
+
+	var mediaType string
+	var enriched sql.NullInt64
+	database.QueryRow("SELECT mediatype, enriched_at FROM files WHERE filename = 'clip.mp4'").Scan(&mediaType, &enriched)
+	if mediaType != MediaTypeVideo || enriched.Valid {
+		t.Errorf("Expected the clip recomputed as video and queued for thumbnails, got %q (enriched %v)", mediaType, enriched)
+	}
+	database.QueryRow("SELECT mediatype, enriched_at FROM files WHERE filename = 'photo.jpg'").Scan(&mediaType, &enriched)
+	if mediaType != "image" || !enriched.Valid {
+		t.Errorf("Expected the photo left as it was, got %q (enriched %v)", mediaType, enriched)
+	}
+
+	// A watched change indexes the file alone, the same way
+	database.Write("UPDATE files SET mediatype = 'AUD', enriched_at = 1 WHERE filename = 'clip.mp4'")
+	if result, err = ScanSingleFile(database, clipPath, folderID); err != nil || result.FilesUpdated != 1 {
+		t.Fatalf("Expected ScanSingleFile to update the clip, got %+v, %v", result, err)
+	}
+	database.QueryRow("SELECT mediatype FROM files WHERE filename = 'clip.mp4'").Scan(&mediaType)
+	if mediaType != MediaTypeVideo {
+		t.Errorf("Expected the clip recomputed as video by ScanSingleFile, got %q", mediaType)
+	}
+}
+
+func TestScanFolder_SkipsSidecarFolderInAnyCase(t *testing.T) {
+	database, folder, folderID := setupScanTest(t)
+
+	photo := filepath.Join(folder, "photo.jpg")
+	writeScanFile(t, photo)
+	for _, name := range []string{ThumbnailSidecarDir, ".Q2Thumbs"} {
+		writeScanFile(t, filepath.Join(folder, "album", name, "photo_small.jpg"))
+	}
+
+	result, err := ScanFolder(database, folder, folderID)
+	if err != nil {
+		t.Fatalf("ScanFolder failed: %v", err)
+	}
+	if result.FilesAdded != 1 || !isIndexed(database, photo) {
+		t.Errorf("Expected only the photo indexed, got %+v", result)
+	}
+	if result, err = ScanTree(database, filepath.Join(folder, "album"), folderID); err != nil || result.FilesAdded != 0 {
+		t.Errorf("Expected ScanTree to skip the sidecar folders, got %+v, %v", result, err)
+	}
+}
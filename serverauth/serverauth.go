@@ -0,0 +1,146 @@
+// Package serverauth guards the HTTP server with API keys stored in the
+// api_keys table.
+package serverauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"jukel.org/q2/db"
+)
+
+const (
+	// HeaderName carries the API key on a request; the api_key query
+	// parameter is accepted too, for links such as stream URLs.
+	HeaderName = "X-API-Key"
+	queryParam = "api_key"
+
+	keyPrefix = "q2_" // Marks q2 keys, e.g. for secret scanners
+	keyBytes  = 32
+	prefixLen = len(keyPrefix) + 8 // Stored to tell keys apart
+
+	// touchAge is how stale a key's last_used_at gets before a request
+	// updates it, so busy clients don't write on every request.
+	touchAge = "-1 minute"
+)
+
+// keyContextKey marks, in a request's context, that it carried a valid key.
+type keyContextKey struct{}
+
+// DefaultAllow is the paths served without a key by default: the health check.
+var DefaultAllow = []string{"/"}
+
+// CreateKey generates a new API key named name and stores its hash.
+// The key itself is returned and cannot be recovered afterwards.
+func CreateKey(database *db.DB, name string) (string, error) {
+	raw := make([]byte, keyBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	key := keyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	result := database.Write(
+		"INSERT INTO api_keys (name, prefix, key_hash) VALUES (?, ?, ?)",
+		strings.TrimSpace(name), key[:prefixLen], hashKey(key),
+	)
+	if result.Err != nil {
+		return "", result.Err
+	}
+	return key, nil
+}
+
+// CountKeys returns how many API keys exist.
+func CountKeys(database *db.DB) (int, error) {
+	var n int
+	err := database.QueryRow("SELECT COUNT(*) FROM api_keys").Scan(&n)
+	return n, err
+}
+
+// ValidKey reports whether key is a stored API key, and records its use
+// when last recorded over a minute ago.
+func ValidKey(database *db.DB, key string) bool {
+	if key == "" {
+		return false
+	}
+	var id int64
+	var stale bool
+	err := database.QueryRow(
+		"SELECT id, last_used_at IS NULL OR last_used_at < datetime('now', ?) FROM api_keys WHERE key_hash = ?",
+		touchAge, hashKey(key),
+	).Scan(&id, &stale)
+	if err != nil {
+		return false
+	}
+	if stale {
+		database.Write("UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?", id)
+	}
+	return true
+}
+
+// hashKey returns the stored form of key. Keys are random, so a plain
+// SHA-256 is enough; a slow password hash would only slow every request.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Middleware returns a handler that serves requests carrying a valid API
+// key, in the X-API-Key header or the api_key query parameter, with next,
+// and answers others with 401. Paths in allow are served without a key;
+// entries ending in "/" other than "/" itself also allow the paths under them.
+// Requests served with a valid key report true from Authenticated.
+func Middleware(database *db.DB, allow []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allowed(r.URL.Path, allow) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.Header.Get(HeaderName)
+		if key == "" {
+			key = r.URL.Query().Get(queryParam)
+		}
+		if !ValidKey(database, key) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keyContextKey{}, true)))
+	})
+}
+
+// Authenticated reports whether r reached its handler through Middleware
+// with a valid API key.
+func Authenticated(r *http.Request) bool {
+	ok, _ := r.Context().Value(keyContextKey{}).(bool)
+	return ok
+}
+
+// allowed reports whether path is served without a key.
+func allowed(path string, allow []string) bool {
+	for _, a := range allow {
+		if path == a || (a != "/" && strings.HasSuffix(a, "/") && strings.HasPrefix(path, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAllow splits a comma-separated list of paths, as given to serve's
+// -auth-allow flag.
+func ParseAllow(s string) []string {
+	var allow []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			allow = append(allow, p)
+		}
+	}
+	return allow
+}
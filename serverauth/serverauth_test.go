@@ -0,0 +1,152 @@
+package serverauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"jukel.org/q2/db"
+	_ "jukel.org/q2/migrations"
+)
+
+func setupTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	database, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Failed to run migrations: %v", err)
+	}
+	return database
+}
+
+func TestCreateKey_StoresOnlyHash(t *testing.T) {
+	database := setupTestDB(t)
+
+	key, err := CreateKey(database, "phone")
+	if err != nil {
+		t.Fatalf("CreateKey failed: %v", err)
+	}
+	if !strings.HasPrefix(key, keyPrefix) || len(key) < 40 {
+		t.Errorf("Unexpected key format %q", key)
+	}
+
+	var name, prefix, hash string
+	if err := database.QueryRow("SELECT name, prefix, key_hash FROM api_keys").Scan(&name, &prefix, &hash); err != nil {
+		t.Fatalf("Key not stored: %v", err)
+	}
+	if name != "phone" || !strings.HasPrefix(key, prefix) || hash == key || strings.Contains(hash, key[len(keyPrefix):]) {
+		t.Errorf("Expected name, prefix and hash stored without the key; got %q, %q, %q", name, prefix, hash)
+	}
+
+	other, _ := CreateKey(database, "")
+	if other == key {
+		t.Error("Expected a different key each time")
+	}
+	if n, _ := CountKeys(database); n != 2 {
+		t.Errorf("Expected 2 keys, got %d", n)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	database := setupTestDB(t)
+	key, err := CreateKey(database, "test")
+	if err != nil {
+		t.Fatalf("CreateKey failed: %v", err)
+	}
+
+	var authenticated bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticated = Authenticated(r)
+		w.Write([]byte("ok"))
+	})
+	handler := Middleware(database, []string{"/", "/public/"}, next)
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+		want   int
+		authed bool // Authenticated in the handler
+	}{
+		{"header key", "/api/roots", key, http.StatusOK, true},
+		{"query key", "/api/stream?path=x&api_key=" + key, "", http.StatusOK, true},
+		{"allowlisted path", "/", "", http.StatusOK, false},
+		{"allowlisted prefix", "/public/app.js", "", http.StatusOK, false},
+		{"no key", "/api/roots", "", http.StatusUnauthorized, false},
+		{"wrong key", "/api/roots", key + "x", http.StatusUnauthorized, false},
+		{"root allows only itself", "/browse", "", http.StatusUnauthorized, false},
+		{"prefix needs the separator", "/publicity", "", http.StatusUnauthorized, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set(HeaderName, tt.header)
+			}
+			authenticated = false
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("Expected %d, got %d", tt.want, rec.Code)
+			}
+			if authenticated != tt.authed {
+				t.Errorf("Expected Authenticated %v, got %v", tt.authed, authenticated)
+			}
+		})
+	}
+
+	var used int
+	database.QueryRow("SELECT COUNT(*) FROM api_keys WHERE last_used_at IS NOT NULL").Scan(&used)
+	if used != 1 {
+		t.Errorf("Expected the key's use recorded, got %d used keys", used)
+	}
+}
+
+func TestValidKey_RecordsUseAtMostEveryMinute(t *testing.T) {
+	database := setupTestDB(t)
+	key, err := CreateKey(database, "test")
+	if err != nil {
+		t.Fatalf("CreateKey failed: %v", err)
+	}
+	lastUsed := func() string {
+		var at string
+		database.QueryRow("SELECT COALESCE(last_used_at, '') FROM api_keys").Scan(&at)
+		return at
+	}
+	setLastUsed := func(modifier string) string {
+		if result := database.Write("UPDATE api_keys SET last_used_at = datetime('now', ?)", modifier); result.Err != nil {
+			t.Fatalf("Failed to set last_used_at: %v", result.Err)
+		}
+		return lastUsed()
+	}
+
+	// Used recently: left alone
+	recent := setLastUsed("-10 seconds")
+	if !ValidKey(database, key) {
+		t.Fatal("Expected the key to be valid")
+	}
+	if got := lastUsed(); got != recent {
+		t.Errorf("Expected last_used_at kept at %s, got %s", recent, got)
+	}
+
+	// Used over a minute ago: updated
+	old := setLastUsed("-2 minutes")
+	if !ValidKey(database, key) {
+		t.Fatal("Expected the key to be valid")
+	}
+	if got := lastUsed(); got == old {
+		t.Errorf("Expected last_used_at updated from %s", old)
+	}
+}
+
+func TestParseAllow(t *testing.T) {
+	got := ParseAllow(" /, /public/ ,,/health")
+	if strings.Join(got, "|") != "/|/public/|/health" {
+		t.Errorf("Unexpected allowlist %q", got)
+	}
+}
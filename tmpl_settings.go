@@ -40,7 +40,7 @@ const settingsPageHTML = `<!DOCTYPE html>
         .add-folder input::placeholder { color: #484f58; }
         .setting-row { display: flex; align-items: center; gap: 10px; margin-bottom: 10px; }
         .setting-row label { font-size: 13px; color: #8b949e; min-width: 140px; }
-        .setting-row input { flex: 1; padding: 8px 12px; background: #0d1117; border: 1px solid #30363d; border-radius: 4px; color: #c9d1d9; font-family: inherit; font-size: 13px; }
+        .setting-row input, .setting-row select { flex: 1; padding: 8px 12px; background: #0d1117; border: 1px solid #30363d; border-radius: 4px; color: #c9d1d9; font-family: inherit; font-size: 13px; }
         .setting-row input::placeholder { color: #484f58; }
         .empty { color: #484f58; font-size: 13px; padding: 10px 0; font-style: italic; }
         .status-msg { font-size: 12px; margin-top: 8px; }
@@ -80,6 +80,18 @@ const settingsPageHTML = `<!DOCTYPE html>
             <p style="font-size: 12px; color: #484f58; margin-top: 4px;">New audio files dropped in the Inbox will be copied to &lt;destination&gt;/&lt;Artist&gt;/&lt;Album&gt;/</p>
             <p class="status-msg" :class="settingsMsg.type" v-if="settingsMsg.text">{{ settingsMsg.text }}</p>
         </div>
+
+        <div class="section">
+            <h2>Thumbnails</h2>
+            <div class="setting-row">
+                <label>Store thumbnails:</label>
+                <select v-model="thumbnailStore" @change="saveSettings">
+                    <option value="central">In the Q2 cache</option>
+                    <option value="sidecar">Next to the originals</option>
+                </select>
+            </div>
+            <p style="font-size: 12px; color: #484f58; margin-top: 4px;">"Next to the originals" keeps thumbnails in a .q2thumbs folder in each folder, so they travel with the media. Read-only folders use the Q2 cache.</p>
+        </div>
     </div>
 
     <script type="module">
@@ -91,6 +103,7 @@ const settingsPageHTML = `<!DOCTYPE html>
             const newFolder = ref('');
             const folderMsg = ref({ text: '', type: '' });
             const audioDestination = ref('');
+            const thumbnailStore = ref('central');
             const settingsMsg = ref({ text: '', type: '' });
 
             const loadFolders = async () => {
@@ -103,6 +116,7 @@ const settingsPageHTML = `<!DOCTYPE html>
                 const res = await fetch('/api/settings');
                 const data = await res.json();
                 audioDestination.value = data.audio_destination || '';
+                thumbnailStore.value = data.thumbnail_store || 'central';
             };
 
             const addFolder = async () => {
@@ -148,7 +162,7 @@ const settingsPageHTML = `<!DOCTYPE html>
                     const res = await fetch('/api/settings', {
                         method: 'POST',
                         headers: { 'Content-Type': 'application/json' },
-                        body: JSON.stringify({ audio_destination: audioDestination.value })
+                        body: JSON.stringify({ audio_destination: audioDestination.value, thumbnail_store: thumbnailStore.value })
                     });
                     if (res.ok) {
                         settingsMsg.value = { text: 'Saved', type: 'ok' };
@@ -161,7 +175,7 @@ const settingsPageHTML = `<!DOCTYPE html>
 
             onMounted(() => { loadFolders(); loadSettings(); });
 
-            return { folders, newFolder, folderMsg, audioDestination, settingsMsg, addFolder, removeFolder, saveSettings };
+            return { folders, newFolder, folderMsg, audioDestination, thumbnailStore, settingsMsg, addFolder, removeFolder, saveSettings };
         }
     }).mount('#app');
     </script>
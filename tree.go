@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"jukel.org/q2/db"
+	"jukel.org/q2/scanner"
+)
+
+// TreeCounts counts the indexed files under a directory, at any depth.
+type TreeCounts struct {
+	Files  int64 `json:"files"`
+	Images int64 `json:"images"`
+	Audio  int64 `json:"audio"`
+	Videos int64 `json:"videos"`
+}
+
+// add adds the counts of c to t.
+func (t *TreeCounts) add(c TreeCounts) {
+	t.Files += c.Files
+	t.Images += c.Images
+	t.Audio += c.Audio
+	t.Videos += c.Videos
+}
+
+// TreeDir is a subdirectory in a tree level, with the counts of everything under it.
+type TreeDir struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	TreeCounts
+}
+
+// TreeFile is an indexed file directly in a tree level.
+type TreeFile struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	MediaType string `json:"mediatype"` // image, audio, video, or empty
+	Size      int64  `json:"size"`
+	BlurHash  string `json:"blurhash,omitempty"`
+}
+
+// TreeResponse is one level of a folder's tree, as returned by GET /api/tree.
+type TreeResponse struct {
+	FolderID int64      `json:"folder_id"`
+	Path     string     `json:"path"`
+	Parent   *string    `json:"parent"` // nil at the folder's root
+	Counts   TreeCounts `json:"counts"` // Everything under path
+	Dirs     []TreeDir  `json:"dirs"`
+	Files    []TreeFile `json:"files"`
+}
+
+// errTreePathOutside is returned by folderTree for paths outside the folder.
+var errTreePathOutside = errors.New("path is not within the folder")
+
+// treeMediaTypes maps the scanner's media types to the ones metadata
+// refresh writes, so both read the same.
+var treeMediaTypes = map[string]string{"IMG": "image", "AUD": "audio", "VID": "video"}
+
+// treeChildDirsQuery groups the files below a directory by the first segment
+// of their path after it, counting each subdirectory without listing its
+// files. Arguments: the separator, prefix length + 1, folder ID, the
+// directory's path range and the separator again.
+const treeChildDirsQuery = `
+	SELECT substr(rest, 1, instr(rest, ?) - 1) AS name,
+		COUNT(*),
+		SUM(CASE WHEN mediatype IN ('IMG', 'image') THEN 1 ELSE 0 END),
+		SUM(CASE WHEN mediatype IN ('AUD', 'audio') THEN 1 ELSE 0 END),
+		SUM(CASE WHEN mediatype IN ('VID', 'video') THEN 1 ELSE 0 END)
+	FROM (
+		SELECT substr(path, ?) AS rest, mediatype FROM files
+		WHERE folder_id = ? AND path >= ? AND path < ? AND deleted_at IS NULL
+	)
+	WHERE instr(rest, ?) > 0
+	GROUP BY name
+	ORDER BY name`
+
+// treeChildFilesQuery lists the files directly in a directory. Arguments:
+// folder ID, the directory's path range, prefix length + 1 and the separator.
+const treeChildFilesQuery = `
+	SELECT id, path, COALESCE(mediatype, ''), size, COALESCE(blurhash, '') FROM files
+	WHERE folder_id = ? AND path >= ? AND path < ? AND instr(substr(path, ?), ?) = 0 AND deleted_at IS NULL
+	ORDER BY path`
+
+// folderTree returns the level of the folder's tree at dir: its immediate
+// subdirectories, derived from the paths of the indexed files below them,
+// and the files directly in it. An empty dir is the folder's root.
+func folderTree(database *db.DB, folderID int64, dir string) (TreeResponse, error) {
+	var root string
+	if err := database.QueryRow("SELECT path FROM folders WHERE id = ?", folderID).Scan(&root); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return TreeResponse{}, errFolderNotFound
+		}
+		return TreeResponse{}, err
+	}
+	root = normalizePath(root)
+
+	tree := TreeResponse{FolderID: folderID, Path: root, Dirs: []TreeDir{}, Files: []TreeFile{}}
+	if dir != "" {
+		tree.Path = normalizePath(dir)
+	}
+	if tree.Path == "" || (tree.Path != root && !strings.HasPrefix(tree.Path, withSeparator(root))) {
+		return tree, errTreePathOutside
+	}
+	if tree.Path != root {
+		parent := filepath.Dir(tree.Path)
+		tree.Parent = &parent
+	}
+
+	// Lengths are in characters, as SQLite's substr counts them
+	sep := string(filepath.Separator)
+	prefix, end := scanner.PathPrefixRange(tree.Path)
+	n := len([]rune(prefix))
+
+	rows, err := database.Query(treeChildDirsQuery, sep, n+1, folderID, prefix, end, sep)
+	if err != nil {
+		return tree, err
+	}
+	for rows.Next() {
+		var d TreeDir
+		if err := rows.Scan(&d.Name, &d.Files, &d.Images, &d.Audio, &d.Videos); err != nil {
+			rows.Close()
+			return tree, err
+		}
+		d.Path = prefix + d.Name
+		tree.Counts.add(d.TreeCounts)
+		tree.Dirs = append(tree.Dirs, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return tree, err
+	}
+
+	rows, err = database.Query(treeChildFilesQuery, folderID, prefix, end, n+1, sep)
+	if err != nil {
+		return tree, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f TreeFile
+		if err := rows.Scan(&f.ID, &f.Path, &f.MediaType, &f.Size, &f.BlurHash); err != nil {
+			return tree, err
+		}
+		f.Name = filepath.Base(f.Path)
+		if mediaType, ok := treeMediaTypes[f.MediaType]; ok {
+			f.MediaType = mediaType
+		}
+		tree.Files = append(tree.Files, f)
+
+		tree.Counts.Files++
+		switch f.MediaType {
+		case "image":
+			tree.Counts.Images++
+		case "audio":
+			tree.Counts.Audio++
+		case "video":
+			tree.Counts.Videos++
+		}
+	}
+	return tree, rows.Err()
+}
+
+// withSeparator returns path ending in a path separator.
+func withSeparator(path string) string {
+	if strings.HasSuffix(path, string(filepath.Separator)) {
+		return path
+	}
+	return path + string(filepath.Separator)
+}
+
+// makeTreeHandler creates a handler for GET /api/tree, which returns a level
+// of a folder's tree from the index: the subdirectories and files under
+// path, with counts per media type. Without folder_id, the monitored folder
+// holding path is used, so clients can browse by path alone.
+// Query params: folder_id, path (defaults to the folder's root; required without folder_id)
+func makeTreeHandler(database *db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+
+		path := r.URL.Query().Get("path")
+		var folderID int64
+		if param := r.URL.Query().Get("folder_id"); param != "" || path == "" {
+			id, err := strconv.ParseInt(param, 10, 64)
+			if err != nil || id <= 0 {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "folder_id or path parameter required"})
+				return
+			}
+			folderID = id
+		} else {
+			cleaned, ok := cleanPath(path)
+			if !ok {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid path"})
+				return
+			}
+			roots, err := getMonitoredFolders(database)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+				return
+			}
+			if isPathWithinRoots(cleaned, roots) == "" {
+				writeJSON(w, http.StatusForbidden, ErrorResponse{Error: "path not within monitored folders"})
+				return
+			}
+			if folderID, err = getFolderIDForPath(database, cleaned); err != nil {
+				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+				return
+			}
+		}
+
+		tree, err := folderTree(database, folderID, path)
+		switch {
+		case errors.Is(err, errFolderNotFound):
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "folder not found"})
+			return
+		case errors.Is(err, errTreePathOutside):
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "database error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, tree)
+	}
+}
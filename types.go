@@ -44,6 +44,7 @@ type FileEntry struct {
 	MediaType      string `json:"mediaType,omitempty"`      // "image", "audio", "video", or empty
 	ThumbnailSmall string `json:"thumbnailSmall,omitempty"` // URL to small thumbnail
 	ThumbnailLarge string `json:"thumbnailLarge,omitempty"` // URL to large thumbnail
+	BlurHash       string `json:"blurHash,omitempty"`       // Placeholder for the small thumbnail
 	// Audio-specific metadata
 	Title    string `json:"title,omitempty"`
 	Artist   string `json:"artist,omitempty"`
@@ -73,6 +74,7 @@ type CastPlayRequest struct {
 // CastConnectRequest is the request body for /api/cast/connect.
 type CastConnectRequest struct {
 	UUID string `json:"uuid"`
+	Name string `json:"name,omitempty"` // Friendly name, matched case-insensitively; used without a UUID
 }
 
 // CastSeekRequest is the request body for /api/cast/seek.
@@ -82,8 +84,8 @@ type CastSeekRequest struct {
 
 // CastVolumeRequest is the request body for /api/cast/volume.
 type CastVolumeRequest struct {
-	Level float64 `json:"level"`
-	Muted *bool   `json:"muted,omitempty"`
+	Level *float64 `json:"level,omitempty"` // 0 to 1
+	Muted *bool    `json:"muted,omitempty"`
 }
 
 // PlaylistSong represents a song in a playlist.
@@ -171,6 +173,7 @@ type AlbumItem struct {
 	Filename       string `json:"filename"`
 	ThumbnailSmall string `json:"thumbnail_small,omitempty"`
 	ThumbnailLarge string `json:"thumbnail_large,omitempty"`
+	BlurHash       string `json:"blurhash,omitempty"`
 }
 
 // AlbumWithContains adds a contains flag for checking if an image is in the album.
@@ -257,3 +260,16 @@ type InboxFileStatus struct {
 	Dest   string `json:"dest,omitempty"`
 	Error  string `json:"error,omitempty"`
 }
+
+// DownloadZipRequest is the request body for /api/download/zip.
+type DownloadZipRequest struct {
+	IDs  []int64 `json:"ids"`            // File IDs, archived in this order
+	Name string  `json:"name,omitempty"` // Archive file name; defaults to q2-download.zip
+}
+
+// AlbumExportRequest is the request body for /api/album/export.
+type AlbumExportRequest struct {
+	AlbumID int64  `json:"album_id"`
+	Dest    string `json:"dest"` // Directory on the server; created if missing
+	Link    bool   `json:"link"` // Hard-link instead of copying where possible
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"encoding/json"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
+
+	"jukel.org/q2/scanner"
 )
 
 // writeJSON writes a JSON response with the given status code.
@@ -29,14 +31,15 @@ func cleanPath(path string) (string, bool) {
 }
 
 // normalizePath cleans the path and applies platform-specific normalization.
-// On Windows, paths are lowercased for case-insensitive comparison.
+// On Windows, paths are lowercased for case-insensitive comparison, keeping
+// any \\?\ long-path prefix intact.
 // On Linux/macOS, paths are kept as-is for case-sensitive comparison.
 func normalizePath(path string) string {
-	path, _ = cleanPath(path)
-	if runtime.GOOS == "windows" {
-		path = strings.ToLower(path)
+	path, ok := cleanPath(path)
+	if !ok {
+		return ""
 	}
-	return path
+	return scanner.NormalizePath(path)
 }
 
 // sanitizePlaylistName sanitizes a playlist name to be a valid filename.
@@ -94,3 +97,13 @@ func moveFile(src, dst string) error {
 	in.Close()
 	return os.Remove(src)
 }
+
+// ffmpegLogger returns the logger for ffmpeg's download progress: the default
+// logger, which reports the download but not extraction details, or with
+// quiet set, one that reports only warnings and errors.
+func ffmpegLogger(quiet bool) *slog.Logger {
+	if !quiet {
+		return nil
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+}